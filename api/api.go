@@ -0,0 +1,472 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/logging"
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/tracing"
+)
+
+var log = logging.New("api")
+
+// The API mimics the subset of the Firecracker REST API that maps onto gokvm:
+// the machine is configured with PUT requests before boot, then started with
+// the InstanceStart action.
+//
+// refs: https://github.com/firecracker-microvm/firecracker/blob/main/src/firecracker/swagger/firecracker.yaml
+
+const (
+	StateNotStarted = "Not started"
+	StateRunning    = "Running"
+	StatePaused     = "Paused"
+
+	VMStatePaused  = "Paused"
+	VMStateResumed = "Resumed"
+
+	ActionInstanceStart  = "InstanceStart"
+	ActionSendCtrlAltDel = "SendCtrlAltDel"
+	ActionFlushMetrics   = "FlushMetrics"
+)
+
+var (
+	ErrorNotAllowedAfterBoot = errors.New("the update operation is not allowed after boot")
+	ErrorUnknownAction       = errors.New("unknown action")
+	ErrorNotSupported        = errors.New("not supported")
+	ErrorNotStarted          = errors.New("the microVM is not started")
+	ErrorInvalidVMState      = errors.New("invalid vm state")
+)
+
+type InstanceInfo struct {
+	AppName    string `json:"app_name"`
+	ID         string `json:"id"`
+	State      string `json:"state"`
+	VMMVersion string `json:"vmm_version"`
+}
+
+type MachineConfig struct {
+	VCPUCount  int    `json:"vcpu_count"`
+	MemSizeMib uint64 `json:"mem_size_mib"`
+}
+
+type BootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	InitrdPath      string `json:"initrd_path,omitempty"`
+	BootArgs        string `json:"boot_args,omitempty"`
+}
+
+type VMState struct {
+	State string `json:"state"`
+}
+
+// VM is the booted machine controlled through PATCH /vm.
+type VM interface {
+	Pause() error
+	Resume() error
+	IsPaused() bool
+	KVMStats() (machine.KVMStats, error)
+}
+
+// KVMStats is the response of GET /kvm-stats, which is specific to gokvm. A
+// statistic is a number, or an array with a number per bucket for
+// histograms.
+type KVMStats struct {
+	VM    map[string]interface{}   `json:"vm"`
+	VCPUs []map[string]interface{} `json:"vcpus"`
+}
+
+type InstanceActionInfo struct {
+	ActionType string `json:"action_type"`
+}
+
+type fault struct {
+	FaultMessage string `json:"fault_message"`
+}
+
+// Server serves the API on a unix socket.
+type Server struct {
+	ln  net.Listener
+	srv *http.Server
+
+	mu    sync.Mutex
+	c     config.Config
+	state string
+	vm    VM
+
+	// start is closed on InstanceStart.
+	start chan struct{}
+
+	// observe is called with the latency of every request.
+	observe func(method, path string, d time.Duration)
+}
+
+// Listen creates the unix socket at path. c is the initial machine
+// configuration, which may still be changed through the API before boot.
+func Listen(path string, c *config.Config) (*Server, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServer(ln, c), nil
+}
+
+// NewServer is like Listen but serves on an existing listener, e.g. one
+// passed by socket activation.
+func NewServer(ln net.Listener, c *config.Config) *Server {
+	s := &Server{
+		ln:    ln,
+		c:     *c,
+		state: StateNotStarted,
+		start: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleInstanceInfo)
+	mux.HandleFunc("/machine-config", s.handleMachineConfig)
+	mux.HandleFunc("/boot-source", s.handleBootSource)
+	mux.HandleFunc("/actions", s.handleActions)
+	mux.HandleFunc("/vm", s.handleVM)
+	mux.HandleFunc("/kvm-stats", s.handleKVMStats)
+	mux.HandleFunc("/drives/", s.handleNotSupported("drives"))
+	mux.HandleFunc("/network-interfaces/", s.handleNotSupported("network interfaces"))
+	s.srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		span := tracing.StartSpan("api "+r.Method+" "+pattern, "http.method", r.Method, "http.target", r.URL.Path)
+
+		start := time.Now()
+		mux.ServeHTTP(w, r)
+		d := time.Since(start)
+
+		span.End()
+
+		log.Debug("request", "method", r.Method, "path", r.URL.Path, "duration", d)
+
+		if s.observe != nil {
+			s.observe(r.Method, pattern, d)
+		}
+	})}
+
+	return s
+}
+
+// SetObserver registers f to be called with the latency of every request,
+// keyed by the route which served it. It must be called before Serve.
+func (s *Server) SetObserver(f func(method, path string, d time.Duration)) {
+	s.observe = f
+}
+
+// Serve handles requests until the server is closed.
+func (s *Server) Serve() error {
+	if err := s.srv.Serve(s.ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// WaitStart blocks until InstanceStart is requested and returns the
+// configuration to boot the machine with.
+func (s *Server) WaitStart() *config.Config {
+	<-s.start
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.c
+
+	return &c
+}
+
+// SetVM registers the booted machine.
+func (s *Server) SetVM(vm VM) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.vm = vm
+}
+
+func (s *Server) started() bool {
+	select {
+	case <-s.start:
+		return true
+	default:
+		return false
+	}
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if v != nil {
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+func replyError(w http.ResponseWriter, code int, err error) {
+	reply(w, code, fault{FaultMessage: err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	replyError(w, http.StatusMethodNotAllowed, fmt.Errorf("%w: %s %s", ErrorNotSupported, r.Method, r.URL.Path))
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		replyError(w, http.StatusBadRequest, err)
+
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleInstanceInfo(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		replyError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrorNotSupported, r.URL.Path))
+
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.state
+	if s.vm != nil && s.vm.IsPaused() {
+		state = StatePaused
+	}
+
+	reply(w, http.StatusOK, InstanceInfo{
+		AppName: "gokvm",
+		ID:      "anonymous-instance",
+		State:   state,
+	})
+}
+
+func (s *Server) handleMachineConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		reply(w, http.StatusOK, MachineConfig{
+			VCPUCount:  s.c.CPUs,
+			MemSizeMib: uint64(s.c.Memory >> 20),
+		})
+	case http.MethodPut:
+		mc := MachineConfig{}
+		if !decode(w, r, &mc) {
+			return
+		}
+
+		s.update(w, func(c *config.Config) {
+			c.CPUs = mc.VCPUCount
+			c.Memory = config.Size(mc.MemSizeMib << 20)
+		})
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+func (s *Server) handleBootSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, r)
+
+		return
+	}
+
+	bs := BootSource{}
+	if !decode(w, r, &bs) {
+		return
+	}
+
+	s.update(w, func(c *config.Config) {
+		c.Kernel = bs.KernelImagePath
+		c.Initrd = bs.InitrdPath
+
+		if bs.BootArgs != "" {
+			c.Params = bs.BootArgs
+		}
+	})
+}
+
+// update applies f to the configuration if the machine is not started yet and
+// the result is valid.
+func (s *Server) update(w http.ResponseWriter, f func(c *config.Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started() {
+		replyError(w, http.StatusBadRequest, ErrorNotAllowedAfterBoot)
+
+		return
+	}
+
+	c := s.c
+	f(&c)
+
+	if err := c.Validate(); err != nil {
+		replyError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	s.c = c
+
+	reply(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) handleActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, r)
+
+		return
+	}
+
+	a := InstanceActionInfo{}
+	if !decode(w, r, &a) {
+		return
+	}
+
+	switch a.ActionType {
+	case ActionInstanceStart:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.started() {
+			replyError(w, http.StatusBadRequest, ErrorNotAllowedAfterBoot)
+
+			return
+		}
+
+		if err := s.c.Validate(); err != nil {
+			replyError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		s.state = StateRunning
+		close(s.start)
+
+		reply(w, http.StatusNoContent, nil)
+	case ActionSendCtrlAltDel, ActionFlushMetrics:
+		replyError(w, http.StatusBadRequest, fmt.Errorf("%w: %s", ErrorNotSupported, a.ActionType))
+	default:
+		replyError(w, http.StatusBadRequest, fmt.Errorf("%w: %q", ErrorUnknownAction, a.ActionType))
+	}
+}
+
+func (s *Server) handleVM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		methodNotAllowed(w, r)
+
+		return
+	}
+
+	vs := VMState{}
+	if !decode(w, r, &vs) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.vm == nil {
+		replyError(w, http.StatusBadRequest, ErrorNotStarted)
+
+		return
+	}
+
+	var err error
+
+	switch vs.State {
+	case VMStatePaused:
+		err = s.vm.Pause()
+	case VMStateResumed:
+		err = s.vm.Resume()
+	default:
+		err = fmt.Errorf("%w: %q", ErrorInvalidVMState, vs.State)
+	}
+
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	reply(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) handleKVMStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.vm == nil {
+		replyError(w, http.StatusBadRequest, ErrorNotStarted)
+
+		return
+	}
+
+	stats, err := s.vm.KVMStats()
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	res := KVMStats{VM: statsMap(stats.VM), VCPUs: []map[string]interface{}{}}
+	for _, vcpu := range stats.VCPUs {
+		res.VCPUs = append(res.VCPUs, statsMap(vcpu))
+	}
+
+	reply(w, http.StatusOK, res)
+}
+
+func statsMap(stats []kvm.Stat) map[string]interface{} {
+	m := map[string]interface{}{}
+
+	for _, st := range stats {
+		switch st.Type() {
+		case kvm.StatsTypeLinearHist, kvm.StatsTypeLogHist:
+			m[st.Name] = st.Values
+		default:
+			m[st.Name] = st.Values[0]
+		}
+	}
+
+	return m
+}
+
+func (s *Server) handleNotSupported(what string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("%w: gokvm has no %s", ErrorNotSupported, what))
+	}
+}
@@ -0,0 +1,234 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/api"
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+func startServer(t *testing.T) (*api.Server, *http.Client) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "api.sock")
+
+	s, err := api.Listen(path, config.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	return s, client
+}
+
+func do(t *testing.T, client *http.Client, method, path, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+func TestConfigureAndStart(t *testing.T) {
+	t.Parallel()
+
+	s, client := startServer(t)
+
+	if res := do(t, client, http.MethodPut, "/machine-config",
+		`{"vcpu_count": 2, "mem_size_mib": 512}`); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+
+	if res := do(t, client, http.MethodPut, "/boot-source",
+		`{"kernel_image_path": "/vmlinux", "boot_args": "console=ttyS0"}`); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+
+	mc := api.MachineConfig{}
+	if err := json.NewDecoder(do(t, client, http.MethodGet, "/machine-config", "").Body).Decode(&mc); err != nil {
+		t.Fatal(err)
+	}
+
+	if mc.VCPUCount != 2 || mc.MemSizeMib != 512 {
+		t.Fatalf("unexpected machine config: %+v", mc)
+	}
+
+	if res := do(t, client, http.MethodPut, "/actions",
+		`{"action_type": "InstanceStart"}`); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+
+	c := s.WaitStart()
+	if c.CPUs != 2 || c.Memory != 512<<20 || c.Kernel != "/vmlinux" || c.Params != "console=ttyS0" {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+
+	info := api.InstanceInfo{}
+	if err := json.NewDecoder(do(t, client, http.MethodGet, "/", "").Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info.State != api.StateRunning {
+		t.Fatalf("unexpected state: %s", info.State)
+	}
+
+	if res := do(t, client, http.MethodPut, "/machine-config",
+		`{"vcpu_count": 1, "mem_size_mib": 512}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("update after boot must fail: %d", res.StatusCode)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	t.Parallel()
+
+	_, client := startServer(t)
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPut, "/machine-config", `{"vcpu_count": 0, "mem_size_mib": 512}`, http.StatusBadRequest},
+		{http.MethodPut, "/machine-config", `{"unknown": 1}`, http.StatusBadRequest},
+		{http.MethodPut, "/actions", `{"action_type": "Reboot"}`, http.StatusBadRequest},
+		{http.MethodPut, "/drives/rootfs", `{}`, http.StatusBadRequest},
+		{http.MethodDelete, "/boot-source", ``, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/nothing", ``, http.StatusNotFound},
+	} {
+		res := do(t, client, tc.method, tc.path, tc.body)
+		if res.StatusCode != tc.code {
+			t.Fatalf("%s %s: unexpected status %d", tc.method, tc.path, res.StatusCode)
+		}
+
+		f := struct {
+			FaultMessage string `json:"fault_message"`
+		}{}
+
+		if err := json.NewDecoder(res.Body).Decode(&f); err != nil || f.FaultMessage == "" {
+			t.Fatalf("%s %s: fault message is missing", tc.method, tc.path)
+		}
+	}
+}
+
+type fakeVM struct {
+	paused bool
+}
+
+func (v *fakeVM) Pause() error {
+	v.paused = true
+
+	return nil
+}
+
+func (v *fakeVM) Resume() error {
+	v.paused = false
+
+	return nil
+}
+
+func (v *fakeVM) IsPaused() bool {
+	return v.paused
+}
+
+func (v *fakeVM) KVMStats() (machine.KVMStats, error) {
+	return machine.KVMStats{
+		VM: []kvm.Stat{{Name: "remote_tlb_flush", Flags: kvm.StatsTypeCumulative, Values: []uint64{3}}},
+		VCPUs: [][]kvm.Stat{{
+			{Name: "halt_exits", Flags: kvm.StatsTypeCumulative, Values: []uint64{5}},
+			{Name: "halt_wait_hist", Flags: kvm.StatsTypeLogHist, Values: []uint64{1, 2}},
+		}},
+	}, nil
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+
+	s, client := startServer(t)
+
+	if res := do(t, client, http.MethodPatch, "/vm", `{"state": "Paused"}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("pause before boot must fail: %d", res.StatusCode)
+	}
+
+	vm := &fakeVM{}
+	s.SetVM(vm)
+
+	for _, tc := range []struct {
+		body  string
+		code  int
+		state string
+	}{
+		{`{"state": "Paused"}`, http.StatusNoContent, api.StatePaused},
+		{`{"state": "Resumed"}`, http.StatusNoContent, api.StateNotStarted},
+		{`{"state": "Stopped"}`, http.StatusBadRequest, api.StateNotStarted},
+	} {
+		if res := do(t, client, http.MethodPatch, "/vm", tc.body); res.StatusCode != tc.code {
+			t.Fatalf("%s: unexpected status %d", tc.body, res.StatusCode)
+		}
+
+		info := api.InstanceInfo{}
+		if err := json.NewDecoder(do(t, client, http.MethodGet, "/", "").Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+
+		if info.State != tc.state {
+			t.Fatalf("%s: unexpected state: %s", tc.body, info.State)
+		}
+	}
+}
+
+func TestKVMStats(t *testing.T) {
+	t.Parallel()
+
+	s, client := startServer(t)
+
+	if res := do(t, client, http.MethodGet, "/kvm-stats", ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("stats before boot must fail: %d", res.StatusCode)
+	}
+
+	s.SetVM(&fakeVM{})
+
+	res := do(t, client, http.MethodGet, "/kvm-stats", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+
+	stats := map[string]interface{}{}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := json.Marshal(stats)
+	if want := `{"vcpus":[{"halt_exits":5,"halt_wait_hist":[1,2]}],"vm":{"remote_tlb_flush":3}}`; string(b) != want {
+		t.Fatalf("unexpected stats: %s", b)
+	}
+}
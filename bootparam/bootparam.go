@@ -1,12 +1,12 @@
 package bootparam
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/fdpath"
 )
 
 const (
@@ -16,6 +16,10 @@ const (
 	KeepSegments = uint8(1 << 6)
 	CanUseHeap   = uint8(1 << 7)
 
+	// xloadflags of protocol 2.12+
+	XLFKernel64           = uint16(1 << 0)
+	XLFCanBeLoadedAbove4G = uint16(1 << 1)
+
 	EddMbrSigMax = 16
 	E820Max      = 128
 	E820Ram      = 1
@@ -26,8 +30,63 @@ const (
 	VGARAMBegin      = 0x000a0000
 	MBBIOSBegin      = 0x000f0000
 	MBBIOSEnd        = 0x000fffff
+
+	// SetupDTB is the type of a setup_data entry holding a device tree.
+	SetupDTB = 2
+
+	// Size is the size of the zeropage.
+	Size = 0x1000
+
+	// SetupHeaderSize is the size of the setup header, at offset 0x1f1 of
+	// both the zeropage and the kernel image.
+	SetupHeaderSize = 0x7b
+
+	// SetupDataSize is the size of the header of a setup_data entry.
+	SetupDataSize = 16
+
+	// E820EntrySize is the size of an entry of the E820 map.
+	E820EntrySize = 20
+
+	setupHeaderOffset = 0x1f1
+	e820MapOffset     = 0x2d0
+
+	// defaults of the fields older protocols lack
+	defaultCmdlineSize   = 255
+	defaultInitrdAddrMax = 0x37ffffff
+)
+
+// The versions of the boot protocol which introduced the fields a loader
+// has to take into account. Kernels older than ProtocolMin can only be
+// booted through their real-mode setup code, which gokvm doesn't run.
+const (
+	ProtocolMin           = 0x0202 // cmd_line_ptr
+	ProtocolInitrdAddrMax = 0x0203
+	ProtocolRelocatable   = 0x0205
+	ProtocolCmdlineSize   = 0x0206
+	ProtocolKeepSegments  = 0x0207
+	ProtocolSetupData     = 0x0209
+	ProtocolInitSize      = 0x020a
+	ProtocolXloadFlags    = 0x020c
 )
 
+// SetupData is the header of an entry of the setup_data list of protocol
+// 2.09+, followed by Len bytes of data.
+type SetupData struct {
+	Next uint64
+	Type uint32
+	Len  uint32
+}
+
+// Bytes returns the little-endian encoding of the header.
+func (s SetupData) Bytes() []byte {
+	b := make([]byte, SetupDataSize)
+	binary.LittleEndian.PutUint64(b[0:], s.Next)
+	binary.LittleEndian.PutUint32(b[8:], s.Type)
+	binary.LittleEndian.PutUint32(b[12:], s.Len)
+
+	return b
+}
+
 type E820Entry struct {
 	Addr uint64
 	Size uint64
@@ -98,12 +157,16 @@ type SetupHeader struct {
 
 var ErrorSignatureNotMatch = errors.New("signature not match in bzImage")
 
-var ErrorOldProtocolVersion = errors.New("old protocol version")
+var (
+	ErrorOldProtocolVersion = errors.New("old protocol version")
+	ErrorCmdlineTooLong     = errors.New("command line too long for the kernel")
+	ErrorInitrdTooHigh      = errors.New("initrd above the highest address the kernel accepts")
+)
 
 func New(bzImagePath string) (*BootParam, error) {
 	b := &BootParam{}
 
-	bzImage, err := ioutil.ReadFile(bzImagePath)
+	bzImage, err := fdpath.ReadFile(bzImagePath)
 	if err != nil {
 		return b, err
 	}
@@ -116,11 +179,12 @@ func New(bzImagePath string) (*BootParam, error) {
 	// and examined.
 	//
 	// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#id1
-	reader := bytes.NewReader(bzImage[0x01f1:])
-	if err := binary.Read(reader, binary.LittleEndian, &(b.Hdr)); err != nil {
-		return b, err
+	if len(bzImage) < setupHeaderOffset+SetupHeaderSize {
+		return b, ErrorSignatureNotMatch
 	}
 
+	b.Hdr.decode(bzImage[setupHeaderOffset:])
+
 	if err := b.isValid(); err != nil {
 		return b, err
 	}
@@ -133,9 +197,101 @@ func (b *BootParam) isValid() error {
 		return ErrorSignatureNotMatch
 	}
 
-	// Protocol 2.06+ is required.
-	if b.Hdr.Version < 0x0206 {
-		return fmt.Errorf("%w: 0x%x", ErrorOldProtocolVersion, b.Hdr.Version)
+	if b.Hdr.Version < ProtocolMin {
+		return fmt.Errorf("%w: 0x%x, 0x%x is required", ErrorOldProtocolVersion, b.Hdr.Version, ProtocolMin)
+	}
+
+	return nil
+}
+
+// CmdlineMax returns the length of the longest command line the kernel
+// accepts, without the terminating null.
+func (b *BootParam) CmdlineMax() int {
+	if b.Hdr.Version < ProtocolCmdlineSize || b.Hdr.CmdlineSize == 0 {
+		return defaultCmdlineSize
+	}
+
+	return int(b.Hdr.CmdlineSize)
+}
+
+// InitrdMax returns the highest address the initrd may occupy. Kernels
+// which can be loaded above 4G take an initrd anywhere.
+func (b *BootParam) InitrdMax() uint64 {
+	if b.Hdr.Version >= ProtocolXloadFlags && b.Hdr.XloadFlags&XLFCanBeLoadedAbove4G != 0 {
+		return ^uint64(0)
+	}
+
+	if b.Hdr.Version < ProtocolInitrdAddrMax || b.Hdr.InitrdAddrMax == 0 {
+		return defaultInitrdAddrMax
+	}
+
+	return uint64(b.Hdr.InitrdAddrMax)
+}
+
+// Relocatable returns whether the kernel can run at another address than
+// the one it was built for.
+func (b *BootParam) Relocatable() bool {
+	return b.Hdr.Version >= ProtocolRelocatable && b.Hdr.RelocatableKernel != 0
+}
+
+// KernelEnd returns the end of the memory the kernel uses once loaded at
+// loadAddr, where it decompresses itself. The kernel runs at loadAddr aligned
+// to kernel_alignment if it is relocatable, but not below pref_address, and
+// needs init_size bytes from there. Before protocol 2.10, only the image of
+// imageSize bytes is known.
+func (b *BootParam) KernelEnd(loadAddr, imageSize uint64) uint64 {
+	end := loadAddr + imageSize
+
+	if b.Hdr.Version < ProtocolInitSize {
+		return end
+	}
+
+	runAddr := loadAddr
+
+	if align := uint64(b.Hdr.KernelAlignment); b.Relocatable() && align != 0 {
+		runAddr = (loadAddr + align - 1) &^ (align - 1)
+	}
+
+	if !b.Relocatable() || runAddr < b.Hdr.PrefAddress {
+		runAddr = b.Hdr.PrefAddress
+	}
+
+	if runAddr+uint64(b.Hdr.InitSize) > end {
+		end = runAddr + uint64(b.Hdr.InitSize)
+	}
+
+	return end
+}
+
+// SetLoader fills the fields of the setup header a loader writes, as far as
+// the protocol of the kernel has them: the command line at cmdlineAddr and
+// the initrd of initrdSize bytes at initrdAddr.
+func (b *BootParam) SetLoader(cmdlineAddr uint32, cmdline string, initrdAddr, initrdSize uint32) error {
+	if len(cmdline) > b.CmdlineMax() {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrorCmdlineTooLong, len(cmdline), b.CmdlineMax())
+	}
+
+	if initrdSize > 0 && uint64(initrdAddr)+uint64(initrdSize)-1 > b.InitrdMax() {
+		return fmt.Errorf("%w: 0x%x-0x%x, at most 0x%x",
+			ErrorInitrdTooHigh, initrdAddr, uint64(initrdAddr)+uint64(initrdSize), b.InitrdMax())
+	}
+
+	h := &b.Hdr
+	h.VidMode = 0xFFFF    // normal
+	h.TypeOfLoader = 0xFF // undefined loader
+	h.RamdiskImage = initrdAddr
+	h.RamdiskSize = initrdSize
+	h.CmdlinePtr = cmdlineAddr
+	h.ExtLoaderVer = 0
+
+	// The heap of protocol 2.01+ ends below the zeropage segment. Only the
+	// real-mode setup code, which gokvm skips, uses it.
+	h.LoadFlags |= LoadedHigh | CanUseHeap
+	h.HeapEndPtr = 0xFE00
+
+	// obsolete since Linux 5.10, which reloads the segments anyway
+	if h.Version >= ProtocolKeepSegments {
+		h.LoadFlags |= KeepSegments
 	}
 
 	return nil
@@ -151,12 +307,114 @@ func (b *BootParam) AddE820Entry(addr, size uint64, typ uint32) {
 	b.E820Entries = i + 1
 }
 
+// Bytes returns the zeropage. The padding fields are left zero.
 func (b *BootParam) Bytes() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	buf := make([]byte, Size)
 
-	if err := binary.Write(buf, binary.LittleEndian, b); err != nil {
-		return []byte{}, err
+	buf[0x1e8] = b.E820Entries
+	buf[0x1e9] = b.EddbufEntries
+	buf[0x1ea] = b.EddMbrSigBufEntries
+	buf[0x1eb] = b.KdbStatus
+	b.Hdr.encode(buf[setupHeaderOffset:])
+	copy(buf[e820MapOffset-EddMbrSigMax:], b.EddMbrSigBuffer[:])
+
+	for i, e := range b.E820Map {
+		off := e820MapOffset + i*E820EntrySize
+		binary.LittleEndian.PutUint64(buf[off:], e.Addr)
+		binary.LittleEndian.PutUint64(buf[off+8:], e.Size)
+		binary.LittleEndian.PutUint32(buf[off+16:], e.Type)
 	}
 
-	return buf.Bytes(), nil
+	return buf, nil
+}
+
+// The offsets below are relative to the setup header, 0x1f1 less than the
+// ones of the boot protocol documentation.
+
+func (h *SetupHeader) encode(b []byte) {
+	le := binary.LittleEndian
+
+	b[0x00] = h.SetupSects
+	le.PutUint16(b[0x01:], h.RootFlags)
+	le.PutUint32(b[0x03:], h.SysSize)
+	le.PutUint16(b[0x07:], h.RAMSize)
+	le.PutUint16(b[0x09:], h.VidMode)
+	le.PutUint16(b[0x0b:], h.RootDev)
+	le.PutUint16(b[0x0d:], h.BootFlag)
+	le.PutUint16(b[0x0f:], h.Jump)
+	le.PutUint32(b[0x11:], h.Header)
+	le.PutUint16(b[0x15:], h.Version)
+	le.PutUint32(b[0x17:], h.ReadModeSwitch)
+	le.PutUint16(b[0x1b:], h.StartSysSeg)
+	le.PutUint16(b[0x1d:], h.KernelVersion)
+	b[0x1f] = h.TypeOfLoader
+	b[0x20] = h.LoadFlags
+	le.PutUint16(b[0x21:], h.SetupMoveSize)
+	le.PutUint32(b[0x23:], h.Code32Start)
+	le.PutUint32(b[0x27:], h.RamdiskImage)
+	le.PutUint32(b[0x2b:], h.RamdiskSize)
+	le.PutUint32(b[0x2f:], h.BootsectKludge)
+	le.PutUint16(b[0x33:], h.HeapEndPtr)
+	b[0x35] = h.ExtLoaderVer
+	b[0x36] = h.ExtLoaderType
+	le.PutUint32(b[0x37:], h.CmdlinePtr)
+	le.PutUint32(b[0x3b:], h.InitrdAddrMax)
+	le.PutUint32(b[0x3f:], h.KernelAlignment)
+	b[0x43] = h.RelocatableKernel
+	b[0x44] = h.MinAlignment
+	le.PutUint16(b[0x45:], h.XloadFlags)
+	le.PutUint32(b[0x47:], h.CmdlineSize)
+	le.PutUint32(b[0x4b:], h.HardwareSubarch)
+	le.PutUint64(b[0x4f:], h.HardwareSubarchData)
+	le.PutUint32(b[0x57:], h.PayloadOffset)
+	le.PutUint32(b[0x5b:], h.PayloadLength)
+	le.PutUint64(b[0x5f:], h.SetupData)
+	le.PutUint64(b[0x67:], h.PrefAddress)
+	le.PutUint32(b[0x6f:], h.InitSize)
+	le.PutUint32(b[0x73:], h.HandoverOffset)
+	le.PutUint32(b[0x77:], h.KernelInfoOffset)
+}
+
+func (h *SetupHeader) decode(b []byte) {
+	le := binary.LittleEndian
+
+	h.SetupSects = b[0x00]
+	h.RootFlags = le.Uint16(b[0x01:])
+	h.SysSize = le.Uint32(b[0x03:])
+	h.RAMSize = le.Uint16(b[0x07:])
+	h.VidMode = le.Uint16(b[0x09:])
+	h.RootDev = le.Uint16(b[0x0b:])
+	h.BootFlag = le.Uint16(b[0x0d:])
+	h.Jump = le.Uint16(b[0x0f:])
+	h.Header = le.Uint32(b[0x11:])
+	h.Version = le.Uint16(b[0x15:])
+	h.ReadModeSwitch = le.Uint32(b[0x17:])
+	h.StartSysSeg = le.Uint16(b[0x1b:])
+	h.KernelVersion = le.Uint16(b[0x1d:])
+	h.TypeOfLoader = b[0x1f]
+	h.LoadFlags = b[0x20]
+	h.SetupMoveSize = le.Uint16(b[0x21:])
+	h.Code32Start = le.Uint32(b[0x23:])
+	h.RamdiskImage = le.Uint32(b[0x27:])
+	h.RamdiskSize = le.Uint32(b[0x2b:])
+	h.BootsectKludge = le.Uint32(b[0x2f:])
+	h.HeapEndPtr = le.Uint16(b[0x33:])
+	h.ExtLoaderVer = b[0x35]
+	h.ExtLoaderType = b[0x36]
+	h.CmdlinePtr = le.Uint32(b[0x37:])
+	h.InitrdAddrMax = le.Uint32(b[0x3b:])
+	h.KernelAlignment = le.Uint32(b[0x3f:])
+	h.RelocatableKernel = b[0x43]
+	h.MinAlignment = b[0x44]
+	h.XloadFlags = le.Uint16(b[0x45:])
+	h.CmdlineSize = le.Uint32(b[0x47:])
+	h.HardwareSubarch = le.Uint32(b[0x4b:])
+	h.HardwareSubarchData = le.Uint64(b[0x4f:])
+	h.PayloadOffset = le.Uint32(b[0x57:])
+	h.PayloadLength = le.Uint32(b[0x5b:])
+	h.SetupData = le.Uint64(b[0x5f:])
+	h.PrefAddress = le.Uint64(b[0x67:])
+	h.InitSize = le.Uint32(b[0x6f:])
+	h.HandoverOffset = le.Uint32(b[0x73:])
+	h.KernelInfoOffset = le.Uint32(b[0x77:])
 }
@@ -3,6 +3,10 @@ package bootparam_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bobuhiro11/gokvm/bootparam"
@@ -16,6 +20,29 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNewSetupHeader(t *testing.T) {
+	t.Parallel()
+
+	b, err := bootparam.New("../bzImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := ioutil.ReadFile("../bzImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bootparam.SetupHeader{}
+	if err := binary.Read(bytes.NewReader(image[0x1f1:]), binary.LittleEndian, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Hdr != want {
+		t.Fatalf("setup header not decoded: %+v", b.Hdr)
+	}
+}
+
 func TestNewNotbzImage(t *testing.T) {
 	t.Parallel()
 
@@ -68,3 +95,180 @@ func TestAddE820Entry(t *testing.T) {
 		t.Fatalf("invalid e820 type: %v", actual.Type)
 	}
 }
+
+func TestBytesLayout(t *testing.T) {
+	t.Parallel()
+
+	b, err := bootparam.New("../bzImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.AddE820Entry(0x100000, 0x1000, bootparam.E820Ram)
+	b.Hdr.CmdlinePtr = 0x20000
+	b.Hdr.SetupData = 0x30000
+
+	if n := binary.Size(b.Hdr); n != bootparam.SetupHeaderSize {
+		t.Fatalf("setup header is %d bytes", n)
+	}
+
+	if n := binary.Size(bootparam.E820Entry{}); n != bootparam.E820EntrySize {
+		t.Fatalf("e820 entry is %d bytes", n)
+	}
+
+	raw, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw) != bootparam.Size {
+		t.Fatalf("zeropage is %d bytes", len(raw))
+	}
+
+	// the layout the struct describes
+	want := new(bytes.Buffer)
+	if err := binary.Write(want, binary.LittleEndian, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(raw[:want.Len()], want.Bytes()) {
+		t.Fatal("zeropage differs from the layout of BootParam")
+	}
+
+	hdr := bootparam.SetupHeader{}
+	if err := binary.Read(bytes.NewReader(raw[0x1f1:]), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr != b.Hdr {
+		t.Fatalf("setup header not encoded: %+v", hdr)
+	}
+}
+
+func TestSetupDataBytes(t *testing.T) {
+	t.Parallel()
+
+	s := bootparam.SetupData{Next: 0x1122334455667788, Type: bootparam.SetupDTB, Len: 0x100}
+
+	want := new(bytes.Buffer)
+	if err := binary.Write(want, binary.LittleEndian, s); err != nil {
+		t.Fatal(err)
+	}
+
+	if raw := s.Bytes(); len(raw) != bootparam.SetupDataSize || !bytes.Equal(raw, want.Bytes()) {
+		t.Fatalf("unexpected encoding: %x", raw)
+	}
+}
+
+// writeKernel writes a kernel image whose setup header is h.
+func writeKernel(t *testing.T, h bootparam.SetupHeader) string {
+	t.Helper()
+
+	h.Header = bootparam.MagicSignature
+
+	b := new(bytes.Buffer)
+	b.Write(make([]byte, 0x1f1))
+
+	if err := binary.Write(b, binary.LittleEndian, h); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "bzImage")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestProtocolVersion(t *testing.T) {
+	t.Parallel()
+
+	_, err := bootparam.New(writeKernel(t, bootparam.SetupHeader{Version: 0x0201}))
+	if !errors.Is(err, bootparam.ErrorOldProtocolVersion) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 2.05 has no cmdline_size and keeps the segments itself
+	b, err := bootparam.New(writeKernel(t, bootparam.SetupHeader{
+		Version: 0x0205, InitrdAddrMax: 0x7fffffff, CmdlineSize: 4096,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.CmdlineMax() != 255 || b.InitrdMax() != 0x7fffffff {
+		t.Fatalf("unexpected limits: %d 0x%x", b.CmdlineMax(), b.InitrdMax())
+	}
+
+	err = b.SetLoader(0x20000, strings.Repeat("x", 256), 0xf000000, 0x1000)
+	if !errors.Is(err, bootparam.ErrorCmdlineTooLong) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = b.SetLoader(0x20000, "console=ttyS0", 0x7ffff000, 0x2000)
+	if !errors.Is(err, bootparam.ErrorInitrdTooHigh) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := b.SetLoader(0x20000, "console=ttyS0", 0xf000000, 0x1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Hdr.LoadFlags != bootparam.LoadedHigh|bootparam.CanUseHeap || b.Hdr.CmdlineSize != 4096 {
+		t.Fatalf("unexpected header: %+v", b.Hdr)
+	}
+
+	// 2.12 takes the initrd anywhere when it can be loaded above 4G
+	b, err = bootparam.New(writeKernel(t, bootparam.SetupHeader{
+		Version: 0x020c, CmdlineSize: 2047, XloadFlags: bootparam.XLFKernel64 | bootparam.XLFCanBeLoadedAbove4G,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.CmdlineMax() != 2047 || b.InitrdMax() != ^uint64(0) {
+		t.Fatalf("unexpected limits: %d 0x%x", b.CmdlineMax(), b.InitrdMax())
+	}
+
+	if err := b.SetLoader(0x20000, "console=ttyS0", 0xf000000, 0x1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Hdr.LoadFlags&bootparam.KeepSegments == 0 {
+		t.Fatalf("unexpected load flags: 0x%x", b.Hdr.LoadFlags)
+	}
+}
+
+func TestKernelEnd(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		hdr bootparam.SetupHeader
+		end uint64
+	}{
+		// only the image is known
+		{bootparam.SetupHeader{Version: 0x0209, RelocatableKernel: 1}, 0x100000 + 0x800000},
+		// relocated to pref_address, above the load address aligned to 2M
+		{bootparam.SetupHeader{
+			Version: 0x020f, RelocatableKernel: 1, KernelAlignment: 0x200000,
+			PrefAddress: 0x1000000, InitSize: 0x2000000,
+		}, 0x3000000},
+		// aligned above pref_address
+		{bootparam.SetupHeader{
+			Version: 0x020f, RelocatableKernel: 1, KernelAlignment: 0x200000,
+			PrefAddress: 0x100000, InitSize: 0x2000000,
+		}, 0x2200000},
+		// moved to pref_address
+		{bootparam.SetupHeader{Version: 0x020f, PrefAddress: 0x1000000, InitSize: 0x2000000}, 0x3000000},
+	} {
+		b, err := bootparam.New(writeKernel(t, tc.hdr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if end := b.KernelEnd(0x100000, 0x800000); end != tc.end {
+			t.Fatalf("%+v: unexpected end 0x%x", tc.hdr, end)
+		}
+	}
+}
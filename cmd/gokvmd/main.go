@@ -0,0 +1,60 @@
+// gokvmd manages multiple VMs, each running as a supervised gokvm process.
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/daemon"
+)
+
+func main() {
+	dir := flag.String("dir", "/run/gokvm", "directory holding the sockets and logs of each VM")
+	sock := flag.String("sock", "", "unix socket path for the management API (default <dir>/gokvmd.sock)")
+	command := flag.String("gokvm", defaultCommand(), "gokvm binary used to run each VM")
+	flag.Parse()
+
+	if *sock == "" {
+		*sock = filepath.Join(*dir, "gokvmd.sock")
+	}
+
+	d, err := daemon.New(*dir, *command)
+	if err != nil {
+		panic(err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sig
+		d.Close()
+		os.Remove(*sock)
+		os.Exit(0)
+	}()
+
+	if err := d.Serve(*sock); err != nil {
+		d.Close()
+		panic(err)
+	}
+}
+
+// defaultCommand prefers the gokvm binary installed next to gokvmd.
+func defaultCommand() string {
+	if exe, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(exe), "gokvm")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	if path, err := exec.LookPath("gokvm"); err == nil {
+		return path
+	}
+
+	return "gokvm"
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/bobuhiro11/gokvm/console"
+	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/instance"
+	"github.com/bobuhiro11/gokvm/probe"
+	"github.com/bobuhiro11/gokvm/qmp"
+	"github.com/bobuhiro11/gokvm/term"
+	"github.com/bobuhiro11/gokvm/unittest"
+	"github.com/bobuhiro11/gokvm/validate"
+)
+
+var (
+	errorValidationFailed = errors.New("validation failed")
+	errorTestsFailed      = errors.New("tests failed")
+)
+
+// qmpCommands maps the subcommands talking to a running instance onto the
+// control socket commands.
+var qmpCommands = map[string]string{
+	flag.CmdStop:     "quit",
+	flag.CmdPause:    "stop",
+	flag.CmdResume:   "cont",
+	flag.CmdReset:    "system_reset",
+	flag.CmdSnapshot: "snapshot-save",
+	flag.CmdMigrate:  "migrate",
+}
+
+func runClientCommand(cmd *flag.Command) error {
+	if cmd.Name == flag.CmdPs {
+		return ps(os.Stdout)
+	}
+
+	if cmd.Name == flag.CmdValidate {
+		return validateConfig(os.Stdout, cmd)
+	}
+
+	if cmd.Name == flag.CmdProbe {
+		return probeHost(os.Stdout, cmd.KVMDevice)
+	}
+
+	if cmd.Name == flag.CmdTest {
+		return runTests(os.Stdout, cmd)
+	}
+
+	if !instance.IsRunning(cmd.Instance) {
+		return fmt.Errorf("%w: %s", instance.ErrorNotRunning, cmd.Instance)
+	}
+
+	if cmd.Name == flag.CmdConsole {
+		return attachConsole(cmd.Instance, cmd.Escape)
+	}
+
+	var args interface{}
+
+	if cmd.Name == flag.CmdSnapshot {
+		// the file is opened by the instance, which may run in another
+		// working directory
+		path, err := filepath.Abs(cmd.Args[0])
+		if err != nil {
+			return err
+		}
+
+		args = snapshotArgs{File: path, Incremental: cmd.Incremental}
+	}
+
+	if cmd.Name == flag.CmdMigrate {
+		args = migrateArgs{URI: "tcp:" + cmd.Args[0], Postcopy: cmd.Postcopy}
+	}
+
+	q, err := qmp.Dial(instance.QMPSocket(cmd.Instance))
+	if err != nil {
+		return err
+	}
+
+	defer q.Close()
+
+	_, err = q.Execute(qmpCommands[cmd.Name], args)
+
+	return err
+}
+
+func ps(w io.Writer) error {
+	names, err := instance.List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS")
+
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, queryStatus(name))
+	}
+
+	return tw.Flush()
+}
+
+func queryStatus(name string) string {
+	q, err := qmp.Dial(instance.QMPSocket(name))
+	if err != nil {
+		return "unreachable"
+	}
+
+	defer q.Close()
+
+	ret, err := q.Execute("query-status", nil)
+	if err != nil {
+		return "unknown"
+	}
+
+	status := statusInfo{}
+	if err := json.Unmarshal(ret, &status); err != nil {
+		return "unknown"
+	}
+
+	return status.Status
+}
+
+func attachConsole(name string, escape byte) error {
+	fmt.Printf("Connected to %s. Escape character is %s d.\n", name, console.FormatEscape(escape))
+
+	if term.IsTerminal(0) {
+		restoreMode, err := term.SetRawMode()
+		if err != nil {
+			return err
+		}
+
+		defer restoreMode()
+	}
+
+	return console.Attach(instance.ConsoleSocket(name), escape, os.Stdin, os.Stdout)
+}
+
+func validateConfig(w io.Writer, cmd *flag.Command) error {
+	problems := validate.Check(cmd.Config)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %d problem(s)", errorValidationFailed, len(problems))
+	}
+
+	fmt.Fprintln(w, "configuration is valid")
+
+	return nil
+}
+
+func probeHost(w io.Writer, kvmDevice string) error {
+	r, err := probe.Probe(kvmDevice)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
+
+// runTests boots each test kernel with this gokvm.
+func runTests(w io.Writer, cmd *flag.Command) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd.Test.Gokvm = exe
+
+	failed, err := unittest.Run(w, cmd.Test, cmd.Args)
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", errorTestsFailed, failed, len(cmd.Args))
+	}
+
+	return nil
+}
@@ -0,0 +1,616 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/console"
+	"github.com/bobuhiro11/gokvm/ebda"
+	"github.com/bobuhiro11/gokvm/fdpath"
+	"github.com/bobuhiro11/gokvm/logging"
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/seccomp"
+)
+
+// maxDebugExitPort leaves room for the two ports of the debug exit device.
+const maxDebugExitPort = 0xfffe
+
+// maxMPLAPICAddr is the highest address the MP table can hold.
+const maxMPLAPICAddr = 0xffffffff
+
+var (
+	ErrorInvalidConfig = errors.New("invalid configuration")
+	ErrorInvalidSize   = errors.New("invalid size")
+)
+
+// Config describes a virtual machine. It can be loaded from a YAML file such
+// as the following, and individual values can be overridden by CLI flags.
+//
+//	machine: pc-1.0
+//	kernel: ./bzImage
+//	initrd: ./initrd
+//	params: console=ttyS0
+//	cpus: 2
+//	name: vm0
+//	memory: 1G
+//	qmp: /run/gokvm/vm0.sock
+type Config struct {
+	// Name identifies the running instance for the other subcommands.
+	Name string `json:"name"`
+
+	// Machine is the machine type, e.g. pc-1.0. An unversioned name such as
+	// pc selects the latest version, so configurations of long-lived guests
+	// should pin a versioned one.
+	Machine string `json:"machine"`
+
+	// KVMDevice is the KVM device, /dev/kvm unless a supervisor passes one
+	// it opened. It and the kernel, initrd, restore and crash_dump files
+	// can be descriptors inherited by gokvm, written fd=N.
+	KVMDevice string `json:"kvm_device"`
+
+	Kernel string `json:"kernel"`
+	Initrd string `json:"initrd"`
+
+	// Multiboot boots the kernel with the multiboot protocol instead of the
+	// Linux one, e.g. a test kernel of kvm-unit-tests. The initrd, if any, is
+	// passed as its module.
+	Multiboot bool `json:"multiboot"`
+
+	Params string `json:"params"`
+	CPUs   int    `json:"cpus"`
+	Memory Size   `json:"memory"`
+
+	// Restore is a snapshot file from which the machine resumes instead of
+	// booting the kernel. The number of vCPUs and the memory size are the
+	// ones of the snapshot; the kernel is only used when the VM is reset.
+	Restore string `json:"restore"`
+
+	// RestoreLazy maps guest memory from the snapshot file instead of
+	// reading it, so that pages are only loaded when the guest touches them.
+	RestoreLazy bool `json:"restore_lazy"`
+
+	// ClockResync advances the guest clock of a restored or received
+	// machine by the time it spent saved or in transit, instead of resuming
+	// the guest as if no time had passed.
+	ClockResync bool `json:"clock_resync"`
+
+	// Incoming is the address, e.g. tcp:0.0.0.0:4444, on which the machine
+	// is received from the migrate command of another gokvm instead of
+	// booting the kernel. fd:N receives it on an inherited connection.
+	Incoming string `json:"incoming"`
+
+	// QMP is the path of the unix socket accepting control commands.
+	QMP string `json:"qmp"`
+
+	// Monitor is the path of the unix socket serving the monitor console,
+	// which offers the control commands to humans.
+	Monitor string `json:"monitor"`
+
+	// EscapeChar is the key in caret notation, e.g. ^a, which prefixes the
+	// commands of the terminal: c switches between the serial console and
+	// the monitor, x quits. A nested gokvm needs another one.
+	EscapeChar string `json:"escape_char"`
+
+	// API is the path of the unix socket serving the Firecracker-style REST
+	// API. When set, the machine boots on the InstanceStart action.
+	API string `json:"api"`
+
+	// DebugExit adds the isa-debug-exit compatible device at I/O port
+	// DebugExitPort, 0x501 by default, through which the guest sets the exit
+	// status of gokvm. kvm-unit-tests expect it at 0xf4.
+	DebugExit     bool `json:"debug_exit"`
+	DebugExitPort int  `json:"debug_exit_port"`
+
+	// DeviceTree passes the kernel a device tree of the memory, the vCPUs
+	// and the command line. Only microvm machines have one, for kernels
+	// built with CONFIG_OF.
+	DeviceTree bool `json:"device_tree"`
+
+	// MPOEM and MPProductID identify the platform in the MP table, e.g. with
+	// the version of gokvm for tooling fingerprinting guests. MPLAPICAddr is
+	// the address of the local APICs the table gives, 0xfee00000 if 0.
+	MPOEM       string `json:"mp_oem"`
+	MPProductID string `json:"mp_product_id"`
+	MPLAPICAddr int    `json:"mp_lapic_addr"`
+
+	// Daemonize runs gokvm in the background once the VM runs, or once the
+	// API is ready for it with api. The console can be attached with gokvm
+	// console.
+	Daemonize bool `json:"daemonize"`
+
+	// SerialLog is a file to which the serial console output is also written
+	// with a timestamp on every line, whether or not a terminal is attached.
+	// It is rotated at SerialLogSize, keeping SerialLogFiles old files.
+	SerialLog      string `json:"serial_log"`
+	SerialLogSize  Size   `json:"serial_log_size"`
+	SerialLogFiles int    `json:"serial_log_files"`
+
+	// SerialPTY also offers the serial console on a pseudo-terminal, whose
+	// path is logged and linked from the directory of the instance.
+	SerialPTY bool `json:"serial_pty"`
+
+	// TraceIO logs the port and MMIO accesses of the guest to the listed
+	// addresses, e.g. 0x3f8-0x3ff,0x501, or all of them with "all".
+	TraceIO string `json:"trace_io"`
+
+	// StallTimeout enables the detection of vCPUs which make no progress for
+	// this duration, e.g. 10s. Stalls are logged with the registers and
+	// emitted as VCPU_STALLED events on the control socket.
+	StallTimeout string `json:"stall_timeout"`
+
+	// CrashDump is the path to which an ELF core of the guest memory and
+	// vCPU registers is written when the guest crashes, for crash(8) or drgn.
+	CrashDump string `json:"crash_dump"`
+
+	// GDB is the TCP address, e.g. localhost:1234, of the GDB remote stub
+	// for debugging the guest.
+	GDB string `json:"gdb"`
+
+	// Metrics is the TCP address, e.g. localhost:9100, serving the metrics
+	// in the Prometheus text format on /metrics.
+	Metrics string `json:"metrics"`
+
+	// OTLPEndpoint is the OTLP/HTTP URL, e.g.
+	// http://localhost:4318/v1/traces, to which traces of the VMM operations
+	// are exported.
+	OTLPEndpoint string `json:"otlp_endpoint"`
+
+	// PidFile is written with the process id while the VM runs.
+	PidFile string `json:"pidfile"`
+
+	// LogLevel is the minimum level of the messages of gokvm: debug, info,
+	// warn or error.
+	LogLevel string `json:"log_level"`
+
+	// LogFormat is text or json.
+	LogFormat string `json:"log_format"`
+
+	// Hooks are run on the lifecycle events of the VM, keyed by event.
+	Hooks map[string][]Hook `json:"hooks"`
+
+	// Seccomp restricts the system calls of gokvm once the VM is set up:
+	// enforce kills gokvm on a system call it doesn't need, log only logs
+	// it to the audit log of the kernel. Empty disables the filters.
+	Seccomp string `json:"seccomp"`
+
+	// Landlock restricts the filesystem access of gokvm once the VM is set
+	// up to the files of the configuration: the kernel and initrd, the
+	// sockets, the pidfile, the serial logs and the crash dump.
+	Landlock bool `json:"landlock"`
+
+	// LandlockAllow are the directories where snapshots and memory dumps
+	// may be written and read under landlock.
+	LandlockAllow []string `json:"landlock_allow"`
+
+	// VCPUSched runs the vCPU threads with a realtime scheduling policy,
+	// fifo or rr, at VCPUPriority between 1 and 99, so that the other
+	// threads of the host don't delay the guest. Empty keeps the normal
+	// policy.
+	VCPUSched    string `json:"vcpu_sched"`
+	VCPUPriority int    `json:"vcpu_priority"`
+
+	// HaltPoll is how long KVM polls for a wakeup of a halted vCPU before
+	// putting its thread to sleep, e.g. 200us, instead of the halt_poll_ns
+	// parameter of the host. 0s disables polling; empty keeps the default
+	// of the host.
+	HaltPoll string `json:"halt_poll"`
+
+	// VCPUReserveProcs raises GOMAXPROCS by the number of vCPUs, so that the
+	// goroutines of the sockets and the API don't wait for the vCPU threads
+	// handling exits.
+	VCPUReserveProcs bool `json:"vcpu_reserve_procs"`
+}
+
+// Lifecycle events of a VM which hooks can be attached to.
+const (
+	EventPreStart   = "pre-start"
+	EventPostStart  = "post-start"
+	EventGuestPanic = "guest-panic"
+	EventShutdown   = "shutdown"
+)
+
+// Hook either executes a program or sends an HTTP POST request to a URL.
+//
+//	hooks:
+//	  pre-start:
+//	    - exec: /usr/local/bin/setup-network
+//	      args:
+//	        - vm0
+//	  guest-panic:
+//	    - url: http://alerts.example.com/gokvm
+type Hook struct {
+	Exec string   `json:"exec,omitempty"`
+	Args []string `json:"args,omitempty"`
+	URL  string   `json:"url,omitempty"`
+}
+
+// Default returns the configuration used when neither a configuration file
+// nor flags specify a value.
+func Default() *Config {
+	return &Config{
+		Machine:   machine.DefaultType,
+		KVMDevice: machine.KVMDevice,
+		Kernel:    "./bzImage",
+		Initrd:    "./initrd",
+
+		//  refs: commit 1621292e73770aabbc146e72036de5e26f901e86 in kvmtool
+		Params: `console=ttyS0 earlyprintk=serial noapic noacpi notsc ` +
+			`debug apic=debug show_lapic=all mitigations=off lapic ` +
+			`dyndbg="file arch/x86/kernel/smpboot.c +plf"`,
+		CPUs:           1,
+		Memory:         1 << 30,
+		SerialLogSize:  10 << 20,
+		SerialLogFiles: 5,
+		LogLevel:       logging.LevelInfo.String(),
+		LogFormat:      logging.FormatText,
+		EscapeChar:     "^a",
+		DebugExitPort:  machine.DebugExitAddr,
+		VCPUPriority:   sched.MinPriority,
+	}
+}
+
+// LoadFile reads the YAML configuration file at path. Values present in the
+// file overwrite the ones already in c; unknown keys are rejected.
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Load(data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Load is like LoadFile but reads the YAML document from data.
+func (c *Config) Load(data []byte) error {
+	tree, err := parseYAML(data)
+	if err != nil {
+		return err
+	}
+
+	if tree == nil {
+		return nil
+	}
+
+	if _, ok := tree.(map[string]interface{}); !ok {
+		return fmt.Errorf("%w: top level must be a mapping", ErrorInvalidConfig)
+	}
+
+	// The parsed tree only contains maps, slices and scalars, so it can be
+	// decoded into Config through encoding/json to reuse its field matching.
+	raw, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(c); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%w: %s: expected %s, got %s",
+				ErrorInvalidConfig, typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+
+		return fmt.Errorf("%w: %s", ErrorInvalidConfig, strings.TrimPrefix(err.Error(), "json: "))
+	}
+
+	return nil
+}
+
+// WriteFile writes c to path as a configuration file which LoadFile reads
+// back into the same configuration.
+func (c *Config) WriteFile(path string) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0o600)
+}
+
+// Marshal is like WriteFile but returns the YAML document.
+func (c *Config) Marshal() ([]byte, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decoding with UseNumber keeps the integers as they are written.
+	var tree interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+
+	formatYAML(&b, tree, 0)
+
+	return []byte(b.String()), nil
+}
+
+// paths are the files which can be inherited descriptors.
+func (c *Config) paths() []struct{ name, path string } {
+	return []struct{ name, path string }{
+		{"kvm_device", c.KVMDevice},
+		{"kernel", c.Kernel},
+		{"initrd", c.Initrd},
+		{"restore", c.Restore},
+		{"crash_dump", c.CrashDump},
+	}
+}
+
+// InheritedFds returns the descriptors gokvm is given by c: the files written
+// fd=N and the incoming connection fd:N.
+func (c *Config) InheritedFds() []int {
+	fds := []int{}
+
+	for _, f := range c.paths() {
+		if fd, ok, err := fdpath.Parse(f.path); ok && err == nil {
+			fds = append(fds, fd)
+		}
+	}
+
+	if strings.HasPrefix(c.Incoming, "fd:") {
+		if fd, err := strconv.Atoi(strings.TrimPrefix(c.Incoming, "fd:")); err == nil && fd >= 0 {
+			fds = append(fds, fd)
+		}
+	}
+
+	return fds
+}
+
+// Platform returns how the MP table identifies the machine.
+func (c *Config) Platform() ebda.Platform {
+	return ebda.Platform{OEM: c.MPOEM, ProductID: c.MPProductID, LAPIC: uint32(c.MPLAPICAddr)}
+}
+
+// Validate reports all the problems found in c at once.
+func (c *Config) Validate() error {
+	problems := []string{}
+
+	if t, err := machine.LookupType(c.Machine); err != nil {
+		problems = append(problems, err.Error())
+	} else if c.DeviceTree && t.LegacyPC {
+		problems = append(problems, fmt.Sprintf("device_tree requires a microvm machine type, got %s", c.Machine))
+	}
+
+	if c.DeviceTree && c.Multiboot {
+		problems = append(problems, "device_tree and multiboot are exclusive")
+	}
+
+	if c.KVMDevice == "" {
+		problems = append(problems, "kvm_device must be specified")
+	}
+
+	if c.Kernel == "" {
+		problems = append(problems, "kernel must be specified")
+	}
+
+	for _, f := range c.paths() {
+		if _, _, err := fdpath.Parse(f.path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f.name, err))
+		}
+	}
+
+	if _, err := console.ParseEscape(c.EscapeChar); err != nil {
+		problems = append(problems, fmt.Sprintf("escape_char: %v", err))
+	}
+
+	if c.CPUs < 1 || c.CPUs > ebda.MaxVCPUs {
+		problems = append(problems, fmt.Sprintf("cpus must be between 1 and %d, got %d", ebda.MaxVCPUs, c.CPUs))
+	}
+
+	if c.Memory < machine.MinMemSize {
+		problems = append(problems, fmt.Sprintf("memory must be at least %s", Size(machine.MinMemSize)))
+	}
+
+	if c.DebugExitPort < 0 || c.DebugExitPort > maxDebugExitPort {
+		problems = append(problems, fmt.Sprintf("debug_exit_port must be between 0 and 0x%x, got 0x%x",
+			maxDebugExitPort, c.DebugExitPort))
+	}
+
+	if c.MPLAPICAddr < 0 || c.MPLAPICAddr > maxMPLAPICAddr {
+		problems = append(problems, fmt.Sprintf("mp_lapic_addr must be between 0 and 0x%x, got 0x%x",
+			maxMPLAPICAddr, c.MPLAPICAddr))
+	} else if err := c.Platform().Check(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if c.RestoreLazy && c.Restore == "" {
+		problems = append(problems, "restore_lazy requires restore")
+	}
+
+	if c.ClockResync && c.Restore == "" && c.Incoming == "" {
+		problems = append(problems, "clock_resync requires restore or incoming")
+	}
+
+	if c.Incoming != "" && !strings.HasPrefix(c.Incoming, "tcp:") && !strings.HasPrefix(c.Incoming, "fd:") {
+		problems = append(problems, fmt.Sprintf("incoming must be tcp:host:port or fd:N, got %q", c.Incoming))
+	}
+
+	if c.Incoming != "" && c.Restore != "" {
+		problems = append(problems, "incoming and restore are exclusive")
+	}
+
+	if c.SerialLog != "" && c.SerialLogSize == 0 {
+		problems = append(problems, "serial_log_size must be greater than 0")
+	}
+
+	if c.SerialLogFiles < 0 {
+		problems = append(problems, fmt.Sprintf("serial_log_files must not be negative, got %d", c.SerialLogFiles))
+	}
+
+	if c.TraceIO != "" {
+		if _, err := machine.ParseTraceRanges(c.TraceIO); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if c.StallTimeout != "" {
+		if d, err := time.ParseDuration(c.StallTimeout); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("stall_timeout must be a positive duration, got %q", c.StallTimeout))
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if err := logging.CheckFormat(c.LogFormat); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if c.Seccomp != "" {
+		if err := seccomp.CheckMode(c.Seccomp); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(c.LandlockAllow) > 0 && !c.Landlock {
+		problems = append(problems, "landlock_allow requires landlock")
+	}
+
+	if c.HaltPoll != "" {
+		if d, err := time.ParseDuration(c.HaltPoll); err != nil || d < 0 || d > machine.MaxHaltPoll {
+			problems = append(problems, fmt.Sprintf("halt_poll must be a duration between 0s and %v, got %q",
+				machine.MaxHaltPoll, c.HaltPoll))
+		}
+	}
+
+	if c.VCPUSched != "" {
+		if err := sched.Check(c.VCPUSched, c.VCPUPriority); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	problems = append(problems, c.validateHooks()...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrorInvalidConfig, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (c *Config) validateHooks() []string {
+	problems := []string{}
+
+	events := make([]string, 0, len(c.Hooks))
+	for event := range c.Hooks {
+		events = append(events, event)
+	}
+
+	sort.Strings(events)
+
+	for _, event := range events {
+		switch event {
+		case EventPreStart, EventPostStart, EventGuestPanic, EventShutdown:
+		default:
+			problems = append(problems, fmt.Sprintf("unknown hook event %q", event))
+
+			continue
+		}
+
+		for i, h := range c.Hooks[event] {
+			if (h.Exec == "") == (h.URL == "") {
+				problems = append(problems, fmt.Sprintf("hook %d of %s must have either exec or url", i, event))
+			}
+
+			// the sandbox is set up after the pre-start hooks
+			if h.Exec == "" || event == EventPreStart {
+				continue
+			}
+
+			if c.Seccomp == seccomp.ModeEnforce {
+				problems = append(problems, fmt.Sprintf("hook %d of %s can't exec under seccomp enforce, use url", i, event))
+			}
+
+			if c.Landlock {
+				problems = append(problems, fmt.Sprintf("hook %d of %s can't exec under landlock, use url", i, event))
+			}
+		}
+	}
+
+	return problems
+}
+
+// Size is an amount of bytes. It is written as a number with an optional
+// B, K, M, G or T suffix (powers of 1024); a bare number is taken as MiB.
+type Size uint64
+
+var sizeUnits = []struct {
+	suffix string
+	shift  uint
+}{{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10}, {"B", 0}}
+
+func ParseSize(s string) (Size, error) {
+	num, shift := strings.TrimSpace(s), uint(20)
+
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(num), u.suffix) {
+			num, shift = num[:len(num)-1], u.shift
+
+			break
+		}
+	}
+
+	v, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || v > (1<<(64-shift))-1 {
+		return 0, fmt.Errorf("%w: %q", ErrorInvalidSize, s)
+	}
+
+	return Size(v << shift), nil
+}
+
+func (s Size) String() string {
+	if s == 0 {
+		return "0"
+	}
+
+	for _, u := range sizeUnits {
+		if s%(1<<u.shift) == 0 {
+			return fmt.Sprintf("%d%s", s>>u.shift, u.suffix)
+		}
+	}
+
+	return strconv.FormatUint(uint64(s), 10) + "B"
+}
+
+// Set implements flag.Value.
+func (s *Size) Set(v string) error {
+	size, err := ParseSize(v)
+	if err != nil {
+		return err
+	}
+
+	*s = size
+
+	return nil
+}
+
+func (s *Size) UnmarshalJSON(data []byte) error {
+	v := strings.Trim(string(data), `"`)
+
+	return s.Set(v)
+}
+
+func (s Size) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
@@ -0,0 +1,424 @@
+package config_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/config"
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	data := `
+# comments and blank lines are ignored
+kernel: /boot/vmlinuz   # trailing comment
+initrd: '/boot/init rd'
+cpus: 4
+memory: 512M
+params: >
+  console=ttyS0
+  quiet
+`
+
+	if err := c.Load([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Kernel != "/boot/vmlinuz" {
+		t.Fatalf("invalid kernel: %q", c.Kernel)
+	}
+
+	if c.Initrd != "/boot/init rd" {
+		t.Fatalf("invalid initrd: %q", c.Initrd)
+	}
+
+	if c.CPUs != 4 {
+		t.Fatalf("invalid cpus: %d", c.CPUs)
+	}
+
+	if c.Memory != 512<<20 {
+		t.Fatalf("invalid memory: %d", c.Memory)
+	}
+
+	if c.Params != "console=ttyS0 quiet\n" {
+		t.Fatalf("invalid params: %q", c.Params)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeepsDefaults(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+
+	if err := c.Load([]byte("cpus: 2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Kernel != config.Default().Kernel {
+		t.Fatalf("default kernel is overwritten: %q", c.Kernel)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	t.Parallel()
+
+	// Every field is set to a value differing from the default, so that
+	// one missing from the file shows up.
+	c := config.Config{}
+	v := reflect.ValueOf(&c).Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		name := v.Type().Field(i).Name
+
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(name + ` "quoted" # not a comment: |` + "\n")
+		case reflect.Int:
+			f.SetInt(-int64(i) - 1)
+		case reflect.Uint64:
+			f.SetUint(uint64(i+1) << 20)
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Slice:
+			f.Set(reflect.ValueOf([]string{name, "- item", ""}))
+		case reflect.Map:
+			f.Set(reflect.ValueOf(map[string][]config.Hook{
+				config.EventPreStart: {{Exec: "/bin/true", Args: []string{"-a", "b: c"}}, {URL: "http://hook"}},
+				"key: quoted":        {{}},
+			}))
+		default:
+			t.Fatalf("%s: unexpected kind %s", name, f.Kind())
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	if err := c.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := config.Default()
+
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*loaded, c) {
+		t.Fatalf("unexpected config:\n%+v\nwant:\n%+v", *loaded, c)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		data string
+		err  error
+		msg  string
+	}{
+		{"disks:\n  - a.img\n", config.ErrorInvalidConfig, `unknown field "disks"`},
+		{"cpus: two\n", config.ErrorInvalidConfig, "cpus: expected int, got string"},
+		{"memory: 1X\n", config.ErrorInvalidConfig, `invalid size: "1X"`},
+		{"kernel: a\n  initrd: b\n", config.ErrorYAMLSyntax, "line 2"},
+		{"kernel: a\nkernel: b\n", config.ErrorYAMLSyntax, `duplicate key "kernel"`},
+		{"- a\n- b\n", config.ErrorInvalidConfig, "top level must be a mapping"},
+		{"cpus: [1, 2]\n", config.ErrorYAMLSyntax, "flow collections"},
+	} {
+		err := config.Default().Load([]byte(tc.data))
+		if !errors.Is(err, tc.err) || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%q: unexpected error: %v", tc.data, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	c.Kernel = ""
+	c.CPUs = 0
+	c.Machine = "pc-0.1"
+	c.StallTimeout = "-1s"
+	c.RestoreLazy = true
+	c.Incoming = "localhost:4444"
+	c.DebugExitPort = 0x10000
+	c.MPOEM = "OEM-TOO-LONG"
+
+	err := c.Validate()
+	if !errors.Is(err, config.ErrorInvalidConfig) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// all problems are reported at once
+	if !strings.Contains(err.Error(), "kernel") || !strings.Contains(err.Error(), "cpus") ||
+		!strings.Contains(err.Error(), "machine type") || !strings.Contains(err.Error(), "stall_timeout") ||
+		!strings.Contains(err.Error(), "restore_lazy") || !strings.Contains(err.Error(), "incoming") ||
+		!strings.Contains(err.Error(), "debug_exit_port") || !strings.Contains(err.Error(), "OEM") {
+		t.Fatalf("missing problems in error: %v", err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		in   string
+		size config.Size
+		str  string
+	}{
+		{"512", 512 << 20, "512M"},
+		{"2G", 2 << 30, "2G"},
+		{"1536m", 1536 << 20, "1536M"},
+		{"64K", 64 << 10, "64K"},
+		{"100B", 100, "100B"},
+	} {
+		s, err := config.ParseSize(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s != tc.size || s.String() != tc.str {
+			t.Fatalf("%q: got %d (%s)", tc.in, s, s)
+		}
+	}
+}
+
+func TestLoadHooks(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	data := `
+hooks:
+  pre-start:
+    - exec: /usr/local/bin/setup-network
+      args:
+        - vm0
+  guest-panic:
+    - url: http://localhost/alert
+`
+
+	if err := c.Load([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	pre := c.Hooks[config.EventPreStart]
+	if len(pre) != 1 || pre[0].Exec != "/usr/local/bin/setup-network" || len(pre[0].Args) != 1 || pre[0].Args[0] != "vm0" {
+		t.Fatalf("invalid pre-start hooks: %+v", pre)
+	}
+
+	if gp := c.Hooks[config.EventGuestPanic]; len(gp) != 1 || gp[0].URL != "http://localhost/alert" {
+		t.Fatalf("invalid guest-panic hooks: %+v", gp)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Hooks["reboot"] = []config.Hook{{Exec: "/bin/true"}}
+	c.Hooks[config.EventShutdown] = []config.Hook{{Exec: "/bin/true", URL: "http://localhost"}}
+
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), `unknown hook event "reboot"`) ||
+		!strings.Contains(err.Error(), "either exec or url") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateSeccomp(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	c.Seccomp = "strict"
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid seccomp mode") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Seccomp = "enforce"
+	c.Hooks = map[string][]config.Hook{
+		config.EventPreStart: {{Exec: "/bin/true"}},
+		config.EventShutdown: {{URL: "http://localhost"}},
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Hooks[config.EventGuestPanic] = []config.Hook{{Exec: "/bin/true"}}
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "hook 0 of guest-panic can't exec") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Seccomp = "log"
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateVCPUSched(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	if err := c.Load([]byte("vcpu_sched: rr\nvcpu_priority: 100\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid realtime priority") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.VCPUSched = "batch"
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid scheduling policy") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.VCPUSched = ""
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = config.Default()
+	c.VCPUSched = "fifo"
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateHaltPoll(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+
+	for _, d := range []string{"0s", "200us", "4s"} {
+		c.HaltPoll = d
+
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, d := range []string{"-1us", "5s", "200"} {
+		c.HaltPoll = d
+
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "halt_poll must be") {
+			t.Fatalf("%s: unexpected error: %v", d, err)
+		}
+	}
+}
+
+func TestValidateMemory(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+
+	for _, size := range []config.Size{256 << 20, 1 << 30} {
+		c.Memory = size
+
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the machine needs room for the kernel and the initrd
+	for _, size := range []config.Size{0, 1, 255 << 20} {
+		c.Memory = size
+
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "memory must be at least 256M") {
+			t.Fatalf("%s: unexpected error: %v", size, err)
+		}
+	}
+}
+
+func TestValidateLandlock(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	if err := c.Load([]byte("landlock_allow:\n  - /var/lib/gokvm\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.LandlockAllow) != 1 || c.LandlockAllow[0] != "/var/lib/gokvm" {
+		t.Fatalf("invalid landlock_allow: %v", c.LandlockAllow)
+	}
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "landlock_allow requires landlock") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Landlock = true
+	c.Hooks = map[string][]config.Hook{config.EventShutdown: {{Exec: "/bin/true"}}}
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "hook 0 of shutdown can't exec under landlock") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Hooks = nil
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateFds(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	c.KVMDevice = "fd=3"
+	c.Kernel = "fd=4"
+	c.Incoming = "fd:5"
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Initrd = "fd=x"
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "initrd: invalid file descriptor") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestInheritedFds(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	c.KVMDevice = "fd=5"
+	c.Kernel = "fd=3"
+	c.Incoming = "fd:7"
+
+	if fds := c.InheritedFds(); !reflect.DeepEqual(fds, []int{5, 3, 7}) {
+		t.Fatalf("unexpected descriptors: %v", fds)
+	}
+}
+
+func TestValidateDeviceTree(t *testing.T) {
+	t.Parallel()
+
+	c := config.Default()
+	c.DeviceTree = true
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "device_tree requires a microvm machine type") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Machine = "microvm"
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,492 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrorYAMLSyntax is returned when a configuration file can't be parsed.
+var ErrorYAMLSyntax = errors.New("yaml syntax error")
+
+// The configuration file is read with a small YAML subset parser to keep
+// gokvm free of dependencies other than the standard library. It supports
+// block mappings and sequences, plain and quoted scalars, literal (|) and
+// folded (>) block scalars and comments. Flow collections, anchors and tags
+// are not supported.
+type yamlLine struct {
+	num    int    // 1-origin line number
+	indent int    // number of leading spaces
+	text   string // content without indentation and trailing comment
+	raw    string // original line
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+var (
+	yamlInt      = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlPlainKey = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+func parseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+
+		p.lines = append(p.lines, yamlLine{
+			num:    i + 1,
+			indent: indent,
+			text:   strings.TrimRight(stripComment(text), " \t"),
+			raw:    raw,
+		})
+	}
+
+	p.skipBlank()
+
+	if p.pos < len(p.lines) && p.lines[p.pos].text == "---" {
+		p.pos++
+		p.skipBlank()
+	}
+
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+
+	v, err := p.parseNode(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipBlank()
+
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected content %q", p.lines[p.pos].text)
+	}
+
+	return v, nil
+}
+
+// stripComment removes a trailing comment that isn't part of a quoted scalar.
+func stripComment(s string) string {
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+func (p *yamlParser) errorf(format string, a ...interface{}) error {
+	line := 0
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].num
+	} else if len(p.lines) > 0 {
+		line = p.lines[len(p.lines)-1].num
+	}
+
+	return fmt.Errorf("%w: line %d: %s", ErrorYAMLSyntax, line, fmt.Sprintf(format, a...))
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && p.lines[p.pos].text == "" {
+		p.pos++
+	}
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	l := p.lines[p.pos]
+
+	if strings.HasPrefix(l.text, "\t") {
+		return nil, p.errorf("tabs are not allowed for indentation")
+	}
+
+	if isSeqItem(l.text) {
+		return p.parseSequence(indent)
+	}
+
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+
+	for {
+		p.skipBlank()
+
+		if p.pos >= len(p.lines) {
+			break
+		}
+
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+
+		if l.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+
+		if !isSeqItem(l.text) {
+			break
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+
+		var (
+			v   interface{}
+			err error
+		)
+
+		switch {
+		case rest == "":
+			p.pos++
+			v, err = p.parseChild(indent)
+		case isSeqItem(rest) || splitKey(rest) >= 0:
+			// The item is a nested collection starting on the same line;
+			// re-read the remaining text as if it were on its own line.
+			offset := len(l.text) - len(rest)
+			p.lines[p.pos].indent += offset
+			p.lines[p.pos].text = rest
+			v, err = p.parseNode(indent + offset)
+		default:
+			v, err = p.parseScalar(rest, indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		seq = append(seq, v)
+	}
+
+	return seq, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+
+	for {
+		p.skipBlank()
+
+		if p.pos >= len(p.lines) {
+			break
+		}
+
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+
+		if l.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+
+		if isSeqItem(l.text) {
+			return nil, p.errorf("unexpected sequence item in mapping")
+		}
+
+		i := splitKey(l.text)
+		if i < 0 {
+			return nil, p.errorf("expected \"key: value\", got %q", l.text)
+		}
+
+		key, err := unquote(strings.TrimSpace(l.text[:i]))
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+
+		if _, ok := m[key]; ok {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+
+		rest := strings.TrimSpace(l.text[i+1:])
+
+		var v interface{}
+
+		if rest == "" {
+			p.pos++
+			v, err = p.parseChild(indent)
+		} else {
+			v, err = p.parseScalar(rest, indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		m[key] = v
+	}
+
+	return m, nil
+}
+
+// parseChild parses the value of a key or sequence item which was left empty
+// on its own line. A sequence is allowed at the same indentation as its key.
+func (p *yamlParser) parseChild(indent int) (interface{}, error) {
+	p.skipBlank()
+
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+
+	l := p.lines[p.pos]
+
+	switch {
+	case l.indent > indent:
+		return p.parseNode(l.indent)
+	case l.indent == indent && isSeqItem(l.text):
+		return p.parseSequence(indent)
+	default:
+		return nil, nil
+	}
+}
+
+// parseScalar parses the scalar at the end of the current line and consumes
+// the line, plus any continuation lines of a block scalar.
+func (p *yamlParser) parseScalar(s string, indent int) (interface{}, error) {
+	if s == "|" || s == ">" {
+		p.pos++
+
+		return p.parseBlockScalar(s == ">", indent), nil
+	}
+
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		return nil, p.errorf("flow collections are not supported")
+	}
+
+	if strings.HasPrefix(s, "&") || strings.HasPrefix(s, "*") || strings.HasPrefix(s, "!") {
+		return nil, p.errorf("anchors, aliases and tags are not supported")
+	}
+
+	p.pos++
+
+	if s[0] == '"' || s[0] == '\'' {
+		v, err := unquote(s)
+		if err != nil {
+			p.pos--
+
+			return nil, p.errorf("%s", err)
+		}
+
+		return v, nil
+	}
+
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+
+	if yamlInt.MatchString(s) {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+	}
+
+	return s, nil
+}
+
+func (p *yamlParser) parseBlockScalar(folded bool, indent int) string {
+	lines := []string{}
+	blockIndent := -1
+
+	for ; p.pos < len(p.lines); p.pos++ {
+		l := p.lines[p.pos]
+
+		if strings.TrimSpace(l.raw) == "" {
+			lines = append(lines, "")
+
+			continue
+		}
+
+		if l.indent <= indent || (blockIndent >= 0 && l.indent < blockIndent) {
+			break
+		}
+
+		if blockIndent < 0 {
+			blockIndent = l.indent
+		}
+
+		lines = append(lines, l.raw[blockIndent:])
+	}
+
+	// drop trailing empty lines, keeping a single final newline (clip)
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+
+	if !folded {
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	var b strings.Builder
+
+	for i, l := range lines {
+		switch {
+		case i == 0:
+		case l == "" || lines[i-1] == "":
+			b.WriteString("\n")
+		default:
+			b.WriteString(" ")
+		}
+
+		b.WriteString(l)
+	}
+
+	b.WriteString("\n")
+
+	return b.String()
+}
+
+// splitKey returns the index of the colon separating a mapping key from its
+// value, or -1 if the text is not a mapping entry.
+func splitKey(s string) int {
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i == len(s)-1 || s[i+1] == ' '):
+			return i
+		}
+	}
+
+	return -1
+}
+
+func unquote(s string) (string, error) {
+	if s == "" {
+		return s, nil
+	}
+
+	switch s[0] {
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted string %s", s)
+		}
+
+		return v, nil
+	default:
+		return s, nil
+	}
+}
+
+// formatYAML writes v, a tree as decoded by encoding/json, to b in the subset
+// parseYAML reads. Strings are always double-quoted so that none is taken for
+// another type. Empty collections would need the flow style, so they are left
+// out of mappings as if they weren't set.
+func formatYAML(b *strings.Builder, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if isEmptyCollection(v[k]) {
+				continue
+			}
+
+			key := k
+			if !yamlPlainKey.MatchString(k) {
+				key = strconv.Quote(k)
+			}
+
+			b.WriteString(pad + key + ":")
+			formatYAMLValue(b, v[k], indent)
+		}
+	case []interface{}:
+		for _, item := range v {
+			b.WriteString(pad + "-")
+			formatYAMLValue(b, item, indent)
+		}
+	}
+}
+
+// formatYAMLValue writes the value of a key or sequence item: a scalar on the
+// same line, a collection indented on the following ones.
+func formatYAMLValue(b *strings.Builder, v interface{}, indent int) {
+	switch v := v.(type) {
+	case map[string]interface{}, []interface{}:
+		if isEmptyCollection(v) {
+			b.WriteString(" null\n")
+
+			return
+		}
+
+		b.WriteString("\n")
+		formatYAML(b, v, indent+2)
+	case string:
+		b.WriteString(" " + strconv.Quote(v) + "\n")
+	case nil:
+		b.WriteString(" null\n")
+	default:
+		fmt.Fprintf(b, " %v\n", v)
+	}
+}
+
+func isEmptyCollection(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
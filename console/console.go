@@ -0,0 +1,182 @@
+package console
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+)
+
+// Server shares the serial console of a VM with clients connected to a unix
+// socket. Console output is copied to every client and bytes sent by any
+// client are passed to the input callback.
+type Server struct {
+	ln    net.Listener
+	local io.Writer
+	input func(b byte)
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+}
+
+type client struct {
+	conn net.Conn
+	out  chan []byte
+}
+
+// clientBacklog is the number of pending writes kept for a slow client.
+// Output is dropped for the client beyond this so that the vCPU writing to
+// the console never blocks.
+const clientBacklog = 4096
+
+// Listen creates the unix socket at path. Output is also written to local
+// unless it is nil.
+func Listen(path string, local io.Writer, input func(b byte)) (*Server, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		ln:      ln,
+		local:   local,
+		input:   input,
+		clients: map[*client]struct{}{},
+	}, nil
+}
+
+// Write implements io.Writer for the console output.
+func (s *Server) Write(p []byte) (int, error) {
+	if s.local != nil {
+		if _, err := s.local.Write(p); err != nil {
+			return 0, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		b := make([]byte, len(p))
+		copy(b, p)
+
+		select {
+		case c.out <- b:
+		default:
+		}
+	}
+
+	return len(p), nil
+}
+
+// Serve accepts clients until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		c := &client{conn: conn, out: make(chan []byte, clientBacklog)}
+
+		s.mu.Lock()
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+
+		go s.writeLoop(c)
+		go s.readLoop(c)
+	}
+}
+
+func (s *Server) Close() error {
+	err := s.ln.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		c.conn.Close()
+	}
+
+	return err
+}
+
+func (s *Server) writeLoop(c *client) {
+	for b := range c.out {
+		if _, err := c.conn.Write(b); err != nil {
+			c.conn.Close()
+
+			return
+		}
+	}
+}
+
+func (s *Server) readLoop(c *client) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		close(c.out)
+		s.mu.Unlock()
+
+		c.conn.Close()
+	}()
+
+	in := bufio.NewReader(c.conn)
+
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			return
+		}
+
+		s.input(b)
+	}
+}
+
+// Attach connects to the console socket at path, copying the console output
+// to out and in to the console, until the console is closed or the escape
+// key followed by d is typed to detach.
+func Attach(path string, escape byte, in io.Reader, out io.Writer) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	done := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(out, conn)
+		done <- err
+	}()
+
+	go func() {
+		done <- copyUntilDetach(conn, in, escape)
+	}()
+
+	return <-done
+}
+
+func copyUntilDetach(w io.Writer, r io.Reader, escape byte) error {
+	var before byte = 0
+
+	in := bufio.NewReader(r)
+
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if before == escape && b == 'd' {
+			return nil
+		}
+
+		if _, err := w.Write([]byte{b}); err != nil {
+			return err
+		}
+
+		before = b
+	}
+}
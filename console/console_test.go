@@ -0,0 +1,232 @@
+package console_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/console"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "console.sock")
+	local := &bytes.Buffer{}
+	input := make(chan byte, 10)
+
+	s, err := console.Listen(path, local, func(b byte) { input <- b })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the input proves that the client is registered
+	if b := <-input; b != 'a' {
+		t.Fatalf("unexpected input: %c", b)
+	}
+
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "hello" || local.String() != "hello" {
+		t.Fatalf("unexpected output: %q, %q", buf, local.String())
+	}
+}
+
+func TestAttachDetach(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "console.sock")
+	input := make(chan byte, 10)
+
+	s, err := console.Listen(path, nil, func(b byte) { input <- b })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	// Ctrl-a d detaches, the rest is sent to the console
+	if err := console.Attach(path, console.DefaultEscape, strings.NewReader("ls\x01dpwd"), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []byte("ls\x01") {
+		if b := <-input; b != c {
+			t.Fatalf("unexpected input: %q", b)
+		}
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "console.log")
+
+	// every line takes 35 bytes with its timestamp, so 2 fit in a file
+	l, err := console.OpenLogFile(path, 80, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	for _, s := range []string{"line 0001\n", "line 0002\n", "line 0003\n", "line 0004\n", "line 0005\n", "line 0006\n", "line", " 0007\n"} {
+		if n, err := l.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("unexpected write: %d, %v", n, err)
+		}
+	}
+
+	stamp := regexp.MustCompile(`(?m)^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z line (\d{4})$`)
+
+	for suffix, want := range map[string]string{".2": "0003 0004", ".1": "0005 0006", "": "0007"} {
+		data, err := ioutil.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := []string{}
+		for _, m := range stamp.FindAllStringSubmatch(string(data), -1) {
+			lines = append(lines, m[1])
+		}
+
+		if got := strings.Join(lines, " "); got != want {
+			t.Fatalf("console.log%s: got lines %q in:\n%s", suffix, got, data)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("too many files are kept: %v", err)
+	}
+}
+
+func TestParseEscape(t *testing.T) {
+	t.Parallel()
+
+	for s, want := range map[string]byte{"^a": 0x01, "^A": 0x01, "^]": 0x1d, "^@": 0x00} {
+		b, err := console.ParseEscape(s)
+		if err != nil || b != want {
+			t.Fatalf("%s: got 0x%x, %v", s, b, err)
+		}
+	}
+
+	for _, s := range []string{"", "a", "^", "^1", "^ab", "x]"} {
+		if _, err := console.ParseEscape(s); !errors.Is(err, console.ErrorInvalidEscape) {
+			t.Fatalf("%q: unexpected error: %v", s, err)
+		}
+	}
+
+	if s := console.FormatEscape(0x1d); s != "^]" {
+		t.Fatalf("unexpected format: %s", s)
+	}
+}
+
+func TestMux(t *testing.T) {
+	t.Parallel()
+
+	out := &bytes.Buffer{}
+	input := []byte{}
+	lines := []string{}
+
+	mux := console.NewMux(console.DefaultEscape, out, func(b byte) { input = append(input, b) },
+		func(line string) string {
+			lines = append(lines, line)
+
+			return "ok"
+		})
+
+	// a doubled escape key is sent, c switches to the monitor and back
+	for _, b := range []byte("ls\x01\x01\x01cinfo x\x7fstatus\r\x01cpwd") {
+		if !mux.Feed(b) {
+			t.Fatalf("quit on %q", b)
+		}
+	}
+
+	if string(input) != "ls\x01pwd" {
+		t.Fatalf("unexpected input: %q", input)
+	}
+
+	if len(lines) != 1 || lines[0] != "info status" {
+		t.Fatalf("unexpected monitor lines: %q", lines)
+	}
+
+	if !strings.Contains(out.String(), "ok\r\n(gokvm) ") {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+
+	if !mux.Feed(0x01) || !mux.Feed('h') || !mux.Feed(0x01) || mux.Feed('x') {
+		t.Fatal("escape x doesn't quit")
+	}
+}
+
+func TestPTY(t *testing.T) {
+	t.Parallel()
+
+	input := make(chan byte, 10)
+
+	p, err := console.OpenPTY(func(b byte) { input <- b })
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+
+	defer p.Close()
+
+	f, err := os.OpenFile(p.Path(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if _, err := p.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// raw mode keeps the line feed as it is
+	b := make([]byte, 6)
+	if _, err := io.ReadFull(f, b); err != nil || string(b) != "hello\n" {
+		t.Fatalf("unexpected output: %q, %v", b, err)
+	}
+
+	if _, err := f.Write([]byte("l")); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := <-input; b != 'l' {
+		t.Fatalf("unexpected input: %q", b)
+	}
+}
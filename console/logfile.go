@@ -0,0 +1,130 @@
+package console
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/logging"
+)
+
+var log = logging.New("console")
+
+// LogFile records console output to a file, prefixing every line with the
+// time it started. When the file would grow beyond its maximum size, it is
+// renamed to path.1, the older files are shifted up to path.<keep>, and a new
+// file is started.
+//
+// Write errors, e.g. on a full disk, are logged once and the output is
+// dropped, so that the log never affects the console itself.
+type LogFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu          sync.Mutex
+	f           *os.File
+	size        int64
+	atLineStart bool
+	failed      bool
+}
+
+// OpenLogFile appends to the log file at path, which is rotated at maxSize
+// bytes keeping keep old files. A keep of 0 truncates the file instead.
+func OpenLogFile(path string, maxSize int64, keep int) (*LogFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	return &LogFile{
+		path:        path,
+		maxSize:     maxSize,
+		keep:        keep,
+		f:           f,
+		size:        fi.Size(),
+		atLineStart: true,
+	}, nil
+}
+
+// Write implements io.Writer. It always succeeds.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]byte, 0, len(p))
+
+	for _, b := range p {
+		if l.atLineStart {
+			out = append(out, time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00 ")...)
+		}
+
+		out = append(out, b)
+		l.atLineStart = b == '\n'
+	}
+
+	if l.size > 0 && l.size+int64(len(out)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.fail(err)
+
+			return len(p), nil
+		}
+	}
+
+	n, err := l.f.Write(out)
+	l.size += int64(n)
+
+	if err != nil {
+		l.fail(err)
+	}
+
+	return len(p), nil
+}
+
+func (l *LogFile) fail(err error) {
+	if !l.failed {
+		l.failed = true
+		log.Error("failed to write the console log", "path", l.path, "err", err)
+	}
+}
+
+func (l *LogFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	for i := l.keep - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+
+	if l.keep > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.f = f
+	l.size = 0
+
+	return nil
+}
+
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
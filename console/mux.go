@@ -0,0 +1,150 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/monitor"
+)
+
+// DefaultEscape is Ctrl-a, the escape key of the terminal by default.
+const DefaultEscape = 0x01
+
+var ErrorInvalidEscape = errors.New("escape key must be ^ followed by a letter or one of @[\\]^_, e.g. ^a")
+
+// ParseEscape parses a control key written in caret notation, e.g. ^a for
+// Ctrl-a or ^] for Ctrl-].
+func ParseEscape(s string) (byte, error) {
+	if len(s) != 2 || s[0] != '^' {
+		return 0, fmt.Errorf("%w: %q", ErrorInvalidEscape, s)
+	}
+
+	c := s[1]
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+
+	if c < '@' || c > '_' {
+		return 0, fmt.Errorf("%w: %q", ErrorInvalidEscape, s)
+	}
+
+	return c - '@', nil
+}
+
+// FormatEscape returns the caret notation of the control key b.
+func FormatEscape(b byte) string {
+	c := b + '@'
+	if c >= 'A' && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+
+	return "^" + string(c)
+}
+
+// Mux shares the terminal between the serial console and the monitor. Keys
+// go to the console unless they follow the escape key:
+//
+//	c       switch between the console and the monitor
+//	x       quit
+//	h       show the keys
+//	escape  send the escape key itself, e.g. to a nested gokvm
+//
+// The monitor reads a line at a time, echoing it since the terminal is raw.
+// The output of the console is written to the terminal by its owner, also
+// while the monitor is in front.
+type Mux struct {
+	escape  byte
+	out     io.Writer
+	input   func(b byte)
+	execute func(line string) string
+
+	escaped   bool
+	inMonitor bool
+	line      []byte
+}
+
+// NewMux returns a multiplexer writing to out, which passes the keys of the
+// console to input and runs the lines of the monitor with execute.
+func NewMux(escape byte, out io.Writer, input func(b byte), execute func(line string) string) *Mux {
+	return &Mux{escape: escape, out: out, input: input, execute: execute}
+}
+
+// write writes s to the raw terminal, which doesn't turn line feeds into new
+// lines.
+func (x *Mux) write(s string) {
+	_, _ = io.WriteString(x.out, strings.ReplaceAll(s, "\n", "\r\n"))
+}
+
+func (x *Mux) help() string {
+	e := FormatEscape(x.escape)
+
+	return fmt.Sprintf("\n%[1]s c  switch between console and monitor\n%[1]s x  quit\n"+
+		"%[1]s h  show this help\n%[1]s %[1]s  send %[1]s\n", e)
+}
+
+// Feed handles a key typed on the terminal. It returns false once the user
+// asked to quit.
+func (x *Mux) Feed(b byte) bool {
+	if x.escaped {
+		x.escaped = false
+
+		switch b {
+		case 'x':
+			return false
+		case 'c':
+			x.inMonitor = !x.inMonitor
+			x.line = x.line[:0]
+
+			if x.inMonitor {
+				x.write("\n" + monitor.Banner + monitor.Prompt)
+			} else {
+				x.write("\n")
+			}
+		case 'h':
+			x.write(x.help())
+		case x.escape:
+			x.key(b)
+		}
+
+		return true
+	}
+
+	if b == x.escape {
+		x.escaped = true
+
+		return true
+	}
+
+	x.key(b)
+
+	return true
+}
+
+func (x *Mux) key(b byte) {
+	if !x.inMonitor {
+		x.input(b)
+
+		return
+	}
+
+	switch b {
+	case '\r', '\n':
+		out := x.execute(string(x.line))
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+
+		x.write("\n" + out + monitor.Prompt)
+		x.line = x.line[:0]
+	case 0x7f, '\b':
+		if len(x.line) > 0 {
+			x.line = x.line[:len(x.line)-1]
+			x.write("\b \b")
+		}
+	default:
+		x.line = append(x.line, b)
+		_, _ = x.out.Write([]byte{b})
+	}
+}
@@ -0,0 +1,132 @@
+package console
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/term"
+)
+
+const (
+	ioctlTIOCGPTN   = 0x80045430
+	ioctlTIOCSPTLCK = 0x40045431
+)
+
+// PTY offers the serial console on a pseudo-terminal, for tools such as
+// minicom or expect to open. Output is dropped rather than blocking the
+// console while no one reads it.
+//
+// gokvm keeps the terminal side open itself, so that the pseudo-terminal
+// survives the tools opening and closing it.
+type PTY struct {
+	master *os.File
+	slave  *os.File
+	path   string
+	out    chan []byte
+}
+
+// OpenPTY allocates a pseudo-terminal in raw mode, whose input is passed to
+// the input callback.
+func OpenPTY(input func(b byte)) (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlock int32
+
+	if err := ioctl(master, ioctlTIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+
+		return nil, fmt.Errorf("unlock pty: %w", err)
+	}
+
+	var n uint32
+
+	if err := ioctl(master, ioctlTIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+
+		return nil, fmt.Errorf("pty number: %w", err)
+	}
+
+	path := fmt.Sprintf("/dev/pts/%d", n)
+
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+
+		return nil, err
+	}
+
+	// without echo, the guest doesn't read back what it writes
+	if _, err := term.MakeRaw(int(slave.Fd())); err != nil {
+		slave.Close()
+		master.Close()
+
+		return nil, err
+	}
+
+	p := &PTY{master: master, slave: slave, path: path, out: make(chan []byte, clientBacklog)}
+
+	go p.writeLoop()
+	go p.readLoop(input)
+
+	return p, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Path returns the path of the terminal side, e.g. /dev/pts/3.
+func (p *PTY) Path() string {
+	return p.path
+}
+
+// Write implements io.Writer for the console output.
+func (p *PTY) Write(b []byte) (int, error) {
+	c := make([]byte, len(b))
+	copy(c, b)
+
+	select {
+	case p.out <- c:
+	default:
+	}
+
+	return len(b), nil
+}
+
+func (p *PTY) writeLoop() {
+	for b := range p.out {
+		if _, err := p.master.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func (p *PTY) readLoop(input func(b byte)) {
+	in := bufio.NewReader(p.master)
+
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			return
+		}
+
+		input(b)
+	}
+}
+
+// Close releases the pseudo-terminal.
+func (p *PTY) Close() error {
+	p.slave.Close()
+
+	return p.master.Close()
+}
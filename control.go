@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/logging"
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/qmp"
+)
+
+const (
+	reasonGuestShutdown = "guest-shutdown"
+	reasonGuestReset    = "guest-reset"
+	reasonHostQMPQuit   = "host-qmp-quit"
+	reasonHostUI        = "host-ui"
+	reasonGuestPanic    = "guest-panic"
+	reasonMigrated      = "migrated"
+
+	reasonHostQMPSystemReset = "host-qmp-system-reset"
+)
+
+var (
+	errorInvalidDumpProtocol   = errors.New("dump-guest-memory only supports the file: and fd: protocols")
+	errorPowerdownNotSupported = errors.New("system_powerdown is not supported: the machine has no ACPI power button")
+	errorHotplugNotSupported   = errors.New("device hotplug is not supported")
+	errorSnapshotParent        = errors.New("an incremental snapshot can't replace its parent")
+)
+
+type statusInfo struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+type guestPanicEvent struct {
+	Action string `json:"action"`
+}
+
+// logLevel is the argument of set-log-level and an element of the result of
+// query-log-levels. An empty subsystem stands for the default level.
+type logLevel struct {
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+// exitStats is the result of query-exit-stats. The I/O ports are sorted by
+// the time spent emulating them, the hottest first.
+type exitStats struct {
+	VCPUs   []vcpuExitStats `json:"vcpus"`
+	IOPorts []ioportStat    `json:"ioports"`
+}
+
+type vcpuExitStats struct {
+	VCPU  int        `json:"vcpu"`
+	Exits []exitStat `json:"exits"`
+}
+
+type exitStat struct {
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+	TimeNs int64  `json:"time-ns"`
+	Slow   uint64 `json:"slow"`
+}
+
+type ioportStat struct {
+	Port   uint16 `json:"port"`
+	Count  uint64 `json:"count"`
+	TimeNs int64  `json:"time-ns"`
+}
+
+func queryExitStats(m *machine.Machine) (exitStats, error) {
+	stats := exitStats{VCPUs: []vcpuExitStats{}, IOPorts: []ioportStat{}}
+
+	for cpu := 0; cpu < m.NumCPUs(); cpu++ {
+		st, err := m.ExitStats(cpu)
+		if err != nil {
+			return stats, err
+		}
+
+		v := vcpuExitStats{VCPU: cpu, Exits: []exitStat{}}
+		for reason, s := range st {
+			v.Exits = append(v.Exits, exitStat{Reason: reason, Count: s.Count, TimeNs: int64(s.Time), Slow: s.Slow})
+		}
+
+		sort.Slice(v.Exits, func(i, j int) bool { return v.Exits[i].Reason < v.Exits[j].Reason })
+		stats.VCPUs = append(stats.VCPUs, v)
+	}
+
+	for port, s := range m.IOPortStats() {
+		stats.IOPorts = append(stats.IOPorts, ioportStat{Port: port, Count: s.Count, TimeNs: int64(s.Time)})
+	}
+
+	sort.Slice(stats.IOPorts, func(i, j int) bool {
+		if stats.IOPorts[i].TimeNs != stats.IOPorts[j].TimeNs {
+			return stats.IOPorts[i].TimeNs > stats.IOPorts[j].TimeNs
+		}
+
+		return stats.IOPorts[i].Port < stats.IOPorts[j].Port
+	})
+
+	return stats, nil
+}
+
+// stallEvent is the data of the VCPU_STALLED event.
+type stallEvent struct {
+	VCPU       int               `json:"vcpu"`
+	Reason     string            `json:"reason"`
+	DurationNs int64             `json:"duration-ns"`
+	Registers  map[string]string `json:"registers"`
+}
+
+// reportStall logs a stalled vCPU with its registers and emits the
+// VCPU_STALLED event.
+func reportStall(q *qmp.Server, s machine.Stall) {
+	r := s.Regs
+	regs := map[string]string{}
+
+	for _, reg := range []struct {
+		name  string
+		value uint64
+	}{
+		{"rax", r.RAX}, {"rbx", r.RBX}, {"rcx", r.RCX}, {"rdx", r.RDX},
+		{"rsi", r.RSI}, {"rdi", r.RDI}, {"rsp", r.RSP}, {"rbp", r.RBP},
+		{"r8", r.R8}, {"r9", r.R9}, {"r10", r.R10}, {"r11", r.R11},
+		{"r12", r.R12}, {"r13", r.R13}, {"r14", r.R14}, {"r15", r.R15},
+		{"rip", r.RIP}, {"rflags", r.RFLAGS},
+	} {
+		regs[reg.name] = fmt.Sprintf("0x%x", reg.value)
+	}
+
+	log.Warn("vcpu stalled", "vcpu", s.VCPU, "reason", s.Reason, "duration", s.Duration,
+		"rip", regs["rip"], "rsp", regs["rsp"], "rflags", regs["rflags"],
+		"rax", regs["rax"], "rbx", regs["rbx"], "rcx", regs["rcx"], "rdx", regs["rdx"])
+
+	q.Emit("VCPU_STALLED", stallEvent{
+		VCPU:       s.VCPU,
+		Reason:     s.Reason,
+		DurationNs: int64(s.Duration),
+		Registers:  regs,
+	})
+}
+
+type dumpArgs struct {
+	Protocol string `json:"protocol"`
+}
+
+// createOutput creates the file at path, or takes the descriptor passed with
+// getfd for fd:name.
+func createOutput(q *qmp.Server, path string) (*os.File, error) {
+	if strings.HasPrefix(path, "fd:") {
+		return q.TakeFile(strings.TrimPrefix(path, "fd:"))
+	}
+
+	return os.Create(path)
+}
+
+// dumpGuestMemory writes an ELF core of the machine to f, which is closed.
+func dumpGuestMemory(m *machine.Machine, f *os.File) error {
+	if err := m.WriteCoreDump(f); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+type snapshotArgs struct {
+	File        string `json:"file"`
+	Incremental bool   `json:"incremental"`
+}
+
+// snapshotChain remembers the latest snapshot of the VM, the parent of the
+// next incremental one.
+type snapshotChain struct {
+	mu   sync.Mutex
+	last string
+}
+
+// save writes a snapshot of the machine to path, only with the pages written
+// since the latest one if incremental. The parent is recorded relative to
+// the new snapshot, so that the files can be moved together. A snapshot
+// written to a descriptor with fd:name records the absolute path of its
+// parent, and can't be the parent of the next one.
+func (c *snapshotChain) save(q *qmp.Server, m *machine.Machine, path string, incremental bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	toFd := strings.HasPrefix(path, "fd:")
+
+	var err error
+
+	if !toFd {
+		if path, err = filepath.Abs(path); err != nil {
+			return err
+		}
+	}
+
+	parent := ""
+
+	if incremental {
+		if c.last == "" {
+			return machine.ErrorNoBaseSnapshot
+		}
+
+		if c.last == path {
+			return fmt.Errorf("%w: %s", errorSnapshotParent, path)
+		}
+
+		parent = c.last
+
+		if !toFd {
+			if parent, err = filepath.Rel(filepath.Dir(path), c.last); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := createOutput(q, path)
+	if err != nil {
+		return err
+	}
+
+	if incremental {
+		err = m.SnapshotIncremental(f, parent)
+	} else {
+		err = m.Snapshot(f)
+	}
+
+	if err != nil {
+		f.Close()
+
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	c.last = path
+	if toFd {
+		c.last = ""
+	}
+
+	return nil
+}
+
+// shutdownEvent is the data of the SHUTDOWN and RESET events.
+type shutdownEvent struct {
+	Guest  bool   `json:"guest"`
+	Reason string `json:"reason"`
+}
+
+// requestShutdown records the first reason for stopping the VM, later
+// requests are ignored.
+func requestShutdown(shutdown chan<- string, reason string) {
+	select {
+	case shutdown <- reason:
+	default:
+	}
+}
+
+func newControlServer(ln net.Listener, m *machine.Machine, snapshots *snapshotChain,
+	shutdown chan<- string) *qmp.Server {
+	q := qmp.NewServer(ln)
+
+	q.Register("query-status", func(json.RawMessage) (interface{}, error) {
+		if m.IsPaused() {
+			return statusInfo{Running: false, Status: "paused"}, nil
+		}
+
+		return statusInfo{Running: true, Status: "running"}, nil
+	})
+
+	q.Register("stop", func(json.RawMessage) (interface{}, error) {
+		if err := m.Pause(); err != nil {
+			return nil, err
+		}
+
+		q.Emit("STOP", nil)
+
+		return nil, nil
+	})
+
+	q.Register("cont", func(json.RawMessage) (interface{}, error) {
+		if err := m.Resume(); err != nil {
+			return nil, err
+		}
+
+		q.Emit("RESUME", nil)
+
+		return nil, nil
+	})
+
+	q.Register("system_reset", func(json.RawMessage) (interface{}, error) {
+		if err := m.Reset(); err != nil {
+			return nil, err
+		}
+
+		q.Emit("RESET", shutdownEvent{Guest: false, Reason: reasonHostQMPSystemReset})
+
+		return nil, nil
+	})
+
+	q.Register("quit", func(json.RawMessage) (interface{}, error) {
+		requestShutdown(shutdown, reasonHostQMPQuit)
+
+		return nil, nil
+	})
+
+	q.Register("system_powerdown", func(json.RawMessage) (interface{}, error) {
+		return nil, errorPowerdownNotSupported
+	})
+
+	q.Register("dump-guest-memory", func(args json.RawMessage) (interface{}, error) {
+		arg := dumpArgs{}
+		if err := json.Unmarshal(args, &arg); err != nil {
+			return nil, fmt.Errorf("%w: %s", qmp.ErrorInvalidRequest, err)
+		}
+
+		if !strings.HasPrefix(arg.Protocol, "file:") && !strings.HasPrefix(arg.Protocol, "fd:") {
+			return nil, fmt.Errorf("%w: %q", errorInvalidDumpProtocol, arg.Protocol)
+		}
+
+		f, err := createOutput(q, strings.TrimPrefix(arg.Protocol, "file:"))
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, dumpGuestMemory(m, f)
+	})
+
+	q.Register("snapshot-save", func(args json.RawMessage) (interface{}, error) {
+		arg := snapshotArgs{}
+		if err := json.Unmarshal(args, &arg); err != nil || arg.File == "" {
+			return nil, fmt.Errorf("%w: snapshot-save takes a file", qmp.ErrorInvalidRequest)
+		}
+
+		return nil, snapshots.save(q, m, arg.File, arg.Incremental)
+	})
+
+	q.Register("migrate", func(args json.RawMessage) (interface{}, error) {
+		arg := migrateArgs{}
+		if err := json.Unmarshal(args, &arg); err != nil {
+			return nil, fmt.Errorf("%w: %s", qmp.ErrorInvalidRequest, err)
+		}
+
+		if err := migrate(m, q, arg.URI, arg.Postcopy); err != nil {
+			q.Emit("MIGRATION", migrationEvent{Status: "failed"})
+
+			return nil, err
+		}
+
+		// the guest now runs on the destination
+		q.Emit("MIGRATION", migrationEvent{Status: "completed"})
+		requestShutdown(shutdown, reasonMigrated)
+
+		return nil, nil
+	})
+
+	q.Register("query-exit-stats", func(json.RawMessage) (interface{}, error) {
+		return queryExitStats(m)
+	})
+
+	q.Register("set-log-level", func(args json.RawMessage) (interface{}, error) {
+		arg := logLevel{}
+		if err := json.Unmarshal(args, &arg); err != nil {
+			return nil, fmt.Errorf("%w: %s", qmp.ErrorInvalidRequest, err)
+		}
+
+		level, err := logging.ParseLevel(arg.Level)
+		if err != nil {
+			return nil, err
+		}
+
+		logging.SetLevel(arg.Subsystem, level)
+
+		return nil, nil
+	})
+
+	q.Register("query-log-levels", func(json.RawMessage) (interface{}, error) {
+		levels := []logLevel{}
+		for subsystem, level := range logging.Levels() {
+			levels = append(levels, logLevel{Subsystem: subsystem, Level: level.String()})
+		}
+
+		sort.Slice(levels, func(i, j int) bool { return levels[i].Subsystem < levels[j].Subsystem })
+
+		return levels, nil
+	})
+
+	q.Register("device_add", func(json.RawMessage) (interface{}, error) {
+		return nil, errorHotplugNotSupported
+	})
+
+	return q
+}
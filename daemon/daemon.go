@@ -0,0 +1,371 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/qmp"
+)
+
+// Each VM managed by the daemon runs as a supervised gokvm child process.
+// Everything belonging to a VM lives in its own directory under the daemon's
+// directory:
+//
+//	<dir>/<id>/config.yaml  configuration the VM is started with
+//	<dir>/<id>/qmp.sock     QMP-like control socket of the VM
+//	<dir>/<id>/console.log  serial console output
+const (
+	StateRunning = "running"
+	StateExited  = "exited"
+
+	ConfigFileName = "config.yaml"
+	QMPSocketName  = "qmp.sock"
+	ConsoleLogName = "console.log"
+
+	DefaultStopTimeout = 10 * time.Second
+)
+
+var (
+	ErrorInvalidID   = errors.New("id must consist of letters, digits, '-' and '_'")
+	ErrorVMExists    = errors.New("vm already exists")
+	ErrorVMNotFound  = errors.New("vm not found")
+	ErrorInheritedFD = errors.New("the daemon passes no descriptors to VMs")
+)
+
+var validID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type VM struct {
+	ID       string        `json:"id"`
+	Config   config.Config `json:"config"`
+	State    string        `json:"state"`
+	PID      int           `json:"pid"`
+	ExitCode int           `json:"exit_code"`
+	QMP      string        `json:"qmp"`
+	Console  string        `json:"console"`
+
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+type CreateRequest struct {
+	ID     string        `json:"id"`
+	Config config.Config `json:"config"`
+}
+
+type fault struct {
+	FaultMessage string `json:"fault_message"`
+}
+
+type Daemon struct {
+	// Command is the gokvm binary started for each VM.
+	Command string
+
+	// StopTimeout is how long Destroy waits for a VM to quit before it
+	// kills the VM.
+	StopTimeout time.Duration
+
+	dir string
+
+	mu  sync.Mutex
+	vms map[string]*VM
+}
+
+func New(dir, command string) (*Daemon, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Daemon{
+		Command:     command,
+		StopTimeout: DefaultStopTimeout,
+		dir:         dir,
+		vms:         map[string]*VM{},
+	}, nil
+}
+
+// Create starts a new VM. The VM is named id, and its control socket and
+// console log are always placed in its own directory, so c.Name, c.QMP and
+// c.API are ignored. The VM stays a child of the daemon, so c.Daemonize is
+// too. Paths naming inherited descriptors are rejected.
+func (d *Daemon) Create(id string, c config.Config) (VM, error) {
+	if !validID.MatchString(id) {
+		return VM{}, fmt.Errorf("%w: %q", ErrorInvalidID, id)
+	}
+
+	if err := c.Validate(); err != nil {
+		return VM{}, err
+	}
+
+	if fds := c.InheritedFds(); len(fds) > 0 {
+		return VM{}, fmt.Errorf("%w: %v", ErrorInheritedFD, fds)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.vms[id]; ok {
+		return VM{}, fmt.Errorf("%w: %s", ErrorVMExists, id)
+	}
+
+	vmDir := filepath.Join(d.dir, id)
+	if err := os.MkdirAll(vmDir, 0o755); err != nil {
+		return VM{}, err
+	}
+
+	// two VMs of the same name would share an instance directory
+	c.Name = id
+	c.QMP = filepath.Join(vmDir, QMPSocketName)
+	c.API = ""
+	c.Daemonize = false
+
+	vm := &VM{
+		ID:      id,
+		Config:  c,
+		QMP:     c.QMP,
+		Console: filepath.Join(vmDir, ConsoleLogName),
+		done:    make(chan struct{}),
+	}
+
+	console, err := os.OpenFile(vm.Console, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return VM{}, err
+	}
+
+	defer console.Close()
+
+	// The whole configuration goes to the VM through a file, so that none
+	// of its settings is left out of the command line.
+	configPath := filepath.Join(vmDir, ConfigFileName)
+	if err := c.WriteFile(configPath); err != nil {
+		return VM{}, err
+	}
+
+	vm.cmd = exec.Command(d.Command, "-config", configPath)
+	vm.cmd.Stdout = console
+	vm.cmd.Stderr = console
+
+	if err := vm.cmd.Start(); err != nil {
+		return VM{}, err
+	}
+
+	vm.State = StateRunning
+	vm.PID = vm.cmd.Process.Pid
+	d.vms[id] = vm
+
+	go func() {
+		_ = vm.cmd.Wait()
+
+		d.mu.Lock()
+		vm.State = StateExited
+		vm.ExitCode = vm.cmd.ProcessState.ExitCode()
+		d.mu.Unlock()
+
+		close(vm.done)
+	}()
+
+	return *vm, nil
+}
+
+// List returns all VMs sorted by id.
+func (d *Daemon) List() []VM {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vms := make([]VM, 0, len(d.vms))
+	for _, vm := range d.vms {
+		vms = append(vms, *vm)
+	}
+
+	sort.Slice(vms, func(i, j int) bool { return vms[i].ID < vms[j].ID })
+
+	return vms
+}
+
+func (d *Daemon) Get(id string) (VM, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return VM{}, fmt.Errorf("%w: %s", ErrorVMNotFound, id)
+	}
+
+	return *vm, nil
+}
+
+// Destroy stops the VM process and removes its directory. The VM is asked to
+// quit through its control socket first, so that it cleans up and runs its
+// hooks, and is killed if it fails to within StopTimeout.
+func (d *Daemon) Destroy(id string) error {
+	d.mu.Lock()
+	vm, ok := d.vms[id]
+	delete(d.vms, id)
+	d.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrorVMNotFound, id)
+	}
+
+	timer := time.NewTimer(d.StopTimeout)
+	defer timer.Stop()
+
+	go func() {
+		if err := quit(vm.QMP); err != nil {
+			_ = vm.cmd.Process.Kill()
+		}
+	}()
+
+	select {
+	case <-vm.done:
+	case <-timer.C:
+		_ = vm.cmd.Process.Kill()
+		<-vm.done
+	}
+
+	return os.RemoveAll(filepath.Join(d.dir, id))
+}
+
+// quit asks the VM with the control socket at path to stop. It only fails
+// if the VM can't be asked, as the VM may exit before it answers.
+func quit(path string) error {
+	q, err := qmp.Dial(path)
+	if err != nil {
+		return err
+	}
+
+	defer q.Close()
+
+	_, _ = q.Execute("quit", nil)
+
+	return nil
+}
+
+// Close destroys all VMs, which stop at the same time.
+func (d *Daemon) Close() {
+	wg := sync.WaitGroup{}
+
+	for _, vm := range d.List() {
+		wg.Add(1)
+
+		go func(id string) {
+			defer wg.Done()
+
+			_ = d.Destroy(id)
+		}(vm.ID)
+	}
+
+	wg.Wait()
+}
+
+// Handler returns the HTTP handler of the management API:
+//
+//	GET    /vms       list VMs
+//	POST   /vms       create a VM from a CreateRequest
+//	GET    /vms/<id>  show a VM
+//	DELETE /vms/<id>  destroy a VM
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/vms", d.handleVMs)
+	mux.HandleFunc("/vms/", d.handleVM)
+
+	return mux
+}
+
+// Serve serves the management API on the unix socket at path.
+func (d *Daemon) Serve(path string) error {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	return http.Serve(ln, d.Handler())
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if v != nil {
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+func replyError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+
+	switch {
+	case errors.Is(err, ErrorVMNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrorVMExists):
+		code = http.StatusConflict
+	}
+
+	reply(w, code, fault{FaultMessage: err.Error()})
+}
+
+func (d *Daemon) handleVMs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		reply(w, http.StatusOK, d.List())
+	case http.MethodPost:
+		req := CreateRequest{Config: *config.Default()}
+
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(&req); err != nil {
+			replyError(w, err)
+
+			return
+		}
+
+		vm, err := d.Create(req.ID, req.Config)
+		if err != nil {
+			replyError(w, err)
+
+			return
+		}
+
+		reply(w, http.StatusCreated, vm)
+	default:
+		reply(w, http.StatusMethodNotAllowed, fault{FaultMessage: "method not allowed"})
+	}
+}
+
+func (d *Daemon) handleVM(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/vms/")
+
+	switch r.Method {
+	case http.MethodGet:
+		vm, err := d.Get(id)
+		if err != nil {
+			replyError(w, err)
+
+			return
+		}
+
+		reply(w, http.StatusOK, vm)
+	case http.MethodDelete:
+		if err := d.Destroy(id); err != nil {
+			replyError(w, err)
+
+			return
+		}
+
+		reply(w, http.StatusNoContent, nil)
+	default:
+		reply(w, http.StatusMethodNotAllowed, fault{FaultMessage: "method not allowed"})
+	}
+}
@@ -0,0 +1,308 @@
+package daemon_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/daemon"
+	"github.com/bobuhiro11/gokvm/qmp"
+)
+
+// newDaemon returns a daemon whose VMs run a script printing its arguments
+// instead of gokvm.
+func newDaemon(t *testing.T) (*daemon.Daemon, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	command := filepath.Join(dir, "fake-gokvm")
+	script := "#!/bin/sh\necho \"$@\"\nexec sleep 60\n"
+
+	if err := ioutil.WriteFile(command, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := daemon.New(filepath.Join(dir, "run"), command)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(d.Close)
+
+	return d, filepath.Join(dir, "run")
+}
+
+// childConfig returns the configuration the fake gokvm of vm was started with.
+func childConfig(t *testing.T, vm daemon.VM) *config.Config {
+	t.Helper()
+
+	// the arguments are written to the console log by the fake gokvm
+	var log []byte
+
+	for i := 0; i < 100 && !bytes.Contains(log, []byte("\n")); i++ {
+		time.Sleep(10 * time.Millisecond)
+
+		log, _ = ioutil.ReadFile(vm.Console)
+	}
+
+	args := strings.Fields(string(log))
+	if len(args) != 2 || args[0] != "-config" {
+		t.Fatalf("unexpected arguments: %s", log)
+	}
+
+	c := config.Default()
+	if err := c.LoadFile(args[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestCreateAndDestroy(t *testing.T) {
+	t.Parallel()
+
+	d, dir := newDaemon(t)
+
+	for _, id := range []string{"vm1", "vm0"} {
+		if _, err := d.Create(id, *config.Default()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := d.Create("vm0", *config.Default()); !errors.Is(err, daemon.ErrorVMExists) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := d.Create("../vm", *config.Default()); !errors.Is(err, daemon.ErrorInvalidID) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	vms := d.List()
+	if len(vms) != 2 || vms[0].ID != "vm0" || vms[0].State != daemon.StateRunning {
+		t.Fatalf("unexpected vms: %+v", vms)
+	}
+
+	if vms[0].QMP != filepath.Join(dir, "vm0", daemon.QMPSocketName) {
+		t.Fatalf("unexpected qmp socket: %s", vms[0].QMP)
+	}
+
+	if c := childConfig(t, vms[0]); c.QMP != vms[0].QMP {
+		t.Fatalf("unexpected qmp socket of the child: %s", c.QMP)
+	}
+
+	if err := d.Destroy("vm0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "vm0")); !os.IsNotExist(err) {
+		t.Fatal("vm directory is not removed")
+	}
+
+	if err := d.Destroy("vm0"); !errors.Is(err, daemon.ErrorVMNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateConfig(t *testing.T) {
+	t.Parallel()
+
+	d, _ := newDaemon(t)
+
+	c := *config.Default()
+	c.Name = "other"
+	c.Machine = "microvm"
+	c.KVMDevice = "/dev/kvm0"
+	c.Restore = "/var/lib/gokvm/vm0.snap"
+	c.ClockResync = true
+	c.DeviceTree = true
+	c.SerialPTY = true
+	c.PidFile = "/run/vm0.pid"
+	c.Hooks = map[string][]config.Hook{config.EventShutdown: {{URL: "http://localhost/vm0"}}}
+	c.Seccomp = "log"
+	c.Landlock = true
+	c.LandlockAllow = []string{"/var/lib/gokvm"}
+	c.VCPUSched = "fifo"
+	c.VCPUPriority = 10
+	c.HaltPoll = "50us"
+	c.VCPUReserveProcs = true
+	c.API = "/run/vm0-api.sock"
+	c.Daemonize = true
+
+	vm, err := d.Create("vm0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the child gets every setting but the ones the daemon manages itself
+	c.Name, c.QMP, c.API, c.Daemonize = "vm0", vm.QMP, "", false
+
+	if !reflect.DeepEqual(vm.Config, c) {
+		t.Fatalf("unexpected config:\n%+v\nwant:\n%+v", vm.Config, c)
+	}
+
+	if child := childConfig(t, vm); !reflect.DeepEqual(*child, c) {
+		t.Fatalf("unexpected config of the child:\n%+v\nwant:\n%+v", *child, c)
+	}
+
+	c = *config.Default()
+	c.Kernel = "fd=3"
+
+	if _, err := d.Create("vm1", c); !errors.Is(err, daemon.ErrorInheritedFD) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// fakeVM serves the control socket of the VM configured by the -config
+// argument, and writes to marker and exits once asked to quit.
+func fakeVM(marker string) {
+	c := config.Default()
+	if err := c.LoadFile(flag.Arg(1)); err != nil {
+		panic(err)
+	}
+
+	s, err := qmp.Listen(c.QMP)
+	if err != nil {
+		panic(err)
+	}
+
+	quit := make(chan struct{})
+
+	s.Register("quit", func(json.RawMessage) (interface{}, error) {
+		close(quit)
+
+		return nil, nil
+	})
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	<-quit
+	s.Close()
+
+	if err := ioutil.WriteFile(marker, nil, 0o644); err != nil {
+		panic(err)
+	}
+
+	os.Exit(0)
+}
+
+func TestDestroyQuit(t *testing.T) {
+	t.Parallel()
+
+	if marker := os.Getenv("GOKVM_DAEMON_QUIT"); marker != "" {
+		fakeVM(marker)
+	}
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "quit")
+	command := filepath.Join(dir, "fake-gokvm")
+	script := fmt.Sprintf("#!/bin/sh\nGOKVM_DAEMON_QUIT=%s exec %s -test.run='^TestDestroyQuit$' -- \"$@\"\n",
+		marker, os.Args[0])
+
+	if err := ioutil.WriteFile(command, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := daemon.New(filepath.Join(dir, "run"), command)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the VM must quit rather than be killed
+	d.StopTimeout = time.Minute
+
+	vm, err := d.Create("vm0", *config.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(vm.QMP); err == nil {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := d.Destroy("vm0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("vm did not quit: %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	d, _ := newDaemon(t)
+	s := httptest.NewServer(d.Handler())
+
+	defer s.Close()
+
+	res, err := http.Post(s.URL+"/vms", "application/json",
+		strings.NewReader(`{"id": "vm0", "config": {"cpus": 2, "memory": "512M"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+
+	res, err = http.Get(s.URL + "/vms/vm0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := daemon.VM{}
+	if err := json.NewDecoder(res.Body).Decode(&vm); err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if vm.Config.CPUs != 2 || vm.Config.Memory != 512<<20 {
+		t.Fatalf("unexpected vm: %+v", vm)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, s.URL+"/vms/vm0", nil)
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+
+	res, err = http.Get(s.URL + "/vms/vm0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/config"
+)
+
+// daemonizeEnv names the descriptor on which gokvm started by -daemonize
+// reports that the VM runs, so that the gokvm in the foreground can exit.
+const daemonizeEnv = "GOKVM_DAEMONIZE_FD"
+
+// daemonize runs gokvm again with the same arguments in a session of its own,
+// without the terminal, and returns once the VM runs: with 0, or with the
+// exit status of gokvm if it failed before. Errors are still written to
+// stderr until then. The descriptors inherited by c keep their numbers.
+func daemonize(c *config.Config) int {
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stderr = os.Stderr
+
+	// ExtraFiles[i] becomes descriptor 3+i, and the pipe goes above them
+	for _, fd := range c.InheritedFds() {
+		f := os.NewFile(uintptr(fd), "fd="+strconv.Itoa(fd))
+
+		switch {
+		case fd == 0:
+			cmd.Stdin = f
+		case fd == 1:
+			cmd.Stdout = f
+		case fd > 2:
+			for len(cmd.ExtraFiles) <= fd-3 {
+				cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+			}
+
+			cmd.ExtraFiles[fd-3] = f
+		}
+	}
+
+	cmd.Env = append(os.Environ(), daemonizeEnv+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		panic(err)
+	}
+
+	w.Close()
+
+	if n, _ := r.Read(make([]byte, 1)); n == 1 {
+		return 0
+	}
+
+	// the pipe is closed without a byte when gokvm exits
+	err = cmd.Wait()
+
+	exitErr := &exec.ExitError{}
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
+	return 0
+}
+
+// daemonized returns the function detaching gokvm started by -daemonize from
+// the one in the foreground, which does nothing otherwise. Detaching reports
+// that the VM runs and stops writing to stderr, which goes to the terminal.
+func daemonized() (func(), error) {
+	v, ok := os.LookupEnv(daemonizeEnv)
+	if !ok {
+		return func() {}, nil
+	}
+
+	// not for the hooks
+	os.Unsetenv(daemonizeEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := os.NewFile(uintptr(fd), "daemonize")
+	syscall.CloseOnExec(fd)
+
+	// opened now, since the sandbox may not allow it later
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	once := sync.Once{}
+
+	return func() {
+		once.Do(func() {
+			_, _ = ready.Write([]byte{1})
+			ready.Close()
+
+			_ = syscall.Dup3(int(null.Fd()), 2, 0)
+			null.Close()
+		})
+	}, nil
+}
@@ -1,19 +1,31 @@
 package ebda
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/bootparam"
 )
 
 const (
 	MaxVCPUs = 64
+
+	// Sizes of the structures, as laid out by Bytes.
+	MPFIntelSize       = 16
+	MPCTableHeaderSize = 44
+	MPCCpuSize         = 20
+	MPCTableSize       = MPCTableHeaderSize + MaxVCPUs*MPCCpuSize
+	Size               = mpfIntelOffset + MPFIntelSize + MPCTableSize
+
+	mpfIntelOffset = 16 * 3
 )
 
-var errorVCPUNumExceed = fmt.Errorf("the number of vCPUs must be less than or equal to %d", MaxVCPUs)
+var (
+	errorVCPUNumExceed = fmt.Errorf("the number of vCPUs must be less than or equal to %d", MaxVCPUs)
+
+	ErrorInvalidPlatform = errors.New("invalid MP table platform")
+)
 
 // Extended BIOS Data Area (EBDA).
 type EBDA struct {
@@ -26,16 +38,20 @@ type EBDA struct {
 }
 
 func (e *EBDA) Bytes() ([]byte, error) {
-	buf := new(bytes.Buffer)
-
-	if err := binary.Write(buf, binary.LittleEndian, e); err != nil {
-		return []byte{}, err
-	}
+	b := make([]byte, Size)
+	e.mpfIntel.encode(b[mpfIntelOffset:])
+	e.mpcTable.encode(b[mpfIntelOffset+MPFIntelSize:])
 
-	return buf.Bytes(), nil
+	return b, nil
 }
 
 func New(nCPUs int) (*EBDA, error) {
+	return NewWithPlatform(nCPUs, Platform{})
+}
+
+// NewWithPlatform returns the EBDA of nCPUs vCPUs with an MP table naming
+// the platform p.
+func NewWithPlatform(nCPUs int, p Platform) (*EBDA, error) {
 	e := &EBDA{}
 
 	mpfIntel, err := NewMPFIntel()
@@ -45,7 +61,7 @@ func New(nCPUs int) (*EBDA, error) {
 
 	e.mpfIntel = *mpfIntel
 
-	mpcTable, err := NewMPCTable(nCPUs)
+	mpcTable, err := NewMPCTableWithPlatform(nCPUs, p)
 	if err != nil {
 		return e, err
 	}
@@ -72,7 +88,7 @@ type MPFIntel struct {
 
 func NewMPFIntel() (*MPFIntel, error) {
 	m := &MPFIntel{}
-	m.Signature = (('_' << 24) | ('P' << 16) | ('M' << 8) | '_')
+	m.Signature = mpfIntelSignature
 	m.Length = 1 // this must be 1
 	m.Specification = 4
 	m.PhysPtr = bootparam.EBDAStart + 0x40
@@ -105,13 +121,23 @@ func (m *MPFIntel) CalcCheckSum() (uint8, error) {
 }
 
 func (m *MPFIntel) Bytes() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	b := make([]byte, MPFIntelSize)
+	m.encode(b)
 
-	if err := binary.Write(buf, binary.LittleEndian, m); err != nil {
-		return []byte{}, err
-	}
+	return b, nil
+}
 
-	return buf.Bytes(), nil
+func (m *MPFIntel) encode(b []byte) {
+	binary.LittleEndian.PutUint32(b[0:], m.Signature)
+	binary.LittleEndian.PutUint32(b[4:], m.PhysPtr)
+	b[8] = m.Length
+	b[9] = m.Specification
+	b[10] = m.CheckSum
+	b[11] = m.Feature1
+	b[12] = m.Feature2
+	b[13] = m.Feature3
+	b[14] = m.Feature4
+	b[15] = m.Feature5
 }
 
 // MP Configuration Table Header
@@ -135,20 +161,99 @@ type MPCTable struct {
 const (
 	APICDefaultPhysBase = 0xfee00000
 	APICBaseAddrStep    = 0x00400000
+
+	pageSize = 0x1000
 )
 
 func apicAddr(apic uint32) uint32 {
 	return APICDefaultPhysBase + apic*APICBaseAddrStep
 }
 
+// Platform identifies the machine in the MP table, which guests report
+// e.g. as "MPTABLE: OEM ID: ..." in their boot log. The zero value leaves the
+// identifiers zero, as they are in the tables of older versions.
+type Platform struct {
+	// OEM and ProductID are printable ASCII of at most 8 and 12 bytes,
+	// padded with spaces as the MP specification expects.
+	OEM       string
+	ProductID string
+
+	// LAPIC is the address at which the vCPUs find their local APIC,
+	// APICDefaultPhysBase if zero. KVM emulates the local APIC at the
+	// address of the APIC base MSR of each vCPU, which only the guest can
+	// move, so another address is only right for guests moving it.
+	LAPIC uint32
+}
+
+// Check returns an error unless p fits in the MP table.
+func (p Platform) Check() error {
+	if err := checkID("OEM", p.OEM, len(MPCTable{}.OEM)); err != nil {
+		return err
+	}
+
+	if err := checkID("product ID", p.ProductID, len(MPCTable{}.ProductID)); err != nil {
+		return err
+	}
+
+	if p.LAPIC%pageSize != 0 {
+		return fmt.Errorf("%w: local APIC address 0x%x isn't aligned to %d bytes", ErrorInvalidPlatform, p.LAPIC, pageSize)
+	}
+
+	return nil
+}
+
+func checkID(name, id string, size int) error {
+	if len(id) > size {
+		return fmt.Errorf("%w: %s %q is longer than %d bytes", ErrorInvalidPlatform, name, id, size)
+	}
+
+	for _, c := range []byte(id) {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("%w: %s %q isn't printable ASCII", ErrorInvalidPlatform, name, id)
+		}
+	}
+
+	return nil
+}
+
+// putID copies id into field padded with spaces, leaving an empty field zero.
+func putID(field []uint8, id string) {
+	if id == "" {
+		return
+	}
+
+	for i := range field {
+		field[i] = ' '
+	}
+
+	copy(field, id)
+}
+
 func NewMPCTable(nCPUs int) (*MPCTable, error) {
+	return NewMPCTableWithPlatform(nCPUs, Platform{})
+}
+
+// NewMPCTableWithPlatform returns the MP table of nCPUs vCPUs naming the
+// platform p.
+func NewMPCTableWithPlatform(nCPUs int, p Platform) (*MPCTable, error) {
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+
 	m := &MPCTable{}
-	m.Signature = (('P' << 24) | ('M' << 16) | ('C' << 8) | 'P')
-	m.Length = uint16(unsafe.Sizeof(MPCTable{})) // this field must contain the size of entries.
+	m.Signature = mpcTableSignature
+	m.Length = MPCTableSize // this field must contain the size of entries.
 	m.Spec = 4
 	m.LAPIC = apicAddr(0)
 	m.OEMCount = MaxVCPUs // This must be the number of entries
 
+	if p.LAPIC != 0 {
+		m.LAPIC = p.LAPIC
+	}
+
+	putID(m.OEM[:], p.OEM)
+	putID(m.ProductID[:], p.ProductID)
+
 	if nCPUs > MaxVCPUs {
 		return nil, errorVCPUNumExceed
 	}
@@ -190,13 +295,30 @@ func (m *MPCTable) CalcCheckSum() (uint8, error) {
 }
 
 func (m *MPCTable) Bytes() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	b := make([]byte, MPCTableSize)
+	m.encode(b)
 
-	if err := binary.Write(buf, binary.LittleEndian, m); err != nil {
-		return []byte{}, err
-	}
+	return b, nil
+}
 
-	return buf.Bytes(), nil
+func (m *MPCTable) encode(b []byte) {
+	le := binary.LittleEndian
+
+	le.PutUint32(b[0:], m.Signature)
+	le.PutUint16(b[4:], m.Length)
+	b[6] = m.Spec
+	b[7] = m.CheckSum
+	copy(b[8:16], m.OEM[:])
+	copy(b[16:28], m.ProductID[:])
+	le.PutUint32(b[28:], m.OEMPtr)
+	le.PutUint16(b[32:], m.OEMSize)
+	le.PutUint16(b[34:], m.OEMCount)
+	le.PutUint32(b[36:], m.LAPIC)
+	le.PutUint32(b[40:], m.Reserved)
+
+	for i := range m.mpcCPU {
+		m.mpcCPU[i].encode(b[MPCTableHeaderSize+i*MPCCpuSize:])
+	}
 }
 
 type MPCCpu struct {
@@ -226,3 +348,14 @@ func NewMPCCpu(i int) (*MPCCpu, error) {
 
 	return m, nil
 }
+
+func (m *MPCCpu) encode(b []byte) {
+	b[0] = m.Type
+	b[1] = m.APICID
+	b[2] = m.APICVER
+	b[3] = m.CPUFlag
+	binary.LittleEndian.PutUint32(b[4:], m.CPUFeature)
+	binary.LittleEndian.PutUint32(b[8:], m.FeatureFlag)
+	binary.LittleEndian.PutUint32(b[12:], m.Reserved[0])
+	binary.LittleEndian.PutUint32(b[16:], m.Reserved[1])
+}
@@ -1,6 +1,9 @@
 package ebda_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"testing"
 
 	"github.com/bobuhiro11/gokvm/ebda"
@@ -32,3 +35,191 @@ func TestNewMPFIntel(t *testing.T) {
 		t.Fatal("Invalid size")
 	}
 }
+
+func TestBytesLayout(t *testing.T) {
+	t.Parallel()
+
+	for _, n := range []int{1, ebda.MaxVCPUs} {
+		e, err := ebda.New(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := e.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the layout the structs describe
+		want := new(bytes.Buffer)
+		if err := binary.Write(want, binary.LittleEndian, e); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(raw) != ebda.Size || !bytes.Equal(raw, want.Bytes()) {
+			t.Fatalf("%d vCPUs: EBDA differs from the layout of the structs", n)
+		}
+
+		m, err := ebda.NewMPCTable(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if checkSum, err := m.CalcCheckSum(); err != nil || checkSum != 0 {
+			t.Fatalf("%d vCPUs: invalid checkSum %d: %v", n, checkSum, err)
+		}
+
+		if size := binary.Size(m); size != ebda.MPCTableSize || int(m.Length) != size {
+			t.Fatalf("invalid size %d with length %d", size, m.Length)
+		}
+	}
+}
+
+func TestNewWithPlatform(t *testing.T) {
+	t.Parallel()
+
+	p := ebda.Platform{OEM: "GOKVM", ProductID: "gokvm 1.0", LAPIC: 0xfec00000}
+
+	m, err := ebda.NewMPCTableWithPlatform(2, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(m.OEM[:]) != "GOKVM   " || string(m.ProductID[:]) != "gokvm 1.0   " || m.LAPIC != p.LAPIC {
+		t.Fatalf("unexpected identifiers %q %q 0x%x", m.OEM, m.ProductID, m.LAPIC)
+	}
+
+	if checkSum, err := m.CalcCheckSum(); err != nil || checkSum != 0 {
+		t.Fatalf("invalid checkSum %d: %v", checkSum, err)
+	}
+
+	e, err := ebda.NewWithPlatform(2, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(raw, []byte("GOKVM   gokvm 1.0   ")) {
+		t.Fatal("identifiers not in the EBDA")
+	}
+
+	// the zero platform is the table of older versions
+	m, err = ebda.NewMPCTableWithPlatform(2, ebda.Platform{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.OEM != [8]uint8{} || m.ProductID != [12]uint8{} || m.LAPIC != ebda.APICDefaultPhysBase {
+		t.Fatalf("unexpected default identifiers %q %q 0x%x", m.OEM, m.ProductID, m.LAPIC)
+	}
+
+	for _, p := range []ebda.Platform{
+		{OEM: "TOO LONG!"},
+		{ProductID: "much too long"},
+		{OEM: "tab\t"},
+		{LAPIC: 0xfee00010},
+	} {
+		if _, err := ebda.NewWithPlatform(1, p); !errors.Is(err, ebda.ErrorInvalidPlatform) {
+			t.Fatalf("%+v: unexpected error: %v", p, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	p := ebda.Platform{OEM: "GOKVM", ProductID: "gokvm"}
+
+	for _, n := range []int{1, ebda.MaxVCPUs} {
+		e, err := ebda.NewWithPlatform(n, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := e.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ebda.Parse(raw)
+		if err != nil {
+			t.Fatalf("%d vCPUs: %v", n, err)
+		}
+
+		again, err := parsed.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(raw, again) {
+			t.Fatalf("%d vCPUs: EBDA differs after a round trip", n)
+		}
+
+		cpus := parsed.MPCTable().CPUs()
+		if len(cpus) != n || cpus[0].CPUFlag&2 == 0 || int(cpus[n-1].APICID) != n-1 {
+			t.Fatalf("%d vCPUs: unexpected processors %+v", n, cpus)
+		}
+
+		if string(parsed.MPCTable().OEM[:]) != "GOKVM   " || parsed.MPFIntel().Specification != 4 {
+			t.Fatalf("%d vCPUs: unexpected table %+v", n, parsed.MPCTable())
+		}
+	}
+}
+
+func sum(b []byte) uint8 {
+	s := uint8(0)
+	for _, c := range b {
+		s += c
+	}
+
+	return s
+}
+
+func TestParseCorrupted(t *testing.T) {
+	t.Parallel()
+
+	e, err := ebda.New(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		mpfIntel = 16 * 3
+		mpcTable = mpfIntel + ebda.MPFIntelSize
+	)
+
+	for _, tc := range []struct {
+		name    string
+		corrupt func(b []byte) []byte
+		err     error
+	}{
+		{"truncated", func(b []byte) []byte { return b[:mpcTable+ebda.MPCTableHeaderSize-1] }, ebda.ErrorInvalidMPTable},
+		{"floating pointer signature", func(b []byte) []byte { b[mpfIntel] = 'X'; return b }, ebda.ErrorInvalidMPTable},
+		{"floating pointer checksum", func(b []byte) []byte { b[mpfIntel+9]++; return b }, ebda.ErrorMPCheckSum},
+		{"table outside", func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[mpfIntel+4:], 0x1000)
+			b[mpfIntel+10] -= sum(b[mpfIntel:mpcTable]) // a valid checksum
+
+			return b
+		}, ebda.ErrorInvalidMPTable},
+		{"table signature", func(b []byte) []byte { b[mpcTable] = 'X'; return b }, ebda.ErrorInvalidMPTable},
+		{"table length", func(b []byte) []byte { b[mpcTable+5] = 0xff; return b }, ebda.ErrorInvalidMPTable},
+		{"table checksum", func(b []byte) []byte { b[mpcTable+8] = 'X'; return b }, ebda.ErrorMPCheckSum},
+		{"processor entry", func(b []byte) []byte { b[ebda.Size-1] = 1; return b }, ebda.ErrorMPCheckSum},
+	} {
+		b := tc.corrupt(append([]byte{}, raw...))
+
+		if _, err := ebda.Parse(b); !errors.Is(err, tc.err) {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
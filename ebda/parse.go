@@ -0,0 +1,205 @@
+package ebda
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+)
+
+const (
+	mpfIntelSignature = (('_' << 24) | ('P' << 16) | ('M' << 8) | '_')
+	mpcTableSignature = (('P' << 24) | ('M' << 16) | ('C' << 8) | 'P')
+
+	// types of the entries of the MP table, of which only processors are
+	// 20 bytes long
+	mpProcessor = 0
+	mpLINTSrc   = 4
+	mpEntrySize = 8
+)
+
+var (
+	ErrorInvalidMPTable = errors.New("invalid MP table")
+	ErrorMPCheckSum     = errors.New("MP table checksum mismatch")
+)
+
+// checkSum returns the sum of b, which is 0 for a valid structure.
+func checkSum(b []byte) uint8 {
+	sum := uint8(0)
+	for _, c := range b {
+		sum += c
+	}
+
+	return sum
+}
+
+// Parse decodes an EBDA as Bytes lays it out, e.g. read back from guest
+// memory at bootparam.EBDAStart, verifying both checksums.
+func Parse(b []byte) (*EBDA, error) {
+	if len(b) < mpfIntelOffset+MPFIntelSize {
+		return nil, fmt.Errorf("%w: EBDA of %d bytes too short", ErrorInvalidMPTable, len(b))
+	}
+
+	mpfIntel, err := ParseMPFIntel(b[mpfIntelOffset:])
+	if err != nil {
+		return nil, err
+	}
+
+	// the floating pointer gives the physical address of the table
+	off := int64(mpfIntel.PhysPtr) - bootparam.EBDAStart
+	if off < 0 || off >= int64(len(b)) {
+		return nil, fmt.Errorf("%w: table at 0x%x outside of the EBDA", ErrorInvalidMPTable, mpfIntel.PhysPtr)
+	}
+
+	mpcTable, err := ParseMPCTable(b[off:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &EBDA{mpfIntel: *mpfIntel, mpcTable: *mpcTable}, nil
+}
+
+// MPFIntel returns the MP floating pointer structure of the EBDA.
+func (e *EBDA) MPFIntel() *MPFIntel {
+	return &e.mpfIntel
+}
+
+// MPCTable returns the MP configuration table of the EBDA.
+func (e *EBDA) MPCTable() *MPCTable {
+	return &e.mpcTable
+}
+
+// ParseMPFIntel decodes the MP floating pointer structure at the start of b,
+// verifying its signature and checksum.
+func ParseMPFIntel(b []byte) (*MPFIntel, error) {
+	if len(b) < MPFIntelSize {
+		return nil, fmt.Errorf("%w: floating pointer of %d bytes too short", ErrorInvalidMPTable, len(b))
+	}
+
+	le := binary.LittleEndian
+	m := &MPFIntel{
+		Signature:     le.Uint32(b[0:]),
+		PhysPtr:       le.Uint32(b[4:]),
+		Length:        b[8],
+		Specification: b[9],
+		CheckSum:      b[10],
+		Feature1:      b[11],
+		Feature2:      b[12],
+		Feature3:      b[13],
+		Feature4:      b[14],
+		Feature5:      b[15],
+	}
+
+	if m.Signature != mpfIntelSignature {
+		return nil, fmt.Errorf("%w: floating pointer signature 0x%x", ErrorInvalidMPTable, m.Signature)
+	}
+
+	// the length is in 16-byte units
+	n := int(m.Length) * MPFIntelSize
+	if n == 0 || n > len(b) {
+		return nil, fmt.Errorf("%w: floating pointer length %d", ErrorInvalidMPTable, m.Length)
+	}
+
+	if sum := checkSum(b[:n]); sum != 0 {
+		return nil, fmt.Errorf("%w: floating pointer sums to 0x%x", ErrorMPCheckSum, sum)
+	}
+
+	return m, nil
+}
+
+// ParseMPCTable decodes the MP configuration table at the start of b,
+// verifying its signature and checksum. Its processor entries are kept in
+// order, up to MaxVCPUs; the entries of other types are skipped.
+func ParseMPCTable(b []byte) (*MPCTable, error) {
+	if len(b) < MPCTableHeaderSize {
+		return nil, fmt.Errorf("%w: table of %d bytes too short", ErrorInvalidMPTable, len(b))
+	}
+
+	le := binary.LittleEndian
+	m := &MPCTable{
+		Signature: le.Uint32(b[0:]),
+		Length:    le.Uint16(b[4:]),
+		Spec:      b[6],
+		CheckSum:  b[7],
+		OEMPtr:    le.Uint32(b[28:]),
+		OEMSize:   le.Uint16(b[32:]),
+		OEMCount:  le.Uint16(b[34:]),
+		LAPIC:     le.Uint32(b[36:]),
+		Reserved:  le.Uint32(b[40:]),
+	}
+
+	copy(m.OEM[:], b[8:16])
+	copy(m.ProductID[:], b[16:28])
+
+	if m.Signature != mpcTableSignature {
+		return nil, fmt.Errorf("%w: table signature 0x%x", ErrorInvalidMPTable, m.Signature)
+	}
+
+	if int(m.Length) < MPCTableHeaderSize || int(m.Length) > len(b) {
+		return nil, fmt.Errorf("%w: table length %d", ErrorInvalidMPTable, m.Length)
+	}
+
+	b = b[:m.Length]
+
+	if sum := checkSum(b); sum != 0 {
+		return nil, fmt.Errorf("%w: table sums to 0x%x", ErrorMPCheckSum, sum)
+	}
+
+	off, nCPUs := MPCTableHeaderSize, 0
+
+	for i := 0; i < int(m.OEMCount); i++ {
+		if off >= len(b) {
+			return nil, fmt.Errorf("%w: entry %d past the end of the table", ErrorInvalidMPTable, i)
+		}
+
+		switch typ := b[off]; {
+		case typ == mpProcessor:
+			if off+MPCCpuSize > len(b) {
+				return nil, fmt.Errorf("%w: entry %d past the end of the table", ErrorInvalidMPTable, i)
+			}
+
+			if nCPUs == MaxVCPUs {
+				return nil, fmt.Errorf("%w: more than %d processors", ErrorInvalidMPTable, MaxVCPUs)
+			}
+
+			m.mpcCPU[nCPUs].decode(b[off:])
+			nCPUs++
+			off += MPCCpuSize
+		case typ <= mpLINTSrc:
+			off += mpEntrySize
+		default:
+			return nil, fmt.Errorf("%w: entry %d of unknown type %d", ErrorInvalidMPTable, i, typ)
+		}
+	}
+
+	if off > len(b) {
+		return nil, fmt.Errorf("%w: entries past the end of the table", ErrorInvalidMPTable)
+	}
+
+	return m, nil
+}
+
+// CPUs returns the entries of the enabled processors of the table.
+func (m *MPCTable) CPUs() []MPCCpu {
+	cpus := []MPCCpu{}
+
+	for _, c := range m.mpcCPU {
+		if c.CPUFlag&1 != 0 {
+			cpus = append(cpus, c)
+		}
+	}
+
+	return cpus
+}
+
+func (m *MPCCpu) decode(b []byte) {
+	m.Type = b[0]
+	m.APICID = b[1]
+	m.APICVER = b[2]
+	m.CPUFlag = b[3]
+	m.CPUFeature = binary.LittleEndian.Uint32(b[4:])
+	m.FeatureFlag = binary.LittleEndian.Uint32(b[8:])
+	m.Reserved[0] = binary.LittleEndian.Uint32(b[12:])
+	m.Reserved[1] = binary.LittleEndian.Uint32(b[16:])
+}
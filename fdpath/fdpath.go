@@ -0,0 +1,142 @@
+// Package fdpath lets the files given to gokvm by path be descriptors it
+// inherited, written fd=N. A privileged supervisor can then open the files
+// and devices gokvm isn't allowed to, and run it unprivileged or in a jail
+// without them.
+//
+// Each open duplicates the descriptor, so that a file can be opened again,
+// e.g. the kernel on reset, and rewinds it; a pipe is read from where it is.
+package fdpath
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	prefix = "fd="
+
+	fDupfdCloexec = 1030
+)
+
+var ErrorInvalidFd = errors.New("invalid file descriptor")
+
+// Parse returns the descriptor path names, and whether it names one at all.
+func Parse(path string) (int, bool, error) {
+	if !strings.HasPrefix(path, prefix) {
+		return 0, false, nil
+	}
+
+	fd, err := strconv.Atoi(strings.TrimPrefix(path, prefix))
+	if err != nil || fd < 0 {
+		return 0, true, fmt.Errorf("%w: %q", ErrorInvalidFd, path)
+	}
+
+	return fd, true, nil
+}
+
+// dup returns a copy of the descriptor named by path, closed on exec. The
+// descriptor itself is closed on exec as well once it is used, so that the
+// programs run by hooks don't inherit it.
+func dup(path string, fd int) (*os.File, error) {
+	nfd, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), fDupfdCloexec, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("%w: %s: %v", ErrorInvalidFd, path, errno)
+	}
+
+	syscall.CloseOnExec(fd)
+
+	f := os.NewFile(nfd, path)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil && !errors.Is(err, syscall.ESPIPE) {
+		f.Close()
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// OpenFile is os.OpenFile for a path naming a descriptor too, which is used
+// with the mode it was opened with.
+func OpenFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, ok, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return os.OpenFile(path, flag, perm)
+	}
+
+	return dup(path, fd)
+}
+
+// Open opens path for reading.
+func Open(path string) (*os.File, error) {
+	return OpenFile(path, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates path for writing. A descriptor of a pipe or
+// socket is written as is.
+func Create(path string) (*os.File, error) {
+	fd, ok, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return os.Create(path)
+	}
+
+	f, err := dup(path, fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err != nil && !errors.Is(err, syscall.EINVAL) {
+		f.Close()
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ReadFile returns the contents of path.
+func ReadFile(path string) ([]byte, error) {
+	f, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// Stat returns the FileInfo of path.
+func Stat(path string) (os.FileInfo, error) {
+	fd, ok, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return os.Stat(path)
+	}
+
+	f, err := dup(path, fd)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return f.Stat()
+}
@@ -0,0 +1,134 @@
+package fdpath_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/fdpath"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	if fd, ok, err := fdpath.Parse("fd=3"); err != nil || !ok || fd != 3 {
+		t.Fatalf("unexpected result: %d %v %v", fd, ok, err)
+	}
+
+	if _, ok, err := fdpath.Parse("./fd=3"); err != nil || ok {
+		t.Fatalf("a path must not name a descriptor: %v %v", ok, err)
+	}
+
+	for _, path := range []string{"fd=", "fd=x", "fd=-1"} {
+		if _, _, err := fdpath.Parse(path); !errors.Is(err, fdpath.ErrorInvalidFd) {
+			t.Fatalf("%s: unexpected error: %v", path, err)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "kernel")
+	if err := ioutil.WriteFile(path, []byte("kernel"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	name := "fd=" + strconv.Itoa(int(f.Fd()))
+
+	// each read starts over, and leaves the descriptor open
+	for i := 0; i < 2; i++ {
+		data, err := fdpath.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "kernel" {
+			t.Fatalf("unexpected contents: %q", data)
+		}
+	}
+
+	fi, err := fdpath.Stat(name)
+	if err != nil || fi.Size() != int64(len("kernel")) {
+		t.Fatalf("unexpected stat: %v %v", fi, err)
+	}
+
+	if _, err := fdpath.Open("fd=1000000"); !errors.Is(err, fdpath.ErrorInvalidFd) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCloseOnExec(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	// as inherited from a supervisor, without FD_CLOEXEC
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Close(fd)
+
+	if _, err := fdpath.Stat("fd=" + strconv.Itoa(fd)); err != nil {
+		t.Fatal(err)
+	}
+
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+	if errno != 0 || flags&syscall.FD_CLOEXEC == 0 {
+		t.Fatalf("descriptor is not closed on exec: 0x%x %v", flags, errno)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "dump")
+	if err := ioutil.WriteFile(path, []byte("old contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	out, err := fdpath.Create("fd=" + strconv.Itoa(int(f.Fd())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := out.WriteString("new"); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "new" {
+		t.Fatalf("the file is not truncated: %q", data)
+	}
+}
@@ -0,0 +1,369 @@
+// Package fdt builds flattened device trees, the blobs of version 17 of the
+// devicetree specification through which a kernel learns about the memory,
+// CPUs and devices of a machine it can't probe.
+//
+// refs: https://devicetree-specification.readthedocs.io/en/stable/flattened-format.html
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	magic          = 0xd00dfeed
+	version        = 17
+	lastCompatible = 16
+
+	tokenBeginNode = 1
+	tokenEndNode   = 2
+	tokenProp      = 3
+	tokenNop       = 4
+	tokenEnd       = 9
+
+	headerSize = 40
+
+	// rsvmapSize is the memory reservation block, which only has the entry
+	// ending it.
+	rsvmapSize = 16
+)
+
+var ErrorInvalidBlob = errors.New("invalid device tree blob")
+
+// Property is a named value of a node, encoded in big endian.
+type Property struct {
+	Name  string
+	Value []byte
+}
+
+// Node is a node of a device tree, named like memory@0. The root node has an
+// empty name.
+type Node struct {
+	Name       string
+	Properties []Property
+	Children   []*Node
+}
+
+type header struct {
+	Magic           uint32
+	TotalSize       uint32
+	OffDtStruct     uint32
+	OffDtStrings    uint32
+	OffMemRsvmap    uint32
+	Version         uint32
+	LastCompVersion uint32
+	BootCPUIDPhys   uint32
+	SizeDtStrings   uint32
+	SizeDtStruct    uint32
+}
+
+// NewNode returns a node without properties or children.
+func NewNode(name string) *Node {
+	return &Node{Name: name}
+}
+
+// Child adds a child called name to n and returns it.
+func (n *Node) Child(name string) *Node {
+	c := NewNode(name)
+	n.Children = append(n.Children, c)
+
+	return c
+}
+
+// Set sets the property name of n to value, replacing one of the same name.
+func (n *Node) Set(name string, value []byte) {
+	for i := range n.Properties {
+		if n.Properties[i].Name == name {
+			n.Properties[i].Value = value
+
+			return
+		}
+	}
+
+	n.Properties = append(n.Properties, Property{name, value})
+}
+
+// SetEmpty sets a property without a value, e.g. ranges.
+func (n *Node) SetEmpty(name string) {
+	n.Set(name, []byte{})
+}
+
+// SetString sets a property to a list of NUL-terminated strings.
+func (n *Node) SetString(name string, values ...string) {
+	v := []byte{}
+	for _, s := range values {
+		v = append(append(v, s...), 0)
+	}
+
+	n.Set(name, v)
+}
+
+// SetU32 sets a property to a list of 32-bit cells.
+func (n *Node) SetU32(name string, values ...uint32) {
+	v := make([]byte, 4*len(values))
+	for i, x := range values {
+		binary.BigEndian.PutUint32(v[4*i:], x)
+	}
+
+	n.Set(name, v)
+}
+
+// SetU64 sets a property to a list of 64-bit values, each two cells.
+func (n *Node) SetU64(name string, values ...uint64) {
+	v := make([]byte, 8*len(values))
+	for i, x := range values {
+		binary.BigEndian.PutUint64(v[8*i:], x)
+	}
+
+	n.Set(name, v)
+}
+
+// Property returns the value of the property name.
+func (n *Node) Property(name string) ([]byte, bool) {
+	for _, p := range n.Properties {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Lookup returns the descendant of n at the path of node names, e.g.
+// cpus/cpu@0.
+func (n *Node) Lookup(path ...string) (*Node, bool) {
+	for _, name := range path {
+		var next *Node
+
+		for _, c := range n.Children {
+			if c.Name == name {
+				next = c
+
+				break
+			}
+		}
+
+		if next == nil {
+			return nil, false
+		}
+
+		n = next
+	}
+
+	return n, true
+}
+
+func pad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+func u32(buf *bytes.Buffer, v uint32) {
+	_ = binary.Write(buf, binary.BigEndian, v)
+}
+
+// encoder writes the structure block, and the strings block of the property
+// names it refers to.
+type encoder struct {
+	dtStruct  bytes.Buffer
+	dtStrings bytes.Buffer
+	offsets   map[string]uint32
+}
+
+func (e *encoder) nameOffset(name string) uint32 {
+	off, ok := e.offsets[name]
+	if !ok {
+		off = uint32(e.dtStrings.Len())
+		e.offsets[name] = off
+		e.dtStrings.WriteString(name)
+		e.dtStrings.WriteByte(0)
+	}
+
+	return off
+}
+
+func (e *encoder) node(n *Node) {
+	u32(&e.dtStruct, tokenBeginNode)
+	e.dtStruct.WriteString(n.Name)
+	e.dtStruct.WriteByte(0)
+	pad(&e.dtStruct)
+
+	for _, p := range n.Properties {
+		u32(&e.dtStruct, tokenProp)
+		u32(&e.dtStruct, uint32(len(p.Value)))
+		u32(&e.dtStruct, e.nameOffset(p.Name))
+		e.dtStruct.Write(p.Value)
+		pad(&e.dtStruct)
+	}
+
+	for _, c := range n.Children {
+		e.node(c)
+	}
+
+	u32(&e.dtStruct, tokenEndNode)
+}
+
+// Bytes returns the blob of the tree with root n, booted on the CPU whose reg
+// is 0.
+func (n *Node) Bytes() []byte {
+	e := encoder{offsets: map[string]uint32{}}
+	e.node(n)
+	u32(&e.dtStruct, tokenEnd)
+
+	h := header{
+		Magic:           magic,
+		OffMemRsvmap:    headerSize,
+		OffDtStruct:     headerSize + rsvmapSize,
+		SizeDtStruct:    uint32(e.dtStruct.Len()),
+		Version:         version,
+		LastCompVersion: lastCompatible,
+		SizeDtStrings:   uint32(e.dtStrings.Len()),
+	}
+	h.OffDtStrings = h.OffDtStruct + h.SizeDtStruct
+	h.TotalSize = h.OffDtStrings + h.SizeDtStrings
+
+	buf := bytes.Buffer{}
+	_ = binary.Write(&buf, binary.BigEndian, h)
+	buf.Write(make([]byte, rsvmapSize))
+	buf.Write(e.dtStruct.Bytes())
+	buf.Write(e.dtStrings.Bytes())
+
+	return buf.Bytes()
+}
+
+// decoder reads the structure block of a blob.
+type decoder struct {
+	dtStruct  []byte
+	dtStrings []byte
+	off       int
+}
+
+func (d *decoder) token() (uint32, error) {
+	if d.off+4 > len(d.dtStruct) {
+		return 0, fmt.Errorf("%w: truncated structure block", ErrorInvalidBlob)
+	}
+
+	v := binary.BigEndian.Uint32(d.dtStruct[d.off:])
+	d.off += 4
+
+	return v, nil
+}
+
+// cstring returns the NUL-terminated string at off in b.
+func cstring(b []byte, off int) (string, error) {
+	if off < 0 || off > len(b) {
+		return "", fmt.Errorf("%w: string out of bounds", ErrorInvalidBlob)
+	}
+
+	end := bytes.IndexByte(b[off:], 0)
+	if end < 0 {
+		return "", fmt.Errorf("%w: unterminated string", ErrorInvalidBlob)
+	}
+
+	return string(b[off : off+end]), nil
+}
+
+func (d *decoder) align() {
+	d.off = (d.off + 3) &^ 3
+}
+
+// node reads the node whose FDT_BEGIN_NODE token was just read.
+func (d *decoder) node() (*Node, error) {
+	name, err := cstring(d.dtStruct, d.off)
+	if err != nil {
+		return nil, err
+	}
+
+	d.off += len(name) + 1
+	d.align()
+
+	n := NewNode(name)
+
+	for {
+		tok, err := d.token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok {
+		case tokenBeginNode:
+			c, err := d.node()
+			if err != nil {
+				return nil, err
+			}
+
+			n.Children = append(n.Children, c)
+		case tokenProp:
+			size, err := d.token()
+			if err != nil {
+				return nil, err
+			}
+
+			nameoff, err := d.token()
+			if err != nil {
+				return nil, err
+			}
+
+			if uint64(d.off)+uint64(size) > uint64(len(d.dtStruct)) {
+				return nil, fmt.Errorf("%w: truncated property", ErrorInvalidBlob)
+			}
+
+			pname, err := cstring(d.dtStrings, int(nameoff))
+			if err != nil {
+				return nil, err
+			}
+
+			n.Properties = append(n.Properties, Property{pname, append([]byte{}, d.dtStruct[d.off:d.off+int(size)]...)})
+			d.off += int(size)
+			d.align()
+		case tokenNop:
+		case tokenEndNode:
+			return n, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected token %d", ErrorInvalidBlob, tok)
+		}
+	}
+}
+
+// Parse returns the root node of the device tree blob b.
+func Parse(b []byte) (*Node, error) {
+	h := header{}
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidBlob, err)
+	}
+
+	if h.Magic != magic {
+		return nil, fmt.Errorf("%w: magic 0x%x", ErrorInvalidBlob, h.Magic)
+	}
+
+	if h.LastCompVersion > version || uint64(h.TotalSize) > uint64(len(b)) ||
+		uint64(h.OffDtStruct)+uint64(h.SizeDtStruct) > uint64(h.TotalSize) ||
+		uint64(h.OffDtStrings)+uint64(h.SizeDtStrings) > uint64(h.TotalSize) {
+		return nil, fmt.Errorf("%w: bad header", ErrorInvalidBlob)
+	}
+
+	d := decoder{
+		dtStruct:  b[h.OffDtStruct : h.OffDtStruct+h.SizeDtStruct],
+		dtStrings: b[h.OffDtStrings : h.OffDtStrings+h.SizeDtStrings],
+	}
+
+	for {
+		tok, err := d.token()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok == tokenNop {
+			continue
+		}
+
+		if tok != tokenBeginNode {
+			return nil, fmt.Errorf("%w: unexpected token %d", ErrorInvalidBlob, tok)
+		}
+
+		return d.node()
+	}
+}
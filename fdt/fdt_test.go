@@ -0,0 +1,111 @@
+package fdt_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/fdt"
+)
+
+func TestBytes(t *testing.T) {
+	t.Parallel()
+
+	root := fdt.NewNode("")
+	root.SetU32("a", 1)
+
+	b := root.Bytes()
+
+	// header, empty memory reservation block, structure and strings
+	be := binary.BigEndian
+	if be.Uint32(b[0:]) != 0xd00dfeed || be.Uint32(b[4:]) != uint32(len(b)) || len(b) != 40+16+32+2 {
+		t.Fatalf("invalid header: %x", b[:40])
+	}
+
+	if be.Uint32(b[20:]) != 17 || be.Uint32(b[24:]) != 16 {
+		t.Fatalf("invalid version: %x", b[20:28])
+	}
+
+	dtStruct := []byte{
+		0, 0, 0, 1, 0, 0, 0, 0, // FDT_BEGIN_NODE ""
+		0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1, // FDT_PROP a = <1>
+		0, 0, 0, 2, // FDT_END_NODE
+		0, 0, 0, 9, // FDT_END
+	}
+
+	if !bytes.Equal(b[56:88], dtStruct) || string(b[88:]) != "a\x00" {
+		t.Fatalf("invalid blob: %x", b[40:])
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	root := fdt.NewNode("")
+	root.SetString("compatible", "gokvm,microvm")
+	root.SetU32("#address-cells", 2)
+
+	cpus := root.Child("cpus")
+	cpus.SetU32("#size-cells", 0)
+	cpus.Child("cpu@1").SetU32("reg", 1)
+
+	mem := root.Child("memory@0")
+	mem.SetString("device_type", "memory")
+	mem.SetU64("reg", 0, 1<<30)
+	mem.SetEmpty("dma-coherent")
+
+	// replaced
+	mem.SetString("device_type", "ram", "memory")
+
+	parsed, err := fdt.Parse(root.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := parsed.Property("compatible"); !ok || string(v) != "gokvm,microvm\x00" {
+		t.Fatalf("invalid compatible: %q", v)
+	}
+
+	cpu, ok := parsed.Lookup("cpus", "cpu@1")
+	if !ok {
+		t.Fatal("cpu@1 not found")
+	}
+
+	if v, _ := cpu.Property("reg"); !bytes.Equal(v, []byte{0, 0, 0, 1}) {
+		t.Fatalf("invalid reg: %x", v)
+	}
+
+	m, ok := parsed.Lookup("memory@0")
+	if !ok || len(m.Properties) != 3 {
+		t.Fatalf("invalid memory node: %+v", m)
+	}
+
+	if v, _ := m.Property("reg"); !bytes.Equal(v, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0}) {
+		t.Fatalf("invalid reg: %x", v)
+	}
+
+	if v, _ := m.Property("device_type"); string(v) != "ram\x00memory\x00" {
+		t.Fatalf("invalid device_type: %q", v)
+	}
+
+	if v, ok := m.Property("dma-coherent"); !ok || len(v) != 0 {
+		t.Fatalf("invalid empty property: %q", v)
+	}
+
+	if _, ok := parsed.Lookup("cpus", "cpu@0"); ok {
+		t.Fatal("unexpected cpu@0")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	t.Parallel()
+
+	b := fdt.NewNode("").Bytes()
+
+	for _, blob := range [][]byte{nil, b[:len(b)-1], append([]byte{0}, b[1:]...)} {
+		if _, err := fdt.Parse(blob); !errors.Is(err, fdt.ErrorInvalidBlob) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
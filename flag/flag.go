@@ -1,24 +1,474 @@
 package flag
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/console"
+	"github.com/bobuhiro11/gokvm/jailer"
+	"github.com/bobuhiro11/gokvm/unittest"
+)
+
+const (
+	CmdRun      = "run"
+	CmdValidate = "validate"
+	CmdStop     = "stop"
+	CmdPause    = "pause"
+	CmdResume   = "resume"
+	CmdReset    = "reset"
+	CmdSnapshot = "snapshot"
+	CmdRestore  = "restore"
+	CmdMigrate  = "migrate"
+	CmdConsole  = "console"
+	CmdPs       = "ps"
+	CmdJail     = "jail"
+	CmdProbe    = "probe"
+	CmdTest     = "test"
 )
 
-func ParseArgs(args []string) (string, string, string, int, error) {
-	kernel := flag.String("k", "./bzImage", "kernel image path")
-	initrd := flag.String("i", "./initrd", "initrd path")
-	nCpus := flag.Int("c", 1, "number of cpus")
+var (
+	ErrorUnknownCommand = errors.New("unknown command")
+	ErrorInvalidArgs    = errors.New("invalid arguments")
+)
+
+const usage = `Usage: %[1]s <command> [arguments]
+
+Commands:
+  run [flags]              boot a VM (default when no command is given)
+  validate [flags]         check the flags of run and the host without booting
+  stop <name>              terminate a running VM
+  pause <name>             pause all vCPUs of a running VM
+  resume <name>            resume a paused VM
+  reset <name>             reset a running VM and boot it again
+  snapshot [-incremental] <name> <file>
+                           save a snapshot of a running VM to file
+  restore [flags] <file>   resume a VM from a snapshot file, with the flags of run
+  migrate [-postcopy] <name> <addr>
+                           live-migrate a running VM to a gokvm run with -incoming tcp:<addr>
+  console [-escape-char ^a] <name>
+                           attach to the serial console (Ctrl-a d to detach)
+  ps                       list running VMs
+  probe [-kvm-device path] report what the KVM of the host supports, in JSON
+  test [flags] <kernel>... run test kernels, e.g. kvm-unit-tests, reporting TAP
+  jail [flags] [command] [flags]
+                           run or restore a VM in a jail as an unprivileged user
+
+Run '%[1]s run -h' for the flags of run.
+`
+
+// Command is a parsed command line.
+type Command struct {
+	Name string
+
+	// Config is the VM configuration for run.
+	Config *config.Config
+
+	// Instance is the name of the VM the other commands talk to.
+	Instance string
+
+	// Args are the remaining positional arguments.
+	Args []string
+
+	// Incremental selects an incremental snapshot for snapshot.
+	Incremental bool
+
+	// Postcopy selects post-copy for migrate.
+	Postcopy bool
+
+	// Escape is the key which prefixes d to detach for console.
+	Escape byte
+
+	// Jail is the jail of jail, which runs gokvm with Args in it.
+	Jail *jailer.Config
+
+	// KVMDevice is the KVM device of probe.
+	KVMDevice string
+
+	// Test is how test runs the test kernels in Args.
+	Test *unittest.Config
+}
+
+// nArgs is the number of positional arguments of each command, including
+// the instance name.
+var nArgs = map[string]int{
+	CmdStop:     1,
+	CmdPause:    1,
+	CmdResume:   1,
+	CmdReset:    1,
+	CmdSnapshot: 2,
+	CmdMigrate:  2,
+	CmdConsole:  1,
+	CmdPs:       0,
+}
+
+// ParseArgs parses the command line. Without a command, the arguments are
+// taken as flags of run.
+func ParseArgs(args []string) (*Command, error) {
+	if len(args) < 2 || (len(args[1]) > 0 && args[1][0] == '-') {
+		return parseRun(args[0], args[1:])
+	}
+
+	name := args[1]
+
+	if name == CmdRun {
+		return parseRun(args[0]+" "+CmdRun, args[2:])
+	}
+
+	if name == CmdValidate {
+		// problems are reported by the validate command instead
+		c, _, err := parseConfig(args[0]+" "+CmdValidate, args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		return &Command{Name: CmdValidate, Config: c}, nil
+	}
+
+	if name == CmdProbe {
+		return parseProbe(args[0], args[2:])
+	}
+
+	if name == CmdRestore {
+		return parseRestore(args[0], args[2:])
+	}
+
+	if name == CmdJail {
+		return parseJail(args[0], args[2:])
+	}
+
+	if name == CmdTest {
+		return parseTest(args[0], args[2:])
+	}
+
+	n, ok := nArgs[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, usage, args[0])
+
+		return nil, fmt.Errorf("%w: %s", ErrorUnknownCommand, name)
+	}
+
+	cmd := &Command{Name: name}
+	fs := flag.NewFlagSet(args[0]+" "+name, flag.ExitOnError)
+
+	if name == CmdSnapshot {
+		fs.BoolVar(&cmd.Incremental, "incremental", false, "only save the pages written since the latest snapshot")
+	}
+
+	if name == CmdMigrate {
+		fs.BoolVar(&cmd.Postcopy, "postcopy", false, "resume the guest on the destination before its memory is copied")
+	}
+
+	escape := ""
+	if name == CmdConsole {
+		fs.StringVar(&escape, "escape-char", "^a", "key prefixing d to detach, in caret notation (e.g. ^])")
+	}
+
+	if err := fs.Parse(args[2:]); err != nil {
+		return nil, err
+	}
+
+	if name == CmdConsole {
+		b, err := console.ParseEscape(escape)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrorInvalidArgs, err)
+		}
 
-	//  refs: commit 1621292e73770aabbc146e72036de5e26f901e86 in kvmtool
-	params := flag.String("p", `console=ttyS0 earlyprintk=serial noapic noacpi notsc `+
-		`debug apic=debug show_lapic=all mitigations=off lapic `+
-		`dyndbg="file arch/x86/kernel/smpboot.c +plf"`, "kernel command-line parameters")
+		cmd.Escape = b
+	}
+
+	if fs.NArg() != n {
+		fmt.Fprintf(os.Stderr, usage, args[0])
 
-	flag.Parse()
+		return nil, fmt.Errorf("%w: %s takes %d argument(s)", ErrorInvalidArgs, name, n)
+	}
 
-	if err := flag.CommandLine.Parse(args[1:]); err != nil {
-		return "", "", "", 0, err
+	cmd.Args = fs.Args()
+	if n > 0 {
+		cmd.Instance, cmd.Args = cmd.Args[0], cmd.Args[1:]
 	}
 
-	return *kernel, *initrd, *params, *nCpus, nil
+	return cmd, nil
+}
+
+func parseProbe(prog string, args []string) (*Command, error) {
+	cmd := &Command{Name: CmdProbe}
+
+	fs := flag.NewFlagSet(prog+" "+CmdProbe, flag.ExitOnError)
+	fs.StringVar(&cmd.KVMDevice, "kvm-device", config.Default().KVMDevice,
+		"KVM device path, or fd=N for one opened by the parent")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, usage, prog)
+
+		return nil, fmt.Errorf("%w: %s takes no argument", ErrorInvalidArgs, CmdProbe)
+	}
+
+	return cmd, nil
+}
+
+func parseRun(name string, args []string) (*Command, error) {
+	c, _, err := parseConfig(name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Command{Name: CmdRun, Config: c}, nil
+}
+
+// parseRestore parses the flags of run followed by the snapshot file, and
+// returns a run command restoring from it.
+func parseRestore(prog string, args []string) (*Command, error) {
+	c, rest, err := parseConfig(prog+" "+CmdRestore, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) != 1 {
+		fmt.Fprintf(os.Stderr, usage, prog)
+
+		return nil, fmt.Errorf("%w: %s takes 1 argument(s)", ErrorInvalidArgs, CmdRestore)
+	}
+
+	c.Restore = rest[0]
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Command{Name: CmdRun, Config: c}, nil
+}
+
+// listValue is a flag of comma-separated values, which adds to the list each
+// time it is given.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = append(*l, strings.Split(s, ",")...)
+
+	return nil
+}
+
+// parseJail parses the flags of the jail. The remaining arguments are the
+// command run in the jail and its flags, which are checked by gokvm in the
+// jail as the paths they name are only found there.
+func parseJail(prog string, args []string) (*Command, error) {
+	j := jailer.Default()
+
+	fs := flag.NewFlagSet(prog+" "+CmdJail, flag.ExitOnError)
+	fs.StringVar(&j.ID, "id", "", "name of the jail and default name of the instance")
+	fs.IntVar(&j.UID, "uid", j.UID, "user to run gokvm as")
+	fs.IntVar(&j.GID, "gid", j.GID, "group to run gokvm as")
+	fs.StringVar(&j.ChrootBase, "chroot-base-dir", j.ChrootBase, "directory to create the jail <id>/root in, under gokvm/")
+	fs.StringVar(&j.NetNS, "netns", "", "network namespace to join (e.g. /var/run/netns/vm0) instead of a new empty one")
+	fs.Var(&j.Rlimits, "resource-limit", "resource limits, e.g. nofile=1024,fsize=1073741824")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := j.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Command{Name: CmdJail, Jail: j, Args: fs.Args()}, nil
+}
+
+func parseTest(prog string, args []string) (*Command, error) {
+	u := unittest.Default()
+
+	fs := flag.NewFlagSet(prog+" "+CmdTest, flag.ExitOnError)
+	fs.IntVar(&u.CPUs, "c", u.CPUs, "number of cpus")
+	fs.Var(&u.Memory, "m", "memory size (e.g. 512M, 2G)")
+	fs.StringVar(&u.Params, "p", u.Params, "command-line parameters of every test kernel")
+	fs.DurationVar(&u.Timeout, "timeout", u.Timeout, "fail a test running longer than this")
+	fs.StringVar(&u.LogDir, "log-dir", u.LogDir, "directory to write the output of each test to, as <test>.log")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, usage, prog)
+
+		return nil, fmt.Errorf("%w: %s takes at least 1 kernel", ErrorInvalidArgs, CmdTest)
+	}
+
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Command{Name: CmdTest, Test: u, Args: fs.Args()}, nil
+}
+
+// parseConfig builds the VM configuration. Values from the configuration file
+// given by -config are applied first, and flags that are explicitly set
+// override them. The positional arguments following the flags are returned.
+func parseConfig(name string, args []string) (*config.Config, []string, error) {
+	c := config.Default()
+	fc := config.Default()
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", "", "VM configuration file (YAML)")
+	fs.StringVar(&fc.Name, "name", c.Name, "instance name (default: process id)")
+	fs.StringVar(&fc.Machine, "machine", c.Machine, "machine type (pc, pc-1.0, microvm, microvm-1.0)")
+	fs.StringVar(&fc.KVMDevice, "kvm-device", c.KVMDevice, "KVM device path, or fd=N for one opened by the parent")
+	fs.StringVar(&fc.Kernel, "k", c.Kernel, "kernel image path, or fd=N")
+	fs.StringVar(&fc.Initrd, "i", c.Initrd, "initrd path, or fd=N")
+	fs.BoolVar(&fc.Multiboot, "multiboot", c.Multiboot, "boot a multiboot kernel, e.g. of kvm-unit-tests, with the initrd as its module")
+	fs.IntVar(&fc.CPUs, "c", c.CPUs, "number of cpus")
+	fs.Var(&fc.Memory, "m", "memory size (e.g. 512M, 2G)")
+	fs.StringVar(&fc.Params, "p", c.Params, "kernel command-line parameters")
+	fs.StringVar(&fc.QMP, "qmp", c.QMP, "unix socket path for the QMP-like control channel")
+	fs.StringVar(&fc.Monitor, "monitor", c.Monitor, "unix socket path for the human monitor console")
+	fs.StringVar(&fc.EscapeChar, "escape-char", c.EscapeChar, "key prefixing the terminal commands, in caret notation (e.g. ^])")
+	fs.StringVar(&fc.API, "api", c.API, "unix socket path for the REST API; boot waits for InstanceStart")
+	fs.StringVar(&fc.PidFile, "pidfile", c.PidFile, "write the process id to this file")
+	fs.StringVar(&fc.LogLevel, "log-level", c.LogLevel, "minimum log level (debug, info, warn, error)")
+	fs.StringVar(&fc.LogFormat, "log-format", c.LogFormat, "log format (text, json)")
+	fs.StringVar(&fc.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "OTLP/HTTP URL to export traces to")
+	fs.StringVar(&fc.Metrics, "metrics", c.Metrics, "TCP address serving Prometheus metrics on /metrics")
+	fs.StringVar(&fc.SerialLog, "serial-log", c.SerialLog, "also write the serial console output to this file")
+	fs.Var(&fc.SerialLogSize, "serial-log-size", "rotate the serial log at this size")
+	fs.IntVar(&fc.SerialLogFiles, "serial-log-files", c.SerialLogFiles, "number of rotated serial logs to keep")
+	fs.BoolVar(&fc.SerialPTY, "serial-pty", c.SerialPTY, "also offer the serial console on a pseudo-terminal, e.g. for minicom")
+	fs.StringVar(&fc.TraceIO, "trace-io", c.TraceIO, "log port and MMIO accesses to these addresses (e.g. 0x3f8-0x3ff,0x501 or all)")
+	fs.StringVar(&fc.StallTimeout, "stall-timeout", c.StallTimeout, "report vCPUs making no progress for this duration (e.g. 10s)")
+	fs.StringVar(&fc.CrashDump, "crash-dump", c.CrashDump, "write an ELF core of the guest to this file when it crashes")
+	fs.StringVar(&fc.GDB, "gdb", c.GDB, "TCP address for the GDB remote stub, e.g. localhost:1234")
+	fs.StringVar(&fc.Incoming, "incoming", c.Incoming, "receive the VM from a migration on this address (e.g. tcp:0.0.0.0:4444, or fd:N)")
+	fs.BoolVar(&fc.RestoreLazy, "restore-lazy", c.RestoreLazy, "map guest memory from the snapshot file given to restore instead of reading it")
+	fs.BoolVar(&fc.ClockResync, "clock-resync", c.ClockResync, "advance the guest clock by the time a restored or migrated VM spent saved")
+	fs.BoolVar(&fc.DebugExit, "debug-exit", c.DebugExit, "let the guest set the exit status by writing to an I/O port")
+	fs.IntVar(&fc.DebugExitPort, "debug-exit-port", c.DebugExitPort, "I/O port of the debug exit device (0xf4 for kvm-unit-tests)")
+	fs.BoolVar(&fc.DeviceTree, "device-tree", c.DeviceTree, "pass the kernel a device tree of the machine (microvm only)")
+	fs.StringVar(&fc.MPOEM, "mp-oem", c.MPOEM, "OEM ID of the MP table, at most 8 characters")
+	fs.StringVar(&fc.MPProductID, "mp-product-id", c.MPProductID, "product ID of the MP table, at most 12 characters")
+	fs.IntVar(&fc.MPLAPICAddr, "mp-lapic-addr", c.MPLAPICAddr, "local APIC address of the MP table (default 0xfee00000)")
+	fs.BoolVar(&fc.Daemonize, "daemonize", c.Daemonize, "run in the background once the VM runs; attach with gokvm console")
+	fs.StringVar(&fc.Seccomp, "seccomp", c.Seccomp, "restrict the system calls of gokvm once the VM runs: enforce or log")
+	fs.BoolVar(&fc.Landlock, "landlock", c.Landlock, "restrict the filesystem access of gokvm to the files of the configuration once the VM runs")
+	fs.Var((*listValue)(&fc.LandlockAllow), "landlock-allow", "comma-separated directories where snapshots and dumps may be written under -landlock")
+	fs.StringVar(&fc.VCPUSched, "vcpu-sched", c.VCPUSched, "run the vCPU threads with a realtime scheduling policy: fifo or rr")
+	fs.IntVar(&fc.VCPUPriority, "vcpu-priority", c.VCPUPriority, "realtime priority of the vCPU threads under -vcpu-sched (1-99)")
+	fs.StringVar(&fc.HaltPoll, "halt-poll", c.HaltPoll, "how long KVM polls halted vCPUs for a wakeup (e.g. 200us, 0s disables)")
+	fs.BoolVar(&fc.VCPUReserveProcs, "vcpu-reserve-procs", c.VCPUReserveProcs, "raise GOMAXPROCS by the number of vCPUs")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath != "" {
+		if err := c.LoadFile(*configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			c.Name = fc.Name
+		case "machine":
+			c.Machine = fc.Machine
+		case "kvm-device":
+			c.KVMDevice = fc.KVMDevice
+		case "k":
+			c.Kernel = fc.Kernel
+		case "i":
+			c.Initrd = fc.Initrd
+		case "multiboot":
+			c.Multiboot = fc.Multiboot
+		case "c":
+			c.CPUs = fc.CPUs
+		case "m":
+			c.Memory = fc.Memory
+		case "p":
+			c.Params = fc.Params
+		case "qmp":
+			c.QMP = fc.QMP
+		case "monitor":
+			c.Monitor = fc.Monitor
+		case "escape-char":
+			c.EscapeChar = fc.EscapeChar
+		case "api":
+			c.API = fc.API
+		case "debug-exit":
+			c.DebugExit = fc.DebugExit
+		case "debug-exit-port":
+			c.DebugExitPort = fc.DebugExitPort
+		case "device-tree":
+			c.DeviceTree = fc.DeviceTree
+		case "mp-oem":
+			c.MPOEM = fc.MPOEM
+		case "mp-product-id":
+			c.MPProductID = fc.MPProductID
+		case "mp-lapic-addr":
+			c.MPLAPICAddr = fc.MPLAPICAddr
+		case "daemonize":
+			c.Daemonize = fc.Daemonize
+		case "incoming":
+			c.Incoming = fc.Incoming
+		case "restore-lazy":
+			c.RestoreLazy = fc.RestoreLazy
+		case "clock-resync":
+			c.ClockResync = fc.ClockResync
+		case "pidfile":
+			c.PidFile = fc.PidFile
+		case "gdb":
+			c.GDB = fc.GDB
+		case "serial-log":
+			c.SerialLog = fc.SerialLog
+		case "serial-pty":
+			c.SerialPTY = fc.SerialPTY
+		case "serial-log-size":
+			c.SerialLogSize = fc.SerialLogSize
+		case "serial-log-files":
+			c.SerialLogFiles = fc.SerialLogFiles
+		case "trace-io":
+			c.TraceIO = fc.TraceIO
+		case "stall-timeout":
+			c.StallTimeout = fc.StallTimeout
+		case "crash-dump":
+			c.CrashDump = fc.CrashDump
+		case "metrics":
+			c.Metrics = fc.Metrics
+		case "otlp-endpoint":
+			c.OTLPEndpoint = fc.OTLPEndpoint
+		case "log-level":
+			c.LogLevel = fc.LogLevel
+		case "log-format":
+			c.LogFormat = fc.LogFormat
+		case "seccomp":
+			c.Seccomp = fc.Seccomp
+		case "landlock":
+			c.Landlock = fc.Landlock
+		case "landlock-allow":
+			c.LandlockAllow = fc.LandlockAllow
+		case "vcpu-sched":
+			c.VCPUSched = fc.VCPUSched
+		case "vcpu-priority":
+			c.VCPUPriority = fc.VCPUPriority
+		case "halt-poll":
+			c.HaltPoll = fc.HaltPoll
+		case "vcpu-reserve-procs":
+			c.VCPUReserveProcs = fc.VCPUReserveProcs
+		}
+	})
+
+	return c, fs.Args(), nil
 }
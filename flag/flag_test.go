@@ -1,9 +1,14 @@
 package flag_test
 
 import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/jailer"
 )
 
 func TestParseArg(t *testing.T) {
@@ -19,26 +24,266 @@ func TestParseArg(t *testing.T) {
 		"params",
 		"-c",
 		"2",
+		"-m",
+		"2G",
+		"-debug-exit",
+		"-seccomp",
+		"log",
+		"-landlock",
+		"-landlock-allow",
+		"/var/lib/gokvm,/tmp",
+		"-kvm-device",
+		"fd=3",
+		"-machine",
+		"microvm",
+		"-device-tree",
+		"-mp-oem",
+		"GOKVM",
+		"-mp-lapic-addr",
+		"0xfee00000",
+		"-daemonize",
+		"-escape-char",
+		"^]",
+		"-serial-pty",
+		"-vcpu-sched",
+		"fifo",
+		"-vcpu-priority",
+		"10",
+		"-vcpu-reserve-procs",
+		"-halt-poll",
+		"200us",
 	}
 
-	kernel, initrd, params, nCpus, err := flag.ParseArgs(args)
+	cmd, err := flag.ParseArgs(args)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if kernel != "kernel_path" {
+	if cmd.Name != flag.CmdRun {
+		t.Fatalf("invalid command: %s", cmd.Name)
+	}
+
+	c := cmd.Config
+
+	if c.Kernel != "kernel_path" {
 		t.Fatal("invalid kernel image path")
 	}
 
-	if initrd != "initrd_path" {
+	if c.Initrd != "initrd_path" {
 		t.Fatal("invalid initrd path")
 	}
 
-	if params != "params" {
+	if c.Params != "params" {
 		t.Fatal("invalid kernel command-line parameters")
 	}
 
-	if nCpus != 2 {
+	if c.CPUs != 2 {
 		t.Fatal("invalid number of vcpus")
 	}
+
+	if c.Memory != 2<<30 {
+		t.Fatal("invalid memory size")
+	}
+
+	if !c.DebugExit {
+		t.Fatal("debug exit device is not enabled")
+	}
+
+	if c.Seccomp != "log" {
+		t.Fatal("invalid seccomp mode")
+	}
+
+	if !c.Landlock || len(c.LandlockAllow) != 2 || c.LandlockAllow[1] != "/tmp" {
+		t.Fatalf("invalid landlock: %v", c.LandlockAllow)
+	}
+
+	if c.KVMDevice != "fd=3" {
+		t.Fatalf("invalid kvm device: %s", c.KVMDevice)
+	}
+
+	if !c.DeviceTree {
+		t.Fatal("device tree is not enabled")
+	}
+
+	if c.MPOEM != "GOKVM" || c.MPLAPICAddr != 0xfee00000 {
+		t.Fatalf("invalid MP table platform: %+v", c.Platform())
+	}
+
+	if !c.Daemonize {
+		t.Fatal("daemonize is not enabled")
+	}
+
+	if c.EscapeChar != "^]" {
+		t.Fatalf("invalid escape char: %s", c.EscapeChar)
+	}
+
+	if !c.SerialPTY {
+		t.Fatal("serial pty is not enabled")
+	}
+
+	if c.VCPUSched != "fifo" || c.VCPUPriority != 10 || !c.VCPUReserveProcs {
+		t.Fatalf("invalid vcpu scheduling: %s %d %v", c.VCPUSched, c.VCPUPriority, c.VCPUReserveProcs)
+	}
+
+	if c.HaltPoll != "200us" {
+		t.Fatalf("invalid halt poll: %s", c.HaltPoll)
+	}
+}
+
+func TestParseArgConfigOverride(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "vm.yaml")
+	data := []byte("kernel: file_kernel\ninitrd: file_initrd\ncpus: 4\n")
+
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := flag.ParseArgs([]string{"gokvm", "run", "-c", "2", "-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cmd.Config
+
+	if c.Kernel != "file_kernel" || c.Initrd != "file_initrd" {
+		t.Fatalf("values from config file are not applied: %+v", c)
+	}
+
+	if c.CPUs != 2 {
+		t.Fatalf("flag must override config file: cpus = %d", c.CPUs)
+	}
+}
+
+func TestParseArgSubcommands(t *testing.T) {
+	t.Parallel()
+
+	cmd, err := flag.ParseArgs([]string{"gokvm", "snapshot", "vm0", "vm0.snap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdSnapshot || cmd.Instance != "vm0" || len(cmd.Args) != 1 || cmd.Args[0] != "vm0.snap" || cmd.Incremental {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "snapshot", "-incremental", "vm0", "vm0.1.snap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmd.Incremental || cmd.Instance != "vm0" || len(cmd.Args) != 1 || cmd.Args[0] != "vm0.1.snap" {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "console", "-escape-char", "^b", "vm0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdConsole || cmd.Instance != "vm0" || cmd.Escape != 0x02 {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "ps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdPs {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "reset", "vm0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdReset || cmd.Instance != "vm0" {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "restore", "-name", "vm1", "-restore-lazy", "-clock-resync", "vm0.snap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdRun || cmd.Config.Name != "vm1" || cmd.Config.Restore != "vm0.snap" || !cmd.Config.RestoreLazy ||
+		!cmd.Config.ClockResync {
+		t.Fatalf("unexpected command: %+v %+v", cmd, cmd.Config)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "migrate", "vm0", "host1:4444"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdMigrate || cmd.Instance != "vm0" || len(cmd.Args) != 1 || cmd.Args[0] != "host1:4444" {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "migrate", "-postcopy", "vm0", "host1:4444"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmd.Postcopy || cmd.Instance != "vm0" || len(cmd.Args) != 1 {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	cmd, err = flag.ParseArgs([]string{
+		"gokvm", "jail", "-id", "vm0", "-uid", "1000", "-gid", "1000",
+		"-resource-limit", "nofile=1024", "--", "-k", "/bzImage",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdJail || cmd.Jail.ID != "vm0" || cmd.Jail.UID != 1000 || len(cmd.Jail.Rlimits) != 1 ||
+		len(cmd.Args) != 2 || cmd.Args[0] != "-k" {
+		t.Fatalf("unexpected command: %+v %+v", cmd, cmd.Jail)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "jail", "-id", "vm0"}); !errors.Is(err, jailer.ErrorInvalidJail) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "probe", "-kvm-device", "fd=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdProbe || cmd.KVMDevice != "fd=3" {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "probe", "vm0"}); !errors.Is(err, flag.ErrorInvalidArgs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cmd, err = flag.ParseArgs([]string{"gokvm", "test", "-c", "2", "-timeout", "10s", "x86/apic.flat", "x86/vmx.flat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Name != flag.CmdTest || cmd.Test.CPUs != 2 || cmd.Test.Timeout != 10*time.Second || len(cmd.Args) != 2 {
+		t.Fatalf("unexpected command: %+v %+v", cmd, cmd.Test)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "test"}); !errors.Is(err, flag.ErrorInvalidArgs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "restore"}); !errors.Is(err, flag.ErrorInvalidArgs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "stop"}); !errors.Is(err, flag.ErrorInvalidArgs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := flag.ParseArgs([]string{"gokvm", "reboot", "vm0"}); !errors.Is(err, flag.ErrorUnknownCommand) {
+		t.Fatalf("unexpected error: %v", err)
+	}
 }
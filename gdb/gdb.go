@@ -0,0 +1,726 @@
+package gdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+// Server implements the GDB remote serial protocol, so that gdb can debug the
+// guest with "target remote <addr>". The machine is stopped while a debugger
+// is attached, until it continues or single-steps; each vCPU is a thread
+// whose id is the vCPU index plus one.
+//
+// refs: https://sourceware.org/gdb/onlinedocs/gdb/Remote-Protocol.html
+type Server struct {
+	ln net.Listener
+	m  *machine.Machine
+}
+
+const (
+	packetSize = 0x1000
+
+	sigInt  = 2
+	sigTrap = 5
+
+	// int3, the breakpoint instruction
+	opInt3 = 0xcc
+
+	debugControl = kvm.GuestDebugEnable | kvm.GuestDebugUseSWBP
+)
+
+var ErrorInvalidPacket = errors.New("invalid packet")
+
+// Listen listens for a debugger on the TCP address addr.
+func Listen(addr string, m *machine.Machine) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{ln: ln, m: m}, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve accepts debuggers one at a time until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.handle(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+type session struct {
+	m *machine.Machine
+
+	mu   sync.Mutex // serializes writes to conn
+	conn net.Conn
+
+	packets    chan string
+	interrupts chan struct{}
+
+	// gCPU is the vCPU for register and memory accesses, cCPU the one to
+	// single-step.
+	gCPU, cCPU int
+
+	// breakpoints maps the address of each breakpoint to the byte it replaced.
+	breakpoints map[uint64]byte
+
+	// hwBreakpoints are the hardware breakpoints and watchpoints set by gdb.
+	hwBreakpoints map[machine.HWBreakpoint]bool
+
+	running  bool
+	stepping int
+	lastStop string
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	ss := &session{
+		m:           s.m,
+		conn:        conn,
+		packets:     make(chan string),
+		interrupts:  make(chan struct{}, 1),
+		breakpoints: map[uint64]byte{},
+		stepping:    -1,
+
+		hwBreakpoints: map[machine.HWBreakpoint]bool{},
+	}
+
+	if err := ss.attach(); err != nil {
+		return
+	}
+
+	defer ss.detach()
+
+	go ss.read()
+
+	for {
+		var stops <-chan machine.DebugStop
+		if ss.running {
+			stops = ss.m.DebugStops()
+		}
+
+		select {
+		case pkt, ok := <-ss.packets:
+			if !ok {
+				return
+			}
+
+			reply, ok := ss.execute(pkt)
+			if ok {
+				ss.send(reply)
+			}
+
+			if strings.HasPrefix(pkt, "D") || pkt == "k" {
+				return
+			}
+		case <-ss.interrupts:
+			if ss.running {
+				ss.stop(ss.cCPU, sigInt, "")
+			}
+		case st := <-stops:
+			ss.stop(st.CPU, sigTrap, watchReason(st.HWBreakpoint))
+		}
+	}
+}
+
+func (ss *session) attach() error {
+	if err := ss.m.Pause(); err != nil {
+		return err
+	}
+
+	for cpu := 0; cpu < ss.m.NumCPUs(); cpu++ {
+		if err := ss.m.SetGuestDebug(cpu, debugControl); err != nil {
+			return err
+		}
+	}
+
+	ss.lastStop = stopReply(0, sigTrap, "")
+
+	return nil
+}
+
+// detach removes the breakpoints and lets the machine run freely.
+func (ss *session) detach() {
+	_ = ss.m.Pause()
+
+	for addr, orig := range ss.breakpoints {
+		_ = ss.m.WriteVirtual(ss.gCPU, addr, []byte{orig})
+	}
+
+	for bp := range ss.hwBreakpoints {
+		_ = ss.m.RemoveHWBreakpoint(bp)
+	}
+
+	for cpu := 0; cpu < ss.m.NumCPUs(); cpu++ {
+		_ = ss.m.SetGuestDebug(cpu, 0)
+	}
+
+	for len(ss.m.DebugStops()) > 0 {
+		<-ss.m.DebugStops()
+	}
+
+	_ = ss.m.Resume()
+}
+
+// stop pauses the whole machine and reports that cpu stopped with signal, and
+// the reason of a watchpoint.
+func (ss *session) stop(cpu, signal int, reason string) {
+	_ = ss.m.Pause()
+	ss.running = false
+
+	if ss.stepping >= 0 {
+		_ = ss.m.SetGuestDebug(ss.stepping, debugControl)
+		ss.stepping = -1
+	}
+
+	ss.gCPU, ss.cCPU = cpu, cpu
+	ss.lastStop = stopReply(cpu, signal, reason)
+	ss.send(ss.lastStop)
+}
+
+func stopReply(cpu, signal int, reason string) string {
+	return fmt.Sprintf("T%02x%sthread:%x;", signal, reason, cpu+1)
+}
+
+// watchReason returns the stop reason of a watchpoint, or "" for other stops.
+func watchReason(bp *machine.HWBreakpoint) string {
+	if bp == nil || bp.Kind == machine.HWBreakExec {
+		return ""
+	}
+
+	name := "watch"
+	if bp.Kind == machine.HWBreakAccess {
+		name = "awatch"
+	}
+
+	return fmt.Sprintf("%s:%x;", name, bp.Addr)
+}
+
+// read parses the incoming packets and acknowledges them.
+func (ss *session) read() {
+	defer close(ss.packets)
+
+	r := bufio.NewReader(ss.conn)
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+
+		switch b {
+		case 0x03:
+			select {
+			case ss.interrupts <- struct{}{}:
+			default:
+			}
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+
+			data = data[:len(data)-1]
+
+			sum := make([]byte, 2)
+			if _, err := io.ReadFull(r, sum); err != nil {
+				return
+			}
+
+			if fmt.Sprintf("%02x", checksum(data)) != strings.ToLower(string(sum)) {
+				ss.write("-")
+
+				continue
+			}
+
+			ss.write("+")
+			ss.packets <- data
+		}
+	}
+}
+
+func checksum(data string) byte {
+	var sum byte
+
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+
+	return sum
+}
+
+func (ss *session) write(s string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	_, _ = ss.conn.Write([]byte(s))
+}
+
+func (ss *session) send(data string) {
+	ss.write(fmt.Sprintf("$%s#%02x", data, checksum(data)))
+}
+
+// execute runs a packet and returns the reply, if the packet has one right
+// away. Unsupported packets get an empty reply.
+func (ss *session) execute(pkt string) (string, bool) {
+	if pkt == "" {
+		return "", true
+	}
+
+	var (
+		reply string
+		err   error
+	)
+
+	args := pkt[1:]
+
+	switch pkt[0] {
+	case '?':
+		reply = ss.lastStop
+	case 'g':
+		reply, err = ss.readRegisters()
+	case 'G':
+		err = ss.writeRegisters(args)
+		reply = "OK"
+	case 'p':
+		reply, err = ss.readRegister(args)
+	case 'P':
+		err = ss.writeRegister(args)
+		reply = "OK"
+	case 'm':
+		reply, err = ss.readMemory(args)
+	case 'M':
+		err = ss.writeMemory(args)
+		reply = "OK"
+	case 'c', 's':
+		if err = ss.resume(pkt[0] == 's', args); err == nil {
+			return "", false
+		}
+	case 'Z', 'z':
+		reply, err = ss.breakpoint(pkt[0] == 'Z', args)
+	case 'H':
+		reply, err = ss.setThread(args)
+	case 'T':
+		if _, err = ss.parseThread(args); err == nil {
+			reply = "OK"
+		}
+	case 'D':
+		reply = "OK"
+	case 'k':
+		return "", false
+	case 'q':
+		reply = ss.query(args)
+	}
+
+	if err != nil {
+		return "E01", true
+	}
+
+	return reply, true
+}
+
+func (ss *session) query(q string) string {
+	switch {
+	case strings.HasPrefix(q, "Supported"):
+		return fmt.Sprintf("PacketSize=%x", packetSize)
+	case q == "fThreadInfo":
+		ids := []string{}
+		for cpu := 0; cpu < ss.m.NumCPUs(); cpu++ {
+			ids = append(ids, strconv.FormatInt(int64(cpu+1), 16))
+		}
+
+		return "m" + strings.Join(ids, ",")
+	case q == "sThreadInfo":
+		return "l"
+	case q == "C":
+		return fmt.Sprintf("QC%x", ss.gCPU+1)
+	case q == "Attached":
+		return "1"
+	default:
+		return ""
+	}
+}
+
+// parseThread returns the vCPU of a thread id. -1 (all threads) and 0 (any
+// thread) select the first vCPU.
+func (ss *session) parseThread(s string) (int, error) {
+	if s == "-1" || s == "0" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || id < 1 || int(id) > ss.m.NumCPUs() {
+		return 0, fmt.Errorf("%w: thread %q", ErrorInvalidPacket, s)
+	}
+
+	return int(id) - 1, nil
+}
+
+func (ss *session) setThread(args string) (string, error) {
+	if args == "" {
+		return "", fmt.Errorf("%w: H", ErrorInvalidPacket)
+	}
+
+	cpu, err := ss.parseThread(args[1:])
+	if err != nil {
+		return "", err
+	}
+
+	switch args[0] {
+	case 'g':
+		ss.gCPU = cpu
+	case 'c':
+		ss.cCPU = cpu
+	default:
+		return "", fmt.Errorf("%w: H%s", ErrorInvalidPacket, args)
+	}
+
+	return "OK", nil
+}
+
+func (ss *session) resume(step bool, args string) error {
+	if args != "" {
+		addr, err := strconv.ParseUint(args, 16, 64)
+		if err != nil {
+			return err
+		}
+
+		regs, err := ss.m.GetRegs(ss.cCPU)
+		if err != nil {
+			return err
+		}
+
+		regs.RIP = addr
+		if err := ss.m.SetRegs(ss.cCPU, regs); err != nil {
+			return err
+		}
+	}
+
+	if step {
+		if err := ss.m.SetGuestDebug(ss.cCPU, debugControl|kvm.GuestDebugSingleStep); err != nil {
+			return err
+		}
+
+		ss.stepping = ss.cCPU
+	}
+
+	ss.running = true
+
+	return ss.m.Resume()
+}
+
+func (ss *session) breakpoint(insert bool, args string) (string, error) {
+	f := strings.Split(args, ",")
+	if len(f) < 2 {
+		return "", fmt.Errorf("%w: Z%s", ErrorInvalidPacket, args)
+	}
+
+	addr, err := strconv.ParseUint(f[1], 16, 64)
+	if err != nil {
+		return "", err
+	}
+
+	if kind, ok := hwBreakKinds[f[0]]; ok {
+		return ss.hwBreakpoint(insert, kind, addr, f)
+	}
+
+	// x86 has no read watchpoints
+	if f[0] != "0" {
+		return "", nil
+	}
+
+	orig, ok := ss.breakpoints[addr]
+
+	switch {
+	case insert && !ok:
+		b := []byte{0}
+		if err := ss.m.ReadVirtual(ss.gCPU, addr, b); err != nil {
+			return "", err
+		}
+
+		if err := ss.m.WriteVirtual(ss.gCPU, addr, []byte{opInt3}); err != nil {
+			return "", err
+		}
+
+		ss.breakpoints[addr] = b[0]
+	case !insert && ok:
+		if err := ss.m.WriteVirtual(ss.gCPU, addr, []byte{orig}); err != nil {
+			return "", err
+		}
+
+		delete(ss.breakpoints, addr)
+	}
+
+	return "OK", nil
+}
+
+// hwBreakKinds are the hardware breakpoints by type of Z packet.
+var hwBreakKinds = map[string]int{
+	"1": machine.HWBreakExec,
+	"2": machine.HWBreakWrite,
+	"4": machine.HWBreakAccess,
+}
+
+func (ss *session) hwBreakpoint(insert bool, kind int, addr uint64, f []string) (string, error) {
+	bp := machine.HWBreakpoint{Addr: addr, Kind: kind, Len: 1}
+
+	// the length of a watchpoint, or the kind of instruction breakpoints
+	if kind != machine.HWBreakExec && len(f) > 2 {
+		n, err := strconv.ParseUint(f[2], 16, 32)
+		if err != nil {
+			return "", err
+		}
+
+		bp.Len = int(n)
+	}
+
+	if insert {
+		if err := ss.m.AddHWBreakpoint(bp); err != nil {
+			return "", err
+		}
+
+		ss.hwBreakpoints[bp] = true
+
+		return "OK", nil
+	}
+
+	if ss.hwBreakpoints[bp] {
+		if err := ss.m.RemoveHWBreakpoint(bp); err != nil {
+			return "", err
+		}
+
+		delete(ss.hwBreakpoints, bp)
+	}
+
+	return "OK", nil
+}
+
+func parseAddrLen(s string) (uint64, int, error) {
+	f := strings.SplitN(s, ",", 2)
+	if len(f) != 2 {
+		return 0, 0, fmt.Errorf("%w: %q", ErrorInvalidPacket, s)
+	}
+
+	addr, err := strconv.ParseUint(f[0], 16, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, err := strconv.ParseUint(f[1], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return addr, int(n), nil
+}
+
+func (ss *session) readMemory(args string) (string, error) {
+	addr, n, err := parseAddrLen(args)
+	if err != nil {
+		return "", err
+	}
+
+	if n > packetSize/2 {
+		n = packetSize / 2
+	}
+
+	data := make([]byte, n)
+	if err := ss.m.ReadVirtual(ss.gCPU, addr, data); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data), nil
+}
+
+func (ss *session) writeMemory(args string) error {
+	f := strings.SplitN(args, ":", 2)
+	if len(f) != 2 {
+		return fmt.Errorf("%w: M%s", ErrorInvalidPacket, args)
+	}
+
+	addr, n, err := parseAddrLen(f[0])
+	if err != nil {
+		return err
+	}
+
+	data, err := hex.DecodeString(f[1])
+	if err != nil || len(data) != n {
+		return fmt.Errorf("%w: M%s", ErrorInvalidPacket, args)
+	}
+
+	return ss.m.WriteVirtual(ss.gCPU, addr, data)
+}
+
+// The registers are in the order of the amd64 'g' packet of gdb: 16 general
+// purpose registers and rip (8 bytes each), then eflags and the cs, ss, ds,
+// es, fs and gs selectors (4 bytes each). The floating point and vector
+// registers are not available.
+const (
+	nRegs64   = 17
+	nRegs     = nRegs64 + 7
+	regRFLAGS = 17
+)
+
+func gprs(regs *kvm.Regs) []*uint64 {
+	return []*uint64{
+		&regs.RAX, &regs.RBX, &regs.RCX, &regs.RDX, &regs.RSI, &regs.RDI, &regs.RBP, &regs.RSP,
+		&regs.R8, &regs.R9, &regs.R10, &regs.R11, &regs.R12, &regs.R13, &regs.R14, &regs.R15,
+		&regs.RIP, &regs.RFLAGS,
+	}
+}
+
+func (ss *session) registers() ([]byte, error) {
+	regs, err := ss.m.GetRegs(ss.gCPU)
+	if err != nil {
+		return nil, err
+	}
+
+	sregs, err := ss.m.GetSregs(ss.gCPU)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, nRegs64*8+(nRegs-nRegs64)*4)
+
+	for _, r := range gprs(&regs)[:nRegs64] {
+		buf = appendUint(buf, *r, 8)
+	}
+
+	buf = appendUint(buf, regs.RFLAGS, 4)
+
+	for _, seg := range []kvm.Segment{sregs.CS, sregs.SS, sregs.DS, sregs.ES, sregs.FS, sregs.GS} {
+		buf = appendUint(buf, uint64(seg.Selector), 4)
+	}
+
+	return buf, nil
+}
+
+func appendUint(buf []byte, v uint64, size int) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+
+	return append(buf, b[:size]...)
+}
+
+func (ss *session) readRegisters() (string, error) {
+	buf, err := ss.registers()
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// regOffset returns the offset and size of register n in the 'g' packet.
+func regOffset(n int) (int, int) {
+	if n < nRegs64 {
+		return n * 8, 8
+	}
+
+	return nRegs64*8 + (n-nRegs64)*4, 4
+}
+
+func (ss *session) readRegister(args string) (string, error) {
+	n, err := strconv.ParseUint(args, 16, 32)
+	if err != nil {
+		return "", err
+	}
+
+	if n >= nRegs {
+		return "", nil
+	}
+
+	buf, err := ss.registers()
+	if err != nil {
+		return "", err
+	}
+
+	off, size := regOffset(int(n))
+
+	return hex.EncodeToString(buf[off : off+size]), nil
+}
+
+// setRegister sets general purpose registers, rip and eflags; writes to the
+// segment selectors are ignored.
+func setRegister(regs *kvm.Regs, n int, value []byte) {
+	if n > regRFLAGS {
+		return
+	}
+
+	b := make([]byte, 8)
+	copy(b, value)
+	*gprs(regs)[n] = binary.LittleEndian.Uint64(b)
+}
+
+func (ss *session) writeRegisters(args string) error {
+	data, err := hex.DecodeString(args)
+	if err != nil {
+		return err
+	}
+
+	regs, err := ss.m.GetRegs(ss.gCPU)
+	if err != nil {
+		return err
+	}
+
+	for n := 0; n < nRegs; n++ {
+		off, size := regOffset(n)
+		if off+size > len(data) {
+			break
+		}
+
+		setRegister(&regs, n, data[off:off+size])
+	}
+
+	return ss.m.SetRegs(ss.gCPU, regs)
+}
+
+func (ss *session) writeRegister(args string) error {
+	f := strings.SplitN(args, "=", 2)
+	if len(f) != 2 {
+		return fmt.Errorf("%w: P%s", ErrorInvalidPacket, args)
+	}
+
+	n, err := strconv.ParseUint(f[0], 16, 32)
+	if err != nil {
+		return err
+	}
+
+	value, err := hex.DecodeString(f[1])
+	if err != nil {
+		return err
+	}
+
+	regs, err := ss.m.GetRegs(ss.gCPU)
+	if err != nil {
+		return err
+	}
+
+	setRegister(&regs, int(n), value)
+
+	return ss.m.SetRegs(ss.gCPU, regs)
+}
@@ -0,0 +1,238 @@
+package gdb_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/gdb"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+const kernelAddr = 0x100000
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// call sends a packet and returns the reply, skipping acknowledgements.
+func (c *client) call(pkt string) string {
+	c.t.Helper()
+
+	var sum byte
+	for i := 0; i < len(pkt); i++ {
+		sum += pkt[i]
+	}
+
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", pkt, sum); err != nil {
+		c.t.Fatal(err)
+	}
+
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+
+		if b != '$' {
+			continue
+		}
+
+		reply, err := c.r.ReadString('#')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+
+		if _, err := c.r.Discard(2); err != nil {
+			c.t.Fatal(err)
+		}
+
+		if _, err := c.conn.Write([]byte("+")); err != nil {
+			c.t.Fatal(err)
+		}
+
+		return strings.TrimSuffix(reply, "#")
+	}
+}
+
+func newMachine(t *testing.T) *machine.Machine {
+	t.Helper()
+
+	image := make([]byte, 1024)
+	image[0x1f1] = 1 // setup_sects
+	copy(image[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(image[0x206:], 0x020f)
+	image = append(image,
+		0x90, 0x90, // nop; nop
+		0xeb, 0xfe, // jmp $
+	)
+
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "bzImage")
+	initrd := filepath.Join(dir, "initrd")
+
+	if err := ioutil.WriteFile(kernel, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(initrd, []byte("initrd"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadLinux(kernel, initrd, "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func rip(t *testing.T, regs string) uint64 {
+	t.Helper()
+
+	b, err := hex.DecodeString(regs[16*16 : 17*16])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint64(b)
+}
+
+func TestSession(t *testing.T) {
+	t.Parallel()
+
+	m := newMachine(t)
+
+	go func() {
+		_ = m.RunInfiniteLoop(0)
+	}()
+
+	s, err := gdb.Listen("127.0.0.1:0", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	for _, tc := range []struct{ pkt, reply string }{
+		{"?", "T05thread:1;"},
+		{"qfThreadInfo", "m1"},
+		{"qsThreadInfo", "l"},
+		{"Hg1", "OK"},
+		{"Hg2", "E01"},
+		{"vMustReplyEmpty", ""},
+		{fmt.Sprintf("Z0,%x,1", kernelAddr+2), "OK"},
+		{fmt.Sprintf("m%x,4", kernelAddr), "9090ccfe"},
+	} {
+		if reply := c.call(tc.pkt); reply != tc.reply {
+			t.Fatalf("%s: unexpected reply %q", tc.pkt, reply)
+		}
+	}
+
+	if reply := c.call(fmt.Sprintf("z0,%x,1", kernelAddr+2)); reply != "OK" {
+		t.Fatalf("z0: unexpected reply %q", reply)
+	}
+
+	if reply := c.call(fmt.Sprintf("m%x,4", kernelAddr)); reply != "9090ebfe" {
+		t.Fatalf("m: unexpected reply %q", reply)
+	}
+
+	// let the guest spin on jmp $ and interrupt it
+	if _, err := fmt.Fprintf(conn, "$c#63"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write([]byte{0x03}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b == '$' {
+			break
+		}
+	}
+
+	if reply, _ := c.r.ReadString('#'); reply != "T02thread:1;#" {
+		t.Fatalf("interrupt: unexpected reply %q", reply)
+	}
+
+	if _, err := c.r.Discard(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write([]byte("+")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the guest may be stopped anywhere in the loaded code
+	if pc := rip(t, c.call("g")); pc < kernelAddr || pc > kernelAddr+2 {
+		t.Fatalf("unexpected rip: 0x%x", pc)
+	}
+
+	// rewind to the first nop and single-step over it
+	pc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(pc, kernelAddr)
+
+	if reply := c.call("P10=" + hex.EncodeToString(pc)); reply != "OK" {
+		t.Fatalf("P: unexpected reply %q", reply)
+	}
+
+	if reply := c.call("s"); reply != "T05thread:1;" {
+		t.Fatalf("s: unexpected reply %q", reply)
+	}
+
+	if regs := c.call("g"); rip(t, regs) != kernelAddr+1 {
+		t.Fatalf("unexpected rip after step: 0x%x", rip(t, regs))
+	}
+
+	// stop at the jmp $ on a hardware breakpoint
+	for _, tc := range []struct{ pkt, reply string }{
+		{fmt.Sprintf("Z1,%x,1", kernelAddr+2), "OK"},
+		{fmt.Sprintf("Z3,%x,4", 0x3000), ""},
+		{fmt.Sprintf("Z2,%x,3", 0x3000), "E01"},
+		{"c", "T05thread:1;"},
+		{fmt.Sprintf("z1,%x,1", kernelAddr+2), "OK"},
+	} {
+		if reply := c.call(tc.pkt); reply != tc.reply {
+			t.Fatalf("%s: unexpected reply %q", tc.pkt, reply)
+		}
+	}
+
+	if regs := c.call("g"); rip(t, regs) != kernelAddr+2 {
+		t.Fatalf("unexpected rip at breakpoint: 0x%x", rip(t, regs))
+	}
+
+	if reply := c.call("D"); reply != "OK" {
+		t.Fatalf("D: unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,100 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/config"
+)
+
+// Timeout bounds how long a single hook may run.
+const Timeout = 30 * time.Second
+
+var ErrorHookFailed = errors.New("hook failed")
+
+// Event describes what happened to the VM. Programs receive it in the
+// environment variables GOKVM_EVENT, GOKVM_NAME and GOKVM_REASON, and URLs
+// receive it as the JSON body of the request.
+type Event struct {
+	Event  string `json:"event"`
+	Name   string `json:"name"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Run runs the hooks of ev.Event in order and stops at the first failure.
+func Run(c *config.Config, ev Event) error {
+	for _, h := range c.Hooks[ev.Event] {
+		var err error
+
+		if h.Exec != "" {
+			err = runExec(h, ev)
+		} else {
+			err = post(h.URL, ev)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrorHookFailed, ev.Event, err)
+		}
+	}
+
+	return nil
+}
+
+func runExec(h config.Hook, ev Event) error {
+	cmd := exec.Command(h.Exec, h.Args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GOKVM_EVENT="+ev.Event,
+		"GOKVM_NAME="+ev.Name,
+		"GOKVM_REASON="+ev.Reason,
+	)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(Timeout):
+		_ = cmd.Process.Kill()
+		<-done
+
+		return fmt.Errorf("%s: timed out after %s", h.Exec, Timeout)
+	}
+}
+
+func post(url string, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: Timeout}
+
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", url, res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package hooks_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/hooks"
+)
+
+func TestRunExec(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "out")
+
+	c := config.Default()
+	c.Hooks = map[string][]config.Hook{
+		config.EventShutdown: {{
+			Exec: "/bin/sh",
+			Args: []string{"-c", `echo "$GOKVM_EVENT $GOKVM_NAME $GOKVM_REASON $0" > ` + out, "arg"},
+		}},
+	}
+
+	ev := hooks.Event{Event: config.EventShutdown, Name: "vm0", Reason: "host-ui"}
+	if err := hooks.Run(c, ev); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "shutdown vm0 host-ui arg\n" {
+		t.Fatalf("unexpected output: %q", data)
+	}
+
+	c.Hooks[config.EventShutdown][0] = config.Hook{Exec: "/bin/false"}
+
+	if err := hooks.Run(c, ev); !errors.Is(err, hooks.ErrorHookFailed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRunURL(t *testing.T) {
+	t.Parallel()
+
+	events := make(chan hooks.Event, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := hooks.Event{}
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		events <- ev
+	}))
+	defer srv.Close()
+
+	c := config.Default()
+	c.Hooks = map[string][]config.Hook{
+		config.EventPostStart: {{URL: srv.URL}},
+		config.EventShutdown:  {{URL: srv.URL + "/missing"}},
+	}
+
+	if err := hooks.Run(c, hooks.Event{Event: config.EventPostStart, Name: "vm0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := <-events; ev.Event != config.EventPostStart || ev.Name != "vm0" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// hooks of other events are not run
+	if err := hooks.Run(c, hooks.Event{Event: config.EventGuestPanic}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// A running gokvm instance is identified by its name and owns a directory
+// under RunDir holding its sockets:
+//
+//	<RunDir>/<name>/qmp.sock      QMP-like control socket
+//	<RunDir>/<name>/console.sock  serial console
+//	<RunDir>/<name>/pty           link to the pseudo-terminal of the console
+const (
+	QMPSocketName     = "qmp.sock"
+	ConsoleSocketName = "console.sock"
+	PTYLinkName       = "pty"
+)
+
+var (
+	ErrorInvalidName = errors.New("name must consist of letters, digits, '-' and '_'")
+	ErrorInUse       = errors.New("instance is already running")
+	ErrorNotRunning  = errors.New("instance is not running")
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// RunDir returns $XDG_RUNTIME_DIR/gokvm, or a per-user directory under the
+// temporary directory when XDG_RUNTIME_DIR is not set.
+func RunDir() string {
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		return filepath.Join(d, "gokvm")
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gokvm-%d", os.Getuid()))
+}
+
+func Dir(name string) string {
+	return filepath.Join(RunDir(), name)
+}
+
+func QMPSocket(name string) string {
+	return filepath.Join(Dir(name), QMPSocketName)
+}
+
+func ConsoleSocket(name string) string {
+	return filepath.Join(Dir(name), ConsoleSocketName)
+}
+
+func PTYLink(name string) string {
+	return filepath.Join(Dir(name), PTYLinkName)
+}
+
+// CheckName returns an error if name is not a valid instance name.
+func CheckName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrorInvalidName, name)
+	}
+
+	return nil
+}
+
+// Check returns an error if name is invalid or an instance of that name is
+// already running.
+func Check(name string) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+
+	if IsRunning(name) {
+		return fmt.Errorf("%w: %s", ErrorInUse, name)
+	}
+
+	return nil
+}
+
+// Create prepares the directory of the instance. Sockets left behind by an
+// instance that is no longer running are removed.
+func Create(name string) error {
+	if err := Check(name); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(Dir(name), 0o700); err != nil {
+		return err
+	}
+
+	for _, path := range []string{QMPSocket(name), ConsoleSocket(name), PTYLink(name)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove deletes the directory of the instance.
+func Remove(name string) error {
+	return os.RemoveAll(Dir(name))
+}
+
+// IsRunning returns true if the control socket of the instance accepts
+// connections.
+func IsRunning(name string) bool {
+	conn, err := net.Dial("unix", QMPSocket(name))
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+
+	return true
+}
+
+// List returns the names of the instances having a directory, sorted.
+func List() ([]string, error) {
+	entries, err := ioutil.ReadDir(RunDir())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for _, e := range entries {
+		if e.IsDir() && validName.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
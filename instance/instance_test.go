@@ -0,0 +1,58 @@
+package instance_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/instance"
+)
+
+func TestInstance(t *testing.T) {
+	os.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	defer os.Unsetenv("XDG_RUNTIME_DIR")
+
+	for _, name := range []string{"vm1", "vm0"} {
+		if err := instance.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := instance.Create("../vm"); !errors.Is(err, instance.ErrorInvalidName) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names, err := instance.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(names, []string{"vm0", "vm1"}) {
+		t.Fatalf("unexpected instances: %v", names)
+	}
+
+	ln, err := net.Listen("unix", instance.QMPSocket("vm0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !instance.IsRunning("vm0") || instance.IsRunning("vm1") {
+		t.Fatal("unexpected running state")
+	}
+
+	if err := instance.Create("vm0"); !errors.Is(err, instance.ErrorInUse) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ln.Close()
+
+	if err := instance.Remove("vm0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if names, _ := instance.List(); !reflect.DeepEqual(names, []string{"vm1"}) {
+		t.Fatalf("unexpected instances: %v", names)
+	}
+}
@@ -0,0 +1,397 @@
+// Package jailer runs gokvm in a jail in the style of the Firecracker jailer:
+// chrooted into a directory holding only what the VM needs, in new mount,
+// PID, IPC and UTS namespaces and a network namespace of its own, with
+// resource limits, as an unprivileged user.
+//
+// The jail of id is <ChrootBase>/gokvm/<id>/root:
+//
+//	/gokvm      a copy of the executable
+//	/dev/kvm    owned by the user
+//	/run        the runtime directory, with the sockets of the instance
+//
+// The kernel, initrd and other files given to gokvm are resolved inside the
+// jail and have to be placed there beforehand. The instance can be controlled
+// from outside with XDG_RUNTIME_DIR set to the runtime directory.
+package jailer
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/instance"
+)
+
+const (
+	// DefaultChrootBase is where jails are created by default.
+	DefaultChrootBase = "/srv/jailer"
+
+	binaryName = "gokvm"
+
+	sysSetns    = 308
+	rlimitNproc = 6
+)
+
+var (
+	ErrorInvalidJail = errors.New("invalid jail")
+	ErrorNotRoot     = errors.New("the jailer must run as root")
+	ErrorNotStatic   = errors.New("gokvm must be linked statically to run in a jail, build it with CGO_ENABLED=0")
+)
+
+// rlimitNames are the resources which can be limited, by name.
+var rlimitNames = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"data":   syscall.RLIMIT_DATA,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"nproc":  rlimitNproc,
+	"stack":  syscall.RLIMIT_STACK,
+}
+
+// Rlimit sets the soft and hard limit of Resource to Value.
+type Rlimit struct {
+	Name     string
+	Resource int
+	Value    uint64
+}
+
+// Rlimits is a flag.Value of comma-separated name=value limits, e.g.
+// nofile=1024,fsize=1073741824. Each use of the flag adds to the limits.
+type Rlimits []Rlimit
+
+func (r *Rlimits) String() string {
+	limits := make([]string, 0, len(*r))
+	for _, l := range *r {
+		limits = append(limits, fmt.Sprintf("%s=%d", l.Name, l.Value))
+	}
+
+	return strings.Join(limits, ",")
+}
+
+func (r *Rlimits) Set(s string) error {
+	for _, limit := range strings.Split(s, ",") {
+		kv := strings.SplitN(limit, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%w: resource limit %q must be name=value", ErrorInvalidJail, limit)
+		}
+
+		resource, ok := rlimitNames[kv[0]]
+		if !ok {
+			names := make([]string, 0, len(rlimitNames))
+			for name := range rlimitNames {
+				names = append(names, name)
+			}
+
+			sort.Strings(names)
+
+			return fmt.Errorf("%w: unknown resource %q (available: %s)",
+				ErrorInvalidJail, kv[0], strings.Join(names, ", "))
+		}
+
+		v, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid limit of %s: %q", ErrorInvalidJail, kv[0], kv[1])
+		}
+
+		*r = append(*r, Rlimit{kv[0], resource, v})
+	}
+
+	return nil
+}
+
+// Config describes a jail.
+type Config struct {
+	// ID names the jail and is the default name of the instance.
+	ID string
+
+	// UID and GID are the user and group gokvm runs as, which must not be
+	// root.
+	UID, GID int
+
+	// ChrootBase is the directory the jail is created in.
+	ChrootBase string
+
+	// NetNS is the path of a network namespace to join, e.g.
+	// /var/run/netns/vm0. Empty creates a new namespace without network.
+	NetNS string
+
+	Rlimits Rlimits
+}
+
+// Default returns a configuration whose user and group must still be set.
+func Default() *Config {
+	return &Config{UID: -1, GID: -1, ChrootBase: DefaultChrootBase}
+}
+
+// Validate reports all problems with the configuration at once.
+func (c *Config) Validate() error {
+	problems := []string{}
+
+	if err := instance.CheckName(c.ID); err != nil {
+		problems = append(problems, fmt.Sprintf("id: %v", err))
+	}
+
+	if c.UID <= 0 || c.GID <= 0 {
+		problems = append(problems, fmt.Sprintf("uid and gid must be given and not root, got %d and %d", c.UID, c.GID))
+	}
+
+	if !filepath.IsAbs(c.ChrootBase) {
+		problems = append(problems, fmt.Sprintf("chroot base must be an absolute path, got %q", c.ChrootBase))
+	}
+
+	if c.NetNS != "" && !filepath.IsAbs(c.NetNS) {
+		problems = append(problems, fmt.Sprintf("netns must be an absolute path, got %q", c.NetNS))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrorInvalidJail, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Root returns the root directory of the jail.
+func (c *Config) Root() string {
+	return filepath.Join(c.ChrootBase, binaryName, c.ID, "root")
+}
+
+// Prepare creates the jail, or refreshes the executable and the devices of
+// an existing one, keeping the files placed in it.
+func (c *Config) Prepare() error {
+	root := c.Root()
+
+	for _, dir := range []string{root, filepath.Join(root, "dev"), filepath.Join(root, "run")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{root, filepath.Join(root, "run")} {
+		if err := os.Chown(dir, c.UID, c.GID); err != nil {
+			return err
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if err := checkStatic(exe); err != nil {
+		return err
+	}
+
+	if err := copyFile(exe, filepath.Join(root, binaryName), 0o755); err != nil {
+		return err
+	}
+
+	return c.makeDevice("/dev/kvm")
+}
+
+// checkStatic returns an error if the executable path needs a dynamic
+// loader, which the jail doesn't have.
+func checkStatic(path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return ErrorNotStatic
+		}
+	}
+
+	return nil
+}
+
+// makeDevice creates the device node path of the host in the jail, owned by
+// the user.
+func (c *Config) makeDevice(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a character device", path)
+	}
+
+	node := filepath.Join(c.Root(), path)
+	if err := os.Remove(node); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := syscall.Mknod(node, syscall.S_IFCHR|0o600, int(st.Rdev)); err != nil {
+		return fmt.Errorf("mknod %s: %w", node, err)
+	}
+
+	return os.Chown(node, c.UID, c.GID)
+}
+
+// copyFile replaces dst with a copy of src, so that an executable running in
+// another jail isn't written to.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// childArgs returns the arguments of gokvm in the jail, naming the instance
+// after the jail unless args name it.
+func (c *Config) childArgs(args []string) []string {
+	cmd := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	return append([]string{binaryName, cmd, "-name", c.ID}, args...)
+}
+
+// Run prepares the jail and runs gokvm with args in it, returning its exit
+// status. SIGINT, SIGTERM and SIGHUP are passed on to it.
+func Run(c *Config, args []string) (int, error) {
+	if os.Geteuid() != 0 {
+		return -1, ErrorNotRoot
+	}
+
+	if err := c.Prepare(); err != nil {
+		return -1, err
+	}
+
+	// inherited by the child
+	for _, l := range c.Rlimits {
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Value, Max: l.Value}); err != nil {
+			return -1, fmt.Errorf("resource limit %s: %w", l.Name, err)
+		}
+	}
+
+	cloneflags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if c.NetNS == "" {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	cmd := &exec.Cmd{
+		Path:   "/" + binaryName,
+		Args:   c.childArgs(args),
+		Env:    []string{"XDG_RUNTIME_DIR=/run"},
+		Dir:    "/",
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Chroot:     c.Root(),
+			Credential: &syscall.Credential{Uid: uint32(c.UID), Gid: uint32(c.GID)},
+			Cloneflags: cloneflags,
+			Pdeathsig:  syscall.SIGKILL,
+		},
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	defer signal.Stop(sigs)
+
+	done := make(chan error, 1)
+
+	// The child is created on this thread, and joins its network namespace.
+	// The thread is never unlocked, so that it lives as long as the child,
+	// which is killed when it exits.
+	go func() {
+		runtime.LockOSThread()
+
+		if err := c.joinNetNS(); err != nil {
+			done <- err
+
+			return
+		}
+
+		if err := cmd.Start(); err != nil {
+			done <- err
+
+			return
+		}
+
+		go func() {
+			for sig := range sigs {
+				_ = cmd.Process.Signal(sig)
+			}
+		}()
+
+		done <- cmd.Wait()
+	}()
+
+	err := <-done
+
+	exitErr := &exec.ExitError{}
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal()), nil
+		}
+
+		return exitErr.ExitCode(), nil
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return 0, nil
+}
+
+// joinNetNS moves the calling thread into the network namespace of the jail.
+func (c *Config) joinNetNS() error {
+	if c.NetNS == "" {
+		return nil
+	}
+
+	f, err := os.Open(c.NetNS)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if _, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return fmt.Errorf("setns %s: %w", c.NetNS, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package jailer_test
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/jailer"
+)
+
+func TestRlimits(t *testing.T) {
+	t.Parallel()
+
+	r := jailer.Rlimits{}
+
+	if err := r.Set("nofile=1024,fsize=4096"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Set("nproc=64"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r) != 3 || r[0].Resource != syscall.RLIMIT_NOFILE || r[0].Value != 1024 ||
+		r[1].Resource != syscall.RLIMIT_FSIZE || r[2].Value != 64 {
+		t.Fatalf("unexpected limits: %+v", r)
+	}
+
+	if s := r.String(); s != "nofile=1024,fsize=4096,nproc=64" {
+		t.Fatalf("unexpected string: %s", s)
+	}
+
+	for _, s := range []string{"nofile", "files=1", "nofile=-1"} {
+		if err := r.Set(s); !errors.Is(err, jailer.ErrorInvalidJail) {
+			t.Fatalf("%q: unexpected error: %v", s, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	c := jailer.Default()
+	c.ID = "vm/0"
+	c.GID = 0
+	c.ChrootBase = "srv"
+
+	err := c.Validate()
+	if !errors.Is(err, jailer.ErrorInvalidJail) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, s := range []string{"id", "uid and gid", "chroot base"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("missing %s in error: %v", s, err)
+		}
+	}
+
+	c.ID = "vm0"
+	c.UID = 1000
+	c.GID = 1000
+	c.ChrootBase = jailer.DefaultChrootBase
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if root := c.Root(); root != "/srv/jailer/gokvm/vm0/root" {
+		t.Fatalf("unexpected root: %s", root)
+	}
+}
@@ -0,0 +1,85 @@
+package kvm
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Error is the error of a KVM ioctl. It unwraps to the errno, so callers
+// test it with errors.Is(err, syscall.EINTR) and the like.
+type Error struct {
+	Op    uintptr
+	Errno syscall.Errno
+}
+
+func (e *Error) Error() string {
+	return IoctlName(e.Op) + ": " + e.Errno.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Errno
+}
+
+var ioctlNames = map[uintptr]string{
+	kvmGetAPIVersion:       "KVM_GET_API_VERSION",
+	kvmCheckExtension:      "KVM_CHECK_EXTENSION",
+	kvmCreateVM:            "KVM_CREATE_VM",
+	kvmCreateVCPU:          "KVM_CREATE_VCPU",
+	kvmRun:                 "KVM_RUN",
+	kvmGetVCPUMMapSize:     "KVM_GET_VCPU_MMAP_SIZE",
+	kvmGetSregs:            "KVM_GET_SREGS",
+	kvmSetSregs:            "KVM_SET_SREGS",
+	kvmGetRegs:             "KVM_GET_REGS",
+	kvmSetRegs:             "KVM_SET_REGS",
+	kvmSetUserMemoryRegion: "KVM_SET_USER_MEMORY_REGION",
+	kvmSetTSSAddr:          "KVM_SET_TSS_ADDR",
+	kvmSetIdentityMapAddr:  "KVM_SET_IDENTITY_MAP_ADDR",
+	kvmCreateIRQChip:       "KVM_CREATE_IRQCHIP",
+	kvmCreatePIT2:          "KVM_CREATE_PIT2",
+	kvmGetSupportedCPUID:   "KVM_GET_SUPPORTED_CPUID",
+	kvmSetCPUID2:           "KVM_SET_CPUID2",
+	kvmIRQLine:             "KVM_IRQ_LINE",
+	kvmIRQFD:               "KVM_IRQFD",
+	kvmIOEventFD:           "KVM_IOEVENTFD",
+	kvmSetGSIRouting:       "KVM_SET_GSI_ROUTING",
+	kvmEnableCap:           "KVM_ENABLE_CAP",
+	kvmSetGuestDebug:       "KVM_SET_GUEST_DEBUG",
+	kvmTranslate:           "KVM_TRANSLATE",
+	kvmGetMPState:          "KVM_GET_MP_STATE",
+	kvmGetStatsFD:          "KVM_GET_STATS_FD",
+	kvmSetMPState:          "KVM_SET_MP_STATE",
+	kvmGetFPU:              "KVM_GET_FPU",
+	kvmSetFPU:              "KVM_SET_FPU",
+	kvmGetLAPIC:            "KVM_GET_LAPIC",
+	kvmSetLAPIC:            "KVM_SET_LAPIC",
+	kvmGetMSRIndexList:     "KVM_GET_MSR_INDEX_LIST",
+	kvmGetMSRs:             "KVM_GET_MSRS",
+	kvmSetMSRs:             "KVM_SET_MSRS",
+	kvmGetVCPUEvents:       "KVM_GET_VCPU_EVENTS",
+	kvmSetVCPUEvents:       "KVM_SET_VCPU_EVENTS",
+	kvmGetXSave:            "KVM_GET_XSAVE",
+	kvmSetXSave:            "KVM_SET_XSAVE",
+	kvmGetXCRS:             "KVM_GET_XCRS",
+	kvmSetXCRS:             "KVM_SET_XCRS",
+	kvmGetIRQChip:          "KVM_GET_IRQCHIP",
+	kvmSetIRQChip:          "KVM_SET_IRQCHIP",
+	kvmGetPIT2:             "KVM_GET_PIT2",
+	kvmSetPIT2:             "KVM_SET_PIT2",
+	kvmGetClock:            "KVM_GET_CLOCK",
+	kvmSetClock:            "KVM_SET_CLOCK",
+	kvmGetDirtyLog:         "KVM_GET_DIRTY_LOG",
+	kvmCreateDevice:        "KVM_CREATE_DEVICE",
+	kvmSetDeviceAttr:       "KVM_SET_DEVICE_ATTR",
+	kvmGetDeviceAttr:       "KVM_GET_DEVICE_ATTR",
+	kvmHasDeviceAttr:       "KVM_HAS_DEVICE_ATTR",
+}
+
+// IoctlName returns the name of a KVM ioctl, e.g. "KVM_RUN", or its number
+// for ioctls unknown to gokvm.
+func IoctlName(op uintptr) string {
+	if name, ok := ioctlNames[op]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("ioctl 0x%x", op)
+}
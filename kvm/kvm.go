@@ -1,6 +1,8 @@
 package kvm
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"syscall"
 	"unsafe"
@@ -8,6 +10,7 @@ import (
 
 const (
 	kvmGetAPIVersion       = 44544
+	kvmCheckExtension      = 0xAE03
 	kvmCreateVM            = 44545
 	kvmCreateVCPU          = 44609
 	kvmRun                 = 44672
@@ -24,6 +27,39 @@ const (
 	kvmGetSupportedCPUID   = 0xC008AE05
 	kvmSetCPUID2           = 0x4008AE90
 	kvmIRQLine             = 0xc008ae67
+	kvmIRQFD               = 0x4020ae76
+	kvmIOEventFD           = 0x4040AE79
+	kvmSetGSIRouting       = 0x4008AE6A
+	kvmEnableCap           = 0x4068aea3
+	kvmSetGuestDebug       = 0x4048AE9B
+	kvmTranslate           = 0xC018AE85
+	kvmGetMPState          = 0x8004AE98
+	kvmGetStatsFD          = 0xAECE
+	kvmSetMPState          = 0x4004AE99
+	kvmGetFPU              = 0x81A0AE8C
+	kvmSetFPU              = 0x41A0AE8D
+	kvmGetLAPIC            = 0x8400AE8E
+	kvmSetLAPIC            = 0x4400AE8F
+	kvmGetMSRIndexList     = 0xC004AE02
+	kvmGetMSRs             = 0xC008AE88
+	kvmSetMSRs             = 0x4008AE89
+	kvmGetVCPUEvents       = 0x8040AE9F
+	kvmSetVCPUEvents       = 0x4040AEA0
+	kvmGetXSave            = 0x9000AEA4
+	kvmSetXSave            = 0x5000AEA5
+	kvmGetXCRS             = 0x8188AEA6
+	kvmSetXCRS             = 0x4188AEA7
+	kvmGetIRQChip          = 0xC208AE62
+	kvmSetIRQChip          = 0x8208AE63
+	kvmGetPIT2             = 0x8070AE9F
+	kvmSetPIT2             = 0x4070AEA0
+	kvmGetClock            = 0x8030AE7C
+	kvmSetClock            = 0x4030AE7B
+	kvmGetDirtyLog         = 0x4010AE42
+	kvmCreateDevice        = 0xC00CAEE0
+	kvmSetDeviceAttr       = 0x4018AEE1
+	kvmGetDeviceAttr       = 0x4018AEE2
+	kvmHasDeviceAttr       = 0x4018AEE3
 
 	EXITUNKNOWN       = 0
 	EXITEXCEPTION     = 1
@@ -43,10 +79,66 @@ const (
 	EXITDCR           = 15
 	EXITNMI           = 16
 	EXITINTERNALERROR = 17
+	EXITOSI           = 18
+	EXITPAPRHCALL     = 19
+	EXITS390UCONTROL  = 20
+	EXITWATCHDOG      = 21
+	EXITS390TSCH      = 22
+	EXITEPR           = 23
+	EXITSYSTEMEVENT   = 24
 
 	EXITIOIN  = 0
 	EXITIOOUT = 1
 
+	// The types of a KVM_EXIT_SYSTEM_EVENT exit.
+	SystemEventShutdown = 1
+	SystemEventReset    = 2
+	SystemEventCrash    = 3
+
+	MPStateRunnable      = 0
+	MPStateUninitialized = 1
+	MPStateInitReceived  = 2
+	MPStateHalted        = 3
+	MPStateSIPIReceived  = 4
+
+	GuestDebugEnable     = 0x1
+	GuestDebugSingleStep = 0x2
+	GuestDebugUseSWBP    = 0x10000
+	GuestDebugUseHWBP    = 0x20000
+
+	// APIVersion is the only stable version of the KVM API.
+	APIVersion = 12
+
+	CapIRQChip    = 0
+	CapUserMemory = 3
+	CapSetTSSAddr = 4
+	CapNRVCPUs    = 9
+	CapNRMemslots = 10
+	CapIRQRouting = 25
+	CapIRQFD      = 32
+	CapPIT2       = 33
+	CapIOEventFD  = 36
+	CapMaxVCPUs   = 66
+
+	CapDeviceCtrl    = 89
+	CapEnableCapVM   = 98
+	CapImmediateExit = 136
+	CapHaltPoll      = 182
+	CapExitHypercall = 201
+	CapBinaryStatsFD = 203
+
+	// HCMapGPARange is KVM_HC_MAP_GPA_RANGE, by which guests tell the host
+	// that pages become private or shared.
+	HCMapGPARange = 12
+
+	// The type of a statistic in the flags of its descriptor.
+	StatsTypeMask       = 0xf
+	StatsTypeCumulative = 0x0
+	StatsTypeInstant    = 0x1
+	StatsTypePeak       = 0x2
+	StatsTypeLinearHist = 0x3
+	StatsTypeLogHist    = 0x4
+
 	numInterrupts   = 0x100
 	CPUIDFeatures   = 0x40000001
 	CPUIDSignature  = 0x40000000
@@ -55,6 +147,53 @@ const (
 
 var ErrorUnexpectedEXITReason = errors.New("unexpected kvm exit reason")
 
+// NumExitReasons is the number of exit reasons known to gokvm, which are
+// numbered from 0.
+const NumExitReasons = EXITSYSTEMEVENT + 1
+
+var exitReasonNames = [NumExitReasons]string{
+	"unknown", "exception", "io", "hypercall", "debug", "hlt", "mmio",
+	"irq_window_open", "shutdown", "fail_entry", "intr", "set_tpr",
+	"tpr_access", "s390_sieic", "s390_reset", "dcr", "nmi", "internal_error",
+	"osi", "papr_hcall", "s390_ucontrol", "watchdog", "s390_tsch", "epr",
+	"system_event",
+}
+
+// ExitReasonName returns the name of an exit reason in lower case without
+// the KVM_EXIT_ prefix, e.g. "io" for KVM_EXIT_IO.
+func ExitReasonName(reason uint32) string {
+	if reason >= NumExitReasons {
+		return "unknown"
+	}
+
+	return exitReasonNames[reason]
+}
+
+var capNames = map[int]string{
+	CapIRQChip:       "KVM_CAP_IRQCHIP",
+	CapUserMemory:    "KVM_CAP_USER_MEMORY",
+	CapSetTSSAddr:    "KVM_CAP_SET_TSS_ADDR",
+	CapNRVCPUs:       "KVM_CAP_NR_VCPUS",
+	CapNRMemslots:    "KVM_CAP_NR_MEMSLOTS",
+	CapIRQRouting:    "KVM_CAP_IRQ_ROUTING",
+	CapIRQFD:         "KVM_CAP_IRQFD",
+	CapPIT2:          "KVM_CAP_PIT2",
+	CapIOEventFD:     "KVM_CAP_IOEVENTFD",
+	CapMaxVCPUs:      "KVM_CAP_MAX_VCPUS",
+	CapDeviceCtrl:    "KVM_CAP_DEVICE_CTRL",
+	CapEnableCapVM:   "KVM_CAP_ENABLE_CAP_VM",
+	CapImmediateExit: "KVM_CAP_IMMEDIATE_EXIT",
+	CapHaltPoll:      "KVM_CAP_HALT_POLL",
+	CapExitHypercall: "KVM_CAP_EXIT_HYPERCALL",
+	CapBinaryStatsFD: "KVM_CAP_BINARY_STATS_FD",
+}
+
+// CapName returns the name of a capability, e.g. "KVM_CAP_IRQCHIP", or ""
+// for capabilities unknown to gokvm.
+func CapName(capability int) string {
+	return capNames[capability]
+}
+
 type Regs struct {
 	RAX    uint64
 	RBX    uint64
@@ -142,6 +281,64 @@ func (r *RunData) IO() (uint64, uint64, uint64, uint64, uint64) {
 	return direction, size, port, count, offset
 }
 
+// MMIO returns the guest physical address, the data and the direction of a
+// KVM_EXIT_MMIO exit. For reads, data is filled by userspace.
+func (r *RunData) MMIO() (uint64, []byte, bool) {
+	addr := r.Data[0]
+	data := (*[8]byte)(unsafe.Pointer(&r.Data[1]))
+	size := r.Data[2] & 0xFFFFFFFF
+	write := (r.Data[2]>>32)&0xFF != 0
+
+	if size > 8 {
+		size = 8
+	}
+
+	return addr, data[:size], write
+}
+
+// Debug returns the exception and the instruction pointer of a
+// KVM_EXIT_DEBUG exit.
+func (r *RunData) Debug() (uint32, uint64) {
+	exception := uint32(r.Data[0] & 0xFFFFFFFF)
+	pc := r.Data[1]
+
+	return exception, pc
+}
+
+// SystemEvent returns the type and the data of a KVM_EXIT_SYSTEM_EVENT exit.
+func (r *RunData) SystemEvent() (uint32, []uint64) {
+	typ := uint32(r.Data[0] & 0xFFFFFFFF)
+	ndata := r.Data[0] >> 32
+
+	if ndata > 16 {
+		ndata = 16
+	}
+
+	return typ, append([]uint64{}, r.Data[1:1+ndata]...)
+}
+
+// Hypercall returns the number and the arguments of a KVM_EXIT_HYPERCALL
+// exit.
+func (r *RunData) Hypercall() (uint64, [6]uint64) {
+	var args [6]uint64
+
+	copy(args[:], r.Data[1:7])
+
+	return r.Data[0], args
+}
+
+// SetHypercallRet sets the value returned to the guest by the hypercall of a
+// KVM_EXIT_HYPERCALL exit, on the next KVM_RUN.
+func (r *RunData) SetHypercallRet(ret uint64) {
+	r.Data[7] = ret
+}
+
+// DebugStatus returns DR6 of a KVM_EXIT_DEBUG exit, whose low bits tell the
+// hardware breakpoints hit.
+func (r *RunData) DebugStatus() uint64 {
+	return r.Data[2]
+}
+
 type UserspaceMemoryRegion struct {
 	Slot          uint32
 	Flags         uint32
@@ -150,12 +347,18 @@ type UserspaceMemoryRegion struct {
 	UserspaceAddr uint64
 }
 
+// Flags of a memory region.
+const (
+	MemLogDirtyPages = 1 << 0
+	MemReadonly      = 1 << 1
+)
+
 func (r *UserspaceMemoryRegion) SetMemLogDirtyPages() {
-	r.Flags |= 1 << 0
+	r.Flags |= MemLogDirtyPages
 }
 
 func (r *UserspaceMemoryRegion) SetMemReadonly() {
-	r.Flags |= 1 << 1
+	r.Flags |= MemReadonly
 }
 
 func ioctl(fd, op, arg uintptr) (uintptr, error) {
@@ -164,7 +367,22 @@ func ioctl(fd, op, arg uintptr) (uintptr, error) {
 
 	var err error = nil
 	if errno != 0 {
-		err = errno
+		err = &Error{Op: op, Errno: errno}
+	}
+
+	return res, err
+}
+
+// ioctlPtr is ioctl with a pointer argument. The pointer must reach
+// syscall.Syscall as unsafe.Pointer: the stack of the goroutine may move as
+// ioctlPtr is called, and a uintptr would still point into the old one.
+func ioctlPtr(fd, op uintptr, arg unsafe.Pointer) (uintptr, error) {
+	res, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, fd, op, uintptr(arg))
+
+	var err error = nil
+	if errno != 0 {
+		err = &Error{Op: op, Errno: errno}
 	}
 
 	return res, err
@@ -174,6 +392,14 @@ func GetAPIVersion(kvmFd uintptr) (uintptr, error) {
 	return ioctl(kvmFd, uintptr(kvmGetAPIVersion), uintptr(0))
 }
 
+// CheckExtension returns 0 if the capability is not supported, and a positive
+// value, sometimes with a capability specific meaning, otherwise.
+func CheckExtension(kvmFd uintptr, capability int) (int, error) {
+	res, err := ioctl(kvmFd, uintptr(kvmCheckExtension), uintptr(capability))
+
+	return int(res), err
+}
+
 func CreateVM(kvmFd uintptr) (uintptr, error) {
 	return ioctl(kvmFd, uintptr(kvmCreateVM), uintptr(0))
 }
@@ -200,32 +426,49 @@ func GetVCPUMMmapSize(kvmFd uintptr) (uintptr, error) {
 
 func GetSregs(vcpuFd uintptr) (Sregs, error) {
 	sregs := Sregs{}
-	_, err := ioctl(vcpuFd, uintptr(kvmGetSregs), uintptr(unsafe.Pointer(&sregs)))
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetSregs), unsafe.Pointer(&sregs))
 
 	return sregs, err
 }
 
 func SetSregs(vcpuFd uintptr, sregs Sregs) error {
-	_, err := ioctl(vcpuFd, uintptr(kvmSetSregs), uintptr(unsafe.Pointer(&sregs)))
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetSregs), unsafe.Pointer(&sregs))
 
 	return err
 }
 
 func GetRegs(vcpuFd uintptr) (Regs, error) {
 	regs := Regs{}
-	_, err := ioctl(vcpuFd, uintptr(kvmGetRegs), uintptr(unsafe.Pointer(&regs)))
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetRegs), unsafe.Pointer(&regs))
 
 	return regs, err
 }
 
 func SetRegs(vcpuFd uintptr, regs Regs) error {
-	_, err := ioctl(vcpuFd, uintptr(kvmSetRegs), uintptr(unsafe.Pointer(&regs)))
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetRegs), unsafe.Pointer(&regs))
 
 	return err
 }
 
 func SetUserMemoryRegion(vmFd uintptr, region *UserspaceMemoryRegion) error {
-	_, err := ioctl(vmFd, uintptr(kvmSetUserMemoryRegion), uintptr(unsafe.Pointer(region)))
+	_, err := ioctlPtr(vmFd, uintptr(kvmSetUserMemoryRegion), unsafe.Pointer(region))
+
+	return err
+}
+
+// dirtyLog is struct kvm_dirty_log.
+type dirtyLog struct {
+	Slot        uint32
+	_           uint32
+	DirtyBitmap uint64
+}
+
+// GetDirtyLog fills bitmap with one bit per page of the memory slot, set for
+// the pages written since the last call. The slot must have
+// SetMemLogDirtyPages.
+func GetDirtyLog(vmFd uintptr, slot uint32, bitmap []uint64) error {
+	l := dirtyLog{Slot: slot, DirtyBitmap: uint64(uintptr(unsafe.Pointer(&bitmap[0])))}
+	_, err := ioctlPtr(vmFd, uintptr(kvmGetDirtyLog), unsafe.Pointer(&l))
 
 	return err
 }
@@ -238,7 +481,7 @@ func SetTSSAddr(vmFd uintptr) error {
 
 func SetIdentityMapAddr(vmFd uintptr) error {
 	var mapAddr uint64 = 0xffffc000
-	_, err := ioctl(vmFd, kvmSetIdentityMapAddr, uintptr(unsafe.Pointer(&mapAddr)))
+	_, err := ioctlPtr(vmFd, kvmSetIdentityMapAddr, unsafe.Pointer(&mapAddr))
 
 	return err
 }
@@ -254,11 +497,213 @@ func IRQLine(vmFd uintptr, irq, level uint32) error {
 		Level: level,
 	}
 
-	_, err := ioctl(vmFd, kvmIRQLine, uintptr(unsafe.Pointer(&irqLevel)))
+	_, err := ioctlPtr(vmFd, kvmIRQLine, unsafe.Pointer(&irqLevel))
+
+	return err
+}
+
+// enableCap is struct kvm_enable_cap.
+type enableCap struct {
+	Cap   uint32
+	Flags uint32
+	Args  [4]uint64
+	_     [64]uint8
+}
+
+// EnableCap enables the capability on the VM or vCPU fd with up to four
+// arguments of a capability specific meaning.
+func EnableCap(fd uintptr, capability uint32, args ...uint64) error {
+	c := enableCap{Cap: capability}
+	copy(c.Args[:], args)
+
+	_, err := ioctlPtr(fd, kvmEnableCap, unsafe.Pointer(&c))
+
+	return err
+}
+
+// irqFD is struct kvm_irqfd.
+type irqFD struct {
+	FD         uint32
+	GSI        uint32
+	Flags      uint32
+	ResampleFD uint32
+	_          [16]uint8
+}
+
+// IRQFD makes KVM inject an edge of the interrupt gsi each time the eventfd
+// fd is written to, without a KVM ioctl or a vCPU exit.
+func IRQFD(vmFd uintptr, fd int, gsi uint32) error {
+	f := irqFD{FD: uint32(fd), GSI: gsi}
+	_, err := ioctlPtr(vmFd, kvmIRQFD, unsafe.Pointer(&f))
+
+	return err
+}
+
+// DeassignIRQFD detaches the eventfd fd from the interrupt gsi.
+func DeassignIRQFD(vmFd uintptr, fd int, gsi uint32) error {
+	f := irqFD{FD: uint32(fd), GSI: gsi, Flags: irqFDFlagDeassign}
+	_, err := ioctlPtr(vmFd, kvmIRQFD, unsafe.Pointer(&f))
+
+	return err
+}
+
+// EventFD returns a new eventfd, closed on exec, for IRQFD and IOEventFD.
+func EventFD() (int, error) {
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, efdCloexec, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+const (
+	irqFDFlagDeassign = 1 << 0
+	efdCloexec        = 0x80000
+
+	// The flags of IOEvent.
+	IOEventFDDataMatch = 1 << 0
+	IOEventFDPIO       = 1 << 1
+	IOEventFDDeassign  = 1 << 2
+)
+
+// IOEvent is struct kvm_ioeventfd. Writes of Len bytes by the guest to Addr,
+// of guest physical memory or of the I/O ports with IOEventFDPIO, signal the
+// eventfd FD instead of exiting to gokvm. With IOEventFDDataMatch, only
+// writes of DataMatch do.
+type IOEvent struct {
+	DataMatch uint64
+	Addr      uint64
+	Len       uint32
+	FD        int32
+	Flags     uint32
+	_         [36]uint8
+}
+
+// IOEventFD assigns the eventfd of ev, or deassigns it with
+// IOEventFDDeassign.
+func IOEventFD(vmFd uintptr, ev *IOEvent) error {
+	_, err := ioctlPtr(vmFd, kvmIOEventFD, unsafe.Pointer(ev))
+
+	return err
+}
+
+const (
+	// The types of IRQRoutingEntry.
+	IRQRoutingIRQChip = 1
+	IRQRoutingMSI     = 2
+
+	irqRoutingEntrySize = 48
+)
+
+// IRQRoutingEntry is struct kvm_irq_routing_entry, routing the interrupt GSI
+// to a pin of an interrupt controller or to an MSI. U is the union with the
+// pin or the message.
+type IRQRoutingEntry struct {
+	GSI   uint32
+	Type  uint32
+	Flags uint32
+	_     uint32
+	U     [8]uint32
+}
+
+// IRQChipRoute routes gsi to the pin of the interrupt controller irqchip,
+// one of IRQChipPICMaster, IRQChipPICSlave and IRQChipIOAPIC.
+func IRQChipRoute(gsi, irqchip, pin uint32) IRQRoutingEntry {
+	return IRQRoutingEntry{GSI: gsi, Type: IRQRoutingIRQChip, U: [8]uint32{irqchip, pin}}
+}
+
+// MSIRoute routes gsi to the message data written at addr.
+func MSIRoute(gsi uint32, addr uint64, data uint32) IRQRoutingEntry {
+	return IRQRoutingEntry{GSI: gsi, Type: IRQRoutingMSI, U: [8]uint32{uint32(addr), uint32(addr >> 32), data}}
+}
+
+// SetGSIRouting replaces the whole routing table of the VM by entries. A GSI
+// may have several entries, e.g. a pin of both the PIC and the IOAPIC.
+func SetGSIRouting(vmFd uintptr, entries []IRQRoutingEntry) error {
+	// struct kvm_irq_routing is a header of 8 bytes and the entries
+	buf := make([]byte, 8+irqRoutingEntrySize*len(entries))
+	binary.LittleEndian.PutUint32(buf, uint32(len(entries)))
+
+	for i, e := range entries {
+		b := buf[8+irqRoutingEntrySize*i:]
+		binary.LittleEndian.PutUint32(b, e.GSI)
+		binary.LittleEndian.PutUint32(b[4:], e.Type)
+		binary.LittleEndian.PutUint32(b[8:], e.Flags)
+
+		for j, u := range e.U {
+			binary.LittleEndian.PutUint32(b[16+4*j:], u)
+		}
+	}
+
+	_, err := ioctlPtr(vmFd, kvmSetGSIRouting, unsafe.Pointer(&buf[0]))
 
 	return err
 }
 
+const (
+	// DevTypeVFIO is the device tracking the VFIO groups of the VM.
+	DevTypeVFIO = 4
+
+	// CreateDeviceTest makes CreateDevice only check that the type is
+	// supported.
+	CreateDeviceTest = 1 << 0
+)
+
+// createDevice is struct kvm_create_device.
+type createDevice struct {
+	Type  uint32
+	FD    uint32
+	Flags uint32
+}
+
+// CreateDevice creates an in-kernel device of typ, and returns its fd for the
+// attribute ioctls. With CreateDeviceTest, the returned fd is meaningless.
+func CreateDevice(vmFd uintptr, typ, flags uint32) (uintptr, error) {
+	d := createDevice{Type: typ, Flags: flags}
+	if _, err := ioctlPtr(vmFd, kvmCreateDevice, unsafe.Pointer(&d)); err != nil {
+		return 0, err
+	}
+
+	return uintptr(d.FD), nil
+}
+
+// DeviceAttr is struct kvm_device_attr. Addr is the address of the value of
+// the attribute in the memory of gokvm, of a size given by Group and Attr.
+type DeviceAttr struct {
+	Flags uint32
+	Group uint32
+	Attr  uint64
+	Addr  uint64
+}
+
+// SetDeviceAttr sets an attribute of a device, or of a VM or vCPU.
+func SetDeviceAttr(fd uintptr, attr *DeviceAttr) error {
+	_, err := ioctlPtr(fd, kvmSetDeviceAttr, unsafe.Pointer(attr))
+
+	return err
+}
+
+// GetDeviceAttr gets an attribute of a device, or of a VM or vCPU.
+func GetDeviceAttr(fd uintptr, attr *DeviceAttr) error {
+	_, err := ioctlPtr(fd, kvmGetDeviceAttr, unsafe.Pointer(attr))
+
+	return err
+}
+
+// HasDeviceAttr reports whether a device, or a VM or vCPU, has the attribute
+// of group.
+func HasDeviceAttr(fd uintptr, group uint32, attr uint64) (bool, error) {
+	a := DeviceAttr{Group: group, Attr: attr}
+
+	_, err := ioctlPtr(fd, kvmHasDeviceAttr, unsafe.Pointer(&a))
+	if errors.Is(err, syscall.ENXIO) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
 func CreateIRQChip(vmFd uintptr) error {
 	_, err := ioctl(vmFd, kvmCreateIRQChip, 0)
 
@@ -274,7 +719,7 @@ func CreatePIT2(vmFd uintptr) error {
 	pit := PitConfig{
 		Flags: 0,
 	}
-	_, err := ioctl(vmFd, kvmCreatePIT2, uintptr(unsafe.Pointer(&pit)))
+	_, err := ioctlPtr(vmFd, kvmCreatePIT2, unsafe.Pointer(&pit))
 
 	return err
 }
@@ -297,13 +742,414 @@ type CPUIDEntry2 struct {
 }
 
 func GetSupportedCPUID(kvmFd uintptr, kvmCPUID *CPUID) error {
-	_, err := ioctl(kvmFd, kvmGetSupportedCPUID, uintptr(unsafe.Pointer(kvmCPUID)))
+	_, err := ioctlPtr(kvmFd, kvmGetSupportedCPUID, unsafe.Pointer(kvmCPUID))
 
 	return err
 }
 
 func SetCPUID2(vcpuFd uintptr, kvmCPUID *CPUID) error {
-	_, err := ioctl(vcpuFd, kvmSetCPUID2, uintptr(unsafe.Pointer(kvmCPUID)))
+	_, err := ioctlPtr(vcpuFd, kvmSetCPUID2, unsafe.Pointer(kvmCPUID))
+
+	return err
+}
+
+type GuestDebug struct {
+	Control  uint32
+	_        uint32
+	DebugReg [8]uint64
+}
+
+// SetGuestDebug enables or disables debugging features of the vCPU, such as
+// single-stepping and exiting on the breakpoint instruction.
+func SetGuestDebug(vcpuFd uintptr, dbg *GuestDebug) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetGuestDebug), unsafe.Pointer(dbg))
+
+	return err
+}
+
+type Translation struct {
+	LinearAddress   uint64
+	PhysicalAddress uint64
+	Valid           uint8
+	Writeable       uint8
+	UserMode        uint8
+	_               [5]uint8
+}
+
+// Translate translates a virtual address according to the current paging
+// mode of the vCPU.
+func Translate(vcpuFd uintptr, t *Translation) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmTranslate), unsafe.Pointer(t))
+
+	return err
+}
+
+// GetMPState returns the multiprocessing state of the vCPU, e.g.
+// MPStateHalted while it waits for an interrupt in the in-kernel irqchip.
+func GetMPState(vcpuFd uintptr) (uint32, error) {
+	var state uint32
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetMPState), unsafe.Pointer(&state))
+
+	return state, err
+}
+
+// GetStatsFD returns a file descriptor from which the statistics of the VM or
+// the vCPU of fd are read with ReadStats.
+func GetStatsFD(fd uintptr) (uintptr, error) {
+	return ioctl(fd, uintptr(kvmGetStatsFD), 0)
+}
+
+// Stat is a statistic of KVM. Values has one element except for histograms,
+// which have one per bucket. The value is scaled by 10^Exponent, or by
+// 2^Exponent when the flags say so, e.g. -9 for nanoseconds.
+//
+// refs: https://docs.kernel.org/virt/kvm/api.html#kvm-get-stats-fd
+type Stat struct {
+	Name     string
+	Flags    uint32
+	Exponent int16
+	Values   []uint64
+}
+
+// Type returns one of the StatsType constants.
+func (s Stat) Type() uint32 {
+	return s.Flags & StatsTypeMask
+}
+
+type statsHeader struct {
+	Flags      uint32
+	NameSize   uint32
+	NumDesc    uint32
+	IDOffset   uint32
+	DescOffset uint32
+	DataOffset uint32
+}
+
+type statsDesc struct {
+	Flags      uint32
+	Exponent   int16
+	Size       uint16
+	Offset     uint32
+	BucketSize uint32
+}
+
+// ReadStats reads all the statistics of a stats file descriptor. The
+// descriptors are read every time, which is simple and cheap enough for
+// scrapes every few seconds.
+func ReadStats(statsFd uintptr) ([]Stat, error) {
+	fd := int(statsFd)
+
+	buf := make([]byte, binary.Size(statsHeader{}))
+	if _, err := syscall.Pread(fd, buf, 0); err != nil {
+		return nil, err
+	}
+
+	h := statsHeader{}
+	_ = binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h)
+
+	descSize := binary.Size(statsDesc{}) + int(h.NameSize)
+
+	buf = make([]byte, descSize*int(h.NumDesc))
+	if _, err := syscall.Pread(fd, buf, int64(h.DescOffset)); err != nil {
+		return nil, err
+	}
+
+	stats := make([]Stat, h.NumDesc)
+	descs := make([]statsDesc, h.NumDesc)
+	dataSize := 0
+
+	for i := range descs {
+		b := buf[i*descSize : (i+1)*descSize]
+		_ = binary.Read(bytes.NewReader(b), binary.LittleEndian, &descs[i])
+
+		name := b[binary.Size(statsDesc{}):]
+		if n := bytes.IndexByte(name, 0); n >= 0 {
+			name = name[:n]
+		}
+
+		stats[i] = Stat{
+			Name:     string(name),
+			Flags:    descs[i].Flags,
+			Exponent: descs[i].Exponent,
+			Values:   make([]uint64, descs[i].Size),
+		}
+
+		if end := int(descs[i].Offset) + 8*int(descs[i].Size); end > dataSize {
+			dataSize = end
+		}
+	}
+
+	buf = make([]byte, dataSize)
+	if _, err := syscall.Pread(fd, buf, int64(h.DataOffset)); err != nil {
+		return nil, err
+	}
+
+	for i, d := range descs {
+		for j := range stats[i].Values {
+			stats[i].Values[j] = binary.LittleEndian.Uint64(buf[int(d.Offset)+8*j:])
+		}
+	}
+
+	return stats, nil
+}
+
+// SetMPState sets the multiprocessing state of the vCPU.
+func SetMPState(vcpuFd uintptr, state uint32) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetMPState), unsafe.Pointer(&state))
+
+	return err
+}
+
+// The following structures hold the state of a vCPU or of the in-kernel
+// devices which KVM keeps for itself. gokvm only saves and restores them, so
+// the ones it never looks into are kept opaque.
+
+type FPU struct {
+	FPR        [8][16]uint8
+	FCW        uint16
+	FSW        uint16
+	FTWX       uint8
+	_          uint8
+	LastOpcode uint16
+	LastIP     uint64
+	LastDP     uint64
+	XMM        [16][16]uint8
+	MXCSR      uint32
+	_          uint32
+}
+
+// LAPICState is the register page of the local APIC.
+type LAPICState struct {
+	Regs [1024]byte
+}
+
+// VCPUEvents are the pending exceptions, interrupts and NMIs of a vCPU, as
+// struct kvm_vcpu_events.
+type VCPUEvents struct {
+	Data [64]byte
+}
+
+// XSave is the XSAVE area of a vCPU, which includes the FPU state.
+type XSave struct {
+	Region [1024]uint32
+}
+
+type XCR struct {
+	XCR   uint32
+	_     uint32
+	Value uint64
+}
+
+type XCRS struct {
+	NrXCRS uint32
+	Flags  uint32
+	XCRS   [16]XCR
+	_      [16]uint64
+}
+
+// The chips of the in-kernel irqchip.
+const (
+	IRQChipPICMaster = 0
+	IRQChipPICSlave  = 1
+	IRQChipIOAPIC    = 2
+)
+
+type IRQChip struct {
+	ChipID uint32
+	_      uint32
+	Chip   [512]byte
+}
+
+// PITState2 is the state of the in-kernel PIT, as struct kvm_pit_state2.
+type PITState2 struct {
+	Data [112]byte
+}
+
+type ClockData struct {
+	Clock    uint64
+	Flags    uint32
+	_        uint32
+	Realtime uint64
+	HostTSC  uint64
+	_        [4]uint32
+}
+
+type MSREntry struct {
+	Index uint32
+	_     uint32
+	Data  uint64
+}
+
+func GetFPU(vcpuFd uintptr) (FPU, error) {
+	fpu := FPU{}
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetFPU), unsafe.Pointer(&fpu))
+
+	return fpu, err
+}
+
+func SetFPU(vcpuFd uintptr, fpu FPU) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetFPU), unsafe.Pointer(&fpu))
+
+	return err
+}
+
+func GetLAPIC(vcpuFd uintptr) (LAPICState, error) {
+	lapic := LAPICState{}
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetLAPIC), unsafe.Pointer(&lapic))
+
+	return lapic, err
+}
+
+func SetLAPIC(vcpuFd uintptr, lapic LAPICState) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetLAPIC), unsafe.Pointer(&lapic))
+
+	return err
+}
+
+func GetVCPUEvents(vcpuFd uintptr) (VCPUEvents, error) {
+	events := VCPUEvents{}
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetVCPUEvents), unsafe.Pointer(&events))
+
+	return events, err
+}
+
+func SetVCPUEvents(vcpuFd uintptr, events VCPUEvents) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetVCPUEvents), unsafe.Pointer(&events))
+
+	return err
+}
+
+func GetXSave(vcpuFd uintptr) (XSave, error) {
+	xsave := XSave{}
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetXSave), unsafe.Pointer(&xsave))
+
+	return xsave, err
+}
+
+func SetXSave(vcpuFd uintptr, xsave XSave) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetXSave), unsafe.Pointer(&xsave))
+
+	return err
+}
+
+func GetXCRS(vcpuFd uintptr) (XCRS, error) {
+	xcrs := XCRS{}
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmGetXCRS), unsafe.Pointer(&xcrs))
+
+	return xcrs, err
+}
+
+func SetXCRS(vcpuFd uintptr, xcrs XCRS) error {
+	_, err := ioctlPtr(vcpuFd, uintptr(kvmSetXCRS), unsafe.Pointer(&xcrs))
+
+	return err
+}
+
+// GetIRQChip reads the state of the chip of the in-kernel irqchip given by
+// ChipID.
+func GetIRQChip(vmFd uintptr, chip *IRQChip) error {
+	_, err := ioctlPtr(vmFd, uintptr(kvmGetIRQChip), unsafe.Pointer(chip))
+
+	return err
+}
+
+func SetIRQChip(vmFd uintptr, chip *IRQChip) error {
+	_, err := ioctlPtr(vmFd, uintptr(kvmSetIRQChip), unsafe.Pointer(chip))
+
+	return err
+}
+
+func GetPIT2(vmFd uintptr) (PITState2, error) {
+	pit := PITState2{}
+	_, err := ioctlPtr(vmFd, uintptr(kvmGetPIT2), unsafe.Pointer(&pit))
+
+	return pit, err
+}
+
+func SetPIT2(vmFd uintptr, pit PITState2) error {
+	_, err := ioctlPtr(vmFd, uintptr(kvmSetPIT2), unsafe.Pointer(&pit))
+
+	return err
+}
+
+// GetClock returns the kvmclock of the VM, which must be restored on the
+// destination so that the guest time doesn't jump.
+func GetClock(vmFd uintptr) (ClockData, error) {
+	clock := ClockData{}
+	_, err := ioctlPtr(vmFd, uintptr(kvmGetClock), unsafe.Pointer(&clock))
+
+	return clock, err
+}
+
+func SetClock(vmFd uintptr, clock ClockData) error {
+	_, err := ioctlPtr(vmFd, uintptr(kvmSetClock), unsafe.Pointer(&clock))
 
 	return err
 }
+
+// GetMSRIndexList returns the MSRs that KVM saves and restores.
+func GetMSRIndexList(kvmFd uintptr) ([]uint32, error) {
+	// the first call fails with E2BIG and tells the number of MSRs
+	n := uint32(0)
+	if _, err := ioctlPtr(kvmFd, uintptr(kvmGetMSRIndexList), unsafe.Pointer(&n)); err != nil &&
+		!errors.Is(err, syscall.E2BIG) {
+		return nil, err
+	}
+
+	buf := make([]uint32, 1+n)
+	buf[0] = n
+
+	if _, err := ioctlPtr(kvmFd, uintptr(kvmGetMSRIndexList), unsafe.Pointer(&buf[0])); err != nil {
+		return nil, err
+	}
+
+	return buf[1 : 1+buf[0]], nil
+}
+
+// msrs builds struct kvm_msrs, whose entries follow a header of 8 bytes.
+func msrs(entries []MSREntry) []uint64 {
+	buf := make([]uint64, 1+2*len(entries))
+	buf[0] = uint64(len(entries))
+
+	for i, e := range entries {
+		buf[1+2*i] = uint64(e.Index)
+		buf[2+2*i] = e.Data
+	}
+
+	return buf
+}
+
+// GetMSRs reads the MSRs given by the indices of entries, and returns the
+// number read. KVM stops at the first MSR it fails to read.
+func GetMSRs(vcpuFd uintptr, entries []MSREntry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	buf := msrs(entries)
+
+	n, err := ioctlPtr(vcpuFd, uintptr(kvmGetMSRs), unsafe.Pointer(&buf[0]))
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range entries {
+		entries[i].Data = buf[2+2*i]
+	}
+
+	return int(n), nil
+}
+
+// SetMSRs writes the MSRs of entries, and returns the number written. KVM
+// stops at the first MSR it fails to write.
+func SetMSRs(vcpuFd uintptr, entries []MSREntry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	buf := msrs(entries)
+
+	n, err := ioctlPtr(vcpuFd, uintptr(kvmSetMSRs), unsafe.Pointer(&buf[0]))
+
+	return int(n), err
+}
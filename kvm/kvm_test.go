@@ -1,9 +1,11 @@
 package kvm_test
 
 import (
+	"errors"
 	"os"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/kvm"
@@ -25,6 +27,26 @@ func TestGetAPIVersion(t *testing.T) {
 	}
 }
 
+func TestCheckExtension(t *testing.T) {
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	n, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapUserMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n == 0 {
+		t.Fatal("KVM_CAP_USER_MEMORY is not supported")
+	}
+}
+
 func TestCreateVM(t *testing.T) {
 	t.Parallel()
 
@@ -243,6 +265,59 @@ func TestSetMemLogDirtyPages(t *testing.T) {
 	}
 }
 
+func TestGetDirtyLog(t *testing.T) {
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+	mem, _ := syscall.Mmap(-1, 0, 0x2000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+
+	// mov byte [0x2000], 1; hlt
+	copy(mem, []byte{0xc6, 0x06, 0x00, 0x20, 0x01, 0xf4})
+
+	region := &kvm.UserspaceMemoryRegion{
+		GuestPhysAddr: 0x1000,
+		MemorySize:    0x2000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	}
+	region.SetMemLogDirtyPages()
+
+	if err := kvm.SetUserMemoryRegion(vmFd, region); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, _ := kvm.CreateVCPU(vmFd, 0)
+
+	sregs, _ := kvm.GetSregs(vcpuFd)
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+	_ = kvm.SetSregs(vcpuFd, sregs)
+	_ = kvm.SetRegs(vcpuFd, kvm.Regs{RIP: 0x1000, RFLAGS: 0x2})
+
+	if err := kvm.Run(vcpuFd); err != nil {
+		t.Fatal(err)
+	}
+
+	bitmap := make([]uint64, 1)
+	if err := kvm.GetDirtyLog(vmFd, 0, bitmap); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the second page was written
+	if bitmap[0] != 0x2 {
+		t.Fatalf("unexpected dirty bitmap: 0x%x", bitmap[0])
+	}
+
+	if err := kvm.GetDirtyLog(vmFd, 0, bitmap); err != nil || bitmap[0] != 0 {
+		t.Fatalf("the dirty bitmap is not cleared: 0x%x %v", bitmap[0], err)
+	}
+}
+
 func TestIRQLine(t *testing.T) {
 	t.Parallel()
 
@@ -257,3 +332,313 @@ func TestIRQLine(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIRQFD(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	efd, err := kvm.EventFD()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Close(efd)
+
+	if err := kvm.IRQFD(vmFd, efd, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := syscall.Write(efd, []byte{1, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// KVM injects the edge asynchronously; last_irr and irr are the first
+	// bytes of struct kvm_pic_state
+	chip := kvm.IRQChip{ChipID: kvm.IRQChipPICMaster}
+
+	for i := 0; i < 100; i++ {
+		if err := kvm.GetIRQChip(vmFd, &chip); err != nil {
+			t.Fatal(err)
+		}
+
+		if chip.Chip[1]&(1<<4) != 0 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if chip.Chip[1]&(1<<4) == 0 || chip.Chip[0]&(1<<4) != 0 {
+		t.Fatalf("no edge of IRQ 4: last_irr 0x%x irr 0x%x", chip.Chip[0], chip.Chip[1])
+	}
+
+	if err := kvm.DeassignIRQFD(vmFd, efd, 4); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOEventFD(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	efd, err := kvm.EventFD()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Close(efd)
+
+	ev := kvm.IOEvent{Addr: 0x3f8, Len: 1, FD: int32(efd), Flags: kvm.IOEventFDPIO}
+	if err := kvm.IOEventFD(vmFd, &ev); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.IOEventFD(vmFd, &ev); !errors.Is(err, syscall.EEXIST) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ev.Flags |= kvm.IOEventFDDeassign
+	if err := kvm.IOEventFD(vmFd, &ev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetGSIRouting(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []kvm.IRQRoutingEntry{
+		kvm.IRQChipRoute(4, kvm.IRQChipPICMaster, 4),
+		kvm.IRQChipRoute(4, kvm.IRQChipIOAPIC, 4),
+		kvm.MSIRoute(24, 0xfee00000, 0x30),
+	}
+
+	if err := kvm.SetGSIRouting(vmFd, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// a pin of the PIC is 0 to 7
+	if err := kvm.SetGSIRouting(vmFd, []kvm.IRQRoutingEntry{
+		kvm.IRQChipRoute(4, kvm.IRQChipPICMaster, 8),
+	}); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDeviceAttr(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	if _, err := kvm.CreateDevice(vmFd, kvm.DevTypeVFIO, kvm.CreateDeviceTest); err != nil &&
+		!errors.Is(err, syscall.ENODEV) {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// group 0 of vCPUs is KVM_VCPU_TSC_CTRL, which has no attribute 100
+	if ok, err := kvm.HasDeviceAttr(vcpuFd, 0, 100); ok || (err != nil && !errors.Is(err, syscall.ENOTTY)) {
+		t.Fatalf("unexpected attribute: %v", err)
+	}
+}
+
+func TestError(t *testing.T) {
+	t.Parallel()
+
+	err := kvm.Run(^uintptr(0))
+
+	var e *kvm.Error
+	if !errors.As(err, &e) || !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err.Error() != "KVM_RUN: bad file descriptor" {
+		t.Fatalf("unexpected message: %v", err)
+	}
+
+	if name := kvm.IoctlName(0xdead); name != "ioctl 0xdead" {
+		t.Fatalf("unexpected name: %s", name)
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	if n, _ := kvm.CheckExtension(devKVM.Fd(), kvm.CapBinaryStatsFD); n == 0 {
+		t.Skip("KVM_CAP_BINARY_STATS_FD is not supported")
+	}
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fd := range []uintptr{vmFd, vcpuFd} {
+		statsFd, err := kvm.GetStatsFD(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := kvm.ReadStats(statsFd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		syscall.Close(int(statsFd))
+
+		if len(stats) == 0 {
+			t.Fatal("no stats")
+		}
+
+		for _, s := range stats {
+			if s.Name == "" || len(s.Values) == 0 {
+				t.Fatalf("invalid stat: %+v", s)
+			}
+		}
+	}
+}
+
+func TestVCPUState(t *testing.T) {
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.CreatePIT2(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, err := kvm.CreateVCPU(vmFd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpu, err := kvm.GetFPU(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpu.MXCSR = 0x1f80
+	if err := kvm.SetFPU(vcpuFd, fpu); err != nil {
+		t.Fatal(err)
+	}
+
+	if lapic, err := kvm.GetLAPIC(vcpuFd); err != nil || kvm.SetLAPIC(vcpuFd, lapic) != nil {
+		t.Fatalf("lapic: %v", err)
+	}
+
+	if events, err := kvm.GetVCPUEvents(vcpuFd); err != nil || kvm.SetVCPUEvents(vcpuFd, events) != nil {
+		t.Fatalf("vcpu events: %v", err)
+	}
+
+	if xsave, err := kvm.GetXSave(vcpuFd); err != nil || kvm.SetXSave(vcpuFd, xsave) != nil {
+		t.Fatalf("xsave: %v", err)
+	}
+
+	if xcrs, err := kvm.GetXCRS(vcpuFd); err != nil || kvm.SetXCRS(vcpuFd, xcrs) != nil {
+		t.Fatalf("xcrs: %v", err)
+	}
+
+	if err := kvm.SetMPState(vcpuFd, kvm.MPStateRunnable); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []uint32{kvm.IRQChipPICMaster, kvm.IRQChipPICSlave, kvm.IRQChipIOAPIC} {
+		chip := kvm.IRQChip{ChipID: id}
+		if err := kvm.GetIRQChip(vmFd, &chip); err != nil || kvm.SetIRQChip(vmFd, &chip) != nil {
+			t.Fatalf("irqchip %d: %v", id, err)
+		}
+	}
+
+	if pit, err := kvm.GetPIT2(vmFd); err != nil || kvm.SetPIT2(vmFd, pit) != nil {
+		t.Fatalf("pit: %v", err)
+	}
+
+	if clock, err := kvm.GetClock(vmFd); err != nil || kvm.SetClock(vmFd, kvm.ClockData{Clock: clock.Clock}) != nil {
+		t.Fatalf("clock: %v", err)
+	}
+
+	indices, err := kvm.GetMSRIndexList(devKVM.Fd())
+	if err != nil || len(indices) == 0 {
+		t.Fatalf("msr index list: %v %v", indices, err)
+	}
+
+	// IA32_SYSENTER_CS is always available
+	entries := []kvm.MSREntry{{Index: 0x174}}
+
+	if n, err := kvm.GetMSRs(vcpuFd, entries); err != nil || n != 1 {
+		t.Fatalf("get msrs: %d %v", n, err)
+	}
+
+	entries[0].Data = 0x10
+	if n, err := kvm.SetMSRs(vcpuFd, entries); err != nil || n != 1 {
+		t.Fatalf("set msrs: %d %v", n, err)
+	}
+
+	entries[0].Data = 0
+	if _, err := kvm.GetMSRs(vcpuFd, entries); err != nil || entries[0].Data != 0x10 {
+		t.Fatalf("msr is not written: %v %v", entries, err)
+	}
+}
+
+func TestSystemEvent(t *testing.T) {
+	t.Parallel()
+
+	r := kvm.RunData{ExitReason: kvm.EXITSYSTEMEVENT}
+	r.Data[0] = 2<<32 | kvm.SystemEventCrash
+	r.Data[1] = 0xdead
+	r.Data[2] = 0xbeef
+
+	typ, data := r.SystemEvent()
+	if typ != kvm.SystemEventCrash || len(data) != 2 || data[0] != 0xdead || data[1] != 0xbeef {
+		t.Fatalf("unexpected event %d: %x", typ, data)
+	}
+
+	if name := kvm.ExitReasonName(r.ExitReason); name != "system_event" {
+		t.Fatalf("unexpected name: %s", name)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build go1.16
+// +build go1.16
+
+package landlock
+
+import "syscall"
+
+const allThreads = true
+
+func allThreadsSyscall(trap, a1, a2, a3 uintptr) (uintptr, uintptr, syscall.Errno) {
+	return syscall.AllThreadsSyscall(trap, a1, a2, a3)
+}
@@ -0,0 +1,14 @@
+//go:build !go1.16
+// +build !go1.16
+
+package landlock
+
+import "syscall"
+
+// Go has only been able to make a system call on all threads since 1.16, so
+// older versions of it can't enter a domain and ABI fails.
+const allThreads = false
+
+func allThreadsSyscall(trap, a1, a2, a3 uintptr) (uintptr, uintptr, syscall.Errno) {
+	return 0, 0, syscall.ENOSYS
+}
@@ -0,0 +1,176 @@
+// Package landlock restricts the filesystem access of gokvm with Landlock.
+//
+// A Landlock domain restricts the thread which enters it, and the threads it
+// creates afterwards. The Go runtime has threads of its own by the time a
+// ruleset is known, so Restrict enters the domain on all of them, which Go
+// only supports since 1.16 and in executables built without cgo.
+package landlock
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Access rights of the files and directories beneath a path.
+const (
+	AccessExecute uint64 = 1 << iota
+	AccessWriteFile
+	AccessReadFile
+	AccessReadDir
+	AccessRemoveDir
+	AccessRemoveFile
+	AccessMakeChar
+	AccessMakeDir
+	AccessMakeReg
+	AccessMakeSock
+	AccessMakeFifo
+	AccessMakeBlock
+	AccessMakeSym
+	AccessRefer    // ABI 2
+	AccessTruncate // ABI 3
+	AccessIoctlDev // ABI 5
+)
+
+const (
+	sysCreateRuleset = 444
+	sysAddRule       = 445
+	sysRestrictSelf  = 446
+
+	createRulesetVersion = 1
+	ruleTypePathBeneath  = 1
+	prSetNoNewPrivs      = 38
+	oPath                = 0x200000
+
+	// fileAccess are the rights granted on a file rather than a directory.
+	fileAccess = AccessExecute | AccessWriteFile | AccessReadFile | AccessTruncate | AccessIoctlDev
+)
+
+var (
+	ErrorUnsupported = errors.New("landlock is not supported")
+	ErrorCgo         = errors.New("landlock needs gokvm built with CGO_ENABLED=0 to restrict all its threads")
+)
+
+type rulesetAttr struct {
+	HandledAccessFS uint64
+}
+
+// pathBeneathAttr is packed in the kernel, which reads the first 12 bytes.
+type pathBeneathAttr struct {
+	AllowedAccess uint64
+	ParentFd      int32
+	_             int32
+}
+
+// Rule grants Access to the files beneath Path. Only the rights of files
+// apply to a path which isn't a directory.
+type Rule struct {
+	Path   string
+	Access uint64
+}
+
+// Ruleset is the filesystem access of a process. Anything not granted by a
+// rule is denied.
+type Ruleset []Rule
+
+// ABI returns the version of Landlock supported by the kernel.
+func ABI() (int, error) {
+	if !allThreads {
+		return 0, fmt.Errorf("%w: gokvm is built with %s, restricting all its threads needs go1.16",
+			ErrorUnsupported, runtime.Version())
+	}
+
+	abi, _, errno := syscall.Syscall(sysCreateRuleset, 0, 0, createRulesetVersion)
+	if errno != 0 {
+		return 0, fmt.Errorf("%w by the kernel: %v", ErrorUnsupported, errno)
+	}
+
+	return int(abi), nil
+}
+
+// handled returns the rights known to abi, which are denied unless granted.
+func handled(abi int) uint64 {
+	access := AccessIoctlDev<<1 - 1
+
+	switch {
+	case abi < 2:
+		access &^= AccessRefer | AccessTruncate | AccessIoctlDev
+	case abi < 3:
+		access &^= AccessTruncate | AccessIoctlDev
+	case abi < 5:
+		access &^= AccessIoctlDev
+	}
+
+	return access
+}
+
+func addRule(ruleset uintptr, rule Rule, handledAccess uint64) error {
+	fd, err := syscall.Open(rule.Path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(fd)
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	access := rule.Access & handledAccess
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= fileAccess
+	}
+
+	attr := pathBeneathAttr{AllowedAccess: access, ParentFd: int32(fd)}
+
+	_, _, errno := syscall.Syscall6(sysAddRule, ruleset, ruleTypePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Restrict restricts all threads of the process to r, for good. It returns
+// the Landlock ABI the ruleset was enforced with.
+func (r Ruleset) Restrict() (int, error) {
+	abi, err := ABI()
+	if err != nil {
+		return 0, err
+	}
+
+	attr := rulesetAttr{HandledAccessFS: handled(abi)}
+
+	fd, _, errno := syscall.Syscall(sysCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return abi, errno
+	}
+
+	defer syscall.Close(int(fd))
+
+	for _, rule := range r {
+		if err := addRule(fd, rule, attr.HandledAccessFS); err != nil {
+			return abi, fmt.Errorf("landlock rule %s: %w", rule.Path, err)
+		}
+	}
+
+	// an unprivileged process may only restrict itself without gaining
+	// privileges afterwards
+	_, _, errno = allThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno == syscall.ENOTSUP {
+		return abi, ErrorCgo
+	}
+
+	if errno != 0 {
+		return abi, errno
+	}
+
+	if _, _, errno := allThreadsSyscall(sysRestrictSelf, fd, 0, 0); errno != 0 {
+		return abi, errno
+	}
+
+	return abi, nil
+}
@@ -0,0 +1,99 @@
+package landlock_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/landlock"
+)
+
+// restrictChild runs in a child process, allowed to read the directory in
+// GOKVM_LANDLOCK_ALLOWED only.
+func restrictChild() error {
+	allowed := os.Getenv("GOKVM_LANDLOCK_ALLOWED")
+	denied := os.Getenv("GOKVM_LANDLOCK_DENIED")
+
+	// a thread which exists before the ruleset is enforced
+	read := make(chan string)
+	result := make(chan error)
+
+	go func() {
+		runtime.LockOSThread()
+		result <- nil
+
+		for path := range read {
+			_, err := ioutil.ReadFile(path)
+			result <- err
+		}
+	}()
+
+	<-result
+
+	r := landlock.Ruleset{{Path: allowed, Access: landlock.AccessReadFile | landlock.AccessReadDir}}
+	if _, err := r.Restrict(); err != nil {
+		return err
+	}
+
+	if _, err := ioutil.ReadFile(filepath.Join(allowed, "file")); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(allowed, "new"), nil, 0o644); !errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("writing is not denied: %v", err)
+	}
+
+	read <- filepath.Join(denied, "file")
+	if err := <-result; !errors.Is(err, syscall.EACCES) {
+		return fmt.Errorf("reading on another thread is not denied: %v", err)
+	}
+
+	return nil
+}
+
+func TestRestrict(t *testing.T) {
+	t.Parallel()
+
+	if os.Getenv("GOKVM_LANDLOCK_ALLOWED") != "" {
+		if err := restrictChild(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if _, err := landlock.ABI(); err != nil {
+		t.Skip(err)
+	}
+
+	dirs := []string{}
+
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "landlock")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		dirs = append(dirs, dir)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestrict$")
+	cmd.Env = append(os.Environ(), "GOKVM_LANDLOCK_ALLOWED="+dirs[0], "GOKVM_LANDLOCK_DENIED="+dirs[1])
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
@@ -0,0 +1,251 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The API follows log/slog, which needs a newer Go than gokvm supports:
+// messages take alternating keys and values, e.g.
+//
+//	log.Info("vcpu stopped", "vcpu", 0, "reason", "hlt")
+//
+// Every logger belongs to a subsystem, and the minimum level can be changed
+// per subsystem while the VM runs.
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	ErrorInvalidLevel  = errors.New("invalid log level")
+	ErrorInvalidFormat = errors.New("invalid log format")
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrorInvalidLevel, s)
+}
+
+// CheckFormat returns an error if format is neither FormatText nor FormatJSON.
+func CheckFormat(format string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("%w: %q", ErrorInvalidFormat, format)
+	}
+
+	return nil
+}
+
+var std = struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	level  Level
+	levels map[string]Level
+}{
+	out:    os.Stderr,
+	format: FormatText,
+	level:  LevelInfo,
+	levels: map[string]Level{},
+}
+
+// SetOutput changes where the messages are written, os.Stderr by default.
+func SetOutput(w io.Writer) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.out = w
+}
+
+func SetFormat(format string) error {
+	if err := CheckFormat(format); err != nil {
+		return err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	std.format = format
+
+	return nil
+}
+
+// SetLevel changes the minimum level of a subsystem. An empty subsystem sets
+// the default for the subsystems without a level of their own.
+func SetLevel(subsystem string, level Level) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if subsystem == "" {
+		std.level = level
+	} else {
+		std.levels[subsystem] = level
+	}
+}
+
+// Levels returns the default level under the empty key and the levels set
+// per subsystem.
+func Levels() map[string]Level {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	levels := map[string]Level{"": std.level}
+	for subsystem, level := range std.levels {
+		levels[subsystem] = level
+	}
+
+	return levels
+}
+
+type Logger struct {
+	subsystem string
+}
+
+// New returns the logger of a subsystem, e.g. "kvm" or "serial".
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.log(LevelDebug, msg, args)
+}
+
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.log(LevelInfo, msg, args)
+}
+
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.log(LevelWarn, msg, args)
+}
+
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.log(LevelError, msg, args)
+}
+
+// Enabled reports whether messages of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	return level >= l.minLevel()
+}
+
+// minLevel must be called with std.mu held.
+func (l *Logger) minLevel() Level {
+	if level, ok := std.levels[l.subsystem]; ok {
+		return level
+	}
+
+	return std.level
+}
+
+func (l *Logger) log(level Level, msg string, args []interface{}) {
+	now := time.Now()
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+
+	if level < l.minLevel() {
+		return
+	}
+
+	if len(args)%2 != 0 {
+		args = append(args, "!MISSING")
+	}
+
+	var line []byte
+
+	if std.format == FormatJSON {
+		line = l.json(now, level, msg, args)
+	} else {
+		line = l.text(now, level, msg, args)
+	}
+
+	_, _ = std.out.Write(line)
+}
+
+func (l *Logger) text(now time.Time, level Level, msg string, args []interface{}) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %s %s: %s", now.Format(time.RFC3339Nano), strings.ToUpper(level.String()), l.subsystem, msg)
+
+	for i := 0; i < len(args); i += 2 {
+		v := fmt.Sprint(value(args[i+1]))
+		if v == "" || strings.ContainsAny(v, " =\"") {
+			v = fmt.Sprintf("%q", v)
+		}
+
+		fmt.Fprintf(&b, " %v=%s", args[i], v)
+	}
+
+	b.WriteString("\n")
+
+	return []byte(b.String())
+}
+
+func (l *Logger) json(now time.Time, level Level, msg string, args []interface{}) []byte {
+	record := map[string]interface{}{}
+
+	for i := 0; i < len(args); i += 2 {
+		record[fmt.Sprint(args[i])] = value(args[i+1])
+	}
+
+	record["time"] = now.Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	record["subsystem"] = l.subsystem
+	record["msg"] = msg
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		// e.g. a value of an unsupported type such as a channel
+		line, _ = json.Marshal(map[string]string{
+			"time":      now.Format(time.RFC3339Nano),
+			"level":     level.String(),
+			"subsystem": l.subsystem,
+			"msg":       msg,
+			"error":     err.Error(),
+		})
+	}
+
+	return append(line, '\n')
+}
+
+// value makes errors readable; they are usually marshaled as {}.
+func value(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+
+	return v
+}
@@ -0,0 +1,102 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/logging"
+)
+
+// The tests change the global configuration, so they don't run in parallel.
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(os.Stderr)
+	defer logging.SetLevel("", logging.LevelInfo)
+
+	if err := logging.SetFormat(logging.FormatText); err != nil {
+		t.Fatal(err)
+	}
+
+	kvm := logging.New("kvm")
+	serial := logging.New("serial")
+
+	kvm.Debug("hidden")
+	kvm.Info("vcpu halted", "vcpu", 0, "reason", "guest hlt")
+
+	logging.SetLevel("serial", logging.LevelError)
+	serial.Warn("hidden")
+	serial.Error("overrun", "err", errors.New("queue full"))
+
+	logging.SetLevel("", logging.LevelDebug)
+	kvm.Debug("shown")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	for i, want := range []string{
+		` INFO kvm: vcpu halted vcpu=0 reason="guest hlt"`,
+		` ERROR serial: overrun err="queue full"`,
+		` DEBUG kvm: shown`,
+	} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Fatalf("line %d: %q does not end with %q", i, lines[i], want)
+		}
+	}
+
+	levels := logging.Levels()
+	if levels[""] != logging.LevelDebug || levels["serial"] != logging.LevelError {
+		t.Fatalf("unexpected levels: %v", levels)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(os.Stderr)
+
+	if err := logging.SetFormat(logging.FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = logging.SetFormat(logging.FormatText)
+	}()
+
+	logging.New("api").Warn("slow request", "path", "/actions", "ms", 1500)
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record["level"] != "warn" || record["subsystem"] != "api" || record["msg"] != "slow request" ||
+		record["path"] != "/actions" || record["ms"] != 1500.0 || record["time"] == nil {
+		t.Fatalf("unexpected record: %v", record)
+	}
+
+	if err := logging.SetFormat("xml"); !errors.Is(err, logging.ErrorInvalidFormat) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	t.Parallel()
+
+	if l, err := logging.ParseLevel("WARN"); err != nil || l != logging.LevelWarn {
+		t.Fatalf("unexpected level: %v %v", l, err)
+	}
+
+	if _, err := logging.ParseLevel("verbose"); !errors.Is(err, logging.ErrorInvalidLevel) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
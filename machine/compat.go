@@ -0,0 +1,216 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// The compat section of a snapshot or a migration records what the guest
+// depends on: the machine type, the parts of the machine with state and the
+// CPUID of the vCPUs. It is loaded first and checked against the machine
+// before any other state, so that restoring on another version of gokvm or
+// another host fails with the reasons rather than running a broken guest.
+// Snapshots of versions before the section are restored without the checks.
+const sectionCompat = "compat"
+
+var ErrorIncompatibleSnapshot = errors.New("incompatible snapshot")
+
+// compatState is followed by NDevices section names of 16 bytes each.
+type compatState struct {
+	Type     [16]byte
+	CPUID    kvm.CPUID
+	NDevices uint32
+	_        uint32
+}
+
+// cpuFeatures are the CPUID registers with feature flags. The guest may use
+// any flag it was given, so the host must support all of them.
+var cpuFeatures = []struct {
+	function, index uint32
+	reg             string
+}{
+	{1, 0, "ecx"}, {1, 0, "edx"},
+	{7, 0, "ebx"}, {7, 0, "ecx"}, {7, 0, "edx"},
+	{0xd, 0, "eax"}, {0xd, 1, "eax"},
+	{0x80000001, 0, "ecx"}, {0x80000001, 0, "edx"},
+}
+
+// featureNames names the common feature flags in diagnostics, by leaf,
+// register and bit.
+var featureNames = map[string]map[int]string{
+	"0x1.ecx": {
+		0: "sse3", 1: "pclmulqdq", 9: "ssse3", 12: "fma", 13: "cx16", 19: "sse4.1", 20: "sse4.2",
+		21: "x2apic", 22: "movbe", 23: "popcnt", 24: "tsc-deadline", 25: "aes", 26: "xsave", 28: "avx",
+		29: "f16c", 30: "rdrand",
+	},
+	"0x7.ebx":        {0: "fsgsbase", 3: "bmi1", 5: "avx2", 8: "bmi2", 9: "erms", 16: "avx512f", 18: "rdseed", 19: "adx", 29: "sha"},
+	"0x7.ecx":        {1: "avx512vbmi", 8: "gfni", 9: "vaes", 10: "vpclmulqdq"},
+	"0x80000001.ecx": {5: "lzcnt", 6: "sse4a"},
+	"0x80000001.edx": {20: "nx", 26: "pdpe1gb", 27: "rdtscp", 29: "lm"},
+}
+
+// compatDevice checks the compat section on load, and gives the vCPUs the
+// CPUID they had.
+type compatDevice struct {
+	m *Machine
+}
+
+func (d compatDevice) StateVersion() uint32 {
+	return 1
+}
+
+// devices returns the names of the parts of the machine with state.
+func (d compatDevice) devices() []string {
+	names := []string{}
+
+	for _, e := range d.m.states {
+		if e.name != sectionCompat {
+			names = append(names, e.name)
+		}
+	}
+
+	return names
+}
+
+func (d compatDevice) SaveState() ([]byte, error) {
+	names := d.devices()
+	st := compatState{CPUID: d.m.cpuid, NDevices: uint32(len(names))}
+	copy(st.Type[:], d.m.typ.Name)
+
+	buf := bytes.NewBuffer(encode(st))
+
+	for _, name := range names {
+		n := [16]byte{}
+		copy(n[:], name)
+		buf.Write(n[:])
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (d compatDevice) LoadState(version uint32, data []byte) error {
+	st := compatState{}
+	if err := decode(data, &st); err != nil {
+		return err
+	}
+
+	names := make([][16]byte, st.NDevices)
+	if err := decode(data[binary.Size(st):], names); err != nil {
+		return err
+	}
+
+	problems := []string{}
+
+	if typ := string(bytes.TrimRight(st.Type[:], "\x00")); typ != d.m.typ.Name {
+		problems = append(problems, fmt.Sprintf("the guest ran on a %s machine, not %s", typ, d.m.typ.Name))
+	}
+
+	saved := map[string]bool{}
+	for _, n := range names {
+		saved[string(bytes.TrimRight(n[:], "\x00"))] = true
+	}
+
+	for _, name := range d.devices() {
+		if !saved[name] {
+			problems = append(problems, fmt.Sprintf("no state for device %s", name))
+		}
+
+		delete(saved, name)
+	}
+
+	unknown := []string{}
+	for name := range saved {
+		unknown = append(unknown, name)
+	}
+
+	sort.Strings(unknown)
+
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("device %s is unknown to this machine", name))
+	}
+
+	problems = append(problems, checkCPUID(&st.CPUID, &d.m.cpuid)...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrorIncompatibleSnapshot, strings.Join(problems, "; "))
+	}
+
+	// the guest keeps seeing the CPU it was started on
+	for _, fd := range d.m.vcpuFds {
+		if err := kvm.SetCPUID2(fd, &st.CPUID); err != nil {
+			return err
+		}
+	}
+
+	d.m.cpuid = st.CPUID
+
+	return nil
+}
+
+func cpuidEntry(cpuid *kvm.CPUID, function, index uint32) kvm.CPUIDEntry2 {
+	for i := 0; i < int(cpuid.Nent) && i < len(cpuid.Entries); i++ {
+		if e := cpuid.Entries[i]; e.Function == function && e.Index == index {
+			return e
+		}
+	}
+
+	return kvm.CPUIDEntry2{Function: function, Index: index}
+}
+
+func cpuidRegister(e kvm.CPUIDEntry2, reg string) uint32 {
+	return map[string]uint32{"eax": e.Eax, "ebx": e.Ebx, "ecx": e.Ecx, "edx": e.Edx}[reg]
+}
+
+func cpuVendor(cpuid *kvm.CPUID) string {
+	e := cpuidEntry(cpuid, 0, 0)
+
+	return string(encode(e.Ebx, e.Edx, e.Ecx))
+}
+
+// checkCPUID reports the differences between the CPUID a guest was given and
+// what the host supports.
+func checkCPUID(saved, host *kvm.CPUID) []string {
+	problems := []string{}
+
+	if v, h := cpuVendor(saved), cpuVendor(host); v != h {
+		problems = append(problems, fmt.Sprintf("the guest ran on a %s CPU, this host has %s", v, h))
+	}
+
+	for _, f := range cpuFeatures {
+		missing := cpuidRegister(cpuidEntry(saved, f.function, f.index), f.reg) &^
+			cpuidRegister(cpuidEntry(host, f.function, f.index), f.reg)
+		if missing == 0 {
+			continue
+		}
+
+		leaf := fmt.Sprintf("0x%x.%s", f.function, f.reg)
+		if f.index != 0 {
+			leaf = fmt.Sprintf("0x%x.%d.%s", f.function, f.index, f.reg)
+		}
+
+		flags := []string{}
+
+		for missing != 0 {
+			bit := bits.TrailingZeros32(missing)
+			missing &^= 1 << bit
+
+			if name, ok := featureNames[leaf][bit]; ok {
+				flags = append(flags, name)
+			} else {
+				flags = append(flags, fmt.Sprintf("bit %d", bit))
+			}
+		}
+
+		problems = append(problems, fmt.Sprintf("CPU features missing on this host: cpuid %s %s",
+			leaf, strings.Join(flags, ", ")))
+	}
+
+	return problems
+}
@@ -0,0 +1,221 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+var (
+	ErrorInvalidCPU = errors.New("invalid vcpu")
+	ErrorNotMapped  = errors.New("address is not mapped")
+)
+
+const pageSize = 0x1000
+
+// DebugStop is reported when a vCPU stops on a debug exit: a breakpoint
+// instruction, a hardware breakpoint or the end of a single step.
+type DebugStop struct {
+	CPU       int
+	Exception uint32
+	PC        uint64
+
+	// HWBreakpoint is the hardware breakpoint hit, nil for other stops.
+	HWBreakpoint *HWBreakpoint
+}
+
+// The functions below are meant for debuggers. Registers and memory must only
+// be accessed while the machine is paused.
+
+// NumCPUs returns the number of vCPUs.
+func (m *Machine) NumCPUs() int {
+	return len(m.vcpuFds)
+}
+
+// MemSize returns the size of guest memory in bytes.
+func (m *Machine) MemSize() int {
+	return len(m.mem)
+}
+
+func (m *Machine) checkCPU(cpu int) error {
+	if cpu < 0 || cpu >= len(m.vcpuFds) {
+		return fmt.Errorf("%w: %d", ErrorInvalidCPU, cpu)
+	}
+
+	return nil
+}
+
+func (m *Machine) GetRegs(cpu int) (kvm.Regs, error) {
+	if err := m.checkCPU(cpu); err != nil {
+		return kvm.Regs{}, err
+	}
+
+	return kvm.GetRegs(m.vcpuFds[cpu])
+}
+
+func (m *Machine) SetRegs(cpu int, regs kvm.Regs) error {
+	if err := m.checkCPU(cpu); err != nil {
+		return err
+	}
+
+	return kvm.SetRegs(m.vcpuFds[cpu], regs)
+}
+
+func (m *Machine) GetSregs(cpu int) (kvm.Sregs, error) {
+	if err := m.checkCPU(cpu); err != nil {
+		return kvm.Sregs{}, err
+	}
+
+	return kvm.GetSregs(m.vcpuFds[cpu])
+}
+
+func (m *Machine) SetSregs(cpu int, sregs kvm.Sregs) error {
+	if err := m.checkCPU(cpu); err != nil {
+		return err
+	}
+
+	return kvm.SetSregs(m.vcpuFds[cpu], sregs)
+}
+
+// SetGuestDebug sets the debug control flags of a vCPU, a combination of
+// kvm.GuestDebug* or 0 to disable debugging. Debug exits are reported on
+// DebugStops. Hardware breakpoints stay enabled whatever the flags.
+func (m *Machine) SetGuestDebug(cpu int, control uint32) error {
+	if err := m.checkCPU(cpu); err != nil {
+		return err
+	}
+
+	m.debugControls[cpu] = control
+
+	return m.applyGuestDebug(cpu)
+}
+
+func (m *Machine) applyGuestDebug(cpu int) error {
+	dbg := kvm.GuestDebug{Control: m.debugControls[cpu]}
+
+	if len(m.hwBreakpoints) > 0 {
+		dbg.Control |= kvm.GuestDebugEnable | kvm.GuestDebugUseHWBP
+	}
+
+	// a vCPU stepping over a breakpoint steps with it disabled
+	over := m.steppingOver[cpu]
+	if over != nil {
+		dbg.Control |= kvm.GuestDebugEnable | kvm.GuestDebugSingleStep
+	}
+
+	for i, bp := range m.hwBreakpoints {
+		dbg.DebugReg[i] = bp.Addr
+
+		if over == nil || bp != *over {
+			dbg.DebugReg[7] |= bp.dr7(i)
+		}
+	}
+
+	return kvm.SetGuestDebug(m.vcpuFds[cpu], &dbg)
+}
+
+// DebugStops returns the channel on which debug exits are reported. The
+// machine is paused when a vCPU stops, and stays paused until Resume.
+func (m *Machine) DebugStops() <-chan DebugStop {
+	return m.debugStops
+}
+
+// stopForDebug pauses the machine from the vCPU thread which got a debug
+// exit. It can't wait for the other vCPUs like Pause, since the calling vCPU
+// only parks after returning; the debugger calls Pause for that.
+func (m *Machine) stopForDebug(i int) {
+	exception, pc := m.runs[i].Debug()
+	st := DebugStop{CPU: i, Exception: exception, PC: pc}
+
+	if exception == vectorDB {
+		st.HWBreakpoint = m.hitHWBreakpoint(i, m.runs[i].DebugStatus())
+	}
+
+	log.Debug("vcpu stopped for debugging", "vcpu", i, "exception", exception, "pc", pc)
+
+	m.pause.mu.Lock()
+	m.pause.setPaused(true)
+	m.pause.kick()
+	m.pause.mu.Unlock()
+
+	select {
+	case m.debugStops <- st:
+	default:
+	}
+}
+
+// translate returns the physical address of the virtual address addr in the
+// address space of the vCPU.
+func (m *Machine) translate(cpu int, addr uint64) (uint64, error) {
+	t := kvm.Translation{LinearAddress: addr}
+	if err := kvm.Translate(m.vcpuFds[cpu], &t); err != nil {
+		return 0, err
+	}
+
+	if t.Valid == 0 || t.PhysicalAddress >= uint64(len(m.mem)) {
+		return 0, fmt.Errorf("%w: 0x%x", ErrorNotMapped, addr)
+	}
+
+	return t.PhysicalAddress, nil
+}
+
+// accessVirtual calls f for each page-contiguous part of the virtual range
+// [addr, addr+n) with the guest memory backing it.
+func (m *Machine) accessVirtual(cpu int, addr uint64, n int, f func(mem []byte, phys uint64, off int)) error {
+	if err := m.checkCPU(cpu); err != nil {
+		return err
+	}
+
+	if err := m.checkMemory(); err != nil {
+		return err
+	}
+
+	for off := 0; off < n; {
+		phys, err := m.translate(cpu, addr+uint64(off))
+		if err != nil {
+			return err
+		}
+
+		size := int(pageSize - (addr+uint64(off))%pageSize)
+		if size > n-off {
+			size = n - off
+		}
+
+		if phys+uint64(size) > uint64(len(m.mem)) {
+			return fmt.Errorf("%w: 0x%x", ErrorNotMapped, addr+uint64(off))
+		}
+
+		f(m.mem[phys:phys+uint64(size)], phys, off)
+		off += size
+	}
+
+	return nil
+}
+
+// ReadPhysical reads guest memory at the physical address addr.
+func (m *Machine) ReadPhysical(addr uint64, data []byte) error {
+	b, err := m.SlicePhysical(addr, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	copy(data, b)
+
+	return nil
+}
+
+// ReadVirtual reads guest memory at the virtual address addr of the vCPU.
+func (m *Machine) ReadVirtual(cpu int, addr uint64, data []byte) error {
+	return m.accessVirtual(cpu, addr, len(data), func(mem []byte, phys uint64, off int) {
+		copy(data[off:], mem)
+	})
+}
+
+// WriteVirtual writes guest memory at the virtual address addr of the vCPU.
+func (m *Machine) WriteVirtual(cpu int, addr uint64, data []byte) error {
+	return m.accessVirtual(cpu, addr, len(data), func(mem []byte, phys uint64, off int) {
+		copy(mem, data[off:])
+		m.markWritten(phys, uint64(len(mem)))
+	})
+}
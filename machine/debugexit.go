@@ -0,0 +1,65 @@
+package machine
+
+import (
+	"sync/atomic"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// DebugExitAddr is the I/O port of the debug exit device, at the same address
+// as the default of QEMU's isa-debug-exit.
+//
+// A write of value to the port stops the machine with the exit status
+// (value << 1) | 1, so a guest can report success or failure to the host,
+// e.g. when gokvm runs kernel or unikernel tests in CI. The status is always
+// odd so that it can't be mistaken for a plain successful exit.
+//
+// refs: https://github.com/qemu/qemu/blob/master/hw/misc/debugexit.c
+const (
+	DebugExitAddr = 0x501
+	debugExitSize = 2
+
+	// DebugExitTestAddr is the port kvm-unit-tests write their exit status
+	// to, with 4-byte writes.
+	DebugExitTestAddr = 0xf4
+)
+
+// EnableDebugExit adds the debug exit device to the machine at
+// DebugExitAddr.
+func (m *Machine) EnableDebugExit() {
+	m.EnableDebugExitAt(DebugExitAddr)
+}
+
+// EnableDebugExitAt adds the debug exit device to the machine at port.
+func (m *Machine) EnableDebugExitAt(port int) {
+	m.debugExit = true
+	m.debugExitPort = port
+	m.initDebugExit()
+}
+
+func (m *Machine) initDebugExit() {
+	for port := m.debugExitPort; port < m.debugExitPort+debugExitSize; port++ {
+		m.ioportHandlers[port][kvm.EXITIOIN] = func(m *Machine, port uint64, bytes []byte) error {
+			return nil
+		}
+		m.ioportHandlers[port][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
+			var v uint32
+
+			for i := len(bytes) - 1; i >= 0; i-- {
+				v = v<<8 | uint32(bytes[i])
+			}
+
+			atomic.StoreInt32(&m.exitCode, int32(v<<1|1))
+
+			return nil
+		}
+	}
+}
+
+// ExitCode returns the exit status requested by the guest through the debug
+// exit device, and whether it was requested at all.
+func (m *Machine) ExitCode() (int, bool) {
+	code := atomic.LoadInt32(&m.exitCode)
+
+	return int(code), code >= 0
+}
@@ -0,0 +1,245 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// The crash dump is an ELF core file in the layout of QEMU's
+// dump-guest-memory, which crash(8) and drgn read: a PT_NOTE segment holding
+// an NT_PRSTATUS note and a QEMU CPU state note for every vCPU, followed by a
+// PT_LOAD segment of the guest physical memory.
+//
+// refs: https://github.com/qemu/qemu/blob/master/target/i386/arch_dump.c
+const (
+	elfHeaderSize  = 64
+	progHeaderSize = 56
+
+	etCore   = 4
+	emX86_64 = 62
+	ptLoad   = 1
+	ptNote   = 4
+	pfRWX    = 7
+
+	ntPRStatus = 1
+	// The type of a QEMU note is unused; QEMU sets it to 0.
+	ntQEMU = 0
+
+	prStatusSize = 336
+	// offset of pr_reg in struct elf_prstatus
+	prRegOffset = 112
+
+	qemuCPUStateVersion = 1
+)
+
+// qemuCPUSegment and qemuCPUState mirror the structures of QEMU's note.
+type qemuCPUSegment struct {
+	Selector uint32
+	Limit    uint32
+	Flags    uint32
+	_        uint32
+	Base     uint64
+}
+
+type qemuCPUState struct {
+	Version uint32
+	Size    uint32
+	RAX     uint64
+	RBX     uint64
+	RCX     uint64
+	RDX     uint64
+	RSI     uint64
+	RDI     uint64
+	RSP     uint64
+	RBP     uint64
+	R8      uint64
+	R9      uint64
+	R10     uint64
+	R11     uint64
+	R12     uint64
+	R13     uint64
+	R14     uint64
+	R15     uint64
+	RIP     uint64
+	RFLAGS  uint64
+	CS      qemuCPUSegment
+	DS      qemuCPUSegment
+	ES      qemuCPUSegment
+	FS      qemuCPUSegment
+	GS      qemuCPUSegment
+	SS      qemuCPUSegment
+	LDT     qemuCPUSegment
+	TR      qemuCPUSegment
+	GDT     qemuCPUSegment
+	IDT     qemuCPUSegment
+	CR      [5]uint64
+	// KernelGSBase is left 0 as gokvm doesn't read MSRs.
+	KernelGSBase uint64
+}
+
+// segmentFlags packs the attributes of a segment like the access rights
+// byte and flags nibble of a descriptor, shifted as in QEMU's SegmentCache.
+func segmentFlags(s kvm.Segment) uint32 {
+	return uint32(s.Typ)<<8 | uint32(s.S)<<12 | uint32(s.DPL)<<13 | uint32(s.Present)<<15 |
+		uint32(s.AVL)<<20 | uint32(s.L)<<21 | uint32(s.DB)<<22 | uint32(s.G)<<23
+}
+
+func qemuSegment(s kvm.Segment) qemuCPUSegment {
+	return qemuCPUSegment{
+		Selector: uint32(s.Selector),
+		Limit:    s.Limit,
+		Flags:    segmentFlags(s),
+		Base:     s.Base,
+	}
+}
+
+func newQEMUCPUState(regs kvm.Regs, sregs kvm.Sregs) qemuCPUState {
+	st := qemuCPUState{
+		Version: qemuCPUStateVersion,
+		RAX:     regs.RAX, RBX: regs.RBX, RCX: regs.RCX, RDX: regs.RDX,
+		RSI: regs.RSI, RDI: regs.RDI, RSP: regs.RSP, RBP: regs.RBP,
+		R8: regs.R8, R9: regs.R9, R10: regs.R10, R11: regs.R11,
+		R12: regs.R12, R13: regs.R13, R14: regs.R14, R15: regs.R15,
+		RIP: regs.RIP, RFLAGS: regs.RFLAGS,
+		CS: qemuSegment(sregs.CS), DS: qemuSegment(sregs.DS),
+		ES: qemuSegment(sregs.ES), FS: qemuSegment(sregs.FS),
+		GS: qemuSegment(sregs.GS), SS: qemuSegment(sregs.SS),
+		LDT: qemuSegment(sregs.LDT), TR: qemuSegment(sregs.TR),
+		GDT: qemuCPUSegment{Limit: uint32(sregs.GDT.Limit), Base: sregs.GDT.Base},
+		IDT: qemuCPUSegment{Limit: uint32(sregs.IDT.Limit), Base: sregs.IDT.Base},
+		CR:  [5]uint64{sregs.CR0, 0, sregs.CR2, sregs.CR3, sregs.CR4},
+	}
+
+	st.Size = uint32(binary.Size(st))
+
+	return st
+}
+
+// prStatus builds struct elf_prstatus of x86_64, of which only pr_pid and
+// pr_reg are filled.
+func prStatus(cpu int, regs kvm.Regs, sregs kvm.Sregs) []byte {
+	b := make([]byte, prStatusSize)
+
+	// pr_pid
+	binary.LittleEndian.PutUint32(b[32:], uint32(cpu+1))
+
+	// struct user_regs_struct
+	for i, v := range []uint64{
+		regs.R15, regs.R14, regs.R13, regs.R12, regs.RBP, regs.RBX,
+		regs.R11, regs.R10, regs.R9, regs.R8, regs.RAX, regs.RCX,
+		regs.RDX, regs.RSI, regs.RDI,
+		regs.RAX, // orig_rax
+		regs.RIP, uint64(sregs.CS.Selector), regs.RFLAGS, regs.RSP,
+		uint64(sregs.SS.Selector), sregs.FS.Base, sregs.GS.Base,
+		uint64(sregs.DS.Selector), uint64(sregs.ES.Selector),
+		uint64(sregs.FS.Selector), uint64(sregs.GS.Selector),
+	} {
+		binary.LittleEndian.PutUint64(b[prRegOffset+8*i:], v)
+	}
+
+	return b
+}
+
+// appendNote appends an ELF note with its name and descriptor padded to
+// 4 bytes.
+func appendNote(buf *bytes.Buffer, name string, typ uint32, desc []byte) {
+	pad := func(n int) int { return (n + 3) &^ 3 }
+
+	namesz := len(name) + 1
+
+	_ = binary.Write(buf, binary.LittleEndian, []uint32{uint32(namesz), uint32(len(desc)), typ})
+	buf.WriteString(name)
+	buf.Write(make([]byte, pad(namesz)-len(name)))
+	buf.Write(desc)
+	buf.Write(make([]byte, pad(len(desc))-len(desc)))
+}
+
+// WriteCoreDump writes guest memory and vCPU registers as an ELF core file.
+// The machine is paused while the dump is written, and resumed afterwards
+// unless it was already paused.
+func (m *Machine) WriteCoreDump(w io.Writer) error {
+	if err := m.checkMemory(); err != nil {
+		return err
+	}
+
+	wasPaused := m.IsPaused()
+
+	if err := m.Pause(); err != nil {
+		return err
+	}
+
+	if !wasPaused {
+		defer func() {
+			_ = m.Resume()
+		}()
+	}
+
+	notes := &bytes.Buffer{}
+
+	for cpu := range m.vcpuFds {
+		regs, err := m.GetRegs(cpu)
+		if err != nil {
+			return err
+		}
+
+		sregs, err := m.GetSregs(cpu)
+		if err != nil {
+			return err
+		}
+
+		appendNote(notes, "CORE", ntPRStatus, prStatus(cpu, regs, sregs))
+
+		st := &bytes.Buffer{}
+		_ = binary.Write(st, binary.LittleEndian, newQEMUCPUState(regs, sregs))
+		appendNote(notes, "QEMU", ntQEMU, st.Bytes())
+	}
+
+	const nProgs = 2
+
+	notesOffset := uint64(elfHeaderSize + nProgs*progHeaderSize)
+	memOffset := (notesOffset + uint64(notes.Len()) + pageSize - 1) &^ (pageSize - 1)
+
+	buf := &bytes.Buffer{}
+
+	// ELF header
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', 2 /* 64-bit */, 1 /* LE */, 1 /* version */})
+	buf.Write(make([]byte, 9))
+	_ = binary.Write(buf, binary.LittleEndian, struct {
+		Type, Machine                                        uint16
+		Version                                              uint32
+		Entry, Phoff, Shoff                                  uint64
+		Flags                                                uint32
+		Ehsize, Phentsize, Phnum, Shentsize, Shnum, Shstrndx uint16
+	}{
+		Type: etCore, Machine: emX86_64, Version: 1,
+		Phoff:  elfHeaderSize,
+		Ehsize: elfHeaderSize, Phentsize: progHeaderSize, Phnum: nProgs,
+	})
+
+	type progHeader struct {
+		Type, Flags                                uint32
+		Offset, Vaddr, Paddr, Filesz, Memsz, Align uint64
+	}
+
+	_ = binary.Write(buf, binary.LittleEndian, []progHeader{
+		{Type: ptNote, Offset: notesOffset, Filesz: uint64(notes.Len()), Memsz: uint64(notes.Len())},
+		{
+			Type: ptLoad, Flags: pfRWX, Offset: memOffset,
+			Filesz: uint64(len(m.mem)), Memsz: uint64(len(m.mem)),
+		},
+	})
+
+	buf.Write(notes.Bytes())
+	buf.Write(make([]byte, int(memOffset)-buf.Len()))
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	_, err := w.Write(m.mem)
+
+	return err
+}
@@ -0,0 +1,84 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/fdt"
+)
+
+// fdtMaxSize is the room for the setup_data entry of the device tree, enough
+// for the nodes of MaxVCPUs.
+const fdtMaxSize = 0x10000
+
+var ErrorDeviceTreeTooLarge = errors.New("device tree too large")
+
+// EnableDeviceTree passes the kernel a device tree of the memory, the vCPUs
+// and the command line, in a setup_data entry of the boot parameters. Linux
+// only reads it if it is built with CONFIG_OF, e.g. to find devices without
+// ACPI on a microvm machine. It must be called before LoadLinux.
+func (m *Machine) EnableDeviceTree() {
+	m.deviceTree = true
+}
+
+// DeviceTree returns the device tree of the machine booting with params and
+// an initrd of initrdSize bytes.
+func (m *Machine) DeviceTree(params string, initrdSize int) *fdt.Node {
+	root := fdt.NewNode("")
+	root.SetString("compatible", "gokvm,"+m.typ.Name)
+	root.SetU32("#address-cells", 2)
+	root.SetU32("#size-cells", 2)
+
+	chosen := root.Child("chosen")
+	chosen.SetString("bootargs", params)
+
+	if initrdSize > 0 {
+		chosen.SetU64("linux,initrd-start", initrdAddr)
+		chosen.SetU64("linux,initrd-end", initrdAddr+uint64(initrdSize))
+	}
+
+	// the RAM of the E820 map
+	mem := root.Child("memory@0")
+	mem.SetString("device_type", "memory")
+	mem.SetU64("reg",
+		bootparam.RealModeIvtBegin, bootparam.EBDAStart-bootparam.RealModeIvtBegin,
+		kernelAddr, uint64(len(m.mem)-kernelAddr))
+
+	cpus := root.Child("cpus")
+	cpus.SetU32("#address-cells", 1)
+	cpus.SetU32("#size-cells", 0)
+
+	for i := range m.vcpuFds {
+		cpu := cpus.Child(fmt.Sprintf("cpu@%d", i))
+		cpu.SetString("device_type", "cpu")
+		cpu.SetU32("reg", uint32(i))
+	}
+
+	return root
+}
+
+// loadDeviceTree places the device tree at fdtAddr and links it into the
+// setup_data list of bootParam.
+func (m *Machine) loadDeviceTree(bootParam *bootparam.BootParam, params string, initrdSize int) error {
+	if bootParam.Hdr.Version < bootparam.ProtocolSetupData {
+		return fmt.Errorf("%w: 0x%x, setup_data needs 0x%x",
+			bootparam.ErrorOldProtocolVersion, bootParam.Hdr.Version, bootparam.ProtocolSetupData)
+	}
+
+	blob := m.DeviceTree(params, initrdSize).Bytes()
+	hdr := bootparam.SetupData{Next: bootParam.Hdr.SetupData, Type: bootparam.SetupDTB, Len: uint32(len(blob))}
+
+	data := append(hdr.Bytes(), blob...)
+	if len(data) > fdtMaxSize {
+		return fmt.Errorf("%w: %d bytes", ErrorDeviceTreeTooLarge, len(data))
+	}
+
+	if err := m.load(fdtAddr, data); err != nil {
+		return err
+	}
+
+	bootParam.Hdr.SetupData = fdtAddr
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package machine
+
+import "fmt"
+
+// SlicePhysical returns the n bytes of guest memory at the physical address
+// addr without copying them, for devices reading buffers in place. The slice
+// is only valid until the machine is restored or receives a migration, which
+// replace guest memory.
+func (m *Machine) SlicePhysical(addr, n uint64) ([]byte, error) {
+	if err := m.checkMemory(); err != nil {
+		return nil, err
+	}
+
+	return m.slice(addr, n)
+}
+
+// SlicePhysicalForWrite is SlicePhysical for devices writing in place. The
+// range is counted as written by incremental snapshots, which don't see
+// writes of gokvm in the dirty log of KVM.
+func (m *Machine) SlicePhysicalForWrite(addr, n uint64) ([]byte, error) {
+	b, err := m.SlicePhysical(addr, n)
+	if err != nil {
+		return nil, err
+	}
+
+	m.markWritten(addr, n)
+
+	return b, nil
+}
+
+// slice returns guest memory at addr, capped so that appending to it can't
+// overwrite the memory after it. addr+n is checked without overflowing.
+func (m *Machine) slice(addr, n uint64) ([]byte, error) {
+	size := uint64(len(m.mem))
+	if addr >= size || n > size-addr {
+		return nil, fmt.Errorf("%w: 0x%x-0x%x", ErrorNotMapped, addr, addr+n)
+	}
+
+	return m.mem[addr : addr+n : addr+n], nil
+}
+
+// load copies data to guest memory at addr.
+func (m *Machine) load(addr uint64, data []byte) error {
+	b, err := m.slice(addr, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	copy(b, data)
+
+	return nil
+}
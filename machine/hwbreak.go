@@ -0,0 +1,206 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// MaxHWBreakpoints is the number of debug address registers, DR0 to DR3.
+const MaxHWBreakpoints = 4
+
+// The kinds of hardware breakpoints, the values of the R/W fields of DR7.
+// x86 has no breakpoint on reads only.
+const (
+	HWBreakExec   = 0
+	HWBreakWrite  = 1
+	HWBreakAccess = 3
+)
+
+const (
+	// vectorDB is the debug exception, raised by hardware breakpoints and
+	// single steps.
+	vectorDB = 1
+
+	// dr7Global enables a breakpoint in every task.
+	dr7Global = 2
+
+	// stepTimeout bounds Step for vCPUs which don't run, e.g. halted.
+	stepTimeout = time.Second
+)
+
+// dr7Len are the LEN fields of DR7 by length.
+var dr7Len = map[int]uint64{1: 0, 2: 1, 4: 3, 8: 2}
+
+var (
+	ErrorInvalidHWBreakpoint = errors.New("invalid hardware breakpoint")
+	ErrorNoHWBreakpoint      = errors.New("all hardware breakpoints are in use")
+	ErrorUnknownHWBreakpoint = errors.New("unknown hardware breakpoint")
+	ErrorStepTimeout         = errors.New("vcpu did not step")
+)
+
+// HWBreakpoint stops the machine when a vCPU executes the instruction at the
+// virtual address Addr, or, for watchpoints, writes or accesses any of the
+// Len bytes there. Len is 1 for HWBreakExec, and 1, 2, 4 or 8 for watchpoints,
+// which must be aligned to it. Debug registers match virtual addresses, so
+// guest physical memory is watched through a mapping of it.
+type HWBreakpoint struct {
+	Addr uint64
+	Kind int
+	Len  int
+}
+
+func (bp HWBreakpoint) check() error {
+	_, ok := dr7Len[bp.Len]
+
+	switch {
+	case bp.Kind == HWBreakExec && bp.Len == 1:
+	case (bp.Kind == HWBreakWrite || bp.Kind == HWBreakAccess) && ok && bp.Addr%uint64(bp.Len) == 0:
+	default:
+		return fmt.Errorf("%w: kind %d of %d bytes at 0x%x", ErrorInvalidHWBreakpoint, bp.Kind, bp.Len, bp.Addr)
+	}
+
+	return nil
+}
+
+// dr7 returns the bits of DR7 enabling the breakpoint in the debug register
+// n.
+func (bp HWBreakpoint) dr7(n int) uint64 {
+	return dr7Global<<(2*n) | uint64(bp.Kind)<<(16+4*n) | dr7Len[bp.Len]<<(18+4*n)
+}
+
+// HWBreakpoints returns the hardware breakpoints, by debug register.
+func (m *Machine) HWBreakpoints() []HWBreakpoint {
+	return append([]HWBreakpoint{}, m.hwBreakpoints...)
+}
+
+// AddHWBreakpoint sets a hardware breakpoint on all vCPUs, which stop on it
+// as on any debug exit. Adding a breakpoint twice does nothing. The machine
+// should be paused.
+func (m *Machine) AddHWBreakpoint(bp HWBreakpoint) error {
+	if err := bp.check(); err != nil {
+		return err
+	}
+
+	for _, b := range m.hwBreakpoints {
+		if b == bp {
+			return nil
+		}
+	}
+
+	if len(m.hwBreakpoints) == MaxHWBreakpoints {
+		return fmt.Errorf("%w: %d", ErrorNoHWBreakpoint, MaxHWBreakpoints)
+	}
+
+	m.hwBreakpoints = append(m.hwBreakpoints, bp)
+
+	return m.applyHWBreakpoints()
+}
+
+// RemoveHWBreakpoint removes a hardware breakpoint from all vCPUs.
+func (m *Machine) RemoveHWBreakpoint(bp HWBreakpoint) error {
+	for i, b := range m.hwBreakpoints {
+		if b == bp {
+			m.hwBreakpoints = append(m.hwBreakpoints[:i], m.hwBreakpoints[i+1:]...)
+
+			return m.applyHWBreakpoints()
+		}
+	}
+
+	return fmt.Errorf("%w: kind %d at 0x%x", ErrorUnknownHWBreakpoint, bp.Kind, bp.Addr)
+}
+
+func (m *Machine) applyHWBreakpoints() error {
+	for cpu := range m.vcpuFds {
+		if err := m.applyGuestDebug(cpu); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hitHWBreakpoint returns the hardware breakpoint of the status dr6 of a
+// debug exit of the vCPU i, from its thread. When it resumes, the vCPU steps
+// over an instruction breakpoint with the breakpoint disabled rather than
+// stopping on it again.
+func (m *Machine) hitHWBreakpoint(i int, dr6 uint64) *HWBreakpoint {
+	for n, bp := range m.hwBreakpoints {
+		if dr6&(1<<n) == 0 {
+			continue
+		}
+
+		hit := bp
+
+		if bp.Kind == HWBreakExec {
+			m.steppingOver[i] = &hit
+			_ = m.applyGuestDebug(i)
+		}
+
+		return &hit
+	}
+
+	return nil
+}
+
+// steppedOver ends the step over a breakpoint of the vCPU i, and returns
+// whether its debug exit is for the step only, which no one asked for.
+func (m *Machine) steppedOver(i int) bool {
+	if m.steppingOver[i] == nil {
+		return false
+	}
+
+	m.steppingOver[i] = nil
+	_ = m.applyGuestDebug(i)
+
+	return m.debugControls[i]&kvm.GuestDebugSingleStep == 0 && m.runs[i].DebugStatus()&0xf == 0
+}
+
+// Step single-steps the vCPU cpu of the paused machine, and returns its stop.
+// The other vCPUs run until the step pauses the machine again. It must not
+// be used while a debugger waits on DebugStops.
+func (m *Machine) Step(cpu int) (DebugStop, error) {
+	if err := m.checkCPU(cpu); err != nil {
+		return DebugStop{}, err
+	}
+
+	if err := m.Pause(); err != nil {
+		return DebugStop{}, err
+	}
+
+	for len(m.debugStops) > 0 {
+		<-m.debugStops
+	}
+
+	control := m.debugControls[cpu]
+	if err := m.SetGuestDebug(cpu, control|kvm.GuestDebugEnable|kvm.GuestDebugSingleStep); err != nil {
+		return DebugStop{}, err
+	}
+
+	if err := m.Resume(); err != nil {
+		return DebugStop{}, err
+	}
+
+	var (
+		st  DebugStop
+		err error
+	)
+
+	select {
+	case st = <-m.debugStops:
+	case <-time.After(stepTimeout):
+		err = fmt.Errorf("%w: %d", ErrorStepTimeout, cpu)
+	}
+
+	if perr := m.Pause(); perr != nil {
+		return DebugStop{}, perr
+	}
+
+	if serr := m.SetGuestDebug(cpu, control); serr != nil {
+		return DebugStop{}, serr
+	}
+
+	return st, err
+}
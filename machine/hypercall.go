@@ -0,0 +1,68 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// kvmENOSYS is returned to the guest, negated, for hypercalls without a
+// handler, as KVM does for those it doesn't know.
+const kvmENOSYS = 1000
+
+var ErrorHypercallUnsupported = errors.New("hypercall is not forwarded by the host")
+
+// HypercallHandler handles a hypercall of the vCPU vcpu with the arguments in
+// RBX, RCX, RDX, RSI, RDI and R8 (EBX to EDI outside long mode), and returns
+// the value of RAX for the guest. An error stops the vCPU.
+type HypercallHandler func(m *Machine, vcpu int, args [6]uint64) (uint64, error)
+
+// RegisterHypercall makes KVM exit on the hypercall nr of the guest and calls
+// h for it, instead of KVM handling it. KVM only forwards the hypercalls of
+// KVM_CAP_EXIT_HYPERCALL, KVM_HC_MAP_GPA_RANGE as of Linux 6.0, and
+// ErrorHypercallUnsupported is returned for the others. Handlers must be
+// registered before the vCPUs run.
+func (m *Machine) RegisterHypercall(nr uint64, h HypercallHandler) error {
+	supported, err := kvm.CheckExtension(m.vmFd, kvm.CapExitHypercall)
+	if err != nil || nr >= 64 || uint64(supported)&(1<<nr) == 0 {
+		return fmt.Errorf("%w: %d", ErrorHypercallUnsupported, nr)
+	}
+
+	mask := uint64(1) << nr
+	for n := range m.hypercalls {
+		mask |= 1 << n
+	}
+
+	if err := kvm.EnableCap(m.vmFd, kvm.CapExitHypercall, mask); err != nil {
+		return err
+	}
+
+	if m.hypercalls == nil {
+		m.hypercalls = map[uint64]HypercallHandler{}
+	}
+
+	m.hypercalls[nr] = h
+
+	return nil
+}
+
+func (m *Machine) handleHypercall(i int) (bool, error) {
+	nr, args := m.runs[i].Hypercall()
+
+	h, ok := m.hypercalls[nr]
+	if !ok {
+		m.runs[i].SetHypercallRet(^uint64(kvmENOSYS - 1))
+
+		return true, nil
+	}
+
+	ret, err := h(m, i, args)
+	if err != nil {
+		return false, fmt.Errorf("hypercall %d: %w", nr, err)
+	}
+
+	m.runs[i].SetHypercallRet(ret)
+
+	return true, nil
+}
@@ -0,0 +1,349 @@
+package machine
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// An incremental snapshot only holds the pages written since the snapshot it
+// was taken against, its parent, which may be incremental itself. Its header
+// has its own magic, the sections identify the parent, and guest memory is
+// replaced by a bitmap of the pages it holds, followed by these pages.
+//
+//	snapshotHeader
+//	sectionHeader, data
+//	...
+//	padding to MemOffset
+//	bitmap, padding to a page
+//	pages
+//
+// Every snapshot has an id section, which the parent section of its children
+// refers to. Once a snapshot has been taken or restored, KVM logs the pages
+// the guest writes to the memory slot; the pages gokvm writes itself, which
+// KVM doesn't see, are recorded along.
+const (
+	deltaMagic = "GOKVMDLT"
+
+	sectionID     = "id"
+	sectionParent = "parent"
+
+	// maxDeltaChain bounds the incremental snapshots restored on top of a
+	// full snapshot.
+	maxDeltaChain = 256
+)
+
+var ErrorNoBaseSnapshot = errors.New("no snapshot to take an incremental snapshot against")
+
+// parentHeader is followed by NPath bytes of the path of the parent, which
+// is relative to the directory of the child unless absolute.
+type parentHeader struct {
+	ID    [16]byte
+	NPath uint32
+	_     uint32
+}
+
+// snapshotBase is the latest snapshot taken or restored, which the next
+// incremental snapshot is taken against.
+type snapshotBase struct {
+	mu    sync.Mutex
+	id    [16]byte
+	valid bool
+
+	// written are the pages written by gokvm since.
+	written []uint64
+}
+
+func newSnapshotID() ([16]byte, error) {
+	id := [16]byte{}
+	_, err := rand.Read(id[:])
+
+	return id, err
+}
+
+// trackFrom makes the snapshot id the base of the next incremental snapshot
+// and starts logging the pages written from now on. The machine must be
+// paused.
+func (m *Machine) trackFrom(id [16]byte) error {
+	if err := m.setDirtyLogging(true); err != nil {
+		return err
+	}
+
+	// reading the log clears it
+	bitmap := make([]uint64, (len(m.mem)/pageSize+63)/64)
+	if err := kvm.GetDirtyLog(m.vmFd, m.ramSlot, bitmap); err != nil {
+		return err
+	}
+
+	m.base.mu.Lock()
+	m.base.id = id
+	m.base.valid = true
+	m.base.written = make([]uint64, len(bitmap))
+	m.base.mu.Unlock()
+
+	return nil
+}
+
+// untrack drops the base of incremental snapshots, for users of the dirty
+// log other than snapshots.
+func (m *Machine) untrack() {
+	m.base.mu.Lock()
+	m.base.valid = false
+	m.base.mu.Unlock()
+}
+
+// markWritten records that gokvm wrote the guest memory [addr, addr+n).
+func (m *Machine) markWritten(addr, n uint64) {
+	m.base.mu.Lock()
+	defer m.base.mu.Unlock()
+
+	if !m.base.valid || n == 0 {
+		return
+	}
+
+	for page := addr / pageSize; page <= (addr+n-1)/pageSize; page++ {
+		m.base.written[page/64] |= 1 << (page % 64)
+	}
+}
+
+// SnapshotIncremental writes the pages written since the latest snapshot
+// taken or restored, and the state of the vCPUs and the devices to w, like
+// Snapshot. parent is the path of that snapshot, relative to the directory of
+// the new one unless absolute; the new snapshot can only be restored along
+// with it. The new snapshot becomes the base of the next one.
+func (m *Machine) SnapshotIncremental(w io.Writer, parent string) error {
+	if err := m.checkMemory(); err != nil {
+		return err
+	}
+
+	wasPaused := m.IsPaused()
+
+	if err := m.Pause(); err != nil {
+		return err
+	}
+
+	if !wasPaused {
+		defer func() {
+			_ = m.Resume()
+		}()
+	}
+
+	m.base.mu.Lock()
+	defer m.base.mu.Unlock()
+
+	if !m.base.valid {
+		return ErrorNoBaseSnapshot
+	}
+
+	bitmap := make([]uint64, len(m.base.written))
+	if err := kvm.GetDirtyLog(m.vmFd, m.ramSlot, bitmap); err != nil {
+		return err
+	}
+
+	for i := range bitmap {
+		bitmap[i] |= m.base.written[i]
+	}
+
+	if err := m.writeDelta(w, parent, bitmap); err != nil {
+		// the pages are in the next one instead
+		copy(m.base.written, bitmap)
+
+		return err
+	}
+
+	return nil
+}
+
+func (m *Machine) writeDelta(w io.Writer, parent string, bitmap []uint64) error {
+	sections, err := m.saveState()
+	if err != nil {
+		return err
+	}
+
+	id, err := newSnapshotID()
+	if err != nil {
+		return err
+	}
+
+	sections = append(sections,
+		section{sectionID, 1, id[:]},
+		section{sectionParent, 1, encode(parentHeader{ID: m.base.id, NPath: uint32(len(parent))}, []byte(parent))})
+
+	if err := writeHeader(w, deltaMagic, sections, uint64(len(m.mem))); err != nil {
+		return err
+	}
+
+	raw := encode(bitmap)
+	raw = append(raw, make([]byte, pageAlign(uint64(len(raw)))-uint64(len(raw)))...)
+
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+
+	nPages := uint64(len(m.mem) / pageSize)
+
+	err = forEachRun(bitmap, nPages, func(page, n uint64) error {
+		_, err := w.Write(m.mem[page*pageSize : (page+n)*pageSize])
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m.base.id = id
+	m.base.written = make([]uint64, len(bitmap))
+
+	return nil
+}
+
+// forEachRun calls f for each run of consecutive pages set in bitmap.
+func forEachRun(bitmap []uint64, nPages uint64, f func(page, n uint64) error) error {
+	for page := uint64(0); page < nPages; {
+		if bitmap[page/64]&(1<<(page%64)) == 0 {
+			page++
+
+			continue
+		}
+
+		n := uint64(1)
+		for page+n < nPages && bitmap[(page+n)/64]&(1<<((page+n)%64)) != 0 {
+			n++
+		}
+
+		if err := f(page, n); err != nil {
+			return err
+		}
+
+		page += n
+	}
+
+	return nil
+}
+
+func pageAlign(n uint64) uint64 {
+	return (n + pageSize - 1) &^ (pageSize - 1)
+}
+
+// parent returns the id and the path of the parent of an incremental
+// snapshot read from path.
+func (s *snapshot) parent(path string) ([16]byte, string, error) {
+	data := s.sections[sectionParent].data
+	h := parentHeader{}
+
+	if err := decode(data, &h); err != nil {
+		return h.ID, "", err
+	}
+
+	if uint64(len(data)) < uint64(len(encode(h)))+uint64(h.NPath) {
+		return h.ID, "", fmt.Errorf("%w: truncated parent section", ErrorInvalidSnapshot)
+	}
+
+	parent := string(data[len(encode(h)) : len(encode(h))+int(h.NPath)])
+	if !filepath.IsAbs(parent) {
+		parent = filepath.Join(filepath.Dir(path), parent)
+	}
+
+	return h.ID, parent, nil
+}
+
+// id returns the id of a snapshot, if it has one.
+func (s *snapshot) id() ([16]byte, bool) {
+	id := [16]byte{}
+	data := s.sections[sectionID].data
+
+	if len(data) != len(id) {
+		return id, false
+	}
+
+	copy(id[:], data)
+
+	return id, true
+}
+
+// loadMemory reads the guest memory of the snapshot s read from f, after the
+// memory of its parents for an incremental snapshot.
+func (m *Machine) loadMemory(f *os.File, s *snapshot, lazy bool, depth int) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !s.delta {
+		if uint64(fi.Size()) < s.header.MemOffset+s.header.MemSize {
+			return fmt.Errorf("%w: truncated guest memory", ErrorInvalidSnapshot)
+		}
+
+		if lazy {
+			return m.mapMemory(f, int64(s.header.MemOffset))
+		}
+
+		_, err := f.ReadAt(m.mem, int64(s.header.MemOffset))
+
+		return err
+	}
+
+	if depth >= maxDeltaChain {
+		return fmt.Errorf("%w: more than %d incremental snapshots", ErrorInvalidSnapshot, maxDeltaChain)
+	}
+
+	id, path, err := s.parent(f.Name())
+	if err != nil {
+		return err
+	}
+
+	pf, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer pf.Close()
+
+	ps, err := readSnapshot(pf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if pid, ok := ps.id(); !ok || pid != id || ps.header.MemSize != s.header.MemSize {
+		return fmt.Errorf("%w: %s is not the parent of %s", ErrorInvalidSnapshot, path, f.Name())
+	}
+
+	if err := m.loadMemory(pf, ps, lazy, depth+1); err != nil {
+		return err
+	}
+
+	return m.applyDelta(f, s)
+}
+
+// applyDelta reads the pages of an incremental snapshot into guest memory.
+func (m *Machine) applyDelta(f *os.File, s *snapshot) error {
+	nPages := uint64(len(m.mem) / pageSize)
+	bitmap := make([]uint64, (nPages+63)/64)
+	raw := make([]byte, len(bitmap)*8)
+
+	if _, err := f.ReadAt(raw, int64(s.header.MemOffset)); err != nil {
+		return fmt.Errorf("%w: %s", ErrorInvalidSnapshot, err)
+	}
+
+	if err := decode(raw, bitmap); err != nil {
+		return err
+	}
+
+	off := int64(s.header.MemOffset + pageAlign(uint64(len(raw))))
+
+	return forEachRun(bitmap, nPages, func(page, n uint64) error {
+		if _, err := f.ReadAt(m.mem[page*pageSize:(page+n)*pageSize], off); err != nil {
+			return fmt.Errorf("%w: truncated guest memory: %s", ErrorInvalidSnapshot, err)
+		}
+
+		off += int64(n * pageSize)
+
+		return nil
+	})
+}
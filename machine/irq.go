@@ -0,0 +1,68 @@
+package machine
+
+import (
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const (
+	// serialIRQ is the ISA interrupt of COM1.
+	serialIRQ = 4
+)
+
+// irqEdge is the count written to an irqfd, little-endian.
+var irqEdge = []byte{1, 0, 0, 0, 0, 0, 0, 0}
+
+// irqLine raises edges of an interrupt for a device, from any goroutine and
+// without a lock. With an irqfd, each edge is a write to an eventfd; hosts
+// without KVM_CAP_IRQFD get two KVM_IRQ_LINE ioctls.
+type irqLine struct {
+	vmFd uintptr
+	gsi  uint32
+	fd   int // the eventfd of the irqfd, or -1
+}
+
+func newIRQLine(kvmFd, vmFd uintptr, gsi uint32) (*irqLine, error) {
+	l := &irqLine{vmFd: vmFd, gsi: gsi, fd: -1}
+
+	if n, err := kvm.CheckExtension(kvmFd, kvm.CapIRQFD); err != nil || n == 0 {
+		return l, nil
+	}
+
+	fd, err := kvm.EventFD()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := kvm.IRQFD(vmFd, fd, gsi); err != nil {
+		syscall.Close(fd)
+
+		return nil, err
+	}
+
+	l.fd = fd
+
+	return l, nil
+}
+
+// trigger raises an edge of the interrupt, leaving the line low.
+func (l *irqLine) trigger() error {
+	if l.fd < 0 {
+		if err := kvm.IRQLine(l.vmFd, l.gsi, 1); err != nil {
+			return err
+		}
+
+		return kvm.IRQLine(l.vmFd, l.gsi, 0)
+	}
+
+	_, err := syscall.Write(l.fd, irqEdge)
+
+	return err
+}
+
+// lower drops the line, which snapshots of older versions saved high, so
+// that the next edge isn't lost.
+func (l *irqLine) lower() error {
+	return kvm.IRQLine(l.vmFd, l.gsi, 0)
+}
@@ -1,19 +1,28 @@
 package machine
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/bootparam"
 	"github.com/bobuhiro11/gokvm/ebda"
+	"github.com/bobuhiro11/gokvm/fdpath"
 	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/logging"
+	"github.com/bobuhiro11/gokvm/memslot"
 	"github.com/bobuhiro11/gokvm/serial"
 )
 
+var log = logging.New("kvm")
+
 // InitialRegState GuestPhysAddr                      Binary files [+ offsets in the file]
 //
 //                 0x00000000    +------------------+
@@ -30,6 +39,12 @@ import (
 //                               |                  |
 //                               +------------------+
 //                               |                  |
+//                 0x00030000    +------------------+
+//                               |                  |
+//                               |   device tree    |
+//                               |                  |
+//                               +------------------+
+//                               |                  |
 // RIP -->         0x00100000    +------------------+ bzImage [+ 512 x (setup_sects in boot param header + 1)]
 //                               |                  |
 //                               |   64bit kernel   |
@@ -42,36 +57,109 @@ import (
 //                               |                  |
 //                               +------------------+
 //                               |                  |
-//                 0x40000000    +------------------+
+//                 memSize       +------------------+
 const (
-	memSize       = 1 << 30
 	bootParamAddr = 0x10000
 	cmdlineAddr   = 0x20000
+	fdtAddr       = 0x30000
 	kernelAddr    = 0x100000
 	initrdAddr    = 0xf000000
+
+	// MinMemSize is the smallest memory size that can hold the kernel and
+	// an initrd placed at initrdAddr.
+	MinMemSize = initrdAddr + 0x1000000
+)
+
+// KVMDevice is the KVM device machines are created with, which may be a
+// descriptor passed as fd=N.
+var KVMDevice = "/dev/kvm"
+
+var (
+	ErrorMemSizeTooSmall = fmt.Errorf("memory size must be at least 0x%x bytes", MinMemSize)
+	ErrorInitrdTooLarge  = errors.New("initrd does not fit in guest memory")
+	ErrorKernelTooLarge  = errors.New("kernel overlaps the initrd")
+	ErrorGuestCrashed    = errors.New("guest crashed")
+	ErrorGuestShutdown   = errors.New("guest shut down")
+	ErrorGuestReset      = errors.New("guest requested a reset")
 )
 
 type Machine struct {
+	typ            Type
+	devKVM         *os.File // keeps kvmFd open
 	kvmFd, vmFd    uintptr
 	vcpuFds        []uintptr
 	mem            []byte
+	slots          *memslot.Manager
+	ramSlot        uint32
 	runs           []*kvm.RunData
 	serial         *serial.Serial
+	serialIRQ      *irqLine
+	pause          pauseState
+	resetSregs     []kvm.Sregs
+	boot           bootSource
+	powerOn        powerOnState
+	resetMu        sync.Mutex
+	resetFailed    uint32 // set once resetErr stops the vCPUs
+	resetErr       error
+	debugExit      bool
+	debugExitPort  int
+	deviceTree     bool
+	platform       ebda.Platform
+	exitCode       int32
+	debugStops     chan DebugStop
+	debugControls  []uint32
+	hwBreakpoints  []HWBreakpoint
+	steppingOver   []*HWBreakpoint
+	exits          []exitStats
+	traceRanges    []TraceRange
+	stalls         *stallDetector
+	postcopy       *postcopyState
+	base           snapshotBase
+	states         []stateEntry
+	clockSavedAt   int64
+	cpuid          kvm.CPUID
+	vcpuThreadInit func() error
+	statsOnce      sync.Once
+	statsFds       []uintptr
+	statsErr       error
+	ioports        [0x10000]portStats
 	ioportHandlers [0x10000][2]func(m *Machine, port uint64, bytes []byte) error
+	hypercalls     map[uint64]HypercallHandler
+}
+
+// New creates a machine of the default type.
+func New(nCpus int, memSize int) (*Machine, error) {
+	t, err := LookupType(DefaultType)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithType(t, nCpus, memSize)
 }
 
-func New(nCpus int) (*Machine, error) {
-	m := &Machine{}
+func NewWithType(t Type, nCpus int, memSize int) (*Machine, error) {
+	m := &Machine{typ: t, exitCode: -1}
+
+	if memSize < MinMemSize {
+		return m, ErrorMemSizeTooSmall
+	}
 
-	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	devKVM, err := fdpath.OpenFile(KVMDevice, os.O_RDWR, 0o644)
 	if err != nil {
 		return m, err
 	}
 
+	m.devKVM = devKVM
 	m.kvmFd = devKVM.Fd()
 	m.vmFd, err = kvm.CreateVM(m.kvmFd)
 	m.vcpuFds = make([]uintptr, nCpus)
 	m.runs = make([]*kvm.RunData, nCpus)
+	m.resetSregs = make([]kvm.Sregs, nCpus)
+	m.debugStops = make(chan DebugStop, nCpus)
+	m.debugControls = make([]uint32, nCpus)
+	m.steppingOver = make([]*HWBreakpoint, nCpus)
+	m.exits = make([]exitStats, nCpus)
+	m.pause.init(m.runs)
 
 	if err != nil {
 		return m, err
@@ -93,6 +181,10 @@ func New(nCpus int) (*Machine, error) {
 		return m, err
 	}
 
+	if n, err := kvm.CheckExtension(m.kvmFd, kvm.CapImmediateExit); err == nil && n > 0 {
+		m.pause.immediateExit = true
+	}
+
 	mmapSize, err := kvm.GetVCPUMMmapSize(m.kvmFd)
 	if err != nil {
 		return m, err
@@ -105,6 +197,11 @@ func New(nCpus int) (*Machine, error) {
 			return m, err
 		}
 
+		// keep the power-on state of the special registers for resets
+		if m.resetSregs[i], err = kvm.GetSregs(m.vcpuFds[i]); err != nil {
+			return m, err
+		}
+
 		// init CPUID
 		if err := m.initCPUID(i); err != nil {
 			return m, err
@@ -125,60 +222,116 @@ func New(nCpus int) (*Machine, error) {
 		return m, err
 	}
 
-	err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
-		Slot: 0, Flags: 0, GuestPhysAddr: 0, MemorySize: 1 << 30,
-		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[0]))),
-	})
-	if err != nil {
+	if m.slots, err = memslot.New(m.kvmFd, m.vmFd); err != nil {
 		return m, err
 	}
 
-	e, err := ebda.New(nCpus)
-	if err != nil {
+	if m.ramSlot, err = m.slots.Add(0, m.mem, 0); err != nil {
 		return m, err
 	}
 
-	bytes, err := e.Bytes()
-	if err != nil {
+	if m.serialIRQ, err = newIRQLine(m.kvmFd, m.vmFd, serialIRQ); err != nil {
 		return m, err
 	}
 
-	for i, b := range bytes {
-		m.mem[bootparam.EBDAStart+i] = b
+	// the serial port pulses its IRQ low then high, which is one edge
+	serialIRQCallback := func(irq, level uint32) {
+		if level == 0 {
+			return
+		}
+
+		if err := m.serialIRQ.trigger(); err != nil {
+			panic(err)
+		}
+	}
+
+	if m.serial, err = serial.New(serialIRQCallback); err != nil {
+		return m, err
+	}
+
+	m.initState()
+
+	if err := m.savePowerOn(); err != nil {
+		return m, err
 	}
 
 	return m, nil
 }
 
+// SetPlatform sets how the MP table identifies the machine to the guest. It
+// must be called before LoadLinux or LoadMultiboot, which write the table.
+func (m *Machine) SetPlatform(p ebda.Platform) error {
+	if err := p.Check(); err != nil {
+		return err
+	}
+
+	m.platform = p
+
+	return nil
+}
+
+func (m *Machine) initEBDA() error {
+	e, err := ebda.NewWithPlatform(len(m.vcpuFds), m.platform)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return m.load(bootparam.EBDAStart, bytes)
+}
+
+// MaxInitrdSize returns the size of the largest initrd LoadLinux can place in
+// memSize bytes of guest memory.
+func MaxInitrdSize(memSize int) int {
+	return memSize - initrdAddr
+}
+
 // RunData returns the kvm.RunData for the VM.
 func (m *Machine) RunData() []*kvm.RunData {
 	return m.runs
 }
 
 func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
-	// Load initrd
-	initrd, err := ioutil.ReadFile(initPath)
+	m.boot = bootSource{bzImagePath, initPath, params, false}
+
+	if err := m.initEBDA(); err != nil {
+		return err
+	}
+
+	// Load Boot Param, whose protocol version tells which fields the
+	// kernel reads and which limits it has
+	bootParam, err := bootparam.New(bzImagePath)
 	if err != nil {
 		return err
 	}
 
-	for i := 0; i < len(initrd); i++ {
-		m.mem[initrdAddr+i] = initrd[i]
+	// Load initrd
+	initrd, err := fdpath.ReadFile(initPath)
+	if err != nil {
+		return err
 	}
 
-	// Load kernel command-line parameters
-	for i, b := range []byte(params) {
-		m.mem[cmdlineAddr+i] = b
+	if len(initrd) > MaxInitrdSize(len(m.mem)) {
+		return ErrorInitrdTooLarge
 	}
 
-	m.mem[cmdlineAddr+len(params)] = 0 // for null terminated string
+	if err := bootParam.SetLoader(cmdlineAddr, params, initrdAddr, uint32(len(initrd))); err != nil {
+		return err
+	}
 
-	// Load Boot Param
-	bootParam, err := bootparam.New(bzImagePath)
-	if err != nil {
+	if err := m.load(initrdAddr, initrd); err != nil {
 		return err
 	}
 
+	// Load kernel command-line parameters, null terminated
+	if err := m.load(cmdlineAddr, append([]byte(params), 0)); err != nil {
+		return fmt.Errorf("command line: %w", err)
+	}
+
 	// refs https://github.com/kvmtool/kvmtool/blob/0e1882a49f81cb15d328ef83a78849c0ea26eecc/x86/bios.c#L66-L86
 	bootParam.AddE820Entry(
 		bootparam.RealModeIvtBegin,
@@ -197,31 +350,27 @@ func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
 	)
 	bootParam.AddE820Entry(
 		kernelAddr,
-		memSize-kernelAddr,
+		uint64(len(m.mem)-kernelAddr),
 		bootparam.E820Ram,
 	)
 
-	bootParam.Hdr.VidMode = 0xFFFF                                                                  // Proto ALL
-	bootParam.Hdr.TypeOfLoader = 0xFF                                                               // Proto 2.00+
-	bootParam.Hdr.RamdiskImage = initrdAddr                                                         // Proto 2.00+
-	bootParam.Hdr.RamdiskSize = uint32(len(initrd))                                                 // Proto 2.00+
-	bootParam.Hdr.LoadFlags |= bootparam.CanUseHeap | bootparam.LoadedHigh | bootparam.KeepSegments // Proto 2.00+
-	bootParam.Hdr.HeapEndPtr = 0xFE00                                                               // Proto 2.01+
-	bootParam.Hdr.ExtLoaderVer = 0                                                                  // Proto 2.02+
-	bootParam.Hdr.CmdlinePtr = cmdlineAddr                                                          // Proto 2.06+
-	bootParam.Hdr.CmdlineSize = uint32(len(params) + 1)                                             // Proto 2.06+
+	if m.deviceTree {
+		if err := m.loadDeviceTree(bootParam, params, len(initrd)); err != nil {
+			return err
+		}
+	}
 
 	bytes, err := bootParam.Bytes()
 	if err != nil {
 		return err
 	}
 
-	for i, b := range bytes {
-		m.mem[bootParamAddr+i] = b
+	if err := m.load(bootParamAddr, bytes); err != nil {
+		return err
 	}
 
 	// Load kernel
-	bzImage, err := ioutil.ReadFile(bzImagePath)
+	bzImage, err := fdpath.ReadFile(bzImagePath)
 	if err != nil {
 		return err
 	}
@@ -232,11 +381,28 @@ func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
 	// the kernel file (again, if setup_sects == 0 the real value is 4.) It should
 	// be loaded at address 0x10000 for Image/zImage kernels and 0x100000 for bzImage kernels.
 	//
+	// The protected-mode code of a bzImage finds where it was loaded, so
+	// kernels which aren't relocatable are loaded at 0x100000 too and move
+	// themselves to pref_address.
+	//
 	// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#loading-the-rest-of-the-kernel
-	offset := int(bootParam.Hdr.SetupSects+1) * 512
+	setupSects := int(bootParam.Hdr.SetupSects)
+	if setupSects == 0 {
+		setupSects = 4
+	}
+
+	offset := (setupSects + 1) * 512
+
+	if offset < len(bzImage) {
+		// the kernel decompresses itself below the initrd
+		if end := bootParam.KernelEnd(kernelAddr, uint64(len(bzImage)-offset)); end > initrdAddr {
+			return fmt.Errorf("%w: it needs memory up to 0x%x, the initrd starts at 0x%x",
+				ErrorKernelTooLarge, end, initrdAddr)
+		}
 
-	for i := 0; i < len(bzImage)-offset; i++ {
-		m.mem[kernelAddr+i] = bzImage[offset+i]
+		if err := m.load(kernelAddr, bzImage[offset:]); err != nil {
+			return fmt.Errorf("kernel: %w", err)
+		}
 	}
 
 	for i := range m.vcpuFds {
@@ -251,33 +417,48 @@ func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
 
 	m.initIOPortHandlers()
 
-	serialIRQCallback := func(irq, level uint32) {
-		if err := kvm.IRQLine(m.vmFd, irq, level); err != nil {
-			panic(err)
-		}
-	}
+	return nil
+}
 
-	if m.serial, err = serial.New(serialIRQCallback); err != nil {
-		return err
-	}
+// SetConsoleOutput changes where the serial console output is written,
+// os.Stdout by default.
+func (m *Machine) SetConsoleOutput(w io.Writer) {
+	m.serial.SetOutput(w)
+}
 
-	return nil
+// SetVCPUThreadInit sets a function RunInfiniteLoop calls on the thread of
+// the vCPU before running it, such as installing a seccomp filter. The thread
+// is then dedicated to the vCPU, and exits with RunInfiniteLoop.
+func (m *Machine) SetVCPUThreadInit(f func() error) {
+	m.vcpuThreadInit = f
 }
 
 func (m *Machine) GetInputChan() chan<- byte {
 	return m.serial.GetInputChan()
 }
 
+// InjectSerialIRQ raises the serial IRQ, or holds it back until Resume while
+// the machine is paused. It takes no lock, so that console input doesn't
+// contend with the vCPUs for the pause state.
 func (m *Machine) InjectSerialIRQ() {
-	m.serial.InjectIRQ()
-}
+	p := &m.pause
 
-func (m *Machine) initRegs(i int) error {
-	regs, err := kvm.GetRegs(m.vcpuFds[i])
-	if err != nil {
-		return err
+	if atomic.LoadUint32(&p.holdIRQs) == 0 {
+		m.serial.InjectIRQ()
+
+		return
+	}
+
+	atomic.StoreUint32(&p.pendingSerialIRQ, 1)
+
+	// Resume may have missed the pending IRQ after holdIRQs was read
+	if atomic.LoadUint32(&p.holdIRQs) == 0 && atomic.CompareAndSwapUint32(&p.pendingSerialIRQ, 1, 0) {
+		m.serial.InjectIRQ()
 	}
+}
 
+func (m *Machine) initRegs(i int) error {
+	regs := kvm.Regs{}
 	regs.RFLAGS = 2
 	regs.RIP = kernelAddr
 	regs.RSI = bootParamAddr
@@ -290,10 +471,7 @@ func (m *Machine) initRegs(i int) error {
 }
 
 func (m *Machine) initSregs(i int) error {
-	sregs, err := kvm.GetSregs(m.vcpuFds[i])
-	if err != nil {
-		return err
-	}
+	sregs := m.resetSregs[i]
 
 	// set all segment flat
 	sregs.CS.Base, sregs.CS.Limit, sregs.CS.G = 0, 0xFFFFFFFF, 1
@@ -337,6 +515,8 @@ func (m *Machine) initCPUID(i int) error {
 		return err
 	}
 
+	m.cpuid = cpuid
+
 	return nil
 }
 
@@ -355,10 +535,43 @@ func (m *Machine) RunInfiniteLoop(i int) error {
 	//
 	//   device ioctls must be issued from the same process (address space) that
 	//   was used to create the VM.
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+	if m.vcpuThreadInit == nil {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		return m.runLoop(i)
+	}
+
+	// the thread is never unlocked, so that it exits with the goroutine
+	// rather than running others after f changed it
+	errc := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		if err := m.vcpuThreadInit(); err != nil {
+			errc <- err
+
+			return
+		}
+
+		errc <- m.runLoop(i)
+	}()
+
+	return <-errc
+}
+
+func (m *Machine) runLoop(i int) error {
+	m.pause.enter(i)
+	defer m.pause.leave(i)
 
 	for {
+		m.pause.park()
+
+		if atomic.LoadUint32(&m.resetFailed) != 0 {
+			return m.resetErr
+		}
+
 		isContinue, err := m.RunOnce(i)
 		if err != nil {
 			return err
@@ -371,19 +584,43 @@ func (m *Machine) RunInfiniteLoop(i int) error {
 }
 
 func (m *Machine) RunOnce(i int) (bool, error) {
-	if err := kvm.Run(m.vcpuFds[i]); err != nil {
+	if m.stalls != nil {
+		m.stalls.enterRun(i)
+	}
+
+	// KVM returns right away without an exit reason when immediate_exit is
+	// set, which must not handle the previous exit again
+	m.runs[i].ExitReason = kvm.EXITINTR
+
+	err := kvm.Run(m.vcpuFds[i])
+
+	if m.stalls != nil {
+		m.stalls.exitRun(i, m.vcpuFds[i], m.runs[i].ExitReason == kvm.EXITINTR)
+	}
+
+	if err != nil {
 		// When a signal is sent to the thread hosting the VM it will result in EINTR
 		// refs https://gist.github.com/mcastelino/df7e65ade874f6890f618dc51778d83a
 		if m.runs[i].ExitReason == kvm.EXITINTR {
+			m.countExit(i, 0)
+
 			return true, nil
 		}
 
 		return false, err
 	}
 
+	start := time.Now()
+	isContinue, err := m.handleExit(i)
+	m.countExit(i, time.Since(start))
+
+	return isContinue, err
+}
+
+func (m *Machine) handleExit(i int) (bool, error) {
 	switch m.runs[i].ExitReason {
 	case kvm.EXITHLT:
-		fmt.Println("KVM_EXIT_HLT")
+		log.Info("vcpu halted", "vcpu", i)
 
 		return false, nil
 	case kvm.EXITIO:
@@ -391,20 +628,79 @@ func (m *Machine) RunOnce(i int) (bool, error) {
 		f := m.ioportHandlers[port][direction]
 		bytes := (*(*[100]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(m.runs[i])) + uintptr(offset))))[0:size]
 
-		for i := 0; i < int(count); i++ {
+		start := time.Now()
+
+		for j := 0; j < int(count); j++ {
+			if m.traceRanges != nil && direction == kvm.EXITIOOUT {
+				m.traceAccess(i, "pio", port, true, bytes)
+			}
+
 			if err := f(m, port, bytes); err != nil {
 				return false, err
 			}
+
+			if m.traceRanges != nil && direction == kvm.EXITIOIN {
+				m.traceAccess(i, "pio", port, false, bytes)
+			}
+		}
+
+		m.countIOPort(port, time.Since(start))
+
+		if _, ok := m.ExitCode(); ok {
+			return false, nil
 		}
 
+		return true, nil
+	case kvm.EXITMMIO:
+		addr, data, write := m.runs[i].MMIO()
+		if m.traceRanges != nil {
+			m.traceAccess(i, "mmio", addr, write, data)
+		}
+
+		return false, fmt.Errorf("%w: unexpected mmio access at 0x%x", kvm.ErrorUnexpectedEXITReason, addr)
+	case kvm.EXITHYPERCALL:
+		return m.handleHypercall(i)
+	case kvm.EXITDEBUG:
+		if m.steppedOver(i) {
+			return true, nil
+		}
+
+		m.stopForDebug(i)
+
+		return true, nil
+	case kvm.EXITINTR:
+		// interrupted by a signal, e.g. a kick from Pause, which shows up in
+		// park once the next KVM_RUN may enter the guest again
+		m.runs[i].ImmediateExit = 0
+
 		return true, nil
 	case kvm.EXITUNKNOWN:
 		return true, nil
+	case kvm.EXITSHUTDOWN:
+		// a triple fault, which resets a real machine
+		return false, fmt.Errorf("%w: triple fault", ErrorGuestCrashed)
+	case kvm.EXITSYSTEMEVENT:
+		return false, systemEventError(m.runs[i].SystemEvent())
 	default:
 		return false, fmt.Errorf("%w: %d", kvm.ErrorUnexpectedEXITReason, m.runs[i].ExitReason)
 	}
 }
 
+// systemEventError maps a system event to the error stopping the vCPU which
+// got it. The other vCPUs keep running until the VMM acts on the error.
+func systemEventError(typ uint32, data []uint64) error {
+	switch typ {
+	case kvm.SystemEventShutdown:
+		return ErrorGuestShutdown
+	case kvm.SystemEventReset:
+		return ErrorGuestReset
+	case kvm.SystemEventCrash:
+		return fmt.Errorf("%w: crash reported with %x", ErrorGuestCrashed, data)
+	default:
+		return fmt.Errorf("%w: system event %d", kvm.ErrorUnexpectedEXITReason, typ)
+	}
+}
+
 func (m *Machine) initIOPortHandlers() {
 	funcNone := func(m *Machine, port uint64, bytes []byte) error {
 		return nil
@@ -414,13 +710,50 @@ func (m *Machine) initIOPortHandlers() {
 		return fmt.Errorf("%w: unexpected io port 0x%x", kvm.ErrorUnexpectedEXITReason, port)
 	}
 
+	funcAbsent := func(m *Machine, port uint64, bytes []byte) error {
+		for i := range bytes {
+			bytes[i] = 0xff
+		}
+
+		return nil
+	}
+
 	// default handler
 	for port := 0; port < 0x10000; port++ {
-		for dir := kvm.EXITIOIN; dir <= kvm.EXITIOOUT; dir++ {
-			m.ioportHandlers[port][dir] = funcError
+		if m.typ.LegacyPC {
+			m.ioportHandlers[port][kvm.EXITIOIN] = funcError
+			m.ioportHandlers[port][kvm.EXITIOOUT] = funcError
+		} else {
+			m.ioportHandlers[port][kvm.EXITIOIN] = funcAbsent
+			m.ioportHandlers[port][kvm.EXITIOOUT] = funcNone
+		}
+	}
+
+	if m.typ.LegacyPC {
+		m.initLegacyPCPorts()
+	}
+
+	// Serial port 1
+	for port := serial.COM1Addr; port < serial.COM1Addr+8; port++ {
+		m.ioportHandlers[port][kvm.EXITIOIN] = func(m *Machine, port uint64, bytes []byte) error {
+			return m.serial.In(port, bytes)
+		}
+		m.ioportHandlers[port][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
+			return m.serial.Out(port, bytes)
 		}
 	}
 
+	if m.debugExit {
+		m.initDebugExit()
+	}
+}
+
+// initLegacyPCPorts registers the PC devices that Linux probes at boot.
+func (m *Machine) initLegacyPCPorts() {
+	funcNone := func(m *Machine, port uint64, bytes []byte) error {
+		return nil
+	}
+
 	for dir := kvm.EXITIOIN; dir <= kvm.EXITIOOUT; dir++ {
 		// VGA
 		for port := 0x3c0; port <= 0x3da; port++ {
@@ -474,14 +807,4 @@ func (m *Machine) initIOPortHandlers() {
 		}
 		m.ioportHandlers[port][kvm.EXITIOOUT] = funcNone
 	}
-
-	// Serial port 1
-	for port := serial.COM1Addr; port < serial.COM1Addr+8; port++ {
-		m.ioportHandlers[port][kvm.EXITIOIN] = func(m *Machine, port uint64, bytes []byte) error {
-			return m.serial.In(port, bytes)
-		}
-		m.ioportHandlers[port][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
-			return m.serial.Out(port, bytes)
-		}
-	}
 }
@@ -1,15 +1,30 @@
 package machine_test
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/ebda"
+	"github.com/bobuhiro11/gokvm/fdt"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/logging"
 	"github.com/bobuhiro11/gokvm/machine"
 )
 
 func TestNewAndLoadLinux(t *testing.T) {
 	t.Parallel()
 
-	m, err := machine.New(1)
+	m, err := machine.New(1, 1<<30)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,3 +48,1639 @@ func TestNewAndLoadLinux(t *testing.T) {
 		}
 	}
 }
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.LoadLinux("../bzImage", "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = m.RunInfiniteLoop(0)
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := m.Pause(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !m.IsPaused() {
+			t.Fatal("machine is not paused")
+		}
+
+		if err := m.Resume(); err != nil {
+			t.Fatal(err)
+		}
+
+		if m.IsPaused() {
+			t.Fatal("machine is still paused")
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.LoadLinux("../bzImage", "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = m.RunInfiniteLoop(0)
+	}()
+
+	if err := m.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.IsPaused() {
+		t.Fatal("machine is paused after reset")
+	}
+
+	if err := m.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !m.IsPaused() {
+		t.Fatal("paused machine is resumed by reset")
+	}
+
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResetVCPUs(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(2, 1<<28)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the kernel counts its entries at 0x9100 and starts the AP on a
+	// trampoline at 0x8000, which counts its runs at 0x9104
+	kernel := writeImage(t, []byte{
+		0xf0, 0xff, 0x05, 0x00, 0x91, 0x00, 0x00, // lock inc dword [0x9100]
+		0xbe, 0x38, 0x00, 0x10, 0x00, // mov esi, trampoline
+		0xbf, 0x00, 0x80, 0x00, 0x00, // mov edi, 0x8000
+		0xb9, 0x07, 0x00, 0x00, 0x00, // mov ecx, 7
+		0xf3, 0xa4, // rep movsb
+		0xc7, 0x05, 0x10, 0x03, 0xe0, 0xfe, 0x00, 0x00, 0x00, 0x01, // ICR high: APIC ID 1
+		0xc7, 0x05, 0x00, 0x03, 0xe0, 0xfe, 0x00, 0x45, 0x00, 0x00, // ICR low: INIT
+		0xc7, 0x05, 0x00, 0x03, 0xe0, 0xfe, 0x08, 0x46, 0x00, 0x00, // ICR low: SIPI to 0x8000
+		0xeb, 0xfe, // jmp $
+		// trampoline, in real mode
+		0xf0, 0xff, 0x06, 0x04, 0x91, // lock inc word [0x9104]
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			_ = m.RunInfiniteLoop(i)
+		}(i)
+	}
+
+	counts := func() (uint32, uint16) {
+		b := make([]byte, 6)
+		if err := m.ReadPhysical(0x9100, b); err != nil {
+			t.Fatal(err)
+		}
+
+		return binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint16(b[4:])
+	}
+
+	for round := 0; round < 3; round++ {
+		deadline := time.Now().Add(5 * time.Second)
+
+		for _, ap := counts(); ap == 0; _, ap = counts() {
+			if time.Now().After(deadline) {
+				// hosts without hardware virtualization may not deliver
+				// INIT and SIPI
+				if round == 0 {
+					if err := m.Pause(); err != nil {
+						t.Fatal(err)
+					}
+
+					t.Skip("the host does not start APs")
+				}
+
+				t.Fatalf("round %d: the AP isn't started", round)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// an AP kept runnable would enter the kernel as well
+		time.Sleep(100 * time.Millisecond)
+
+		if entries, ap := counts(); entries != 1 || ap != 1 {
+			t.Fatalf("round %d: %d entries of the kernel and %d of the AP", round, entries, ap)
+		}
+
+		if err := m.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResetFailed(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<28)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{0xeb, 0xfe}) // jmp $
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- m.RunInfiniteLoop(0)
+	}()
+
+	// the machine is left as is while the kernel can't be read
+	if err := os.Rename(kernel, kernel+".old"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Reset(); err == nil || errors.Is(err, machine.ErrorResetFailed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if m.IsPaused() {
+		t.Fatal("machine is paused after a reset failing to read the kernel")
+	}
+
+	// a kernel too large for the initrd is only found once memory is cleared
+	image, err := ioutil.ReadFile(kernel + ".old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary.LittleEndian.PutUint64(image[0x258:], 0x1000000)  // pref_address
+	binary.LittleEndian.PutUint32(image[0x260:], 0x10000000) // init_size
+
+	if err := ioutil.WriteFile(kernel, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Reset(); !errors.Is(err, machine.ErrorResetFailed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, machine.ErrorResetFailed) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("vCPU not stopped by the failed reset")
+	}
+}
+
+// writeImage creates a minimal bzImage whose protected-mode code is code.
+func writeImage(t *testing.T, code []byte) string {
+	t.Helper()
+
+	image := make([]byte, 1024)
+	image[0x1f1] = 1 // setup_sects
+	copy(image[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(image[0x206:], 0x020f)
+	image = append(image, code...)
+
+	path := filepath.Join(t.TempDir(), "bzImage")
+	if err := ioutil.WriteFile(path, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestDebugExit(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xb0, 0x2a, // mov al, 0x2a
+		0xee,       // out dx, al
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, ok := m.ExitCode(); !ok || code != 0x2a<<1|1 {
+		t.Fatalf("unexpected exit code: %d %v", code, ok)
+	}
+}
+
+func TestLoadLinuxLimits(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{0xeb, 0xfe}) // jmp $
+
+	err = m.LoadLinux(kernel, "../initrd", strings.Repeat("x", 256))
+	if !errors.Is(err, bootparam.ErrorCmdlineTooLong) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// init_size of 2.10+ reaching the initrd
+	image, err := ioutil.ReadFile(kernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary.LittleEndian.PutUint64(image[0x258:], 0x1000000)  // pref_address
+	binary.LittleEndian.PutUint32(image[0x260:], 0x10000000) // init_size
+
+	if err := ioutil.WriteFile(kernel, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadLinux(kernel, "../initrd", "console=ttyS0"); !errors.Is(err, machine.ErrorKernelTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// multibootImage returns a multiboot kernel running code at 0x200000, as an
+// ELF image or as a flat binary with the load addresses in its header.
+func multibootImage(t *testing.T, flat bool, code []byte) string {
+	t.Helper()
+
+	const (
+		loadAddr   = 0x200000
+		headerSize = 32
+	)
+
+	le := binary.LittleEndian
+	header := make([]byte, headerSize)
+	flags := uint32(0)
+
+	if flat {
+		flags = 1 << 16
+	}
+
+	le.PutUint32(header[0:], 0x1BADB002)
+	le.PutUint32(header[4:], flags)
+	le.PutUint32(header[8:], -(0x1BADB002 + flags))
+
+	if !flat {
+		image := append(header[:12:12], code...)
+
+		phdr := elf.Prog32{
+			Type: uint32(elf.PT_LOAD), Off: 0x1000, Vaddr: loadAddr, Paddr: loadAddr,
+			Filesz: uint32(len(image)), Memsz: uint32(len(image)), Flags: uint32(elf.PF_R | elf.PF_X),
+		}
+		ehdr := elf.Header32{
+			Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_386), Version: uint32(elf.EV_CURRENT),
+			Entry: loadAddr + 12, Phoff: 52, Ehsize: 52, Phentsize: 32, Phnum: 1,
+		}
+		copy(ehdr.Ident[:], elf.ELFMAG)
+		ehdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+		ehdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+		ehdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+		var b bytes.Buffer
+
+		_ = binary.Write(&b, le, ehdr)
+		_ = binary.Write(&b, le, phdr)
+
+		// the header must be in the first 8K, but may be outside the image
+		b.Write(make([]byte, 0x1000-b.Len()))
+		b.Write(image)
+
+		return writeFile(t, "kernel.elf", b.Bytes())
+	}
+
+	le.PutUint32(header[12:], loadAddr) // header_addr
+	le.PutUint32(header[16:], loadAddr) // load_addr
+	le.PutUint32(header[28:], loadAddr+headerSize)
+
+	return writeFile(t, "kernel.flat", append(header, code...))
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadMultiboot(t *testing.T) {
+	t.Parallel()
+
+	// The guest checks the boot magic and exits with the first byte of its
+	// module, or 1, through the debug exit port of kvm-unit-tests.
+	code := []byte{
+		0x3d, 0x02, 0xb0, 0xad, 0x2b, // cmp eax, 0x2badb002
+		0x75, 0x09, // jne fail
+		0x8b, 0x73, 0x18, // mov esi, [ebx+0x18] ; mods_addr
+		0x8b, 0x36, // mov esi, [esi] ; mod_start
+		0x8a, 0x06, // mov al, [esi]
+		0xeb, 0x02, // jmp out
+		0xb0, 0x01, // fail: mov al, 1
+		0xe6, 0xf4, // out: out 0xf4, al
+		0xeb, 0xfe, // jmp $
+	}
+
+	module := writeFile(t, "env", []byte("*NR_CPUS=1\n"))
+
+	for _, flat := range []bool{false, true} {
+		m, err := machine.New(1, 1<<30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kernel := multibootImage(t, flat, code)
+
+		if err := machine.CheckMultiboot(kernel); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = m.LoadMultiboot(kernel, module, "console=ttyS0"); err != nil {
+			t.Fatal(err)
+		}
+
+		m.EnableDebugExitAt(machine.DebugExitTestAddr)
+
+		if err := m.RunInfiniteLoop(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if code, ok := m.ExitCode(); !ok || code != '*'<<1|1 {
+			t.Fatalf("flat %v: unexpected exit code: %d %v", flat, code, ok)
+		}
+	}
+
+	if err := machine.CheckMultiboot("../bzImage"); !errors.Is(err, machine.ErrorNotMultiboot) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadMultibootSegments(t *testing.T) {
+	t.Parallel()
+
+	image, err := ioutil.ReadFile(multibootImage(t, false, []byte{0xf4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := machine.New(1, 256<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fields of the program header following the ELF header
+	const paddr, filesz, memsz = 52 + 12, 52 + 16, 52 + 20
+
+	le := binary.LittleEndian
+
+	for _, tc := range []struct {
+		name  string
+		field int
+		value uint32
+	}{
+		{"memsz past the memory", memsz, 0xfffff000},
+		{"paddr past the memory", paddr, 0xfff00000},
+		{"filesz above memsz", filesz, 0x100000},
+	} {
+		b := append([]byte{}, image...)
+		le.PutUint32(b[tc.field:], tc.value)
+
+		kernel := writeFile(t, "kernel.elf", b)
+		if err := m.LoadMultiboot(kernel, "", ""); !errors.Is(err, machine.ErrorMultibootAddress) {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestLookupType(t *testing.T) {
+	t.Parallel()
+
+	if typ, err := machine.LookupType("microvm"); err != nil || typ.Name != machine.TypeMicroVM1 {
+		t.Fatalf("unexpected type: %+v %v", typ, err)
+	}
+
+	if _, err := machine.LookupType("pc-0.1"); !errors.Is(err, machine.ErrorUnknownType) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTypeLegacyPorts(t *testing.T) {
+	t.Parallel()
+
+	// The guest reads the status register of the PS/2 controller and exits
+	// with it through the debug exit device.
+	kernel := writeImage(t, []byte{
+		0xe4, 0x64, // in al, 0x64
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xee,       // out dx, al
+		0xeb, 0xfe, // jmp $
+	})
+
+	for _, tc := range []struct {
+		typ    string
+		status int
+	}{
+		{machine.TypePC1, 0x20},
+		{machine.TypeMicroVM1, 0xff},
+	} {
+		typ, err := machine.LookupType(tc.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := machine.NewWithType(typ, 1, 1<<30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+			t.Fatal(err)
+		}
+
+		m.EnableDebugExit()
+
+		if err := m.RunInfiniteLoop(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if code, _ := m.ExitCode(); code != tc.status<<1|1 {
+			t.Fatalf("%s: unexpected status register: 0x%x", tc.typ, code>>1)
+		}
+	}
+}
+
+func TestDeviceTree(t *testing.T) {
+	t.Parallel()
+
+	typ, err := machine.LookupType(machine.TypeMicroVM1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := machine.NewWithType(typ, 2, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDeviceTree()
+
+	if err = m.LoadLinux(writeImage(t, []byte{0xeb, 0xfe}), "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// setup_data of boot_params points to the entry of the device tree
+	ptr := make([]byte, 8)
+	if err := m.ReadPhysical(0x10000+0x250, ptr); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := make([]byte, 16)
+	if err := m.ReadPhysical(binary.LittleEndian.Uint64(ptr), hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	if next, typ := binary.LittleEndian.Uint64(hdr), binary.LittleEndian.Uint32(hdr[8:]); next != 0 || typ != 2 {
+		t.Fatalf("invalid setup_data: next 0x%x type %d", next, typ)
+	}
+
+	blob := make([]byte, binary.LittleEndian.Uint32(hdr[12:]))
+	if err := m.ReadPhysical(binary.LittleEndian.Uint64(ptr)+16, blob); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := fdt.Parse(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chosen, ok := root.Lookup("chosen")
+	if !ok {
+		t.Fatal("no chosen node")
+	}
+
+	if v, _ := chosen.Property("bootargs"); string(v) != "console=ttyS0\x00" {
+		t.Fatalf("invalid bootargs: %q", v)
+	}
+
+	if _, ok := root.Lookup("cpus", "cpu@1"); !ok {
+		t.Fatal("no node of the second vCPU")
+	}
+}
+
+func TestSetPlatform(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<28)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetPlatform(ebda.Platform{OEM: "much too long"}); !errors.Is(err, ebda.ErrorInvalidPlatform) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := m.SetPlatform(ebda.Platform{OEM: "GOKVM", ProductID: "gokvm"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadLinux(writeImage(t, []byte{0xeb, 0xfe}), "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := make([]byte, ebda.Size)
+	if err := m.ReadPhysical(bootparam.EBDAStart, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := ebda.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if table := e.MPCTable(); string(table.OEM[:]) != "GOKVM   " || string(table.ProductID[:]) != "gokvm       " {
+		t.Fatalf("unexpected identifiers %q %q", table.OEM, table.ProductID)
+	}
+}
+
+func TestSlicePhysical(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<28)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.SlicePhysicalForWrite(0x1000, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != 4 || cap(b) != 4 {
+		t.Fatalf("unexpected slice: len %d cap %d", len(b), cap(b))
+	}
+
+	copy(b, "gokv")
+
+	data := make([]byte, 4)
+	if err := m.ReadPhysical(0x1000, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "gokv" {
+		t.Fatalf("guest memory not written in place: %q", data)
+	}
+
+	for _, r := range []struct{ addr, n uint64 }{
+		{1 << 28, 1},
+		{1<<28 - 1, 2},
+		{0x1000, ^uint64(0) - 0x800},
+	} {
+		if _, err := m.SlicePhysical(r.addr, r.n); !errors.Is(err, machine.ErrorNotMapped) {
+			t.Fatalf("0x%x+0x%x: unexpected error: %v", r.addr, r.n, err)
+		}
+	}
+}
+
+func TestRegisterHypercall(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The guest asks to map a page shared and exits with the value returned
+	// through the debug exit device.
+	kernel := writeImage(t, []byte{
+		0xb8, 0x0c, 0x00, 0x00, 0x00, // mov eax, 12
+		0xbb, 0x00, 0x10, 0x00, 0x00, // mov ebx, 0x1000
+		0xb9, 0x01, 0x00, 0x00, 0x00, // mov ecx, 1
+		0x31, 0xd2, // xor edx, edx
+		0x0f, 0x01, 0xc1, // vmcall
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xee,       // out dx, al
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+
+	if err := m.RegisterHypercall(1, nil); !errors.Is(err, machine.ErrorHypercallUnsupported) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got [6]uint64
+
+	err = m.RegisterHypercall(kvm.HCMapGPARange, func(m *machine.Machine, vcpu int, args [6]uint64) (uint64, error) {
+		got = args
+
+		return 0x2a, nil
+	})
+	if errors.Is(err, machine.ErrorHypercallUnsupported) {
+		t.Skip(err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- m.RunInfiniteLoop(0)
+	}()
+
+	// hosts without hardware virtualization may never exit on the hypercall
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		if err := m.Pause(); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Skip("the host does not exit on hypercalls")
+	}
+
+	if got[0] != 0x1000 || got[1] != 1 {
+		t.Fatalf("unexpected arguments: %v", got)
+	}
+
+	if code, ok := m.ExitCode(); !ok || code != 0x2a<<1|1 {
+		t.Fatalf("unexpected exit code: %d %v", code, ok)
+	}
+}
+
+func TestHWBreakpoints(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0x90,                         // nop
+		0x90,                         // nop
+		0xa3, 0x00, 0x30, 0x00, 0x00, // mov [0x3000], eax
+		0x90,       // nop
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bp := range []machine.HWBreakpoint{
+		{Addr: 0x100000, Kind: machine.HWBreakExec, Len: 4},
+		{Addr: 0x3002, Kind: machine.HWBreakWrite, Len: 4},
+		{Addr: 0x3000, Kind: machine.HWBreakWrite, Len: 3},
+		{Addr: 0x3000, Kind: 2, Len: 1},
+	} {
+		if err := m.AddHWBreakpoint(bp); !errors.Is(err, machine.ErrorInvalidHWBreakpoint) {
+			t.Fatalf("%+v: unexpected error: %v", bp, err)
+		}
+	}
+
+	exec := machine.HWBreakpoint{Addr: 0x100001, Kind: machine.HWBreakExec, Len: 1}
+	watch := machine.HWBreakpoint{Addr: 0x3000, Kind: machine.HWBreakWrite, Len: 4}
+
+	for _, bp := range []machine.HWBreakpoint{exec, watch, watch} {
+		if err := m.AddHWBreakpoint(bp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if bps := m.HWBreakpoints(); len(bps) != 2 {
+		t.Fatalf("unexpected breakpoints: %+v", bps)
+	}
+
+	go func() {
+		_ = m.RunInfiniteLoop(0)
+	}()
+
+	next := func() machine.DebugStop {
+		t.Helper()
+
+		select {
+		case st := <-m.DebugStops():
+			return st
+		case <-time.After(5 * time.Second):
+			t.Fatal("no debug stop")
+		}
+
+		return machine.DebugStop{}
+	}
+
+	// the instruction breakpoint stops before the instruction, and the vCPU
+	// steps over it
+	if st := next(); st.PC != 0x100001 || st.HWBreakpoint == nil || *st.HWBreakpoint != exec {
+		t.Fatalf("unexpected stop: %+v", st)
+	}
+
+	st, err := m.Step(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.PC != 0x100002 || st.HWBreakpoint != nil {
+		t.Fatalf("unexpected step: %+v", st)
+	}
+
+	if err := m.RemoveHWBreakpoint(exec); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RemoveHWBreakpoint(exec); !errors.Is(err, machine.ErrorUnknownHWBreakpoint) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the watchpoint stops after the instruction
+	select {
+	case st = <-m.DebugStops():
+	case <-time.After(5 * time.Second):
+		if err := m.Pause(); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Skip("the host does not support data breakpoints")
+	}
+
+	if st.PC != 0x100007 || st.HWBreakpoint == nil || *st.HWBreakpoint != watch {
+		t.Fatalf("unexpected stop: %+v", st)
+	}
+}
+
+func TestSetHaltPoll(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SetHaltPoll(200 * time.Microsecond)
+	if errors.Is(err, machine.ErrorHaltPollUnsupported) {
+		t.Skip(err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetHaltPoll(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetHaltPoll(machine.MaxHaltPoll + 1); err == nil {
+		t.Fatal("halt polling interval out of range accepted")
+	}
+}
+
+func TestGuestCrash(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a valid IDT, the exception escalates into a triple fault.
+	kernel := writeImage(t, []byte{
+		0x0f, 0x0b, // ud2
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestCrashed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0x66, 0xba, 0xf8, 0x03, // mov dx, 0x3f8
+		0xb0, 0x61, // mov al, 'a'
+		0xee, 0xee, 0xee, // out dx, al (x3)
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xee,       // out dx, al
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+	m.SetConsoleOutput(ioutil.Discard)
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := m.ExitStats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := stats["io"]; s.Count != 4 || s.Time <= 0 || s.Slow > s.Count {
+		t.Fatalf("unexpected exit stats: %+v", stats)
+	}
+
+	ports := m.IOPortStats()
+	if len(ports) != 2 || ports[0x3f8].Count != 3 || ports[machine.DebugExitAddr].Count != 1 {
+		t.Fatalf("unexpected I/O port stats: %+v", ports)
+	}
+
+	if _, err := m.ExitStats(1); !errors.Is(err, machine.ErrorInvalidCPU) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if stats := m.DeviceStats(); len(stats) != 1 || stats[0].TxBytes != 3 || stats[0].RxBytes != 0 {
+		t.Fatalf("unexpected device stats: %+v", stats)
+	}
+}
+
+// headWriter keeps the first bytes written and counts the rest.
+type headWriter struct {
+	head []byte
+	max  int
+	n    int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if rest := w.max - len(w.head); rest > 0 {
+		if rest > len(p) {
+			rest = len(p)
+		}
+
+		w.head = append(w.head, p[:rest]...)
+	}
+
+	w.n += len(p)
+
+	return len(p), nil
+}
+
+func TestCoreDump(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0xb8, 0x78, 0x56, 0x34, 0x12, // mov eax, 0x12345678
+		0x0f, 0x0b, // ud2
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RunInfiniteLoop(0); !errors.Is(err, machine.ErrorGuestCrashed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := &headWriter{max: 2 << 20}
+	if err := m.WriteCoreDump(w); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(w.head))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Type != elf.ET_CORE || f.Machine != elf.EM_X86_64 || len(f.Progs) != 2 {
+		t.Fatalf("unexpected ELF header: %+v", f.FileHeader)
+	}
+
+	note, load := f.Progs[0], f.Progs[1]
+
+	if note.Type != elf.PT_NOTE || load.Type != elf.PT_LOAD || load.Paddr != 0 ||
+		load.Filesz != machine.MinMemSize || w.n != int(load.Off+load.Filesz) {
+		t.Fatalf("unexpected program headers: %+v %+v", note.ProgHeader, load.ProgHeader)
+	}
+
+	notes := w.head[note.Off : note.Off+note.Filesz]
+	if string(notes[12:16]) != "CORE" || binary.LittleEndian.Uint32(notes[8:]) != uint32(elf.NT_PRSTATUS) {
+		t.Fatalf("unexpected first note: %x", notes[:16])
+	}
+
+	// pr_reg.rax in the descriptor after the 20 bytes of header and name
+	if rax := binary.LittleEndian.Uint64(notes[20+112+10*8:]); rax != 0x12345678 {
+		t.Fatalf("unexpected rax: 0x%x", rax)
+	}
+
+	if !bytes.Contains(notes, []byte("QEMU\x00")) {
+		t.Fatal("QEMU note not found")
+	}
+
+	if code := w.head[load.Off+0x100000:][:5]; !bytes.Equal(code, []byte{0xb8, 0x78, 0x56, 0x34, 0x12}) {
+		t.Fatalf("unexpected memory: %x", code)
+	}
+}
+
+func TestParseTraceRanges(t *testing.T) {
+	t.Parallel()
+
+	ranges, err := machine.ParseTraceRanges("0x3f8-0x3ff, 0x501")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranges) != 2 || ranges[0] != (machine.TraceRange{Start: 0x3f8, End: 0x3ff}) ||
+		ranges[1] != (machine.TraceRange{Start: 0x501, End: 0x501}) {
+		t.Fatalf("unexpected ranges: %v", ranges)
+	}
+
+	for _, s := range []string{"", "0x3ff-0x3f8", "com1", "0x1-"} {
+		if _, err := machine.ParseTraceRanges(s); !errors.Is(err, machine.ErrorInvalidTraceRange) {
+			t.Fatalf("%q: unexpected error: %v", s, err)
+		}
+	}
+}
+
+// TestTrace captures the global log output, so it doesn't run in parallel.
+func TestTrace(t *testing.T) {
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0x66, 0xba, 0xfb, 0x03, // mov dx, 0x3fb
+		0xb0, 0x03, // mov al, 0x3
+		0xee,                   // out dx, al
+		0x66, 0xba, 0xfd, 0x03, // mov dx, 0x3fd
+		0xec,                   // in al, dx
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xee,       // out dx, al
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	ranges, err := machine.ParseTraceRanges("0x3f8-0x3ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+	m.EnableTrace(ranges)
+
+	var buf bytes.Buffer
+
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(os.Stderr)
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected trace:\n%s", buf.String())
+	}
+
+	// KVM may or may not have advanced RIP past the instruction on an I/O
+	// exit, so only the accesses are compared.
+	for i, want := range []string{
+		"addr=0x3fb size=1 value=0x03",
+		"addr=0x3fd size=1 value=0x60",
+	} {
+		if !strings.Contains(lines[i], "trace: pio ") || !strings.HasSuffix(lines[i], want) {
+			t.Fatalf("line %d: %q does not end with %q", i, lines[i], want)
+		}
+	}
+}
+
+func TestDetectStalls(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	stalls := make(chan machine.Stall, 1)
+
+	stop := m.DetectStalls(20*time.Millisecond, func(s machine.Stall) {
+		select {
+		case stalls <- s:
+		default:
+		}
+	})
+	defer stop()
+
+	go func() {
+		_ = m.RunInfiniteLoop(0)
+	}()
+
+	select {
+	case s := <-stalls:
+		if s.VCPU != 0 || s.Reason != machine.StallSameRIP || s.Regs.RIP != 0x100000 {
+			t.Fatalf("unexpected stall: %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stall was not detected")
+	}
+
+	if err := m.Pause(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0xb8, 0x78, 0x56, 0x34, 0x12, // mov eax, 0x12345678
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xee, // out dx, al
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := m.Snapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := buf.Bytes()
+
+	if string(snap[:8]) != "GOKVMSNP" || binary.LittleEndian.Uint32(snap[8:]) != machine.SnapshotVersion {
+		t.Fatalf("unexpected header: %x", snap[:32])
+	}
+
+	off, size := binary.LittleEndian.Uint64(snap[16:]), binary.LittleEndian.Uint64(snap[24:])
+	if off%0x1000 != 0 || size != machine.MinMemSize || uint64(len(snap)) != off+size {
+		t.Fatalf("unexpected memory offset 0x%x and size 0x%x in %d bytes", off, size, len(snap))
+	}
+
+	if !bytes.Contains(snap[:off], []byte("vcpu.0")) {
+		t.Fatal("vCPU section not found")
+	}
+
+	if code := snap[off+0x100000:][:5]; !bytes.Equal(code, []byte{0xb8, 0x78, 0x56, 0x34, 0x12}) {
+		t.Fatalf("unexpected memory: %x", code)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xb0, 0x01, // mov al, 1
+		0xee,       // out dx, al
+		0x04, 0x01, // add al, 1
+		0xee,       // out dx, al
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "vm.snap")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Snapshot(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only restored machines know when their clock was saved
+	if _, err := m.ResyncClock(); !errors.Is(err, machine.ErrorNoClockTimestamp) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, lazy := range []bool{false, true} {
+		r, err := machine.Restore(m.Type(), path, lazy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.NumCPUs() != 1 {
+			t.Fatalf("unexpected number of vCPUs: %d", r.NumCPUs())
+		}
+
+		if elapsed, err := r.ResyncClock(); err != nil || elapsed <= 0 {
+			t.Fatalf("unexpected clock resync: %v %v", elapsed, err)
+		}
+
+		r.EnableDebugExit()
+
+		// the restored vCPU continues after the first out with al = 1
+		if err := r.RunInfiniteLoop(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if code, ok := r.ExitCode(); !ok || code != 2<<1|1 {
+			t.Fatalf("lazy %v: unexpected exit code: %d %v", lazy, code, ok)
+		}
+	}
+
+	// a device state newer than the device is refused
+	snap, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the section header: name and version
+	i := bytes.Index(snap, append([]byte("serial"), append(make([]byte, 10), 1, 0, 0, 0)...))
+	if i < 0 {
+		t.Fatal("serial section not found")
+	}
+
+	binary.LittleEndian.PutUint32(snap[i+16:], 99)
+
+	if err := ioutil.WriteFile(path, snap, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := machine.Restore(m.Type(), path, false); !errors.Is(err, machine.ErrorInvalidSnapshot) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRestoreIncompatible(t *testing.T) {
+	t.Parallel()
+
+	pc, err := machine.LookupType(machine.TypePC1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	microvm, err := machine.LookupType(machine.TypeMicroVM1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := machine.NewWithType(pc, 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := m.Snapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "vm.snap")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = machine.Restore(microvm, path, false)
+	if !errors.Is(err, machine.ErrorIncompatibleSnapshot) || !strings.Contains(err.Error(), "pc-1.0") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the guest was given all extended features of leaf 7, which no host has
+	snap := buf.Bytes()
+	entries := bytes.Index(snap, append([]byte("compat"), make([]byte, 10)...)) + 32 + 16 + 8
+
+	for e := snap[entries:]; len(e) >= 40; e = e[40:] {
+		if binary.LittleEndian.Uint32(e) == 7 && binary.LittleEndian.Uint32(e[4:]) == 0 {
+			binary.LittleEndian.PutUint32(e[16:], 0xffffffff)
+
+			break
+		}
+	}
+
+	if err := ioutil.WriteFile(path, snap, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = machine.Restore(m.Type(), path, false)
+	if !errors.Is(err, machine.ErrorIncompatibleSnapshot) || !strings.Contains(err.Error(), "cpuid 0x7.ebx") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// snapshots of versions without the compat section are restored as is
+	copy(snap[bytes.Index(snap, []byte("compat")):], "unused")
+
+	if err := ioutil.WriteFile(path, snap, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = machine.Restore(m.Type(), path, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "vm.snap")
+	if err := ioutil.WriteFile(path, []byte("not a snapshot"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := machine.Restore(machine.Type{}, path, false); !errors.Is(err, machine.ErrorInvalidSnapshot) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSnapshotIncremental(t *testing.T) {
+	t.Parallel()
+
+	m, err := machine.New(1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0xc6, 0x05, 0x00, 0x00, 0x20, 0x00, 0x01, // mov byte [0x200000], 1
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xb0, 0x01, // mov al, 1
+		0xee,                                     // out dx, al
+		0xc6, 0x05, 0x00, 0x00, 0x30, 0x00, 0x02, // mov byte [0x300000], 2
+		0xb0, 0x02, // mov al, 2
+		0xee,                                     // out dx, al
+		0xc6, 0x05, 0x00, 0x00, 0x20, 0x00, 0x04, // mov byte [0x200000], 4
+		0xb0, 0x03, // mov al, 3
+		0xee,                         // out dx, al
+		0xa0, 0x00, 0x00, 0x20, 0x00, // mov al, [0x200000]
+		0x02, 0x05, 0x00, 0x00, 0x30, 0x00, // add al, [0x300000]
+		0x02, 0x05, 0x00, 0x00, 0x40, 0x00, // add al, [0x400000]
+		0xee,       // out dx, al
+		0xeb, 0xfe, // jmp $
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+
+	if err := m.SnapshotIncremental(ioutil.Discard, "none"); !errors.Is(err, machine.ErrorNoBaseSnapshot) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dir := t.TempDir()
+	snapshot := func(name, parent string) {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parent == "" {
+			err = m.Snapshot(f)
+		} else {
+			err = m.SnapshotIncremental(f, parent)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot("full.snap", "")
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// pages written by gokvm are in the next snapshot too
+	if err := m.WriteVirtual(0, 0x400000, []byte{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot("delta1.snap", "full.snap")
+
+	if err := m.RunInfiniteLoop(0); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot("delta2.snap", filepath.Join(dir, "delta1.snap"))
+
+	fi, err := os.Stat(filepath.Join(dir, "delta2.snap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() > 1<<20 {
+		t.Fatalf("incremental snapshot of %d bytes", fi.Size())
+	}
+
+	// each snapshot continues after its out, with the memory seen then
+	for _, tc := range []struct {
+		name  string
+		lazy  bool
+		codes []int
+	}{
+		{"full.snap", false, []int{2, 3, 4 + 2 + 0}},
+		{"delta1.snap", false, []int{3, 4 + 2 + 3}},
+		{"delta2.snap", false, []int{4 + 2 + 3}},
+		{"delta2.snap", true, []int{4 + 2 + 3}},
+	} {
+		r, err := machine.Restore(m.Type(), filepath.Join(dir, tc.name), tc.lazy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.EnableDebugExit()
+
+		for _, want := range tc.codes {
+			if err := r.RunInfiniteLoop(0); err != nil {
+				t.Fatal(err)
+			}
+
+			if code, ok := r.ExitCode(); !ok || code != want<<1|1 {
+				t.Fatalf("%s lazy %v: unexpected exit code: %d %v, expected %d", tc.name, tc.lazy, code, ok, want)
+			}
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, "delta1.snap")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := machine.Restore(m.Type(), filepath.Join(dir, "delta2.snap"), false); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	stats := testMigrate(t, false)
+
+	if stats.Rounds < 2 || stats.Pages < machine.MinMemSize/0x1000 {
+		t.Fatalf("unexpected migration: %+v", stats)
+	}
+}
+
+func TestMigratePostcopy(t *testing.T) {
+	t.Parallel()
+
+	stats := testMigrate(t, true)
+
+	if stats.Pages != machine.MinMemSize/0x1000 {
+		t.Fatalf("unexpected migration: %+v", stats)
+	}
+}
+
+// testMigrate migrates a guest incrementing a counter in memory, and checks
+// that it continues on the destination.
+func testMigrate(t *testing.T, postcopy bool) machine.MigrationStats {
+	t.Helper()
+
+	m, err := machine.New(1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kernel := writeImage(t, []byte{
+		0x41,                               // loop: inc ecx
+		0x89, 0x0d, 0x00, 0x00, 0x20, 0x00, // mov [0x200000], ecx
+		0xa0, 0x00, 0x00, 0x30, 0x00, // mov al, [0x300000]
+		0x84, 0xc0, // test al, al
+		0x74, 0xf0, // jz loop
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xee, // out dx, al
+	})
+
+	if err = m.LoadLinux(kernel, "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.EnableDebugExit()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- m.RunInfiniteLoop(0)
+	}()
+
+	// post-copy pauses right away, so the guest first runs for a while
+	counter := make([]byte, 4)
+
+	for binary.LittleEndian.Uint32(counter) == 0 {
+		if err := m.ReadPhysical(0x200000, counter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, dst := net.Pipe()
+	received := make(chan *machine.Machine, 1)
+	rdone := make(chan error, 1)
+
+	// the guest runs on the destination as soon as it arrives, faulting on
+	// the pages still missing in post-copy
+	go func() {
+		defer dst.Close()
+
+		r, err := machine.ReceiveMigration(m.Type(), dst)
+		if err != nil {
+			t.Error(err)
+			received <- nil
+
+			return
+		}
+
+		r.EnableDebugExit()
+
+		go func() {
+			rdone <- r.RunInfiniteLoop(0)
+		}()
+
+		if err := r.WaitIncoming(); err != nil {
+			t.Error(err)
+		}
+
+		received <- r
+	}()
+
+	var stats machine.MigrationStats
+
+	if postcopy {
+		stats, err = m.MigratePostcopy(src)
+	} else {
+		stats, err = m.Migrate(src)
+	}
+
+	src.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !m.IsPaused() {
+		t.Fatal("the source is not paused")
+	}
+
+	r := <-received
+	if r == nil {
+		t.FailNow()
+	}
+
+	if err := r.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the counter in memory matches the register it was stored from
+	regs, err := r.GetRegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ReadPhysical(0x200000, counter); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := binary.LittleEndian.Uint32(counter); c == 0 || uint64(c) != regs.RCX && uint64(c) != regs.RCX-1 {
+		t.Fatalf("counter 0x%x does not match ecx 0x%x", c, regs.RCX)
+	}
+
+	for _, vm := range []*machine.Machine{r, m} {
+		if err := vm.WriteVirtual(0, 0x300000, []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.EnableDebugExit()
+
+	if err := r.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-rdone; err != nil {
+		t.Fatal(err)
+	}
+
+	if code, ok := r.ExitCode(); !ok || code != 1<<1|1 {
+		t.Fatalf("unexpected exit code: %d %v", code, ok)
+	}
+
+	// the source stops too once resumed
+	if err := m.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	return stats
+}
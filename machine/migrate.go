@@ -0,0 +1,308 @@
+package machine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// A migration stream starts with a header, followed by records of guest
+// pages and finally by the state of the machine as in a snapshot.
+//
+//	migrationHeader
+//	recordHeader{Type: recordPages}, pages
+//	...
+//	recordHeader{Type: recordState}, sectionHeader, data, ...
+//
+// Memory is sent while the guest runs, first in full, then the pages dirtied
+// in the meantime, round after round. Once a round leaves few enough dirty
+// pages, the machine is paused and the rest is sent along with the state.
+const (
+	migrationMagic = "GOKVMMIG"
+
+	recordPages = 1
+	recordState = 2
+
+	// migrationMaxRounds bounds the rounds for guests dirtying memory faster
+	// than it is sent.
+	migrationMaxRounds = 30
+
+	// migrationStopPages is the number of dirty pages below which the
+	// machine is paused, 1MiB.
+	migrationStopPages = 256
+
+	// migrationMaxRun is the largest number of pages in a record.
+	migrationMaxRun = 256
+)
+
+var ErrorInvalidMigration = errors.New("invalid migration stream")
+
+type migrationHeader struct {
+	Magic   [8]byte
+	Version uint32
+	NCPUs   uint32
+	MemSize uint64
+}
+
+// recordHeader is followed by Count pages from guest physical address Addr,
+// or by Count sections.
+type recordHeader struct {
+	Type  uint32
+	Count uint32
+	Addr  uint64
+}
+
+// MigrationStats describes a completed migration.
+type MigrationStats struct {
+	Rounds   int
+	Pages    uint64
+	Downtime time.Duration
+
+	// Requested is the number of pages sent ahead on request of the
+	// destination, in post-copy.
+	Requested uint64
+}
+
+func (m *Machine) setDirtyLogging(on bool) error {
+	flags := uint32(0)
+	if on {
+		flags = kvm.MemLogDirtyPages
+	}
+
+	return m.slots.SetFlags(m.ramSlot, flags)
+}
+
+// sendPages writes the pages set in bitmap and returns their number.
+func (m *Machine) sendPages(w io.Writer, bitmap []uint64) (uint64, error) {
+	nPages := uint64(len(m.mem) / pageSize)
+	sent := uint64(0)
+
+	for page := uint64(0); page < nPages; {
+		if bitmap[page/64]&(1<<(page%64)) == 0 {
+			page++
+
+			continue
+		}
+
+		n := uint64(1)
+		for page+n < nPages && n < migrationMaxRun && bitmap[(page+n)/64]&(1<<((page+n)%64)) != 0 {
+			n++
+		}
+
+		h := recordHeader{Type: recordPages, Count: uint32(n), Addr: page * pageSize}
+		if _, err := w.Write(encode(h)); err != nil {
+			return sent, err
+		}
+
+		if _, err := w.Write(m.mem[h.Addr : h.Addr+n*pageSize]); err != nil {
+			return sent, err
+		}
+
+		sent += n
+		page += n
+	}
+
+	return sent, nil
+}
+
+func countPages(bitmap []uint64) int {
+	n := 0
+	for _, b := range bitmap {
+		n += bits.OnesCount64(b)
+	}
+
+	return n
+}
+
+// Migrate sends the machine to w, where ReceiveMigration builds a copy of it,
+// while the guest keeps running until the last round. On success the
+// machine is left paused; the caller is expected to stop it. On failure it
+// is resumed unless it was already paused. Migrate takes over the dirty
+// log, so that incremental snapshots need a full one again.
+func (m *Machine) Migrate(w io.Writer) (MigrationStats, error) {
+	stats := MigrationStats{}
+
+	if err := m.checkMemory(); err != nil {
+		return stats, err
+	}
+
+	m.untrack()
+
+	bw := bufio.NewWriterSize(w, 1<<20)
+
+	if err := m.setDirtyLogging(true); err != nil {
+		return stats, err
+	}
+
+	defer func() {
+		_ = m.setDirtyLogging(false)
+	}()
+
+	h := migrationHeader{Version: SnapshotVersion, NCPUs: uint32(len(m.vcpuFds)), MemSize: uint64(len(m.mem))}
+	copy(h.Magic[:], migrationMagic)
+
+	if _, err := bw.Write(encode(h)); err != nil {
+		return stats, err
+	}
+
+	bitmap := make([]uint64, (len(m.mem)/pageSize+63)/64)
+
+	// everything is sent in the first round
+	for i := range bitmap {
+		bitmap[i] = ^uint64(0)
+	}
+
+	for {
+		n, err := m.sendPages(bw, bitmap)
+		stats.Pages += n
+		stats.Rounds++
+
+		if err != nil {
+			return stats, err
+		}
+
+		if err := kvm.GetDirtyLog(m.vmFd, m.ramSlot, bitmap); err != nil {
+			return stats, err
+		}
+
+		dirty := countPages(bitmap)
+		log.Debug("migration round", "round", stats.Rounds, "sent", n, "dirty", dirty)
+
+		if dirty < migrationStopPages || stats.Rounds >= migrationMaxRounds {
+			break
+		}
+	}
+
+	wasPaused := m.IsPaused()
+	start := time.Now()
+
+	if err := m.Pause(); err != nil {
+		return stats, err
+	}
+
+	if err := m.sendFinal(bw, bitmap, &stats); err != nil {
+		if !wasPaused {
+			_ = m.Resume()
+		}
+
+		return stats, err
+	}
+
+	stats.Downtime = time.Since(start)
+
+	return stats, nil
+}
+
+// sendFinal sends the pages dirtied since the last round and the state of
+// the paused machine.
+func (m *Machine) sendFinal(w *bufio.Writer, bitmap []uint64, stats *MigrationStats) error {
+	// the pages dirtied before the vCPUs stopped
+	dirty := make([]uint64, len(bitmap))
+	if err := kvm.GetDirtyLog(m.vmFd, m.ramSlot, dirty); err != nil {
+		return err
+	}
+
+	for i := range bitmap {
+		bitmap[i] |= dirty[i]
+	}
+
+	n, err := m.sendPages(w, bitmap)
+	stats.Pages += n
+	stats.Rounds++
+
+	if err != nil {
+		return err
+	}
+
+	sections, err := m.saveState()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(encode(recordHeader{Type: recordState, Count: uint32(len(sections))})); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(encodeSections(sections)); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// ReceiveMigration creates a machine of type t from the migration stream
+// sent by Migrate or MigratePostcopy. Like a restored machine, it resumes
+// where the source was paused once its vCPUs are run. In post-copy, rw
+// keeps being used until WaitIncoming returns.
+func ReceiveMigration(t Type, rw io.ReadWriter) (*Machine, error) {
+	br := bufio.NewReaderSize(rw, 1<<20)
+	h := migrationHeader{}
+
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorInvalidMigration, err)
+	}
+
+	if string(h.Magic[:]) != migrationMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrorInvalidMigration, h.Magic[:])
+	}
+
+	if h.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: version %d, expected %d", ErrorInvalidMigration, h.Version, SnapshotVersion)
+	}
+
+	m, err := NewWithType(t, int(h.NCPUs), int(h.MemSize))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		rh := recordHeader{}
+		if err := binary.Read(br, binary.LittleEndian, &rh); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrorInvalidMigration, err)
+		}
+
+		switch rh.Type {
+		case recordPages:
+			end := rh.Addr + uint64(rh.Count)*pageSize
+			if end > uint64(len(m.mem)) || end < rh.Addr {
+				return nil, fmt.Errorf("%w: pages at 0x%x beyond memory", ErrorInvalidMigration, rh.Addr)
+			}
+
+			if _, err := io.ReadFull(br, m.mem[rh.Addr:end]); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrorInvalidMigration, err)
+			}
+		case recordPostcopy:
+			if err := m.startPostcopy(rw); err != nil {
+				return nil, err
+			}
+		case recordState:
+			sections, nCpus, err := readSections(br, rh.Count, h.MemSize)
+			if err != nil {
+				return nil, err
+			}
+
+			if nCpus != len(m.vcpuFds) {
+				return nil, fmt.Errorf("%w: %d vCPUs, expected %d", ErrorInvalidMigration, nCpus, len(m.vcpuFds))
+			}
+
+			// loading the state may already touch guest memory
+			if m.postcopy != nil {
+				go m.receivePages(br)
+			}
+
+			if err := m.restoreState(sections); err != nil {
+				return nil, err
+			}
+
+			return m, nil
+		default:
+			return nil, fmt.Errorf("%w: record type %d", ErrorInvalidMigration, rh.Type)
+		}
+	}
+}
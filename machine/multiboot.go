@@ -0,0 +1,324 @@
+package machine
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/fdpath"
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// Multiboot is the boot protocol of GRUB, which QEMU also implements for
+// -kernel. Test kernels such as those of kvm-unit-tests use it: their .flat
+// files are ELF images with a multiboot header, and their environment is
+// passed as the first module.
+//
+// The kernel is entered in 32-bit protected mode without paging, with EAX
+// holding multibootBootMagic and EBX the address of the information
+// structure. Kernels which aren't ELF give their load addresses in the
+// header instead, which also boots flat binaries.
+//
+// refs: https://www.gnu.org/software/grub/manual/multiboot/multiboot.html
+const (
+	multibootMagic     = 0x1BADB002
+	multibootBootMagic = 0x2BADB002
+	multibootSearch    = 8192
+
+	// header flags
+	multibootPageAlign  = 1 << 0
+	multibootMemInfo    = 1 << 1
+	multibootVideoMode  = 1 << 2
+	multibootAOutKludge = 1 << 16
+
+	// the kernel can't boot unless a required flag not listed here is known
+	multibootRequired = 0xffff &^ (multibootPageAlign | multibootMemInfo | multibootVideoMode)
+
+	// flags of the information structure
+	multibootInfoMem     = 1 << 0
+	multibootInfoCmdline = 1 << 2
+	multibootInfoMods    = 1 << 3
+	multibootInfoMmap    = 1 << 6
+
+	multibootInfoAddr = bootParamAddr
+	multibootInfoSize = 0x58
+	multibootModsAddr = multibootInfoAddr + 0x100
+	multibootMmapAddr = multibootInfoAddr + 0x200
+	multibootModSize  = 16
+	multibootMmapSize = 24
+)
+
+var (
+	ErrorNotMultiboot     = errors.New("no multiboot header")
+	ErrorMultibootFlags   = errors.New("unsupported multiboot flags")
+	ErrorMultibootAddress = errors.New("invalid multiboot load address")
+)
+
+// multibootHeader is the header of a multiboot kernel, with the load
+// addresses of the a.out kludge.
+type multibootHeader struct {
+	offset     int // in the file
+	flags      uint32
+	headerAddr uint32
+	loadAddr   uint32
+	loadEnd    uint32
+	bssEnd     uint32
+	entry      uint32
+}
+
+// findMultibootHeader searches the first multibootSearch bytes of kernel for
+// the header, which is 4-byte aligned and has a checksum making the sum of
+// its first three fields 0.
+func findMultibootHeader(kernel []byte) (*multibootHeader, error) {
+	le := binary.LittleEndian
+
+	for off := 0; off+12 <= len(kernel) && off < multibootSearch; off += 4 {
+		magic, flags, sum := le.Uint32(kernel[off:]), le.Uint32(kernel[off+4:]), le.Uint32(kernel[off+8:])
+		if magic != multibootMagic || magic+flags+sum != 0 {
+			continue
+		}
+
+		if flags&multibootRequired != 0 {
+			return nil, fmt.Errorf("%w: 0x%x", ErrorMultibootFlags, flags&multibootRequired)
+		}
+
+		h := &multibootHeader{offset: off, flags: flags}
+
+		if flags&multibootAOutKludge != 0 {
+			if off+32 > len(kernel) {
+				return nil, fmt.Errorf("%w: truncated header", ErrorMultibootAddress)
+			}
+
+			h.headerAddr = le.Uint32(kernel[off+12:])
+			h.loadAddr = le.Uint32(kernel[off+16:])
+			h.loadEnd = le.Uint32(kernel[off+20:])
+			h.bssEnd = le.Uint32(kernel[off+24:])
+			h.entry = le.Uint32(kernel[off+28:])
+		}
+
+		return h, nil
+	}
+
+	return nil, ErrorNotMultiboot
+}
+
+// CheckMultiboot returns an error unless the file at kernelPath has a
+// multiboot header LoadMultiboot can boot.
+func CheckMultiboot(kernelPath string) error {
+	kernel, err := fdpath.ReadFile(kernelPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = findMultibootHeader(kernel)
+
+	return err
+}
+
+// loadMultibootKernel loads kernel into guest memory and returns its entry
+// point and the end of its image, including the bss.
+func (m *Machine) loadMultibootKernel(kernel []byte) (uint32, uint64, error) {
+	h, err := findMultibootHeader(kernel)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if h.flags&multibootAOutKludge == 0 {
+		return m.loadELF(kernel)
+	}
+
+	// the file is loaded from the offset of the header minus its distance
+	// to load_addr, up to load_end_addr or the end of the file
+	start := h.offset - int(h.headerAddr-h.loadAddr)
+	end := len(kernel)
+
+	if h.loadEnd != 0 {
+		end = start + int(h.loadEnd-h.loadAddr)
+	}
+
+	if h.headerAddr < h.loadAddr || start < 0 || end < start || end > len(kernel) {
+		return 0, 0, fmt.Errorf("%w: load_addr 0x%x, header_addr 0x%x", ErrorMultibootAddress, h.loadAddr, h.headerAddr)
+	}
+
+	if err := m.load(uint64(h.loadAddr), kernel[start:end]); err != nil {
+		return 0, 0, err
+	}
+
+	imageEnd := uint64(h.loadAddr) + uint64(end-start)
+
+	if uint64(h.bssEnd) > imageEnd {
+		if err := m.load(imageEnd, make([]byte, uint64(h.bssEnd)-imageEnd)); err != nil {
+			return 0, 0, err
+		}
+
+		imageEnd = uint64(h.bssEnd)
+	}
+
+	return h.entry, imageEnd, nil
+}
+
+// loadELF loads the segments of an ELF multiboot kernel at their physical
+// addresses.
+func (m *Machine) loadELF(kernel []byte) (uint32, uint64, error) {
+	f, err := elf.NewFile(bytes.NewReader(kernel))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	imageEnd := uint64(0)
+
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Memsz == 0 {
+			continue
+		}
+
+		// the sizes come from the file, so the segment is read in place
+		// once it is known to fit in guest memory
+		end := p.Paddr + p.Memsz
+		if p.Filesz > p.Memsz || end < p.Paddr || end > uint64(len(m.mem)) {
+			return 0, 0, fmt.Errorf("%w: segment 0x%x-0x%x with 0x%x bytes in the file",
+				ErrorMultibootAddress, p.Paddr, end, p.Filesz)
+		}
+
+		data := m.mem[p.Paddr:end]
+		if _, err := p.ReadAt(data[:p.Filesz], 0); err != nil {
+			return 0, 0, err
+		}
+
+		// the bss past the file size is cleared as well
+		for i := range data[p.Filesz:] {
+			data[p.Filesz+uint64(i)] = 0
+		}
+
+		if end > imageEnd {
+			imageEnd = end
+		}
+	}
+
+	if f.Entry > 0xffffffff {
+		return 0, 0, fmt.Errorf("%w: entry 0x%x is above 4G", ErrorMultibootAddress, f.Entry)
+	}
+
+	return uint32(f.Entry), imageEnd, nil
+}
+
+// LoadMultiboot boots a multiboot kernel, passing it params as its command
+// line and the file at modulePath, if any, as its only module.
+func (m *Machine) LoadMultiboot(kernelPath, modulePath, params string) error {
+	m.boot = bootSource{kernelPath, modulePath, params, true}
+
+	if err := m.initEBDA(); err != nil {
+		return err
+	}
+
+	kernel, err := fdpath.ReadFile(kernelPath)
+	if err != nil {
+		return err
+	}
+
+	entry, imageEnd, err := m.loadMultibootKernel(kernel)
+	if err != nil {
+		return fmt.Errorf("kernel: %w", err)
+	}
+
+	le := binary.LittleEndian
+	info := make([]byte, multibootInfoSize)
+	flags := uint32(multibootInfoMem | multibootInfoCmdline | multibootInfoMmap)
+
+	// lower memory ends at the EBDA, upper memory starts at 1M
+	le.PutUint32(info[4:], bootparam.EBDAStart>>10)
+	le.PutUint32(info[8:], uint32((len(m.mem)-kernelAddr)>>10))
+
+	if err := m.load(cmdlineAddr, append([]byte(params), 0)); err != nil {
+		return fmt.Errorf("command line: %w", err)
+	}
+
+	le.PutUint32(info[16:], cmdlineAddr)
+
+	if modulePath != "" {
+		module, err := fdpath.ReadFile(modulePath)
+		if err != nil {
+			return err
+		}
+
+		// modules go on the page after the kernel, as with QEMU
+		start := (imageEnd + 0xfff) &^ 0xfff
+		if err := m.load(start, module); err != nil {
+			return fmt.Errorf("module: %w", err)
+		}
+
+		mod := make([]byte, multibootModSize)
+		le.PutUint32(mod[0:], uint32(start))
+		le.PutUint32(mod[4:], uint32(start)+uint32(len(module)))
+
+		if err := m.load(multibootModsAddr, mod); err != nil {
+			return err
+		}
+
+		flags |= multibootInfoMods
+		le.PutUint32(info[20:], 1)
+		le.PutUint32(info[24:], multibootModsAddr)
+	}
+
+	// the same memory map as the e820 one LoadLinux gives
+	mmap := []struct {
+		addr, size uint64
+		typ        uint32
+	}{
+		{bootparam.RealModeIvtBegin, bootparam.EBDAStart - bootparam.RealModeIvtBegin, bootparam.E820Ram},
+		{bootparam.EBDAStart, bootparam.VGARAMBegin - bootparam.EBDAStart, bootparam.E820Reserved},
+		{bootparam.MBBIOSBegin, bootparam.MBBIOSEnd - bootparam.MBBIOSBegin, bootparam.E820Reserved},
+		{kernelAddr, uint64(len(m.mem) - kernelAddr), bootparam.E820Ram},
+	}
+
+	entries := make([]byte, len(mmap)*multibootMmapSize)
+
+	for i, e := range mmap {
+		b := entries[i*multibootMmapSize:]
+
+		// the size excludes the size field itself
+		le.PutUint32(b[0:], multibootMmapSize-4)
+		le.PutUint64(b[4:], e.addr)
+		le.PutUint64(b[12:], e.size)
+		le.PutUint32(b[20:], e.typ)
+	}
+
+	if err := m.load(multibootMmapAddr, entries); err != nil {
+		return err
+	}
+
+	le.PutUint32(info[0:], flags)
+	le.PutUint32(info[44:], uint32(len(entries)))
+	le.PutUint32(info[48:], multibootMmapAddr)
+
+	if err := m.load(multibootInfoAddr, info); err != nil {
+		return err
+	}
+
+	for i := range m.vcpuFds {
+		if err := m.initMultibootRegs(i, entry); err != nil {
+			return err
+		}
+
+		if err := m.initSregs(i); err != nil {
+			return err
+		}
+	}
+
+	m.initIOPortHandlers()
+
+	return nil
+}
+
+func (m *Machine) initMultibootRegs(i int, entry uint32) error {
+	regs := kvm.Regs{}
+	regs.RFLAGS = 2
+	regs.RIP = uint64(entry)
+	regs.RAX = multibootBootMagic
+	regs.RBX = multibootInfoAddr
+
+	return kvm.SetRegs(m.vcpuFds[i], regs)
+}
@@ -0,0 +1,179 @@
+package machine
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// kickInterval is how often vCPUs that have not acknowledged a pause request
+// are kicked again on hosts without KVM_CAP_IMMEDIATE_EXIT, where a kick is
+// lost when the signal arrives just before the vCPU enters KVM_RUN.
+const kickInterval = time.Millisecond
+
+// pauseState coordinates the vCPU threads running RunInfiniteLoop with Pause
+// and Resume.
+type pauseState struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	paused bool
+
+	// tids are the OS thread ids of the vCPUs in RunInfiniteLoop, 0 if the
+	// vCPU is not running there.
+	tids []int
+
+	// runs are the kvm_run structures of the vCPUs. With immediateExit,
+	// a kick sets their immediate_exit flag, so that KVM_RUN returns at
+	// once if the signal came before it.
+	runs          []*kvm.RunData
+	immediateExit bool
+
+	// nParked is the number of vCPUs waiting for Resume.
+	nParked int
+
+	// holdIRQs mirrors paused for InjectSerialIRQ, which reads it and
+	// records held IRQs in pendingSerialIRQ without taking mu.
+	holdIRQs         uint32
+	pendingSerialIRQ uint32
+}
+
+// setPaused must be called with p.mu held.
+func (p *pauseState) setPaused(paused bool) {
+	p.paused = paused
+
+	hold := uint32(0)
+	if paused {
+		hold = 1
+	}
+
+	atomic.StoreUint32(&p.holdIRQs, hold)
+}
+
+func (p *pauseState) init(runs []*kvm.RunData) {
+	p.cond = sync.NewCond(&p.mu)
+	p.tids = make([]int, len(runs))
+	p.runs = runs
+}
+
+func (p *pauseState) enter(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tids[i] = syscall.Gettid()
+}
+
+func (p *pauseState) leave(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tids[i] = 0
+	p.cond.Broadcast()
+}
+
+// park blocks the calling vCPU while the machine is paused.
+func (p *pauseState) park() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return
+	}
+
+	p.nParked++
+	p.cond.Broadcast()
+
+	for p.paused {
+		p.cond.Wait()
+	}
+
+	p.nParked--
+}
+
+func (p *pauseState) nRunning() int {
+	n := 0
+
+	for _, tid := range p.tids {
+		if tid != 0 {
+			n++
+		}
+	}
+
+	return n
+}
+
+// kick makes the vCPUs in KVM_RUN return to userspace. It must be called
+// with p.mu held.
+func (p *pauseState) kick() {
+	// vCPUs in KVM_RUN return with EINTR when a signal is delivered to their
+	// thread. SIGURG is used since the Go runtime already uses it to preempt
+	// goroutines and ignores it otherwise.
+	for i, tid := range p.tids {
+		if tid == 0 {
+			continue
+		}
+
+		if p.immediateExit {
+			p.runs[i].ImmediateExit = 1
+		}
+
+		_ = syscall.Tgkill(syscall.Getpid(), tid, syscall.SIGURG)
+	}
+}
+
+// Pause stops all vCPUs and returns once none of them is executing guest
+// code. While paused, serial IRQs are held back so that the machine state
+// stays consistent, e.g. for snapshots. Pausing a paused machine does nothing.
+func (m *Machine) Pause() error {
+	p := &m.pause
+
+	p.mu.Lock()
+	p.setPaused(true)
+
+	for p.nParked < p.nRunning() {
+		p.kick()
+
+		// no kick is lost, and parking or leaving wakes us up
+		if p.immediateExit {
+			p.cond.Wait()
+
+			continue
+		}
+
+		p.mu.Unlock()
+		time.Sleep(kickInterval)
+		p.mu.Lock()
+	}
+
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Resume restarts the vCPUs stopped by Pause and injects the serial IRQs
+// requested in the meantime.
+func (m *Machine) Resume() error {
+	p := &m.pause
+
+	p.mu.Lock()
+	p.setPaused(false)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	if atomic.SwapUint32(&p.pendingSerialIRQ, 0) == 1 {
+		m.serial.InjectIRQ()
+	}
+
+	return nil
+}
+
+// IsPaused returns true between Pause and Resume.
+func (m *Machine) IsPaused() bool {
+	m.pause.mu.Lock()
+	defer m.pause.mu.Unlock()
+
+	return m.pause.paused
+}
@@ -0,0 +1,289 @@
+package machine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/userfaultfd"
+)
+
+// In a post-copy migration the source is paused right away and sends its
+// state first, so that the guest resumes on the destination while its
+// memory is still on the source. The destination registers guest memory
+// with a userfaultfd, and every page the guest touches before it arrives is
+// requested from the source, which sends it ahead of the pages it pushes in
+// the background.
+//
+//	migrationHeader
+//	recordHeader{Type: recordPostcopy}
+//	recordHeader{Type: recordState}, sectionHeader, data, ...
+//	recordHeader{Type: recordPages}, pages
+//	...
+//
+// The requests flow the other way as the page offsets, 8 bytes each.
+const recordPostcopy = 3
+
+var ErrorMigrationInProgress = errors.New("guest memory is still being migrated")
+
+// postcopyState tracks the pages missing on the destination.
+type postcopyState struct {
+	uffd     *userfaultfd.FD
+	done     chan struct{}
+	err      error
+	received uint64
+	faults   uint64
+}
+
+// checkMemory fails while gokvm itself can't read guest memory: a goroutine
+// waiting for a page could keep the one receiving it from running.
+func (m *Machine) checkMemory() error {
+	p := m.postcopy
+	if p == nil {
+		return nil
+	}
+
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return ErrorMigrationInProgress
+	}
+}
+
+// MigratePostcopy sends the machine to rw, where ReceiveMigration builds a
+// copy of it, like Migrate. The guest is paused only while its state is
+// sent; its memory follows while it already runs on the destination. On
+// success the machine is left paused. Once the state is sent the guest
+// can't run on both sides, so the source stays paused on failures too.
+func (m *Machine) MigratePostcopy(rw io.ReadWriter) (MigrationStats, error) {
+	stats := MigrationStats{}
+
+	if err := m.checkMemory(); err != nil {
+		return stats, err
+	}
+
+	wasPaused := m.IsPaused()
+	start := time.Now()
+
+	if err := m.Pause(); err != nil {
+		return stats, err
+	}
+
+	bw := bufio.NewWriterSize(rw, 1<<20)
+
+	if err := m.sendPostcopyState(bw); err != nil {
+		if !wasPaused {
+			_ = m.Resume()
+		}
+
+		return stats, err
+	}
+
+	stats.Downtime = time.Since(start)
+
+	// the destination asks for the pages its guest is waiting for, and
+	// closes the connection once it has them all
+	requests := make(chan uint64, 64)
+
+	go func() {
+		defer close(requests)
+
+		for {
+			off := uint64(0)
+			if err := binary.Read(rw, binary.LittleEndian, &off); err != nil {
+				return
+			}
+
+			requests <- off
+		}
+	}()
+
+	nPages := uint64(len(m.mem) / pageSize)
+	sent := make([]uint64, (nPages+63)/64)
+	run := make([]uint64, len(sent))
+
+	sendRun := func(page uint64, max uint64) error {
+		for i := range run {
+			run[i] = 0
+		}
+
+		for n := uint64(0); page+n < nPages && n < max && sent[(page+n)/64]&(1<<((page+n)%64)) == 0; n++ {
+			run[(page+n)/64] |= 1 << ((page + n) % 64)
+			sent[(page+n)/64] |= 1 << ((page + n) % 64)
+		}
+
+		n, err := m.sendPages(bw, run)
+		stats.Pages += n
+
+		return err
+	}
+
+	for page := uint64(0); page < nPages; {
+		select {
+		case off, ok := <-requests:
+			if !ok {
+				return stats, io.ErrUnexpectedEOF
+			}
+
+			if off/pageSize < nPages {
+				stats.Requested++
+
+				if err := sendRun(off/pageSize, 1); err != nil {
+					return stats, err
+				}
+
+				if err := bw.Flush(); err != nil {
+					return stats, err
+				}
+			}
+		default:
+			if err := sendRun(page, migrationMaxRun); err != nil {
+				return stats, err
+			}
+
+			for page < nPages && sent[page/64]&(1<<(page%64)) != 0 {
+				page++
+			}
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return stats, err
+	}
+
+	// the requests left are for pages already on their way
+	for range requests {
+	}
+
+	stats.Rounds = 1
+
+	return stats, nil
+}
+
+func (m *Machine) sendPostcopyState(w *bufio.Writer) error {
+	sections, err := m.saveState()
+	if err != nil {
+		return err
+	}
+
+	h := migrationHeader{Version: SnapshotVersion, NCPUs: uint32(len(m.vcpuFds)), MemSize: uint64(len(m.mem))}
+	copy(h.Magic[:], migrationMagic)
+
+	_, _ = w.Write(encode(h, recordHeader{Type: recordPostcopy}))
+	_, _ = w.Write(encode(recordHeader{Type: recordState, Count: uint32(len(sections))}))
+	_, _ = w.Write(encodeSections(sections))
+
+	return w.Flush()
+}
+
+// startPostcopy drops the pages written while creating the machine and
+// registers guest memory, so that the faults on it are sent to w as
+// requests.
+func (m *Machine) startPostcopy(w io.Writer) error {
+	// the memory is shared anonymous memory, which MADV_DONTNEED keeps
+	if err := syscall.Madvise(m.mem, syscall.MADV_REMOVE); err != nil {
+		return err
+	}
+
+	uffd, err := userfaultfd.New()
+	if err != nil {
+		return err
+	}
+
+	if err := uffd.Register(m.mem); err != nil {
+		uffd.Close()
+
+		return err
+	}
+
+	m.postcopy = &postcopyState{uffd: uffd, done: make(chan struct{})}
+	base := uint64(uintptr(unsafe.Pointer(&m.mem[0])))
+
+	go func() {
+		for {
+			addr, err := uffd.ReadFault()
+			if err != nil {
+				return
+			}
+
+			atomic.AddUint64(&m.postcopy.faults, 1)
+
+			// a failure shows as an error receiving pages
+			if _, err := w.Write(encode((addr - base) &^ (pageSize - 1))); err != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// receivePages copies the pages from r into guest memory until all have
+// arrived, waking up the vCPUs waiting for them.
+func (m *Machine) receivePages(r io.Reader) {
+	p := m.postcopy
+	nPages := uint64(len(m.mem) / pageSize)
+	buf := make([]byte, migrationMaxRun*pageSize)
+
+	defer func() {
+		_ = p.uffd.Unregister(m.mem)
+		p.uffd.Close()
+		close(p.done)
+
+		if p.err != nil {
+			log.Error("post-copy migration failed", "received", p.received, "pages", nPages, "err", p.err)
+		} else {
+			log.Info("post-copy migration completed", "pages", nPages, "faults", atomic.LoadUint64(&p.faults))
+		}
+	}()
+
+	for p.received < nPages {
+		h := recordHeader{}
+		if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+			p.err = err
+
+			return
+		}
+
+		end := h.Addr + uint64(h.Count)*pageSize
+		if h.Type != recordPages || h.Count > migrationMaxRun || end > uint64(len(m.mem)) || end < h.Addr {
+			p.err = ErrorInvalidMigration
+
+			return
+		}
+
+		data := buf[:end-h.Addr]
+		if _, err := io.ReadFull(r, data); err != nil {
+			p.err = err
+
+			return
+		}
+
+		if err := p.uffd.Copy(m.mem[h.Addr:], data); err != nil {
+			p.err = err
+
+			return
+		}
+
+		p.received += uint64(h.Count)
+	}
+}
+
+// WaitIncoming waits until all of guest memory has arrived on the
+// destination of a post-copy migration. It returns at once for other
+// machines.
+func (m *Machine) WaitIncoming() error {
+	if m.postcopy == nil {
+		return nil
+	}
+
+	<-m.postcopy.done
+
+	return m.postcopy.err
+}
@@ -0,0 +1,179 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/fdpath"
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// ErrorResetFailed stops the vCPUs of a machine whose memory was cleared by
+// Reset but which failed to load the kernel again.
+var ErrorResetFailed = errors.New("reset failed")
+
+// bootSource is what LoadLinux or LoadMultiboot loaded, so that Reset can
+// load it again.
+type bootSource struct {
+	bzImagePath, initPath, params string
+	multiboot                     bool
+}
+
+// check returns an error unless the files of the boot source can still be
+// loaded, before Reset clears the machine for them.
+func (b bootSource) check() error {
+	if b.multiboot {
+		if err := CheckMultiboot(b.bzImagePath); err != nil {
+			return err
+		}
+	} else if _, err := bootparam.New(b.bzImagePath); err != nil {
+		return err
+	}
+
+	// the module of a multiboot kernel is optional
+	if b.initPath == "" {
+		return nil
+	}
+
+	f, err := fdpath.Open(b.initPath)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// powerOnState is the state of the in-kernel devices and of the vCPUs of a
+// new machine, as SaveState encodes it.
+type powerOnState struct {
+	vm    []byte
+	vcpus [][]byte
+}
+
+// savePowerOn keeps the state of a new machine for Reset.
+func (m *Machine) savePowerOn() error {
+	var err error
+
+	if m.powerOn.vm, err = (vmDevice{m}).SaveState(); err != nil {
+		return err
+	}
+
+	m.powerOn.vcpus = make([][]byte, len(m.vcpuFds))
+
+	for i := range m.vcpuFds {
+		if m.powerOn.vcpus[i], err = (vcpuDevice{m, i}).SaveState(); err != nil {
+			return fmt.Errorf("vCPU %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// loadPowerOn puts the PIC, the IOAPIC, the PIT and the LAPICs, MSRs, FPU
+// and pending events of the vCPUs back into their power-on state, with the
+// boot processor runnable and the others waiting for INIT and SIPI.
+func (m *Machine) loadPowerOn() error {
+	vm := vmDevice{m}
+	if err := vm.LoadState(vm.StateVersion(), m.powerOn.vm); err != nil {
+		return err
+	}
+
+	for i, data := range m.powerOn.vcpus {
+		vcpu := vcpuDevice{m, i}
+		if err := vcpu.LoadState(vcpu.StateVersion(), data); err != nil {
+			return fmt.Errorf("vCPU %d: %w", i, err)
+		}
+
+		state := uint32(kvm.MPStateUninitialized)
+		if i == 0 {
+			state = kvm.MPStateRunnable
+		}
+
+		if err := kvm.SetMPState(m.vcpuFds[i], state); err != nil {
+			return fmt.Errorf("vCPU %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Reset is the equivalent of pressing the reset button: the vCPUs are
+// stopped, the vCPUs and the in-kernel devices are put back into their
+// power-on state, guest memory is cleared, and the kernel and initrd are
+// loaded again from their files. A machine paused before Reset stays paused.
+//
+// Nothing changes if the files can't be loaded anymore. If loading them
+// fails once memory is cleared, the vCPUs stop with ErrorResetFailed.
+func (m *Machine) Reset() error {
+	m.resetMu.Lock()
+	defer m.resetMu.Unlock()
+
+	if err := m.checkMemory(); err != nil {
+		return err
+	}
+
+	if err := m.boot.check(); err != nil {
+		return err
+	}
+
+	wasPaused := m.IsPaused()
+
+	if err := m.Pause(); err != nil {
+		return err
+	}
+
+	// before memory is cleared, so that KVM no longer writes to the areas
+	// the guest gave it with MSRs, such as those of kvmclock
+	if err := m.loadPowerOn(); err != nil {
+		return m.failReset(err)
+	}
+
+	// shared anonymous memory is released rather than written, which would
+	// allocate the pages the guest never used; the memory of a lazy restore
+	// is a private mapping of the snapshot
+	if err := syscall.Madvise(m.mem, syscall.MADV_REMOVE); err != nil {
+		for i := range m.mem {
+			m.mem[i] = 0
+		}
+	}
+
+	m.markWritten(0, uint64(len(m.mem)))
+
+	m.serial.Reset()
+
+	atomic.StoreUint32(&m.pause.pendingSerialIRQ, 0)
+
+	var err error
+
+	if m.boot.multiboot {
+		err = m.LoadMultiboot(m.boot.bzImagePath, m.boot.initPath, m.boot.params)
+	} else {
+		err = m.LoadLinux(m.boot.bzImagePath, m.boot.initPath, m.boot.params)
+	}
+
+	if err != nil {
+		return m.failReset(err)
+	}
+
+	if wasPaused {
+		return nil
+	}
+
+	return m.Resume()
+}
+
+// failReset stops the vCPUs with err rather than leaving them paused over
+// memory without a kernel.
+func (m *Machine) failReset(err error) error {
+	m.resetErr = fmt.Errorf("%w: %v", ErrorResetFailed, err)
+	atomic.StoreUint32(&m.resetFailed, 1)
+
+	if err := m.Resume(); err != nil {
+		return err
+	}
+
+	return m.resetErr
+}
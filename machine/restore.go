@@ -0,0 +1,186 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/fdpath"
+)
+
+// snapshot is a parsed snapshot file without guest memory.
+type snapshot struct {
+	header   snapshotHeader
+	sections map[string]section
+	nCpus    int
+	delta    bool
+}
+
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	s := &snapshot{}
+
+	if err := binary.Read(r, binary.LittleEndian, &s.header); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorInvalidSnapshot, err)
+	}
+
+	s.delta = string(s.header.Magic[:]) == deltaMagic
+
+	if string(s.header.Magic[:]) != snapshotMagic && !s.delta {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrorInvalidSnapshot, s.header.Magic[:])
+	}
+
+	if s.header.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: version %d, expected %d", ErrorInvalidSnapshot, s.header.Version, SnapshotVersion)
+	}
+
+	var err error
+
+	s.sections, s.nCpus, err = readSections(r, s.header.NSections, s.header.MemOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.sections[sectionParent]; s.delta && !ok {
+		return nil, fmt.Errorf("%w: no %s section", ErrorInvalidSnapshot, sectionParent)
+	}
+
+	return s, nil
+}
+
+// readSections reads n sections of at most max bytes each, checks that at
+// least one vCPU is present, and returns the sections by name along with
+// the number of vCPUs.
+func readSections(r io.Reader, n uint32, max uint64) (map[string]section, int, error) {
+	sections := map[string]section{}
+	nCpus := 0
+
+	for i := uint32(0); i < n; i++ {
+		h := sectionHeader{}
+		if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+			return nil, 0, fmt.Errorf("%w: %s", ErrorInvalidSnapshot, err)
+		}
+
+		if h.Size > max {
+			return nil, 0, fmt.Errorf("%w: section of %d bytes", ErrorInvalidSnapshot, h.Size)
+		}
+
+		data := make([]byte, h.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, 0, fmt.Errorf("%w: %s", ErrorInvalidSnapshot, err)
+		}
+
+		name := string(bytes.TrimRight(h.Name[:], "\x00"))
+		sections[name] = section{name, h.Version, data}
+
+		if strings.HasPrefix(name, "vcpu.") {
+			nCpus++
+		}
+	}
+
+	for i := 0; i < nCpus; i++ {
+		if _, ok := sections[fmt.Sprintf(sectionVCPU, i)]; !ok {
+			return nil, 0, fmt.Errorf("%w: no %s section", ErrorInvalidSnapshot, fmt.Sprintf(sectionVCPU, i))
+		}
+	}
+
+	if nCpus == 0 {
+		return nil, 0, fmt.Errorf("%w: no vCPU", ErrorInvalidSnapshot)
+	}
+
+	return sections, nCpus, nil
+}
+
+// Restore creates a machine of type t from the snapshot file at path, with
+// the vCPUs and memory size of the snapshotted machine. With lazy, guest
+// memory is mapped privately from the file, so that pages are only read
+// when the guest touches them; otherwise it is read in full.
+//
+// An incremental snapshot is restored on top of its parents, which are
+// opened from the paths it records; with lazy, only the full snapshot at the
+// root is mapped. The machine resumes where it was snapshotted once its
+// vCPUs are run, and the snapshot becomes the base of the next incremental
+// one. Reset boots from the files given to SetBootSource. The parents of a
+// snapshot passed as fd=N are relative to the working directory.
+func Restore(t Type, path string, lazy bool) (*Machine, error) {
+	f, err := fdpath.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	s, err := readSnapshot(f)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := NewWithType(t, s.nCpus, int(s.header.MemSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.loadMemory(f, s, lazy, 0); err != nil {
+		return nil, err
+	}
+
+	if err := m.restoreState(s.sections); err != nil {
+		return nil, err
+	}
+
+	// snapshots taken before incremental ones existed have no id
+	if id, ok := s.id(); ok {
+		if err := m.trackFrom(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// SetBootSource sets the files Reset boots from, for a machine which was not
+// booted with LoadLinux.
+func (m *Machine) SetBootSource(bzImagePath, initPath, params string) {
+	m.boot = bootSource{bzImagePath, initPath, params, false}
+}
+
+// SetMultibootSource is SetBootSource for a multiboot kernel and its module.
+func (m *Machine) SetMultibootSource(kernelPath, modulePath, params string) {
+	m.boot = bootSource{kernelPath, modulePath, params, true}
+}
+
+// mapMemory replaces the anonymous guest memory by a private mapping of f
+// at offset.
+func (m *Machine) mapMemory(f *os.File, offset int64) error {
+	mem, err := syscall.Mmap(int(f.Fd()), offset, len(m.mem),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+
+	if err := m.slots.Resize(m.ramSlot, mem); err != nil {
+		_ = syscall.Munmap(mem)
+
+		return err
+	}
+
+	_ = syscall.Munmap(m.mem)
+	m.mem = mem
+
+	return nil
+}
+
+func decode(data []byte, v ...interface{}) error {
+	r := bytes.NewReader(data)
+
+	for _, x := range v {
+		if err := binary.Read(r, binary.LittleEndian, x); err != nil {
+			return fmt.Errorf("%w: %s", ErrorInvalidSnapshot, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A snapshot starts with a header followed by named sections holding the
+// state of the VM, the devices and each vCPU. Guest memory comes last at a
+// page-aligned offset, so that it can be mapped from the file on restore.
+//
+//	snapshotHeader
+//	sectionHeader, data
+//	...
+//	padding to MemOffset
+//	guest memory
+//
+// Incremental snapshots are described in incremental.go. All numbers are
+// little endian. Each section records the version of its own encoding, see
+// Saveable; SnapshotVersion must be incremented whenever the layout of the
+// file itself changes.
+const (
+	snapshotMagic   = "GOKVMSNP"
+	SnapshotVersion = 2
+
+	sectionVM     = "vm"
+	sectionSerial = "serial"
+	sectionVCPU   = "vcpu.%d"
+	sectionClock  = "clock"
+)
+
+var ErrorInvalidSnapshot = errors.New("invalid snapshot")
+
+type snapshotHeader struct {
+	Magic     [8]byte
+	Version   uint32
+	NSections uint32
+	MemOffset uint64
+	MemSize   uint64
+}
+
+// sectionHeader is followed by the state of a part of the machine, encoded
+// in Version by its Saveable.
+type sectionHeader struct {
+	Name    [16]byte
+	Version uint32
+	_       uint32
+	Size    uint64
+}
+
+type section struct {
+	name    string
+	version uint32
+	data    []byte
+}
+
+func encode(v ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	for _, x := range v {
+		_ = binary.Write(buf, binary.LittleEndian, x)
+	}
+
+	return buf.Bytes()
+}
+
+func encodeSections(sections []section) []byte {
+	buf := &bytes.Buffer{}
+
+	for _, s := range sections {
+		h := sectionHeader{Version: s.version, Size: uint64(len(s.data))}
+		copy(h.Name[:], s.name)
+		buf.Write(encode(h, s.data))
+	}
+
+	return buf.Bytes()
+}
+
+// Snapshot writes the guest memory and the state of the vCPUs and the
+// devices to w, so that the machine can be restored later. The machine is
+// paused while the snapshot is written, and resumed afterwards unless it was
+// already paused. The snapshot becomes the base of the next incremental one.
+func (m *Machine) Snapshot(w io.Writer) error {
+	if err := m.checkMemory(); err != nil {
+		return err
+	}
+
+	wasPaused := m.IsPaused()
+
+	if err := m.Pause(); err != nil {
+		return err
+	}
+
+	if !wasPaused {
+		defer func() {
+			_ = m.Resume()
+		}()
+	}
+
+	sections, err := m.saveState()
+	if err != nil {
+		return err
+	}
+
+	id, err := newSnapshotID()
+	if err != nil {
+		return err
+	}
+
+	sections = append(sections, section{sectionID, 1, id[:]})
+
+	if err := writeHeader(w, snapshotMagic, sections, uint64(len(m.mem))); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(m.mem); err != nil {
+		return err
+	}
+
+	return m.trackFrom(id)
+}
+
+// writeHeader writes the header and the sections of a snapshot, padded to
+// the offset where guest memory starts.
+func writeHeader(w io.Writer, magic string, sections []section, memSize uint64) error {
+	buf := bytes.NewBuffer(encodeSections(sections))
+
+	headerSize := uint64(binary.Size(snapshotHeader{}))
+	h := snapshotHeader{
+		Version:   SnapshotVersion,
+		NSections: uint32(len(sections)),
+		MemOffset: pageAlign(headerSize + uint64(buf.Len())),
+		MemSize:   memSize,
+	}
+	copy(h.Magic[:], magic)
+
+	if _, err := w.Write(encode(h)); err != nil {
+		return err
+	}
+
+	buf.Write(make([]byte, h.MemOffset-headerSize-uint64(buf.Len())))
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
@@ -0,0 +1,199 @@
+package machine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// Reasons of a Stall.
+const (
+	// StallOutsideRun means the vCPU thread has not returned to KVM_RUN,
+	// e.g. because a device model blocks.
+	StallOutsideRun = "outside-run"
+	// StallSameRIP means the vCPU executed guest code without moving from
+	// one instruction, e.g. a guest deadlocked on a spinlock.
+	StallSameRIP = "same-rip"
+)
+
+// Stall is reported when a vCPU makes no progress for the stall timeout.
+type Stall struct {
+	VCPU     int
+	Reason   string
+	Duration time.Duration
+	Regs     kvm.Regs
+}
+
+// vcpuProgress is what the stall detector knows about a vCPU.
+type vcpuProgress struct {
+	mu sync.Mutex
+
+	inRun bool
+	// since is the time of the last entry to or exit from KVM_RUN.
+	since time.Time
+
+	// rip is the RIP sampled on the last kick of a runnable vCPU, and
+	// ripSince when the vCPU was first seen there. ripSince is zero while
+	// the vCPU is halted or waits for a SIPI, which isn't a stall.
+	rip      uint64
+	ripSince time.Time
+	regs     kvm.Regs
+
+	reportedOutside, reportedRIP bool
+}
+
+type stallDetector struct {
+	timeout time.Duration
+	report  func(Stall)
+	vcpus   []vcpuProgress
+	stop    chan struct{}
+}
+
+// DetectStalls calls report from a separate goroutine when a vCPU stays out
+// of KVM_RUN or on the same RIP for timeout, once per stall. vCPUs in
+// KVM_RUN are kicked every quarter of timeout to sample their RIP, and
+// paused machines are not checked. It must be called before the vCPUs run,
+// and the returned function stops the detection.
+func (m *Machine) DetectStalls(timeout time.Duration, report func(Stall)) (stop func()) {
+	d := &stallDetector{
+		timeout: timeout,
+		report:  report,
+		vcpus:   make([]vcpuProgress, len(m.vcpuFds)),
+		stop:    make(chan struct{}),
+	}
+
+	now := time.Now()
+	for i := range d.vcpus {
+		d.vcpus[i].since = now
+	}
+
+	m.stalls = d
+
+	go m.watchStalls(d)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(d.stop) })
+	}
+}
+
+func (m *Machine) watchStalls(d *stallDetector) {
+	interval := d.timeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+
+		m.pause.mu.Lock()
+		paused := m.pause.paused
+		tids := append([]int(nil), m.pause.tids...)
+
+		if !paused {
+			m.pause.kick()
+		}
+		m.pause.mu.Unlock()
+
+		now := time.Now()
+
+		for i := range d.vcpus {
+			p := &d.vcpus[i]
+
+			p.mu.Lock()
+
+			if paused || tids[i] == 0 {
+				// the vCPU gets a fresh start once it runs again
+				p.since = now
+				p.ripSince = time.Time{}
+				p.mu.Unlock()
+
+				continue
+			}
+
+			stalls := m.checkStall(i, p, now, d.timeout)
+			p.mu.Unlock()
+
+			for _, s := range stalls {
+				d.report(s)
+			}
+		}
+	}
+}
+
+// checkStall must be called with p.mu held, which keeps the vCPU from
+// entering KVM_RUN while its registers are read.
+func (m *Machine) checkStall(i int, p *vcpuProgress, now time.Time, timeout time.Duration) []Stall {
+	stalls := []Stall{}
+
+	if !p.inRun && now.Sub(p.since) >= timeout && !p.reportedOutside {
+		p.reportedOutside = true
+		regs, _ := kvm.GetRegs(m.vcpuFds[i])
+		stalls = append(stalls, Stall{VCPU: i, Reason: StallOutsideRun, Duration: now.Sub(p.since), Regs: regs})
+	}
+
+	if !p.ripSince.IsZero() && now.Sub(p.ripSince) >= timeout && !p.reportedRIP {
+		p.reportedRIP = true
+		stalls = append(stalls, Stall{VCPU: i, Reason: StallSameRIP, Duration: now.Sub(p.ripSince), Regs: p.regs})
+	}
+
+	return stalls
+}
+
+func (d *stallDetector) enterRun(i int) {
+	p := &d.vcpus[i]
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inRun = true
+	p.since = time.Now()
+	p.reportedOutside = false
+}
+
+// exitRun samples the RIP when the vCPU was kicked out of KVM_RUN by the
+// detector; other exits are too frequent to pay for reading the registers.
+func (d *stallDetector) exitRun(i int, vcpuFd uintptr, kicked bool) {
+	p := &d.vcpus[i]
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.inRun = false
+	p.since = now
+
+	if !kicked {
+		return
+	}
+
+	state, err := kvm.GetMPState(vcpuFd)
+	if err != nil || state != kvm.MPStateRunnable {
+		p.ripSince = time.Time{}
+		p.reportedRIP = false
+
+		return
+	}
+
+	regs, err := kvm.GetRegs(vcpuFd)
+	if err != nil {
+		return
+	}
+
+	if p.ripSince.IsZero() || regs.RIP != p.rip {
+		p.rip = regs.RIP
+		p.ripSince = now
+		p.reportedRIP = false
+	}
+
+	p.regs = regs
+}
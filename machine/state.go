@@ -0,0 +1,390 @@
+package machine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// Saveable is a part of the machine kept in snapshots and migrations. Each
+// part versions its encoding on its own, so that a change to one doesn't
+// break the snapshots of the others.
+type Saveable interface {
+	// StateVersion returns the version of the encoding of SaveState, which
+	// must be incremented whenever the encoding changes.
+	StateVersion() uint32
+
+	// SaveState encodes the state of a paused machine.
+	SaveState() ([]byte, error)
+
+	// LoadState decodes the state encoded by SaveState in version, which
+	// is at most StateVersion.
+	LoadState(version uint32, data []byte) error
+}
+
+var ErrorNoClockTimestamp = errors.New("the snapshot doesn't record when it was saved")
+
+// stateEntry is a part of the machine, saved in the section name.
+type stateEntry struct {
+	name string
+	dev  Saveable
+}
+
+// initState registers the parts of the machine with state, in the order
+// they are loaded. The compat section is checked first, and the clock goes
+// last so that the guest sees no time pass while its state is loaded.
+func (m *Machine) initState() {
+	m.states = []stateEntry{{sectionCompat, compatDevice{m}}, {sectionVM, vmDevice{m}}}
+
+	for i := range m.vcpuFds {
+		m.states = append(m.states, stateEntry{fmt.Sprintf(sectionVCPU, i), vcpuDevice{m, i}})
+	}
+
+	m.states = append(m.states,
+		stateEntry{sectionSerial, m.serial},
+		stateEntry{sectionClock, clockDevice{m}})
+}
+
+// saveState returns the sections of all parts of the machine, which must be
+// paused.
+func (m *Machine) saveState() ([]section, error) {
+	sections := make([]section, 0, len(m.states))
+
+	for _, e := range m.states {
+		data, err := e.dev.SaveState()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.name, err)
+		}
+
+		sections = append(sections, section{e.name, e.dev.StateVersion(), data})
+	}
+
+	return sections, nil
+}
+
+// restoreState loads the sections read by readSections into a machine with
+// the same number of vCPUs.
+func (m *Machine) restoreState(sections map[string]section) error {
+	for _, e := range m.states {
+		s, ok := sections[e.name]
+		if !ok && e.name == sectionCompat {
+			// snapshots of older versions don't record what they need
+			log.Warn("snapshot without a compat section, not checking its compatibility")
+
+			continue
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: no %s section", ErrorInvalidSnapshot, e.name)
+		}
+
+		if s.version == 0 || s.version > e.dev.StateVersion() {
+			return fmt.Errorf("%w: %s state version %d, expected at most %d",
+				ErrorInvalidSnapshot, e.name, s.version, e.dev.StateVersion())
+		}
+
+		err := e.dev.LoadState(s.version, s.data)
+		if errors.Is(err, ErrorIncompatibleSnapshot) {
+			return err
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.name, err)
+		}
+	}
+
+	m.initIOPortHandlers()
+
+	return nil
+}
+
+// vmDevice is the state of the in-kernel devices and of the machine itself.
+type vmDevice struct {
+	m *Machine
+}
+
+type vmState struct {
+	PICMaster kvm.IRQChip
+	PICSlave  kvm.IRQChip
+	IOAPIC    kvm.IRQChip
+	PIT       kvm.PITState2
+	ExitCode  int32
+	_         uint32
+}
+
+func (d vmDevice) StateVersion() uint32 {
+	return 1
+}
+
+func (d vmDevice) SaveState() ([]byte, error) {
+	st := vmState{
+		PICMaster: kvm.IRQChip{ChipID: kvm.IRQChipPICMaster},
+		PICSlave:  kvm.IRQChip{ChipID: kvm.IRQChipPICSlave},
+		IOAPIC:    kvm.IRQChip{ChipID: kvm.IRQChipIOAPIC},
+		ExitCode:  atomic.LoadInt32(&d.m.exitCode),
+	}
+
+	for _, chip := range []*kvm.IRQChip{&st.PICMaster, &st.PICSlave, &st.IOAPIC} {
+		if err := kvm.GetIRQChip(d.m.vmFd, chip); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+
+	if st.PIT, err = kvm.GetPIT2(d.m.vmFd); err != nil {
+		return nil, err
+	}
+
+	return encode(st), nil
+}
+
+func (d vmDevice) LoadState(version uint32, data []byte) error {
+	st := vmState{}
+	if err := decode(data, &st); err != nil {
+		return err
+	}
+
+	for _, chip := range []*kvm.IRQChip{&st.PICMaster, &st.PICSlave, &st.IOAPIC} {
+		if err := kvm.SetIRQChip(d.m.vmFd, chip); err != nil {
+			return err
+		}
+	}
+
+	if err := d.m.serialIRQ.lower(); err != nil {
+		return err
+	}
+
+	if err := kvm.SetPIT2(d.m.vmFd, st.PIT); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&d.m.exitCode, st.ExitCode)
+
+	return nil
+}
+
+// clockDevice is the kvmclock of the VM.
+type clockDevice struct {
+	m *Machine
+}
+
+// clockState records when the clock was saved since version 2, so that the
+// time the machine spent saved can be added to it.
+type clockState struct {
+	Clock   kvm.ClockData
+	SavedAt int64
+}
+
+func (d clockDevice) StateVersion() uint32 {
+	return 2
+}
+
+func (d clockDevice) SaveState() ([]byte, error) {
+	clock, err := kvm.GetClock(d.m.vmFd)
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(clockState{clock, time.Now().UnixNano()}), nil
+}
+
+func (d clockDevice) LoadState(version uint32, data []byte) error {
+	st := clockState{}
+
+	var err error
+	if version < 2 {
+		err = decode(data, &st.Clock)
+	} else {
+		err = decode(data, &st)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// KVM_SET_CLOCK rejects the flags KVM_GET_CLOCK reports
+	st.Clock.Flags = 0
+	d.m.clockSavedAt = st.SavedAt
+
+	return kvm.SetClock(d.m.vmFd, st.Clock)
+}
+
+// ResyncClock advances the kvmclock of a restored or migrated machine by the
+// time since its state was saved, so that the guest wall clock is right
+// again instead of lagging behind, e.g. for TLS certificates and cron. It
+// must be called before the vCPUs run, and returns the time added.
+func (m *Machine) ResyncClock() (time.Duration, error) {
+	if m.clockSavedAt == 0 {
+		return 0, ErrorNoClockTimestamp
+	}
+
+	elapsed := time.Duration(time.Now().UnixNano() - m.clockSavedAt)
+	if elapsed <= 0 {
+		return 0, nil
+	}
+
+	clock, err := kvm.GetClock(m.vmFd)
+	if err != nil {
+		return 0, err
+	}
+
+	clock.Clock += uint64(elapsed)
+	clock.Flags = 0
+
+	return elapsed, kvm.SetClock(m.vmFd, clock)
+}
+
+// vcpuDevice is the state of a vCPU and its LAPIC.
+type vcpuDevice struct {
+	m *Machine
+	i int
+}
+
+// vcpuState is followed by NMSRs kvm.MSREntry.
+type vcpuState struct {
+	Regs    kvm.Regs
+	Sregs   kvm.Sregs
+	XSave   kvm.XSave
+	XCRS    kvm.XCRS
+	LAPIC   kvm.LAPICState
+	Events  kvm.VCPUEvents
+	MPState uint32
+	NMSRs   uint32
+}
+
+func (d vcpuDevice) StateVersion() uint32 {
+	return 1
+}
+
+// readMSRs reads all the MSRs KVM knows about. KVM stops reading at an MSR
+// the vCPU doesn't have, which is skipped.
+func (d vcpuDevice) readMSRs() ([]kvm.MSREntry, error) {
+	indices, err := kvm.GetMSRIndexList(d.m.kvmFd)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]kvm.MSREntry, len(indices))
+	for j, index := range indices {
+		entries[j].Index = index
+	}
+
+	msrs := []kvm.MSREntry{}
+
+	for start := 0; start < len(entries); {
+		n, err := kvm.GetMSRs(d.m.vcpuFds[d.i], entries[start:])
+		if err != nil {
+			return nil, err
+		}
+
+		msrs = append(msrs, entries[start:start+n]...)
+		start += n + 1
+	}
+
+	return msrs, nil
+}
+
+func (d vcpuDevice) SaveState() ([]byte, error) {
+	fd := d.m.vcpuFds[d.i]
+	st := vcpuState{}
+
+	var err error
+
+	if st.Regs, err = kvm.GetRegs(fd); err != nil {
+		return nil, err
+	}
+
+	if st.Sregs, err = kvm.GetSregs(fd); err != nil {
+		return nil, err
+	}
+
+	if st.XSave, err = kvm.GetXSave(fd); err != nil {
+		return nil, err
+	}
+
+	if st.XCRS, err = kvm.GetXCRS(fd); err != nil {
+		return nil, err
+	}
+
+	if st.LAPIC, err = kvm.GetLAPIC(fd); err != nil {
+		return nil, err
+	}
+
+	if st.Events, err = kvm.GetVCPUEvents(fd); err != nil {
+		return nil, err
+	}
+
+	if st.MPState, err = kvm.GetMPState(fd); err != nil {
+		return nil, err
+	}
+
+	msrs, err := d.readMSRs()
+	if err != nil {
+		return nil, err
+	}
+
+	st.NMSRs = uint32(len(msrs))
+
+	return encode(st, msrs), nil
+}
+
+// LoadState loads the state in the order QEMU does: the MSRs need the
+// special registers, and the LAPIC and pending events come last.
+func (d vcpuDevice) LoadState(version uint32, data []byte) error {
+	st := vcpuState{}
+	if err := decode(data, &st); err != nil {
+		return err
+	}
+
+	msrs := make([]kvm.MSREntry, st.NMSRs)
+	if err := decode(data[binary.Size(st):], msrs); err != nil {
+		return err
+	}
+
+	fd := d.m.vcpuFds[d.i]
+
+	if err := kvm.SetRegs(fd, st.Regs); err != nil {
+		return err
+	}
+
+	if err := kvm.SetXSave(fd, st.XSave); err != nil {
+		return err
+	}
+
+	if err := kvm.SetXCRS(fd, st.XCRS); err != nil {
+		return err
+	}
+
+	if err := kvm.SetSregs(fd, st.Sregs); err != nil {
+		return err
+	}
+
+	// like reading, writing stops at an MSR KVM refuses, which is skipped
+	for start := 0; start < len(msrs); {
+		n, err := kvm.SetMSRs(fd, msrs[start:])
+		if err != nil {
+			return err
+		}
+
+		if n < len(msrs[start:]) {
+			log.Warn("failed to restore an MSR", "cpu", d.i, "msr", fmt.Sprintf("0x%x", msrs[start+n].Index))
+		}
+
+		start += n + 1
+	}
+
+	if err := kvm.SetMPState(fd, st.MPState); err != nil {
+		return err
+	}
+
+	if err := kvm.SetLAPIC(fd, st.LAPIC); err != nil {
+		return err
+	}
+
+	return kvm.SetVCPUEvents(fd, st.Events)
+}
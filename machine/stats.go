@@ -0,0 +1,198 @@
+package machine
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/tracing"
+)
+
+var ErrorStatsNotSupported = errors.New("kvm binary stats are not supported")
+
+// SlowExitThreshold is the time spent handling an exit in userspace above
+// which the exit is counted as slow.
+const SlowExitThreshold = time.Millisecond
+
+// exitStats accumulates the exits of a vCPU indexed by exit reason.
+type exitStats struct {
+	counts [kvm.NumExitReasons]uint64
+	nanos  [kvm.NumExitReasons]uint64
+	slow   [kvm.NumExitReasons]uint64
+}
+
+type portStats struct {
+	count uint64
+	nanos uint64
+}
+
+// ExitStat describes the exits of one reason.
+type ExitStat struct {
+	Count uint64
+	// Time is the total time spent handling the exits in userspace.
+	Time time.Duration
+	// Slow is the number of exits which took longer than SlowExitThreshold.
+	Slow uint64
+}
+
+// PortStat describes the exits to an I/O port.
+type PortStat struct {
+	Count uint64
+	Time  time.Duration
+}
+
+func (m *Machine) countExit(i int, d time.Duration) {
+	reason := m.runs[i].ExitReason
+	if reason >= kvm.NumExitReasons {
+		reason = kvm.EXITUNKNOWN
+	}
+
+	s := &m.exits[i]
+	atomic.AddUint64(&s.counts[reason], 1)
+	atomic.AddUint64(&s.nanos[reason], uint64(d))
+
+	if d > SlowExitThreshold {
+		atomic.AddUint64(&s.slow[reason], 1)
+		log.Debug("slow exit", "vcpu", i, "reason", kvm.ExitReasonName(reason), "duration", d)
+
+		end := time.Now()
+		tracing.Record("exit "+kvm.ExitReasonName(reason), end.Add(-d), end, "vcpu", i)
+	}
+}
+
+func (m *Machine) countIOPort(port uint64, d time.Duration) {
+	atomic.AddUint64(&m.ioports[port].count, 1)
+	atomic.AddUint64(&m.ioports[port].nanos, uint64(d))
+}
+
+// ExitStats returns the exits so far of a vCPU, keyed by the names of
+// kvm.ExitReasonName. Reasons which never occurred are omitted.
+func (m *Machine) ExitStats(cpu int) (map[string]ExitStat, error) {
+	if err := m.checkCPU(cpu); err != nil {
+		return nil, err
+	}
+
+	s := &m.exits[cpu]
+	stats := map[string]ExitStat{}
+
+	for reason := range s.counts {
+		n := atomic.LoadUint64(&s.counts[reason])
+		if n == 0 {
+			continue
+		}
+
+		stats[kvm.ExitReasonName(uint32(reason))] = ExitStat{
+			Count: n,
+			Time:  time.Duration(atomic.LoadUint64(&s.nanos[reason])),
+			Slow:  atomic.LoadUint64(&s.slow[reason]),
+		}
+	}
+
+	return stats, nil
+}
+
+// IOPortStats returns the exits so far to each I/O port accessed by the
+// guest, which shows the ports worth optimizing.
+func (m *Machine) IOPortStats() map[uint16]PortStat {
+	stats := map[uint16]PortStat{}
+
+	for port := range m.ioports {
+		n := atomic.LoadUint64(&m.ioports[port].count)
+		if n == 0 {
+			continue
+		}
+
+		stats[uint16(port)] = PortStat{
+			Count: n,
+			Time:  time.Duration(atomic.LoadUint64(&m.ioports[port].nanos)),
+		}
+	}
+
+	return stats
+}
+
+// DeviceStats describes the traffic of an emulated device. Rx are the bytes
+// from the host to the guest, and Tx the ones from the guest to the host.
+type DeviceStats struct {
+	Name       string
+	QueueDepth int
+	RxBytes    uint64
+	TxBytes    uint64
+}
+
+// DeviceStats returns the statistics of all the devices with queues.
+func (m *Machine) DeviceStats() []DeviceStats {
+	rx, tx := m.serial.Stats()
+
+	return []DeviceStats{{
+		Name:       "serial0",
+		QueueDepth: m.serial.QueueDepth(),
+		RxBytes:    rx,
+		TxBytes:    tx,
+	}}
+}
+
+// KVMStats are the statistics kept by KVM for the VM and each vCPU, e.g.
+// halt polls, MMU operations and injected interrupts.
+type KVMStats struct {
+	VM    []kvm.Stat
+	VCPUs [][]kvm.Stat
+}
+
+// openStatsFds opens the stats file descriptors of the VM and the vCPUs on
+// the first call, so that machines never asked for their stats don't hold
+// them.
+func (m *Machine) openStatsFds() error {
+	m.statsOnce.Do(func() {
+		if n, _ := kvm.CheckExtension(m.kvmFd, kvm.CapBinaryStatsFD); n == 0 {
+			m.statsErr = ErrorStatsNotSupported
+
+			return
+		}
+
+		for _, fd := range append([]uintptr{m.vmFd}, m.vcpuFds...) {
+			statsFd, err := kvm.GetStatsFD(fd)
+			if err != nil {
+				for _, fd := range m.statsFds {
+					_ = syscall.Close(int(fd))
+				}
+
+				m.statsFds = nil
+				m.statsErr = err
+
+				return
+			}
+
+			m.statsFds = append(m.statsFds, statsFd)
+		}
+	})
+
+	return m.statsErr
+}
+
+// KVMStats reads the statistics of KVM, which makes running kvm_stat on the
+// host unnecessary.
+func (m *Machine) KVMStats() (KVMStats, error) {
+	stats := KVMStats{}
+
+	if err := m.openStatsFds(); err != nil {
+		return stats, err
+	}
+
+	for i, fd := range m.statsFds {
+		st, err := kvm.ReadStats(fd)
+		if err != nil {
+			return stats, err
+		}
+
+		if i == 0 {
+			stats.VM = st
+		} else {
+			stats.VCPUs = append(stats.VCPUs, st)
+		}
+	}
+
+	return stats, nil
+}
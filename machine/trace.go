@@ -0,0 +1,97 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/logging"
+)
+
+var ErrorInvalidTraceRange = errors.New("invalid trace range")
+
+// TraceRange is an inclusive range of I/O ports or guest physical addresses
+// whose accesses are traced.
+type TraceRange struct {
+	Start, End uint64
+}
+
+var traceLog = logging.New("trace")
+
+// ParseTraceRanges parses a comma-separated list of addresses and ranges,
+// e.g. "0x3f8-0x3ff,0x501". "all" matches any address.
+func ParseTraceRanges(s string) ([]TraceRange, error) {
+	if s == "all" {
+		return []TraceRange{{0, ^uint64(0)}}, nil
+	}
+
+	ranges := []TraceRange{}
+
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+
+		start, err := strconv.ParseUint(bounds[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrorInvalidTraceRange, item)
+		}
+
+		end := start
+
+		if len(bounds) == 2 {
+			if end, err = strconv.ParseUint(bounds[1], 0, 64); err != nil || end < start {
+				return nil, fmt.Errorf("%w: %q", ErrorInvalidTraceRange, item)
+			}
+		}
+
+		ranges = append(ranges, TraceRange{start, end})
+	}
+
+	return ranges, nil
+}
+
+// EnableTrace logs every port and MMIO access within ranges with the vCPU
+// and its RIP. Reading the registers on every access makes the guest slow,
+// so this is meant for bringing up device models.
+func (m *Machine) EnableTrace(ranges []TraceRange) {
+	m.traceRanges = ranges
+}
+
+func (m *Machine) traced(addr uint64) bool {
+	for _, r := range m.traceRanges {
+		if r.Start <= addr && addr <= r.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Machine) traceAccess(i int, kind string, addr uint64, write bool, data []byte) {
+	if !m.traced(addr) {
+		return
+	}
+
+	var value uint64
+	for j := len(data) - 1; j >= 0; j-- {
+		value = value<<8 | uint64(data[j])
+	}
+
+	op := "read"
+	if write {
+		op = "write"
+	}
+
+	rip := "unknown"
+	if regs, err := kvm.GetRegs(m.vcpuFds[i]); err == nil {
+		rip = fmt.Sprintf("0x%x", regs.RIP)
+	}
+
+	traceLog.Info(kind+" "+op,
+		"vcpu", i,
+		"rip", rip,
+		"addr", fmt.Sprintf("0x%x", addr),
+		"size", len(data),
+		"value", fmt.Sprintf("0x%0*x", 2*len(data), value))
+}
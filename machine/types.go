@@ -0,0 +1,82 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// A machine type pins the devices and the guest ABI seen by the guest. Once a
+// type is released it must not change: new or changed guest-visible behavior
+// gets a new version of the type, so that a guest keeps the machine it was
+// installed on and snapshots stay loadable.
+const (
+	TypePC1      = "pc-1.0"
+	TypeMicroVM1 = "microvm-1.0"
+
+	// DefaultType is used when no machine type is specified.
+	DefaultType = "pc"
+)
+
+var ErrorUnknownType = errors.New("unknown machine type")
+
+type Type struct {
+	Name string
+
+	// LegacyPC emulates the PC I/O ports that Linux probes at boot as
+	// devices doing nothing: VGA, CMOS clock, DMA page registers, COM2-4 and
+	// the status register of the PS/2 controller. Any other port without a
+	// device is a fatal error, which helps to spot unexpected guest accesses.
+	//
+	// Without LegacyPC, ports without a device behave as on a bus with
+	// nothing attached: reads return all ones and writes are ignored.
+	LegacyPC bool
+}
+
+var types = map[string]Type{
+	TypePC1:      {Name: TypePC1, LegacyPC: true},
+	TypeMicroVM1: {Name: TypeMicroVM1, LegacyPC: false},
+}
+
+// typeAliases map the unversioned names to the latest version.
+var typeAliases = map[string]string{
+	"pc":      TypePC1,
+	"microvm": TypeMicroVM1,
+}
+
+// LookupType returns the machine type called name, which is either a
+// versioned name or an alias for the latest version.
+func LookupType(name string) (Type, error) {
+	if n, ok := typeAliases[name]; ok {
+		name = n
+	}
+
+	t, ok := types[name]
+	if !ok {
+		return Type{}, fmt.Errorf("%w: %q (available: %v)", ErrorUnknownType, name, TypeNames())
+	}
+
+	return t, nil
+}
+
+// TypeNames returns the names of all machine types, including the aliases.
+func TypeNames() []string {
+	names := []string{}
+
+	for name := range types {
+		names = append(names, name)
+	}
+
+	for name := range typeAliases {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Type returns the machine type of m.
+func (m *Machine) Type() Type {
+	return m.typ
+}
@@ -2,62 +2,623 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/bobuhiro11/gokvm/api"
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/console"
+	"github.com/bobuhiro11/gokvm/fdpath"
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/gdb"
+	"github.com/bobuhiro11/gokvm/hooks"
+	"github.com/bobuhiro11/gokvm/instance"
+	"github.com/bobuhiro11/gokvm/jailer"
+	"github.com/bobuhiro11/gokvm/logging"
 	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/metrics"
+	"github.com/bobuhiro11/gokvm/monitor"
+	"github.com/bobuhiro11/gokvm/systemd"
 	"github.com/bobuhiro11/gokvm/term"
+	"github.com/bobuhiro11/gokvm/tracing"
 )
 
+var log = logging.New("vmm")
+
 func main() {
-	kernelPath, initrdPath, params, nCpus, err := flag.ParseArgs(os.Args)
+	cmd, err := flag.ParseArgs(os.Args)
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cmd.Name == flag.CmdJail {
+		code, err := jailer.Run(cmd.Jail, cmd.Args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		os.Exit(code)
+	}
+
+	if cmd.Name != flag.CmdRun {
+		if err := runClientCommand(cmd); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if cmd.Config.Daemonize && os.Getenv(daemonizeEnv) == "" {
+		os.Exit(daemonize(cmd.Config))
+	}
+
+	os.Exit(run(cmd.Config))
+}
+
+// run boots the VM and returns the exit status of gokvm, which the guest may
+// choose through the debug exit device.
+func run(c *config.Config) int {
+	var (
+		a  *api.Server
+		ms *metrics.Server
+	)
+
+	if err := setupLogging(c); err != nil {
 		panic(err)
 	}
 
-	m, err := machine.New(nCpus)
+	detach, err := daemonized()
 	if err != nil {
 		panic(err)
 	}
 
-	if err := m.LoadLinux(kernelPath, initrdPath, params); err != nil {
+	if c.OTLPEndpoint != "" {
+		tracing.Start(c.OTLPEndpoint)
+
+		defer func() {
+			if err := tracing.Shutdown(); err != nil {
+				log.Warn("failed to export traces", "err", err)
+			}
+		}()
+	}
+
+	activated, err := systemd.Listeners()
+	if err != nil {
 		panic(err)
 	}
 
-	for i := 0; i < nCpus; i++ {
-		go func(cpuId int) {
-			if err = m.RunInfiniteLoop(cpuId); err != nil {
+	if c.PidFile != "" {
+		if err := systemd.WritePidFile(c.PidFile); err != nil {
+			panic(err)
+		}
+
+		defer os.Remove(c.PidFile)
+	}
+
+	if c.Metrics != "" {
+		if ms, err = metrics.Listen(c.Metrics); err != nil {
+			panic(err)
+		}
+
+		defer ms.Close()
+
+		go func() {
+			if err := ms.Serve(); err != nil {
 				panic(err)
 			}
-		}(i)
+		}()
+	}
+
+	if ln, ok := activated[socketNameAPI]; ok || c.API != "" {
+		if !ok {
+			if ln, err = net.Listen("unix", c.API); err != nil {
+				panic(err)
+			}
+		}
+
+		a = api.NewServer(ln, c)
+
+		defer a.Close()
+
+		if ms != nil {
+			a.SetObserver(ms.ObserveAPI)
+		}
+
+		go func() {
+			if err := a.Serve(); err != nil {
+				panic(err)
+			}
+		}()
+
+		// the service is ready to be configured through the API
+		if err := systemd.Notify(systemd.StateReady); err != nil {
+			log.Warn("failed to notify systemd", "err", err)
+		}
+
+		detach()
+
+		c = a.WaitStart()
+
+		if err := setupLogging(c); err != nil {
+			panic(err)
+		}
 	}
 
-	restoreMode, err := term.SetRawMode()
+	if c.Name == "" {
+		c.Name = strconv.Itoa(os.Getpid())
+	}
+
+	boot := tracing.StartSpan("boot", "vm.name", c.Name, "vm.cpus", c.CPUs, "vm.memory", int64(c.Memory))
+
+	span := boot.StartChild("pre-start hooks")
+	err = hooks.Run(c, hooks.Event{Event: config.EventPreStart, Name: c.Name})
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		log.Error("pre-start hook failed", "err", err)
+		boot.SetError(err)
+		boot.End()
+
+		return 1
+	}
+
+	t, err := machine.LookupType(c.Machine)
 	if err != nil {
 		panic(err)
 	}
 
-	defer restoreMode()
+	machine.KVMDevice = c.KVMDevice
 
-	var before byte = 0
+	var m *machine.Machine
 
-	in := bufio.NewReader(os.Stdin)
+	if c.Restore != "" || c.Incoming != "" {
+		if c.Restore != "" {
+			span = boot.StartChild("restore", "vm.machine", t.Name, "snapshot", c.Restore)
+			m, err = machine.Restore(t, c.Restore, c.RestoreLazy)
+		} else {
+			span = boot.StartChild("incoming migration", "vm.machine", t.Name, "uri", c.Incoming)
+			m, err = receiveMigration(t, c.Incoming)
+		}
 
-	for {
-		b, err := in.ReadByte()
 		if err != nil {
 			panic(err)
 		}
+
+		span.End()
+
+		if c.ClockResync {
+			elapsed, err := m.ResyncClock()
+			if errors.Is(err, machine.ErrorNoClockTimestamp) {
+				log.Warn("guest clock not advanced", "err", err)
+			} else if err != nil {
+				panic(err)
+			} else {
+				log.Info("guest clock advanced", "by", elapsed)
+			}
+		}
+
+		if c.Multiboot {
+			m.SetMultibootSource(c.Kernel, c.Initrd, c.Params)
+		} else {
+			m.SetBootSource(c.Kernel, c.Initrd, c.Params)
+		}
+		c.CPUs, c.Memory = m.NumCPUs(), config.Size(m.MemSize())
+
+		// for the next reset
+		if c.DeviceTree {
+			m.EnableDeviceTree()
+		}
+
+		if err := m.SetPlatform(c.Platform()); err != nil {
+			panic(err)
+		}
+	} else {
+		span = boot.StartChild("create machine", "vm.machine", t.Name)
+
+		if m, err = machine.NewWithType(t, c.CPUs, int(c.Memory)); err != nil {
+			panic(err)
+		}
+
+		span.End()
+
+		if c.DeviceTree {
+			m.EnableDeviceTree()
+		}
+
+		if err := m.SetPlatform(c.Platform()); err != nil {
+			panic(err)
+		}
+
+		span = boot.StartChild("load kernel", "kernel", c.Kernel, "initrd", c.Initrd)
+
+		if c.Multiboot {
+			err = m.LoadMultiboot(c.Kernel, c.Initrd, c.Params)
+		} else {
+			err = m.LoadLinux(c.Kernel, c.Initrd, c.Params)
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		span.End()
+	}
+
+	if c.DebugExit {
+		m.EnableDebugExitAt(c.DebugExitPort)
+	}
+
+	if c.HaltPoll != "" {
+		d, err := time.ParseDuration(c.HaltPoll)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := m.SetHaltPoll(d); err != nil {
+			panic(err)
+		}
+	}
+
+	if c.TraceIO != "" {
+		ranges, err := machine.ParseTraceRanges(c.TraceIO)
+		if err != nil {
+			panic(err)
+		}
+
+		m.EnableTrace(ranges)
+	}
+
+	if a != nil {
+		a.SetVM(m)
+	}
+
+	if ms != nil {
+		ms.SetMachine(m)
+	}
+
+	if err := instance.Create(c.Name); err != nil {
+		panic(err)
+	}
+
+	defer instance.Remove(c.Name)
+
+	if c.QMP == "" {
+		c.QMP = instance.QMPSocket(c.Name)
+	}
+
+	var local io.Writer = os.Stdout
+
+	if c.SerialLog != "" {
+		lf, err := console.OpenLogFile(c.SerialLog, int64(c.SerialLogSize), c.SerialLogFiles)
+		if err != nil {
+			panic(err)
+		}
+
+		defer lf.Close()
+
+		// the log file never fails, so it goes first
+		local = io.MultiWriter(lf, os.Stdout)
+	}
+
+	if c.SerialPTY {
+		pty, err := console.OpenPTY(func(b byte) {
+			m.GetInputChan() <- b
+			m.InjectSerialIRQ()
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		defer pty.Close()
+
+		if err := os.Symlink(pty.Path(), instance.PTYLink(c.Name)); err != nil {
+			panic(err)
+		}
+
+		log.Info("serial console on a pseudo-terminal", "path", pty.Path())
+
+		// the pty drops output rather than failing
+		local = io.MultiWriter(pty, local)
+	}
+
+	cons, err := console.Listen(instance.ConsoleSocket(c.Name), local, func(b byte) {
+		m.GetInputChan() <- b
+		m.InjectSerialIRQ()
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	defer cons.Close()
+
+	m.SetConsoleOutput(cons)
+
+	go func() {
+		_ = cons.Serve()
+	}()
+
+	// shutdown receives the reason why the VM stops.
+	shutdown := make(chan string, 1)
+
+	ln, ok := qmpListener(activated)
+	if !ok {
+		if ln, err = net.Listen("unix", c.QMP); err != nil {
+			panic(err)
+		}
+	}
+
+	// a restored snapshot is the parent of the first incremental one, unless
+	// it was passed as a descriptor, whose path is unknown
+	snapshots := &snapshotChain{}
+	if _, isFd, _ := fdpath.Parse(c.Restore); c.Restore != "" && !isFd {
+		if snapshots.last, err = filepath.Abs(c.Restore); err != nil {
+			panic(err)
+		}
+	}
+
+	q := newControlServer(ln, m, snapshots, shutdown)
+
+	defer q.Close()
+
+	go func() {
+		_ = q.Serve()
+	}()
+
+	// the terminal has a monitor even without its socket
+	var monLn net.Listener
+	if c.Monitor != "" {
+		if monLn, err = net.Listen("unix", c.Monitor); err != nil {
+			panic(err)
+		}
+	}
+
+	mon := newMonitorServer(monLn, m, q)
+
+	defer mon.Close()
+
+	if monLn != nil {
+		go func() {
+			_ = mon.Serve()
+		}()
+	}
+
+	if c.GDB != "" {
+		g, err := gdb.Listen(c.GDB, m)
+		if err != nil {
+			panic(err)
+		}
+
+		defer g.Close()
+
+		go func() {
+			_ = g.Serve()
+		}()
+	}
+
+	if c.StallTimeout != "" {
+		timeout, err := time.ParseDuration(c.StallTimeout)
+		if err != nil {
+			panic(err)
+		}
+
+		stop := m.DetectStalls(timeout, func(s machine.Stall) { reportStall(q, s) })
+		defer stop()
+	}
+
+	setupSandbox(c, m)
+	setupVCPUThreads(c, m)
+
+	var (
+		wg        sync.WaitGroup
+		crashDump sync.Once
+	)
+
+	for i := 0; i < c.CPUs; i++ {
+		wg.Add(1)
+
+		go func(cpuID int) {
+			defer wg.Done()
+
+			err := m.RunInfiniteLoop(cpuID)
+
+			// the reset stops the other vCPUs and loads the kernel again
+			for errors.Is(err, machine.ErrorGuestReset) {
+				log.Info("guest reset", "vcpu", cpuID)
+
+				if err := m.Reset(); err != nil {
+					panic(err)
+				}
+
+				q.Emit("RESET", shutdownEvent{Guest: true, Reason: reasonGuestReset})
+
+				err = m.RunInfiniteLoop(cpuID)
+			}
+
+			if errors.Is(err, machine.ErrorGuestShutdown) {
+				requestShutdown(shutdown, reasonGuestShutdown)
+
+				return
+			}
+
+			if errors.Is(err, machine.ErrorGuestCrashed) {
+				log.Error("guest crashed", "vcpu", cpuID, "err", err)
+
+				if c.CrashDump != "" {
+					crashDump.Do(func() { writeCrashDump(m, c.CrashDump) })
+				}
+
+				q.Emit("GUEST_PANICKED", guestPanicEvent{Action: "poweroff"})
+				runHooks(c, config.EventGuestPanic, err.Error())
+				requestShutdown(shutdown, reasonGuestPanic)
+
+				return
+			}
+
+			if err != nil {
+				panic(err)
+			}
+
+			// the other vCPUs don't need to stop by themselves
+			if _, ok := m.ExitCode(); ok {
+				requestShutdown(shutdown, reasonGuestShutdown)
+			}
+		}(i)
+	}
+
+	boot.End()
+
+	go runHooks(c, config.EventPostStart, "")
+
+	go func() {
+		wg.Wait()
+		requestShutdown(shutdown, reasonGuestShutdown)
+	}()
+
+	// Without a terminal (e.g. when started by gokvmd) the VM runs headless
+	// and only takes console input from stdin until EOF.
+	if term.IsTerminal(0) {
+		restoreMode, err := term.SetRawMode()
+		if err != nil {
+			panic(err)
+		}
+
+		defer restoreMode()
+	}
+
+	escape, err := console.ParseEscape(c.EscapeChar)
+	if err != nil {
+		panic(err)
+	}
+
+	go readInput(m, mon, escape, shutdown)
+
+	if err := systemd.Notify(systemd.StateReady); err != nil {
+		log.Warn("failed to notify systemd", "err", err)
+	}
+
+	log.Info("vm started", "name", c.Name, "cpus", c.CPUs, "memory", c.Memory)
+
+	detach()
+
+	reason := <-shutdown
+
+	log.Info("vm stopping", "reason", reason)
+
+	_ = systemd.Notify(systemd.StateStopping)
+
+	q.Emit("SHUTDOWN", shutdownEvent{
+		Guest:  reason == reasonGuestShutdown || reason == reasonGuestPanic,
+		Reason: reason,
+	})
+
+	runHooks(c, config.EventShutdown, reason)
+
+	if code, ok := m.ExitCode(); ok {
+		return code
+	}
+
+	return 0
+}
+
+// runHooks runs the hooks of event. Failures are only reported, since the VM
+// has already started.
+func runHooks(c *config.Config, event, reason string) {
+	ev := hooks.Event{Event: event, Name: c.Name, Reason: reason}
+	if err := hooks.Run(c, ev); err != nil {
+		log.Error("hook failed", "event", event, "err", err)
+	}
+}
+
+func writeCrashDump(m *machine.Machine, path string) {
+	f, err := fdpath.Create(path)
+	if err == nil {
+		err = dumpGuestMemory(m, f)
+	}
+
+	if err != nil {
+		log.Error("failed to write crash dump", "path", path, "err", err)
+
+		return
+	}
+
+	log.Info("crash dump written", "path", path)
+}
+
+func setupLogging(c *config.Config) error {
+	level, err := logging.ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	logging.SetLevel("", level)
+
+	return logging.SetFormat(c.LogFormat)
+}
+
+// Sockets passed by socket activation are told apart by their names, set with
+// FileDescriptorName= in the socket unit. A single socket of another name is
+// taken as the control socket.
+const (
+	socketNameAPI = "api"
+	socketNameQMP = "qmp"
+)
+
+func qmpListener(activated map[string]net.Listener) (net.Listener, bool) {
+	if ln, ok := activated[socketNameQMP]; ok {
+		return ln, true
+	}
+
+	if len(activated) != 1 {
+		return nil, false
+	}
+
+	for name, ln := range activated {
+		if name != socketNameAPI {
+			return ln, true
+		}
+	}
+
+	return nil, false
+}
+
+// readInput forwards stdin to the serial console, or to the monitor after
+// the escape key and c, until the escape key and x are pressed.
+func readInput(m *machine.Machine, mon *monitor.Server, escape byte, shutdown chan<- string) {
+	mux := console.NewMux(escape, os.Stdout, func(b byte) {
 		m.GetInputChan() <- b
 
 		if len(m.GetInputChan()) > 0 {
 			m.InjectSerialIRQ()
 		}
+	}, mon.Execute)
+
+	in := bufio.NewReader(os.Stdin)
+
+	for {
+		b, err := in.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return
+		}
 
-		if before == 0x1 && b == 'x' {
-			break
+		if err != nil {
+			panic(err)
 		}
 
-		before = b
+		if !mux.Feed(b) {
+			requestShutdown(shutdown, reasonHostUI)
+
+			return
+		}
 	}
 }
@@ -0,0 +1,291 @@
+// Package memslot manages the memory slots of a VM: the regions of guest
+// physical memory which KVM maps to memory of gokvm.
+//
+// KVM only changes the flags of a slot in place. Moving or resizing a slot
+// deletes it and creates it again, which vCPUs running meanwhile see as a
+// hole in guest memory; the machine should be paused.
+package memslot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const (
+	pageSize = 0x1000
+
+	// defaultMaxSlots is the number of slots of hosts which don't report
+	// KVM_CAP_NR_MEMSLOTS.
+	defaultMaxSlots = 32
+)
+
+var (
+	ErrorInvalidRegion = errors.New("invalid memory region")
+	ErrorOverlap       = errors.New("memory regions overlap")
+	ErrorNoSlot        = errors.New("no memory slot left")
+	ErrorUnknownSlot   = errors.New("unknown memory slot")
+	ErrorNotAdjacent   = errors.New("memory regions are not adjacent")
+)
+
+// Manager tracks the memory slots of a VM and allocates their numbers. The
+// memory of a region must stay mapped as long as the region exists.
+type Manager struct {
+	vmFd    uintptr
+	max     int
+	regions []kvm.UserspaceMemoryRegion // by guest physical address
+}
+
+// New returns the manager of the slots of the VM vmFd, which has none yet,
+// with the maximum number of slots of the host kvmFd.
+func New(kvmFd, vmFd uintptr) (*Manager, error) {
+	max, err := kvm.CheckExtension(kvmFd, kvm.CapNRMemslots)
+	if err != nil {
+		return nil, err
+	}
+
+	if max == 0 {
+		max = defaultMaxSlots
+	}
+
+	return &Manager{vmFd: vmFd, max: max}, nil
+}
+
+// Max returns the number of slots of the host.
+func (m *Manager) Max() int {
+	return m.max
+}
+
+// Regions returns the regions by guest physical address.
+func (m *Manager) Regions() []kvm.UserspaceMemoryRegion {
+	return append([]kvm.UserspaceMemoryRegion{}, m.regions...)
+}
+
+// Lookup returns the region holding the guest physical address addr.
+func (m *Manager) Lookup(addr uint64) (kvm.UserspaceMemoryRegion, bool) {
+	i := sort.Search(len(m.regions), func(i int) bool {
+		return m.regions[i].GuestPhysAddr+m.regions[i].MemorySize > addr
+	})
+
+	if i == len(m.regions) || m.regions[i].GuestPhysAddr > addr {
+		return kvm.UserspaceMemoryRegion{}, false
+	}
+
+	return m.regions[i], true
+}
+
+func (m *Manager) find(slot uint32) (int, error) {
+	for i, r := range m.regions {
+		if r.Slot == slot {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("%w: %d", ErrorUnknownSlot, slot)
+}
+
+// freeSlot returns the lowest slot number not in use.
+func (m *Manager) freeSlot() (uint32, error) {
+	used := make(map[uint32]bool, len(m.regions))
+	for _, r := range m.regions {
+		used[r.Slot] = true
+	}
+
+	for slot := uint32(0); int(slot) < m.max; slot++ {
+		if !used[slot] {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: the host has %d", ErrorNoSlot, m.max)
+}
+
+// check returns an error unless r can be mapped beside the regions other
+// than skip.
+func (m *Manager) check(r kvm.UserspaceMemoryRegion, skip uint32) error {
+	if r.MemorySize == 0 || r.GuestPhysAddr%pageSize != 0 || r.MemorySize%pageSize != 0 ||
+		r.UserspaceAddr%pageSize != 0 || r.GuestPhysAddr+r.MemorySize < r.GuestPhysAddr {
+		return fmt.Errorf("%w: 0x%x bytes at 0x%x must be non-empty and page aligned",
+			ErrorInvalidRegion, r.MemorySize, r.GuestPhysAddr)
+	}
+
+	for _, o := range m.regions {
+		if o.Slot != skip && r.GuestPhysAddr < o.GuestPhysAddr+o.MemorySize &&
+			o.GuestPhysAddr < r.GuestPhysAddr+r.MemorySize {
+			return fmt.Errorf("%w: 0x%x-0x%x and slot %d at 0x%x-0x%x", ErrorOverlap,
+				r.GuestPhysAddr, r.GuestPhysAddr+r.MemorySize, o.Slot, o.GuestPhysAddr, o.GuestPhysAddr+o.MemorySize)
+		}
+	}
+
+	return nil
+}
+
+func region(slot, flags uint32, addr uint64, mem []byte) kvm.UserspaceMemoryRegion {
+	r := kvm.UserspaceMemoryRegion{Slot: slot, Flags: flags, GuestPhysAddr: addr, MemorySize: uint64(len(mem))}
+	if len(mem) > 0 {
+		r.UserspaceAddr = uint64(uintptr(unsafe.Pointer(&mem[0])))
+	}
+
+	return r
+}
+
+func (m *Manager) set(r kvm.UserspaceMemoryRegion) error {
+	if err := kvm.SetUserMemoryRegion(m.vmFd, &r); err != nil {
+		return fmt.Errorf("memory slot %d: %w", r.Slot, err)
+	}
+
+	return nil
+}
+
+// deleteSlot deletes the slot from KVM, keeping track of it.
+func (m *Manager) deleteSlot(slot uint32) error {
+	return m.set(kvm.UserspaceMemoryRegion{Slot: slot})
+}
+
+func (m *Manager) insert(r kvm.UserspaceMemoryRegion) {
+	m.regions = append(m.regions, r)
+	sort.Slice(m.regions, func(i, j int) bool {
+		return m.regions[i].GuestPhysAddr < m.regions[j].GuestPhysAddr
+	})
+}
+
+func (m *Manager) remove(i int) {
+	m.regions = append(m.regions[:i], m.regions[i+1:]...)
+}
+
+// Add maps mem at the guest physical address addr with flags, a combination
+// of kvm.MemLogDirtyPages and kvm.MemReadonly, and returns its slot.
+func (m *Manager) Add(addr uint64, mem []byte, flags uint32) (uint32, error) {
+	slot, err := m.freeSlot()
+	if err != nil {
+		return 0, err
+	}
+
+	r := region(slot, flags, addr, mem)
+	if err := m.check(r, slot); err != nil {
+		return 0, err
+	}
+
+	if err := m.set(r); err != nil {
+		return 0, err
+	}
+
+	m.insert(r)
+
+	return slot, nil
+}
+
+// Remove unmaps the region of slot and frees the slot.
+func (m *Manager) Remove(slot uint32) error {
+	i, err := m.find(slot)
+	if err != nil {
+		return err
+	}
+
+	if err := m.deleteSlot(slot); err != nil {
+		return err
+	}
+
+	m.remove(i)
+
+	return nil
+}
+
+// SetFlags changes the flags of the region of slot in place.
+func (m *Manager) SetFlags(slot, flags uint32) error {
+	i, err := m.find(slot)
+	if err != nil {
+		return err
+	}
+
+	r := m.regions[i]
+	r.Flags = flags
+
+	if err := m.set(r); err != nil {
+		return err
+	}
+
+	m.regions[i] = r
+
+	return nil
+}
+
+// Resize maps mem instead of the memory of the region of slot, at the same
+// guest physical address and with the same flags. mem may be of another
+// size, or the old memory mapped elsewhere. If mapping mem fails, the slot
+// is removed.
+func (m *Manager) Resize(slot uint32, mem []byte) error {
+	i, err := m.find(slot)
+	if err != nil {
+		return err
+	}
+
+	old := m.regions[i]
+
+	r := region(slot, old.Flags, old.GuestPhysAddr, mem)
+	if err := m.check(r, slot); err != nil {
+		return err
+	}
+
+	if err := m.deleteSlot(slot); err != nil {
+		return err
+	}
+
+	if err := m.set(r); err != nil {
+		m.remove(i)
+
+		return err
+	}
+
+	m.regions[i] = r
+
+	return nil
+}
+
+// Merge extends the region of slot a by the region of slot b, which must
+// follow it in both guest physical memory and the memory of gokvm, with the
+// same flags. Slot b is freed. If mapping the merged region fails, both
+// slots are removed.
+func (m *Manager) Merge(a, b uint32) error {
+	i, err := m.find(a)
+	if err != nil {
+		return err
+	}
+
+	j, err := m.find(b)
+	if err != nil {
+		return err
+	}
+
+	ra, rb := m.regions[i], m.regions[j]
+	if ra.GuestPhysAddr+ra.MemorySize != rb.GuestPhysAddr || ra.UserspaceAddr+ra.MemorySize != rb.UserspaceAddr ||
+		ra.Flags != rb.Flags {
+		return fmt.Errorf("%w: slots %d and %d", ErrorNotAdjacent, a, b)
+	}
+
+	if err := m.deleteSlot(b); err != nil {
+		return err
+	}
+
+	m.remove(j)
+
+	if err := m.deleteSlot(a); err != nil {
+		return err
+	}
+
+	ra.MemorySize += rb.MemorySize
+
+	i, _ = m.find(a)
+	if err := m.set(ra); err != nil {
+		m.remove(i)
+
+		return err
+	}
+
+	m.regions[i] = ra
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package memslot_test
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memslot"
+)
+
+func newManager(t *testing.T) (*memslot.Manager, uintptr) {
+	t.Helper()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { devKVM.Close() })
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { syscall.Close(int(vmFd)) })
+
+	m, err := memslot.New(devKVM.Fd(), vmFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Max() < 2 {
+		t.Fatalf("host has %d slots", m.Max())
+	}
+
+	return m, vmFd
+}
+
+func mmap(t *testing.T, size int) []byte {
+	t.Helper()
+
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { syscall.Munmap(mem) })
+
+	return mem
+}
+
+func TestAddRemove(t *testing.T) {
+	t.Parallel()
+
+	m, _ := newManager(t)
+	mem := mmap(t, 0x4000)
+
+	a, err := m.Add(0, mem[:0x2000], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.Add(0x100000, mem[0x2000:], kvm.MemReadonly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Fatalf("slot %d allocated twice", a)
+	}
+
+	if r, ok := m.Lookup(0x101fff); !ok || r.Slot != b || r.Flags != kvm.MemReadonly {
+		t.Fatalf("unexpected region: %+v", r)
+	}
+
+	if _, ok := m.Lookup(0x2000); ok {
+		t.Fatal("hole between the regions found")
+	}
+
+	for _, c := range []struct {
+		addr uint64
+		mem  []byte
+		err  error
+	}{
+		{0x1000, mem[:0x1000], memslot.ErrorOverlap},
+		{0xff000, mem[:0x2000], memslot.ErrorOverlap},
+		{0x200800, mem[:0x1000], memslot.ErrorInvalidRegion},
+		{0x200000, mem[:0x800], memslot.ErrorInvalidRegion},
+		{0x200000, nil, memslot.ErrorInvalidRegion},
+		{^uint64(0) &^ 0xfff, mem[:0x2000], memslot.ErrorInvalidRegion},
+	} {
+		if _, err := m.Add(c.addr, c.mem, 0); !errors.Is(err, c.err) {
+			t.Fatalf("0x%x bytes at 0x%x: unexpected error: %v", len(c.mem), c.addr, err)
+		}
+	}
+
+	if err := m.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Remove(a); !errors.Is(err, memslot.ErrorUnknownSlot) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the freed slot is allocated again
+	if c, err := m.Add(0, mem[:0x1000], 0); err != nil || c != a {
+		t.Fatalf("unexpected slot %d: %v", c, err)
+	}
+}
+
+func TestResizeMerge(t *testing.T) {
+	t.Parallel()
+
+	m, vmFd := newManager(t)
+	mem := mmap(t, 0x4000)
+
+	a, err := m.Add(0, mem[:0x1000], kvm.MemLogDirtyPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.Add(0x3000, mem[0x3000:], kvm.MemLogDirtyPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Merge(a, b); !errors.Is(err, memslot.ErrorNotAdjacent) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := m.Resize(a, mem[:0x4000]); !errors.Is(err, memslot.ErrorOverlap) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := m.Resize(a, mem[:0x3000]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Merge(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	regions := m.Regions()
+	if len(regions) != 1 || regions[0].Slot != a || regions[0].MemorySize != 0x4000 ||
+		regions[0].Flags != kvm.MemLogDirtyPages {
+		t.Fatalf("unexpected regions: %+v", regions)
+	}
+
+	// the merged region is one slot in KVM too
+	if err := kvm.GetDirtyLog(vmFd, a, make([]uint64, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetFlags(a, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.GetDirtyLog(vmFd, a, make([]uint64, 1)); err == nil {
+		t.Fatal("dirty log of a slot without dirty logging")
+	}
+}
@@ -0,0 +1,320 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+// The metrics are served on /metrics in the Prometheus text exposition
+// format, so that they can be scraped without a client library.
+//
+// refs: https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// Buckets are the upper bounds in seconds of the API latency histogram.
+var Buckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type Server struct {
+	ln  net.Listener
+	srv *http.Server
+
+	mu        sync.Mutex
+	m         *machine.Machine
+	latencies map[request]*histogram
+}
+
+type request struct {
+	method, path string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Listen serves the metrics on the TCP address addr.
+func Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:        ln,
+		latencies: map[request]*histogram{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.srv = &http.Server{Handler: mux}
+
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve handles requests until the server is closed.
+func (s *Server) Serve() error {
+	if err := s.srv.Serve(s.ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// SetMachine registers the booted machine. Until then only the API latencies
+// are reported.
+func (s *Server) SetMachine(m *machine.Machine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.m = m
+}
+
+// ObserveAPI records the latency of an API request. path is the route which
+// served the request rather than the requested path, to bound the number of
+// time series.
+func (s *Server) ObserveAPI(method, path string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := request{method, path}
+
+	h, ok := s.latencies[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(Buckets))}
+		s.latencies[key] = h
+	}
+
+	sec := d.Seconds()
+
+	for i, le := range Buckets {
+		if sec <= le {
+			h.counts[i]++
+
+			break
+		}
+	}
+
+	h.count++
+	h.sum += sec
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.m != nil {
+		s.writeMachine(w)
+	}
+
+	s.writeLatencies(w)
+}
+
+func (s *Server) writeMachine(w io.Writer) {
+	stats := make([]map[string]machine.ExitStat, s.m.NumCPUs())
+	for cpu := range stats {
+		stats[cpu], _ = s.m.ExitStats(cpu)
+	}
+
+	fmt.Fprintln(w, "# HELP gokvm_vcpu_exits_total Number of VM exits by vCPU and exit reason.")
+	fmt.Fprintln(w, "# TYPE gokvm_vcpu_exits_total counter")
+
+	for cpu, st := range stats {
+		for _, reason := range sortedKeys(st) {
+			fmt.Fprintf(w, "gokvm_vcpu_exits_total{vcpu=\"%d\",reason=\"%s\"} %d\n", cpu, reason, st[reason].Count)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP gokvm_vcpu_exit_handling_seconds_total Time spent handling VM exits in userspace.")
+	fmt.Fprintln(w, "# TYPE gokvm_vcpu_exit_handling_seconds_total counter")
+
+	for cpu, st := range stats {
+		for _, reason := range sortedKeys(st) {
+			fmt.Fprintf(w, "gokvm_vcpu_exit_handling_seconds_total{vcpu=\"%d\",reason=\"%s\"} %s\n",
+				cpu, reason, seconds(st[reason].Time))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP gokvm_vcpu_slow_exits_total Number of VM exits handled in more than %s.\n",
+		machine.SlowExitThreshold)
+	fmt.Fprintln(w, "# TYPE gokvm_vcpu_slow_exits_total counter")
+
+	for cpu, st := range stats {
+		for _, reason := range sortedKeys(st) {
+			fmt.Fprintf(w, "gokvm_vcpu_slow_exits_total{vcpu=\"%d\",reason=\"%s\"} %d\n", cpu, reason, st[reason].Slow)
+		}
+	}
+
+	ports := s.m.IOPortStats()
+
+	sorted := make([]int, 0, len(ports))
+	for port := range ports {
+		sorted = append(sorted, int(port))
+	}
+
+	sort.Ints(sorted)
+
+	fmt.Fprintln(w, "# HELP gokvm_ioport_exits_total Number of VM exits by I/O port.")
+	fmt.Fprintln(w, "# TYPE gokvm_ioport_exits_total counter")
+
+	for _, port := range sorted {
+		fmt.Fprintf(w, "gokvm_ioport_exits_total{port=\"0x%x\"} %d\n", port, ports[uint16(port)].Count)
+	}
+
+	fmt.Fprintln(w, "# HELP gokvm_ioport_handling_seconds_total Time spent emulating the I/O ports.")
+	fmt.Fprintln(w, "# TYPE gokvm_ioport_handling_seconds_total counter")
+
+	for _, port := range sorted {
+		fmt.Fprintf(w, "gokvm_ioport_handling_seconds_total{port=\"0x%x\"} %s\n", port, seconds(ports[uint16(port)].Time))
+	}
+
+	devices := s.m.DeviceStats()
+
+	fmt.Fprintln(w, "# HELP gokvm_device_queue_depth Number of requests queued for the guest.")
+	fmt.Fprintln(w, "# TYPE gokvm_device_queue_depth gauge")
+
+	for _, d := range devices {
+		fmt.Fprintf(w, "gokvm_device_queue_depth{device=\"%s\"} %d\n", d.Name, d.QueueDepth)
+	}
+
+	fmt.Fprintln(w, "# HELP gokvm_device_io_bytes_total Number of bytes received (rx) and transmitted (tx) by the guest.")
+	fmt.Fprintln(w, "# TYPE gokvm_device_io_bytes_total counter")
+
+	for _, d := range devices {
+		fmt.Fprintf(w, "gokvm_device_io_bytes_total{device=\"%s\",direction=\"rx\"} %d\n", d.Name, d.RxBytes)
+		fmt.Fprintf(w, "gokvm_device_io_bytes_total{device=\"%s\",direction=\"tx\"} %d\n", d.Name, d.TxBytes)
+	}
+
+	if kstats, err := s.m.KVMStats(); err == nil {
+		writeKVMStats(w, kstats)
+	}
+}
+
+// writeKVMStats exports the statistics of KVM with their kernel names, e.g.
+// gokvm_kvm_vm_remote_tlb_flush and gokvm_kvm_vcpu_halt_exits{vcpu="0"}. The
+// histograms are left out.
+func writeKVMStats(w io.Writer, stats machine.KVMStats) {
+	header := func(metric string, st kvm.Stat) {
+		typ := "gauge"
+		if st.Type() == kvm.StatsTypeCumulative {
+			typ = "counter"
+		}
+
+		fmt.Fprintf(w, "# HELP %s KVM statistic %s.\n", metric, st.Name)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric, typ)
+	}
+
+	for _, st := range stats.VM {
+		if !scalar(st) {
+			continue
+		}
+
+		metric := "gokvm_kvm_vm_" + st.Name
+		header(metric, st)
+		fmt.Fprintf(w, "%s %d\n", metric, st.Values[0])
+	}
+
+	if len(stats.VCPUs) == 0 {
+		return
+	}
+
+	// all vCPUs have the same statistics
+	for i, st := range stats.VCPUs[0] {
+		if !scalar(st) {
+			continue
+		}
+
+		metric := "gokvm_kvm_vcpu_" + st.Name
+		header(metric, st)
+
+		for cpu, vcpu := range stats.VCPUs {
+			fmt.Fprintf(w, "%s{vcpu=\"%d\"} %d\n", metric, cpu, vcpu[i].Values[0])
+		}
+	}
+}
+
+func scalar(st kvm.Stat) bool {
+	switch st.Type() {
+	case kvm.StatsTypeCumulative, kvm.StatsTypeInstant, kvm.StatsTypePeak:
+		return len(st.Values) == 1
+	default:
+		return false
+	}
+}
+
+func (s *Server) writeLatencies(w io.Writer) {
+	fmt.Fprintln(w, "# HELP gokvm_api_request_duration_seconds Latency of the REST API requests.")
+	fmt.Fprintln(w, "# TYPE gokvm_api_request_duration_seconds histogram")
+
+	keys := make([]request, 0, len(s.latencies))
+	for key := range s.latencies {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+
+		return keys[i].method < keys[j].method
+	})
+
+	for _, key := range keys {
+		h := s.latencies[key]
+		labels := fmt.Sprintf("method=\"%s\",path=\"%s\"", key.method, key.path)
+
+		var cumulative uint64
+
+		for i, le := range Buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "gokvm_api_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+
+		fmt.Fprintf(w, "gokvm_api_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "gokvm_api_request_duration_seconds_sum{%s} %s\n",
+			labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "gokvm_api_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]machine.ExitStat) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,102 @@
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/metrics"
+)
+
+func scrape(t *testing.T, s *metrics.Server) string {
+	t.Helper()
+
+	res, err := http.Get("http://" + s.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	s, err := metrics.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	s.ObserveAPI(http.MethodPut, "/actions", 2*time.Millisecond)
+	s.ObserveAPI(http.MethodPut, "/actions", 2*time.Second)
+
+	body := scrape(t, s)
+
+	for _, line := range []string{
+		`gokvm_api_request_duration_seconds_bucket{method="PUT",path="/actions",le="0.001"} 0`,
+		`gokvm_api_request_duration_seconds_bucket{method="PUT",path="/actions",le="0.005"} 1`,
+		`gokvm_api_request_duration_seconds_bucket{method="PUT",path="/actions",le="5"} 2`,
+		`gokvm_api_request_duration_seconds_bucket{method="PUT",path="/actions",le="+Inf"} 2`,
+		`gokvm_api_request_duration_seconds_count{method="PUT",path="/actions"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("%q not found in:\n%s", line, body)
+		}
+	}
+
+	if strings.Contains(body, "gokvm_vcpu_exits_total{") {
+		t.Fatalf("vCPU metrics before boot:\n%s", body)
+	}
+
+	m, err := machine.New(1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.LoadLinux("../bzImage", "../initrd", "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetConsoleOutput(ioutil.Discard)
+
+	for i := 0; i < 10; i++ {
+		if _, err := m.RunOnce(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.SetMachine(m)
+
+	body = scrape(t, s)
+
+	for _, line := range []string{
+		`gokvm_vcpu_exits_total{vcpu="0",reason="io"} 10`,
+		`gokvm_ioport_exits_total{port="0x3f8"} 10`,
+		`gokvm_device_queue_depth{device="serial0"} 0`,
+		`gokvm_device_io_bytes_total{device="serial0",direction="tx"} 10`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("%q not found in:\n%s", line, body)
+		}
+	}
+	// the value depends on the exits KVM handled by itself
+	if !strings.Contains(body, "# TYPE gokvm_kvm_vcpu_io_exits counter\n"+`gokvm_kvm_vcpu_io_exits{vcpu="0"} `) {
+		t.Fatalf("KVM stats not found in:\n%s", body)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/qmp"
+)
+
+var errorInvalidMigrationURI = errors.New("migration only supports the tcp: and fd: protocols")
+
+type migrateArgs struct {
+	URI      string `json:"uri"`
+	Postcopy bool   `json:"postcopy"`
+}
+
+// migrationEvent is the data of the MIGRATION event.
+type migrationEvent struct {
+	Status string `json:"status"`
+}
+
+// fileConn returns the connection of the socket f, which is closed.
+func fileConn(f *os.File) (net.Conn, error) {
+	defer f.Close()
+
+	return net.FileConn(f)
+}
+
+// dialMigration connects to the destination at uri: tcp:host:port, or
+// fd:name for a connected socket passed to the control socket with getfd.
+func dialMigration(q *qmp.Server, uri string) (net.Conn, error) {
+	switch {
+	case strings.HasPrefix(uri, "tcp:"):
+		return net.Dial("tcp", strings.TrimPrefix(uri, "tcp:"))
+	case strings.HasPrefix(uri, "fd:"):
+		f, err := q.TakeFile(strings.TrimPrefix(uri, "fd:"))
+		if err != nil {
+			return nil, err
+		}
+
+		return fileConn(f)
+	}
+
+	return nil, fmt.Errorf("%w: %q", errorInvalidMigrationURI, uri)
+}
+
+// acceptMigration returns the connection from the source at uri: the first
+// one accepted on tcp:host:port, or the inherited connected socket fd:N.
+func acceptMigration(uri string) (net.Conn, error) {
+	if strings.HasPrefix(uri, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(uri, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("%w: %q", errorInvalidMigrationURI, uri)
+		}
+
+		return fileConn(os.NewFile(uintptr(fd), uri))
+	}
+
+	if !strings.HasPrefix(uri, "tcp:") {
+		return nil, fmt.Errorf("%w: %q", errorInvalidMigrationURI, uri)
+	}
+
+	ln, err := net.Listen("tcp", strings.TrimPrefix(uri, "tcp:"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer ln.Close()
+
+	log.Info("waiting for an incoming migration", "addr", ln.Addr())
+
+	return ln.Accept()
+}
+
+// migrate sends the machine to the gokvm receiving it with -incoming at uri,
+// in post-copy if postcopy is set.
+func migrate(m *machine.Machine, q *qmp.Server, uri string, postcopy bool) error {
+	conn, err := dialMigration(q, uri)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	var stats machine.MigrationStats
+
+	if postcopy {
+		stats, err = m.MigratePostcopy(conn)
+	} else {
+		stats, err = m.Migrate(conn)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Info("migration completed", "to", uri, "rounds", stats.Rounds, "pages", stats.Pages,
+		"requested", stats.Requested, "downtime", stats.Downtime)
+
+	return nil
+}
+
+// receiveMigration waits for a single migration on uri and returns the
+// received machine. In post-copy, the connection stays open until all of
+// guest memory has arrived; the guest can't go on without it, so a failure
+// then is fatal.
+func receiveMigration(t machine.Type, uri string) (*machine.Machine, error) {
+	conn, err := acceptMigration(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := machine.ReceiveMigration(t, conn)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	go func() {
+		defer conn.Close()
+
+		if err := m.WaitIncoming(); err != nil {
+			panic(fmt.Errorf("post-copy migration failed: %w", err))
+		}
+	}()
+
+	return m, nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/monitor"
+	"github.com/bobuhiro11/gokvm/qmp"
+)
+
+var errorInvalidFormat = errors.New("invalid format")
+
+// newMonitorServer offers the commands of the control socket to humans. The
+// commands which have a control counterpart run it, so that both behave the
+// same.
+func newMonitorServer(ln net.Listener, m *machine.Machine, q *qmp.Server) *monitor.Server {
+	s := monitor.NewServer(ln)
+
+	execute := func(name string, args interface{}) (interface{}, error) {
+		raw, err := json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+
+		return q.Execute(name, raw)
+	}
+
+	simple := func(name string) monitor.CommandFunc {
+		return func([]string) (string, error) {
+			_, err := execute(name, nil)
+
+			return "", err
+		}
+	}
+
+	s.Register("info status", "info status", "show the current VM status", func([]string) (string, error) {
+		ret, err := execute("query-status", nil)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("VM status: %s\n", ret.(statusInfo).Status), nil
+	})
+
+	s.Register("info registers", "info registers [cpu]", "show the registers of a vCPU, 0 by default",
+		func(args []string) (string, error) {
+			cpu := 0
+
+			if len(args) > 0 {
+				n, err := strconv.Atoi(args[0])
+				if err != nil {
+					return "", fmt.Errorf("%w: %s", machine.ErrorInvalidCPU, args[0])
+				}
+
+				cpu = n
+			}
+
+			return infoRegisters(m, cpu)
+		})
+
+	s.Register("info pci", "info pci", "show the PCI devices", func([]string) (string, error) {
+		return "gokvm has no PCI bus\n", nil
+	})
+
+	s.Register("info exits", "info exits", "show the VM exits and the hottest I/O ports",
+		func([]string) (string, error) {
+			ret, err := execute("query-exit-stats", nil)
+			if err != nil {
+				return "", err
+			}
+
+			return formatExitStats(ret.(exitStats)), nil
+		})
+
+	s.Register("x", "x/fmt addr", "dump guest physical memory; fmt is [count][x|d|u|c][b|h|w|g]",
+		func(args []string) (string, error) {
+			return dumpMemory(m, args)
+		})
+
+	s.Register("hbreak", "hbreak addr", "stop the VM when a vCPU executes the instruction at the virtual address addr",
+		func(args []string) (string, error) {
+			return "", addHWBreakpoint(m, machine.HWBreakExec, args)
+		})
+
+	s.Register("watch", "watch addr len [w|rw]",
+		"stop the VM after a vCPU writes (w, the default) or accesses (rw) len bytes at the virtual address addr",
+		func(args []string) (string, error) {
+			kind := machine.HWBreakWrite
+
+			if len(args) == 3 {
+				k, ok := watchKinds[args[2]]
+				if !ok {
+					return "", fmt.Errorf("%w: watch takes w or rw, got %s", qmp.ErrorInvalidRequest, args[2])
+				}
+
+				kind, args = k, args[:2]
+			}
+
+			return "", addHWBreakpoint(m, kind, args)
+		})
+
+	s.Register("info breakpoints", "info breakpoints", "show the hardware breakpoints and watchpoints",
+		func([]string) (string, error) {
+			b := &strings.Builder{}
+
+			for i, bp := range m.HWBreakpoints() {
+				fmt.Fprintf(b, "%d: %s 0x%x len %d\n", i, hwBreakKindNames[bp.Kind], bp.Addr, bp.Len)
+			}
+
+			return b.String(), nil
+		})
+
+	s.Register("delete", "delete n", "remove the hardware breakpoint n of info breakpoints",
+		func(args []string) (string, error) {
+			bps := m.HWBreakpoints()
+
+			if len(args) != 1 {
+				return "", fmt.Errorf("%w: delete takes a breakpoint number", qmp.ErrorInvalidRequest)
+			}
+
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 || n >= len(bps) {
+				return "", fmt.Errorf("%w: %s", machine.ErrorUnknownHWBreakpoint, args[0])
+			}
+
+			return "", whilePaused(m, func() error { return m.RemoveHWBreakpoint(bps[n]) })
+		})
+
+	s.Register("step", "step [cpu]", "single-step a vCPU, 0 by default, and leave the VM paused",
+		func(args []string) (string, error) {
+			cpu := 0
+
+			if len(args) > 0 {
+				n, err := strconv.Atoi(args[0])
+				if err != nil {
+					return "", fmt.Errorf("%w: %s", machine.ErrorInvalidCPU, args[0])
+				}
+
+				cpu = n
+			}
+
+			st, err := m.Step(cpu)
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("vcpu %d stopped at RIP=%016x\n", st.CPU, st.PC), nil
+		})
+
+	s.Register("stop", "stop", "pause the VM", simple("stop"))
+	s.Register("cont", "cont", "resume the VM", simple("cont"))
+	s.Register("system_reset", "system_reset", "reset the VM", simple("system_reset"))
+	s.Register("quit", "quit", "stop gokvm", simple("quit"))
+
+	s.Register("dump-guest-memory", "dump-guest-memory path", "write an ELF core of the VM to path",
+		func(args []string) (string, error) {
+			if len(args) != 1 {
+				return "", fmt.Errorf("%w: dump-guest-memory takes a path", qmp.ErrorInvalidRequest)
+			}
+
+			_, err := execute("dump-guest-memory", dumpArgs{Protocol: "file:" + args[0]})
+
+			return "", err
+		})
+
+	s.Register("snapshot create", "snapshot create file", "write a snapshot of the VM to file",
+		func(args []string) (string, error) {
+			if len(args) != 1 {
+				return "", fmt.Errorf("%w: snapshot create takes a file", qmp.ErrorInvalidRequest)
+			}
+
+			_, err := execute("snapshot-save", snapshotArgs{File: args[0]})
+
+			return "", err
+		})
+
+	s.Register("snapshot incremental", "snapshot incremental file",
+		"write the pages written since the latest snapshot and the state of the VM to file",
+		func(args []string) (string, error) {
+			if len(args) != 1 {
+				return "", fmt.Errorf("%w: snapshot incremental takes a file", qmp.ErrorInvalidRequest)
+			}
+
+			_, err := execute("snapshot-save", snapshotArgs{File: args[0], Incremental: true})
+
+			return "", err
+		})
+
+	s.Register("log_level", "log_level subsystem level", "set the log level of a subsystem",
+		func(args []string) (string, error) {
+			if len(args) != 2 {
+				return "", fmt.Errorf("%w: log_level takes a subsystem and a level", qmp.ErrorInvalidRequest)
+			}
+
+			_, err := execute("set-log-level", logLevel{Subsystem: args[0], Level: args[1]})
+
+			return "", err
+		})
+
+	s.Register("device_add", "device_add driver[,prop=value...]", "add a device", simple("device_add"))
+
+	return s
+}
+
+// watchKinds are the watchpoints of watch by argument, hwBreakKindNames the
+// names info breakpoints shows.
+var (
+	watchKinds       = map[string]int{"w": machine.HWBreakWrite, "rw": machine.HWBreakAccess}
+	hwBreakKindNames = map[int]string{
+		machine.HWBreakExec:   "hbreak",
+		machine.HWBreakWrite:  "watch w",
+		machine.HWBreakAccess: "watch rw",
+	}
+)
+
+// addHWBreakpoint adds the breakpoint of kind at the address and, for
+// watchpoints, of the length of args.
+func addHWBreakpoint(m *machine.Machine, kind int, args []string) error {
+	n := 1
+	if kind != machine.HWBreakExec {
+		n = 2
+	}
+
+	if len(args) != n {
+		return fmt.Errorf("%w: %d argument(s) expected", qmp.ErrorInvalidRequest, n)
+	}
+
+	addr, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s", qmp.ErrorInvalidRequest, err)
+	}
+
+	bp := machine.HWBreakpoint{Addr: addr, Kind: kind, Len: 1}
+
+	if n == 2 {
+		if bp.Len, err = strconv.Atoi(args[1]); err != nil {
+			return fmt.Errorf("%w: %s", qmp.ErrorInvalidRequest, err)
+		}
+	}
+
+	return whilePaused(m, func() error { return m.AddHWBreakpoint(bp) })
+}
+
+// whilePaused runs f with the machine paused, and resumes it unless it was
+// paused before.
+func whilePaused(m *machine.Machine, f func() error) error {
+	wasPaused := m.IsPaused()
+
+	if err := m.Pause(); err != nil {
+		return err
+	}
+
+	if !wasPaused {
+		defer func() {
+			_ = m.Resume()
+		}()
+	}
+
+	return f()
+}
+
+// infoRegisters formats the registers like QEMU's info registers. The
+// machine is paused while they are read.
+func infoRegisters(m *machine.Machine, cpu int) (string, error) {
+	wasPaused := m.IsPaused()
+
+	if err := m.Pause(); err != nil {
+		return "", err
+	}
+
+	if !wasPaused {
+		defer func() {
+			_ = m.Resume()
+		}()
+	}
+
+	r, err := m.GetRegs(cpu)
+	if err != nil {
+		return "", err
+	}
+
+	sr, err := m.GetSregs(cpu)
+	if err != nil {
+		return "", err
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "RAX=%016x RBX=%016x RCX=%016x RDX=%016x\n", r.RAX, r.RBX, r.RCX, r.RDX)
+	fmt.Fprintf(b, "RSI=%016x RDI=%016x RBP=%016x RSP=%016x\n", r.RSI, r.RDI, r.RBP, r.RSP)
+	fmt.Fprintf(b, "R8 =%016x R9 =%016x R10=%016x R11=%016x\n", r.R8, r.R9, r.R10, r.R11)
+	fmt.Fprintf(b, "R12=%016x R13=%016x R14=%016x R15=%016x\n", r.R12, r.R13, r.R14, r.R15)
+	fmt.Fprintf(b, "RIP=%016x RFL=%08x\n", r.RIP, r.RFLAGS)
+
+	for _, seg := range []struct {
+		name string
+		base uint64
+		sel  uint16
+		lim  uint32
+	}{
+		{"ES", sr.ES.Base, sr.ES.Selector, sr.ES.Limit},
+		{"CS", sr.CS.Base, sr.CS.Selector, sr.CS.Limit},
+		{"SS", sr.SS.Base, sr.SS.Selector, sr.SS.Limit},
+		{"DS", sr.DS.Base, sr.DS.Selector, sr.DS.Limit},
+		{"FS", sr.FS.Base, sr.FS.Selector, sr.FS.Limit},
+		{"GS", sr.GS.Base, sr.GS.Selector, sr.GS.Limit},
+		{"LDT", sr.LDT.Base, sr.LDT.Selector, sr.LDT.Limit},
+		{"TR", sr.TR.Base, sr.TR.Selector, sr.TR.Limit},
+	} {
+		fmt.Fprintf(b, "%-3s=%04x %016x %08x\n", seg.name, seg.sel, seg.base, seg.lim)
+	}
+
+	fmt.Fprintf(b, "GDT=     %016x %08x\n", sr.GDT.Base, sr.GDT.Limit)
+	fmt.Fprintf(b, "IDT=     %016x %08x\n", sr.IDT.Base, sr.IDT.Limit)
+	fmt.Fprintf(b, "CR0=%08x CR2=%016x CR3=%016x CR4=%08x\n", sr.CR0, sr.CR2, sr.CR3, sr.CR4)
+	fmt.Fprintf(b, "EFER=%016x\n", sr.EFER)
+
+	return b.String(), nil
+}
+
+func formatExitStats(stats exitStats) string {
+	b := &strings.Builder{}
+
+	for _, v := range stats.VCPUs {
+		fmt.Fprintf(b, "vCPU %d:\n", v.VCPU)
+
+		for _, e := range v.Exits {
+			fmt.Fprintf(b, "  %-16s %10d exits %12d ns %6d slow\n", e.Reason, e.Count, e.TimeNs, e.Slow)
+		}
+	}
+
+	if len(stats.IOPorts) > 0 {
+		fmt.Fprintln(b, "I/O ports:")
+	}
+
+	for _, p := range stats.IOPorts {
+		fmt.Fprintf(b, "  0x%04x %10d exits %12d ns\n", p.Port, p.Count, p.TimeNs)
+	}
+
+	return b.String()
+}
+
+// dumpMemory implements x/fmt addr with QEMU's format letters, 16 bytes per
+// line.
+func dumpMemory(m *machine.Machine, args []string) (string, error) {
+	format := "/1xw"
+
+	if len(args) == 2 && strings.HasPrefix(args[0], "/") {
+		format, args = args[0], args[1:]
+	}
+
+	if len(args) != 1 {
+		return "", fmt.Errorf("%w: x takes an address", qmp.ErrorInvalidRequest)
+	}
+
+	addr, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", qmp.ErrorInvalidRequest, err)
+	}
+
+	count, letter, size, err := parseFormat(format[1:])
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, count*size)
+	if err := m.ReadPhysical(addr, data); err != nil {
+		return "", err
+	}
+
+	b := &strings.Builder{}
+	perLine := 16 / size
+
+	if letter == 'c' {
+		perLine = 16
+	}
+
+	for i := 0; i < count; i++ {
+		if i%perLine == 0 {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+
+			fmt.Fprintf(b, "%016x:", addr+uint64(i*size))
+		}
+
+		var v uint64
+
+		word := data[i*size : (i+1)*size]
+
+		switch size {
+		case 1:
+			v = uint64(word[0])
+		case 2:
+			v = uint64(binary.LittleEndian.Uint16(word))
+		case 4:
+			v = uint64(binary.LittleEndian.Uint32(word))
+		default:
+			v = binary.LittleEndian.Uint64(word)
+		}
+
+		switch letter {
+		case 'x':
+			fmt.Fprintf(b, " 0x%0*x", 2*size, v)
+		case 'd':
+			fmt.Fprintf(b, " %d", signExtend(v, size))
+		case 'u':
+			fmt.Fprintf(b, " %d", v)
+		case 'c':
+			fmt.Fprintf(b, " %q", rune(v))
+		}
+	}
+
+	b.WriteString("\n")
+
+	return b.String(), nil
+}
+
+// parseFormat parses [count][x|d|u|c][b|h|w|g]. c implies bytes.
+func parseFormat(f string) (count int, letter byte, size int, err error) {
+	count, letter, size = 1, 'x', 4
+
+	i := strings.IndexFunc(f, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(f)
+	}
+
+	if i > 0 {
+		if count, err = strconv.Atoi(f[:i]); err != nil || count <= 0 {
+			return 0, 0, 0, fmt.Errorf("%w: /%s", errorInvalidFormat, f)
+		}
+	}
+
+	for _, c := range []byte(f[i:]) {
+		switch c {
+		case 'x', 'd', 'u':
+			letter = c
+		case 'c':
+			letter, size = c, 1
+		case 'b':
+			size = 1
+		case 'h':
+			size = 2
+		case 'w':
+			size = 4
+		case 'g':
+			size = 8
+		default:
+			return 0, 0, 0, fmt.Errorf("%w: /%s", errorInvalidFormat, f)
+		}
+	}
+
+	return count, letter, size, nil
+}
+
+func signExtend(v uint64, size int) int64 {
+	shift := uint(64 - 8*size)
+
+	return int64(v<<shift) >> shift
+}
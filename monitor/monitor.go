@@ -0,0 +1,203 @@
+package monitor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The monitor is a line-based console for humans in the spirit of QEMU's
+// HMP. Every line is a command such as "info registers 0" or "x/4x 0x1000",
+// answered with plain text followed by the prompt.
+//
+// refs: https://qemu.readthedocs.io/en/latest/system/monitor.html
+
+const (
+	Banner = "gokvm monitor - type 'help' for more information\n"
+	Prompt = "(gokvm) "
+)
+
+var ErrorUnknownCommand = errors.New("unknown command")
+
+// CommandFunc runs a command with the words following its name and returns
+// the text printed to the user.
+type CommandFunc func(args []string) (string, error)
+
+type command struct {
+	usage string
+	help  string
+	f     CommandFunc
+}
+
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	commands map[string]command
+	conns    map[net.Conn]struct{}
+}
+
+// Listen creates the unix socket at path. The built-in command help is
+// registered.
+func Listen(path string) (*Server, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServer(ln), nil
+}
+
+// NewServer is like Listen but serves on an existing listener. Without one,
+// ln is nil and the commands are only run by Execute.
+func NewServer(ln net.Listener) *Server {
+	s := &Server{
+		ln:       ln,
+		commands: map[string]command{},
+		conns:    map[net.Conn]struct{}{},
+	}
+
+	s.Register("help", "help", "show this help", func([]string) (string, error) {
+		return s.help(), nil
+	})
+
+	return s
+}
+
+// Register adds a command. name is one word such as "stop", or two such as
+// "info registers". usage shows the arguments, e.g. "x/fmt addr": the
+// format after a slash is passed as the first argument including the slash.
+func (s *Server) Register(name, usage, help string, f CommandFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands[name] = command{usage: usage, help: help, f: f}
+}
+
+func (s *Server) help() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmds := make([]command, 0, len(s.commands))
+	width := 0
+
+	for _, c := range s.commands {
+		cmds = append(cmds, c)
+
+		if len(c.usage) > width {
+			width = len(c.usage)
+		}
+	}
+
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].usage < cmds[j].usage })
+
+	b := &strings.Builder{}
+	for _, c := range cmds {
+		fmt.Fprintf(b, "%-*s -- %s\n", width, c.usage, c.help)
+	}
+
+	return b.String()
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve accepts connections until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections and disconnects all clients.
+func (s *Server) Close() error {
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	if _, err := fmt.Fprint(conn, Banner+Prompt); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		out := s.Execute(scanner.Text())
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+
+		if _, err := fmt.Fprint(conn, out+Prompt); err != nil {
+			return
+		}
+	}
+}
+
+// Execute runs a command line and returns its output, or the error message
+// if it failed.
+func (s *Server) Execute(line string) string {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return ""
+	}
+
+	if i := strings.Index(words[0], "/"); i > 0 {
+		words = append([]string{words[0][:i], words[0][i:]}, words[1:]...)
+	}
+
+	s.mu.Lock()
+	c, ok := s.commands[words[0]]
+	args := words[1:]
+
+	if len(words) > 1 {
+		if sub, found := s.commands[words[0]+" "+words[1]]; found {
+			c, ok, args = sub, true, words[2:]
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Sprintf("Error: %v: '%s'\n", ErrorUnknownCommand, words[0])
+	}
+
+	out, err := c.f(args)
+	if err != nil {
+		return fmt.Sprintf("Error: %v\n", err)
+	}
+
+	return out
+}
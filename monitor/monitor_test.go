@@ -0,0 +1,97 @@
+package monitor_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/monitor"
+)
+
+// readPrompt reads the output up to and excluding the next prompt.
+func readPrompt(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	out := ""
+
+	for !strings.HasSuffix(out, monitor.Prompt) {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("%v after %q", err, out)
+		}
+
+		out += string(b)
+	}
+
+	return strings.TrimSuffix(out, monitor.Prompt)
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	s, err := monitor.Listen(filepath.Join(t.TempDir(), "monitor.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	s.Register("info registers", "info registers [cpu]", "show the registers", func(args []string) (string, error) {
+		return "RAX=0 " + strings.Join(args, ","), nil
+	})
+	s.Register("x", "x/fmt addr", "show memory", func(args []string) (string, error) {
+		return strings.Join(args, ",") + "\n", nil
+	})
+	s.Register("stop", "stop", "stop the VM", func([]string) (string, error) {
+		return "", errors.New("already stopped")
+	})
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	conn, err := net.Dial("unix", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	if out := readPrompt(t, r); out != monitor.Banner {
+		t.Fatalf("unexpected banner: %q", out)
+	}
+
+	for _, tc := range []struct {
+		line, out string
+	}{
+		{"info registers 1", "RAX=0 1\n"},
+		{"x/4x 0x1000", "/4x,0x1000\n"},
+		{"stop", "Error: already stopped\n"},
+		{"info pci", "Error: unknown command: 'info'\n"},
+		{"", ""},
+	} {
+		if _, err := conn.Write([]byte(tc.line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		if out := readPrompt(t, r); out != tc.out {
+			t.Fatalf("%q: unexpected output %q", tc.line, out)
+		}
+	}
+
+	if _, err := conn.Write([]byte("help\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	help := readPrompt(t, r)
+	for _, want := range []string{"help                 -- show this help\n", "x/fmt addr           -- show memory\n"} {
+		if !strings.Contains(help, want) {
+			t.Fatalf("%q not found in help:\n%s", want, help)
+		}
+	}
+}
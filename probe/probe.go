@@ -0,0 +1,146 @@
+// Package probe reports what the KVM of a host supports, so that
+// orchestrators can schedule VMs onto hosts able to run them.
+package probe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/fdpath"
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const (
+	// maxCapability bounds the capabilities probed, above the highest one
+	// of current kernels.
+	maxCapability = 256
+
+	sysModule = "/sys/module"
+)
+
+// modules are the kernel modules whose parameters are reported.
+var modules = []string{"kvm", "kvm_intel", "kvm_amd"}
+
+// Extension is a capability the host supports. Value is 1, or a capability
+// specific value such as a count. Name is empty for capabilities unknown to
+// gokvm.
+type Extension struct {
+	Capability int    `json:"capability"`
+	Name       string `json:"name,omitempty"`
+	Value      int    `json:"value"`
+}
+
+// CPUIDEntry is a leaf of the CPUID KVM can give to guests.
+type CPUIDEntry struct {
+	Function uint32 `json:"function"`
+	Index    uint32 `json:"index"`
+	Flags    uint32 `json:"flags"`
+	EAX      uint32 `json:"eax"`
+	EBX      uint32 `json:"ebx"`
+	ECX      uint32 `json:"ecx"`
+	EDX      uint32 `json:"edx"`
+}
+
+// Report is what the KVM of a host supports.
+type Report struct {
+	APIVersion int `json:"api_version"`
+
+	// MaxVCPUs is the hard limit of vCPUs of a VM, RecommendedVCPUs the
+	// number KVM is tuned for.
+	MaxVCPUs         int `json:"max_vcpus"`
+	RecommendedVCPUs int `json:"recommended_vcpus"`
+	MaxMemslots      int `json:"max_memslots"`
+
+	Extensions []Extension  `json:"extensions"`
+	CPUID      []CPUIDEntry `json:"cpuid"`
+
+	// Modules are the parameters of the KVM modules loaded, by module and
+	// parameter name.
+	Modules map[string]map[string]string `json:"modules"`
+}
+
+// Probe reports what the KVM device kvmDevice, a path or fd=N, supports.
+func Probe(kvmDevice string) (*Report, error) {
+	devKVM, err := fdpath.OpenFile(kvmDevice, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	defer devKVM.Close()
+
+	fd := devKVM.Fd()
+
+	version, err := kvm.GetAPIVersion(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{APIVersion: int(version), Extensions: []Extension{}, CPUID: []CPUIDEntry{}}
+
+	for capability := 0; capability < maxCapability; capability++ {
+		n, err := kvm.CheckExtension(fd, capability)
+		if err != nil || n <= 0 {
+			continue
+		}
+
+		r.Extensions = append(r.Extensions, Extension{Capability: capability, Name: kvm.CapName(capability), Value: n})
+
+		switch capability {
+		case kvm.CapMaxVCPUs:
+			r.MaxVCPUs = n
+		case kvm.CapNRVCPUs:
+			r.RecommendedVCPUs = n
+		case kvm.CapNRMemslots:
+			r.MaxMemslots = n
+		}
+	}
+
+	// older kernels only report the recommended number
+	if r.MaxVCPUs == 0 {
+		r.MaxVCPUs = r.RecommendedVCPUs
+	}
+
+	cpuid := kvm.CPUID{Nent: uint32(len(kvm.CPUID{}.Entries))}
+	if err := kvm.GetSupportedCPUID(fd, &cpuid); err != nil {
+		return nil, err
+	}
+
+	for _, e := range cpuid.Entries[:cpuid.Nent] {
+		r.CPUID = append(r.CPUID, CPUIDEntry{
+			Function: e.Function, Index: e.Index, Flags: e.Flags,
+			EAX: e.Eax, EBX: e.Ebx, ECX: e.Ecx, EDX: e.Edx,
+		})
+	}
+
+	r.Modules = moduleParameters(sysModule)
+
+	return r, nil
+}
+
+// moduleParameters returns the parameters of the KVM modules loaded, skipping
+// those which aren't readable.
+func moduleParameters(dir string) map[string]map[string]string {
+	params := map[string]map[string]string{}
+
+	for _, module := range modules {
+		files, err := ioutil.ReadDir(filepath.Join(dir, module, "parameters"))
+		if err != nil {
+			continue
+		}
+
+		params[module] = map[string]string{}
+
+		for _, f := range files {
+			b, err := ioutil.ReadFile(filepath.Join(dir, module, "parameters", f.Name()))
+			if err != nil {
+				continue
+			}
+
+			params[module][f.Name()] = strings.TrimSpace(string(b))
+		}
+	}
+
+	return params
+}
@@ -0,0 +1,45 @@
+package probe_test
+
+import (
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/probe"
+)
+
+func TestProbe(t *testing.T) {
+	t.Parallel()
+
+	r, err := probe.Probe("/dev/kvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.APIVersion != kvm.APIVersion {
+		t.Fatalf("unexpected API version %d", r.APIVersion)
+	}
+
+	if r.MaxVCPUs < r.RecommendedVCPUs || r.RecommendedVCPUs == 0 || r.MaxMemslots == 0 {
+		t.Fatalf("unexpected limits: %+v", r)
+	}
+
+	found := false
+
+	for _, e := range r.Extensions {
+		if e.Capability == kvm.CapUserMemory {
+			found = e.Name == "KVM_CAP_USER_MEMORY" && e.Value > 0
+		}
+	}
+
+	if !found {
+		t.Fatalf("KVM_CAP_USER_MEMORY not reported: %+v", r.Extensions)
+	}
+
+	if len(r.CPUID) == 0 || r.CPUID[0].Function != 0 {
+		t.Fatalf("unexpected cpuid: %+v", r.CPUID)
+	}
+
+	if _, err := probe.Probe("/nonexistent"); err == nil {
+		t.Fatal("probed a missing device")
+	}
+}
@@ -0,0 +1,135 @@
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+var (
+	ErrorConnectionClosed = errors.New("connection closed")
+	ErrorNotUnixSocket    = errors.New("file descriptors can only be passed over a unix socket")
+)
+
+// Client executes commands on a server. Events received while waiting for a
+// response are discarded.
+type Client struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+type clientMessage struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event  string          `json:"event"`
+}
+
+// Dial connects to the server at path and negotiates capabilities.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:    conn,
+		scanner: bufio.NewScanner(conn),
+	}
+
+	if _, err := c.recv(); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	if _, err := c.Execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Client) recv() (clientMessage, error) {
+	msg := clientMessage{}
+
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return msg, err
+		}
+
+		return msg, ErrorConnectionClosed
+	}
+
+	if err := json.Unmarshal(c.scanner.Bytes(), &msg); err != nil {
+		return msg, err
+	}
+
+	return msg, nil
+}
+
+// Execute runs the command and returns its raw return value. A command
+// failure is returned as *Error.
+func (c *Client) Execute(command string, args interface{}) (json.RawMessage, error) {
+	return c.execute(command, args, nil)
+}
+
+// SendFd passes f to the server with getfd, naming it name for the commands
+// taking a descriptor, e.g. fd:name.
+func (c *Client) SendFd(name string, f *os.File) error {
+	_, err := c.execute("getfd", fdArgs{name}, syscall.UnixRights(int(f.Fd())))
+
+	return err
+}
+
+// execute sends the command with the control message oob and waits for its
+// response.
+func (c *Client) execute(command string, args interface{}, oob []byte) (json.RawMessage, error) {
+	req, err := json.Marshal(struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+	}{command, args})
+	if err != nil {
+		return nil, err
+	}
+
+	req = append(req, '\n')
+
+	if oob == nil {
+		_, err = c.conn.Write(req)
+	} else if uc, ok := c.conn.(*net.UnixConn); ok {
+		_, _, err = uc.WriteMsgUnix(req, oob, nil)
+	} else {
+		err = ErrorNotUnixSocket
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Event != "" {
+			continue
+		}
+
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+
+		return msg.Return, nil
+	}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
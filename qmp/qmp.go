@@ -0,0 +1,591 @@
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/logging"
+	"github.com/bobuhiro11/gokvm/tracing"
+)
+
+var log = logging.New("qmp")
+
+// The protocol follows the QEMU Machine Protocol: every message is a JSON
+// object on its own line. The server first sends a greeting, and the client
+// must then negotiate capabilities with "qmp_capabilities" before executing
+// other commands or receiving events.
+//
+// refs: https://qemu.readthedocs.io/en/latest/interop/qmp-spec.html
+//
+// As in QEMU, a client on a unix socket can pass file descriptors with
+// SCM_RIGHTS along with "getfd", which names the descriptor for commands
+// that take one, and "closefd" closes a named descriptor again.
+
+var (
+	ErrorCommandNotFound = errors.New("command not found")
+	ErrorNotNegotiated   = errors.New("expecting capabilities negotiation with 'qmp_capabilities'")
+	ErrorInvalidRequest  = errors.New("invalid request")
+	ErrorNoFd            = errors.New("no file descriptor was passed with getfd")
+	ErrorFdNotFound      = errors.New("file descriptor not found")
+)
+
+const (
+	// maxFds is the number of descriptors received with a single message.
+	maxFds = 16
+
+	// maxQueuedEvents is how many events a client can fall behind before
+	// it is dropped, and writeTimeout how long a write to it can block.
+	maxQueuedEvents = 64
+	writeTimeout    = 5 * time.Second
+
+	// drainTimeout is how long Close waits for the clients to receive the
+	// events left in their queues.
+	drainTimeout = time.Second
+)
+
+const (
+	ClassGenericError    = "GenericError"
+	ClassCommandNotFound = "CommandNotFound"
+)
+
+// CommandFunc executes a command with its raw arguments and returns the value
+// sent back to the client in "return".
+type CommandFunc func(args json.RawMessage) (interface{}, error)
+
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	commands map[string]CommandFunc
+	clients  map[*client]struct{}
+	files    map[string]*os.File
+	closed   bool
+
+	// closing is closed by Close, after which the clients are sent the
+	// events left in their queues until drainBy.
+	closing chan struct{}
+	drainBy time.Time
+}
+
+type client struct {
+	conn net.Conn
+
+	// wmu serializes the responses and the events written to the client,
+	// which the goroutine of writeEvents sends so that Emit never blocks.
+	wmu     sync.Mutex
+	enc     *json.Encoder
+	events  chan *event
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu         sync.Mutex
+	negotiated bool
+
+	// received are the descriptors passed by the client and not yet named
+	// by getfd, the oldest first.
+	received []*os.File
+}
+
+type fdArgs struct {
+	Name string `json:"fdname"`
+}
+
+type request struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	ID        interface{}     `json:"id,omitempty"`
+}
+
+type response struct {
+	Return interface{} `json:"return,omitempty"`
+	Error  *Error      `json:"error,omitempty"`
+	ID     interface{} `json:"id,omitempty"`
+}
+
+// Error is the error returned for a failed command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return e.Desc
+}
+
+type timestamp struct {
+	Seconds      int64 `json:"seconds"`
+	Microseconds int64 `json:"microseconds"`
+}
+
+type event struct {
+	Event     string      `json:"event"`
+	Data      interface{} `json:"data,omitempty"`
+	Timestamp timestamp   `json:"timestamp"`
+}
+
+type greeting struct {
+	QMP struct {
+		Version struct {
+			Package string `json:"package"`
+		} `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Listen creates the unix socket at path. The built-in commands
+// qmp_capabilities, query-commands, getfd and closefd are registered.
+func Listen(path string) (*Server, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServer(ln), nil
+}
+
+// NewServer is like Listen but serves on an existing listener, e.g. one
+// passed by socket activation.
+func NewServer(ln net.Listener) *Server {
+	s := &Server{
+		ln:       ln,
+		commands: map[string]CommandFunc{},
+		clients:  map[*client]struct{}{},
+		files:    map[string]*os.File{},
+		closing:  make(chan struct{}),
+	}
+
+	s.Register("query-commands", func(json.RawMessage) (interface{}, error) {
+		type command struct {
+			Name string `json:"name"`
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		names := make([]string, 0, len(s.commands)+1)
+		for name := range s.commands {
+			names = append(names, name)
+		}
+
+		names = append(names, "qmp_capabilities", "getfd")
+		sort.Strings(names)
+
+		cmds := make([]command, 0, len(names))
+		for _, name := range names {
+			cmds = append(cmds, command{Name: name})
+		}
+
+		return cmds, nil
+	})
+
+	s.Register("closefd", func(args json.RawMessage) (interface{}, error) {
+		arg := fdArgs{}
+		if err := json.Unmarshal(args, &arg); err != nil || arg.Name == "" {
+			return nil, fmt.Errorf("%w: closefd takes an fdname", ErrorInvalidRequest)
+		}
+
+		f, err := s.TakeFile(arg.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, f.Close()
+	})
+
+	return s
+}
+
+// Register adds a command; a command with the same name is replaced.
+func (s *Server) Register(name string, f CommandFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands[name] = f
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve accepts connections until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections and events, disconnects all clients and
+// closes the descriptors they passed. The events already emitted, e.g.
+// SHUTDOWN as gokvm exits, are still sent to the clients for up to
+// drainTimeout.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+
+	s.mu.Lock()
+
+	if !s.closed {
+		s.closed = true
+		s.drainBy = time.Now().Add(drainTimeout)
+		close(s.closing)
+	}
+
+	clients := make([]*client, 0, len(s.clients))
+
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(s.drainBy))
+	defer timer.Stop()
+
+	for _, c := range clients {
+		select {
+		case <-c.stopped:
+		case <-timer.C:
+		}
+
+		c.conn.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, f := range s.files {
+		f.Close()
+		delete(s.files, name)
+	}
+
+	return err
+}
+
+// TakeFile returns the descriptor named name by getfd, which the caller then
+// owns.
+func (s *Server) TakeFile(name string) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorFdNotFound, name)
+	}
+
+	delete(s.files, name)
+
+	return f, nil
+}
+
+// Emit sends an asynchronous event to every client that finished the
+// capabilities negotiation. It doesn't block: the events are queued, and a
+// client falling more than maxQueuedEvents behind is disconnected. Events
+// emitted once the server is closed are dropped.
+func (s *Server) Emit(name string, data interface{}) {
+	now := time.Now()
+	ev := &event{
+		Event: name,
+		Data:  data,
+		Timestamp: timestamp{
+			Seconds:      now.Unix(),
+			Microseconds: int64(now.Nanosecond() / 1000),
+		},
+	}
+
+	// the events are queued under s.mu, so that Close sees all of them
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	for c := range s.clients {
+		c.mu.Lock()
+		negotiated := c.negotiated
+		c.mu.Unlock()
+
+		if !negotiated {
+			continue
+		}
+
+		select {
+		case c.events <- ev:
+		default:
+			log.Warn("client dropped for falling behind on events", "event", name)
+			c.conn.Close()
+		}
+	}
+}
+
+// write sends v to the client, giving up after writeTimeout.
+func (c *client) write(v interface{}) error {
+	return c.writeBy(v, time.Now().Add(writeTimeout))
+}
+
+// writeBy is like write but gives up at deadline.
+func (c *client) writeBy(v interface{}, deadline time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	return c.enc.Encode(v)
+}
+
+// writeEvents sends the events queued by Emit until the client disconnects,
+// or until s is closed and the queue is drained.
+func (c *client) writeEvents(s *Server) {
+	defer close(c.stopped)
+
+	for {
+		select {
+		case ev := <-c.events:
+			if err := c.write(ev); err != nil {
+				c.conn.Close()
+
+				return
+			}
+		case <-c.done:
+			return
+		case <-s.closing:
+			for {
+				select {
+				case ev := <-c.events:
+					if err := c.writeBy(ev, s.drainBy); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	c := &client{
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		events:  make(chan *event, maxQueuedEvents),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	defer conn.Close()
+
+	g := greeting{}
+	g.QMP.Version.Package = "gokvm"
+	g.QMP.Capabilities = []string{}
+
+	if err := c.write(g); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+
+		return
+	}
+
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	go c.writeEvents(s)
+
+	defer close(c.done)
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+
+		for _, f := range c.received {
+			f.Close()
+		}
+	}()
+
+	var r io.Reader = conn
+	if uc, ok := conn.(*net.UnixConn); ok {
+		r = &fdReader{uc, c}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if err := c.write(s.execute(c, scanner.Bytes())); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) execute(c *client, line []byte) response {
+	req := request{}
+	if err := json.Unmarshal(line, &req); err != nil || req.Execute == "" {
+		return errorResponse(req.ID, fmt.Errorf("%w: %s", ErrorInvalidRequest, line))
+	}
+
+	if req.Execute == "qmp_capabilities" {
+		c.mu.Lock()
+		c.negotiated = true
+		c.mu.Unlock()
+
+		return response{Return: struct{}{}, ID: req.ID}
+	}
+
+	c.mu.Lock()
+	negotiated := c.negotiated
+	c.mu.Unlock()
+
+	if !negotiated {
+		return response{
+			Error: &Error{Class: ClassCommandNotFound, Desc: ErrorNotNegotiated.Error()},
+			ID:    req.ID,
+		}
+	}
+
+	if req.Execute == "getfd" {
+		if err := s.getfd(c, req.Arguments); err != nil {
+			return errorResponse(req.ID, err)
+		}
+
+		return response{Return: struct{}{}, ID: req.ID}
+	}
+
+	ret, err := s.Execute(req.Execute, req.Arguments)
+	if err != nil {
+		return errorResponse(req.ID, err)
+	}
+
+	if ret == nil {
+		ret = struct{}{}
+	}
+
+	return response{Return: ret, ID: req.ID}
+}
+
+// getfd names the oldest descriptor received from c, replacing a descriptor
+// of the same name.
+func (s *Server) getfd(c *client, args json.RawMessage) error {
+	arg := fdArgs{}
+	if err := json.Unmarshal(args, &arg); err != nil || arg.Name == "" {
+		return fmt.Errorf("%w: getfd takes an fdname", ErrorInvalidRequest)
+	}
+
+	c.mu.Lock()
+	if len(c.received) == 0 {
+		c.mu.Unlock()
+
+		return ErrorNoFd
+	}
+
+	f := c.received[0]
+	c.received = c.received[1:]
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.files[arg.Name]; ok {
+		old.Close()
+	}
+
+	s.files[arg.Name] = f
+
+	log.Debug("file descriptor received", "fdname", arg.Name, "fd", f.Fd())
+
+	return nil
+}
+
+// fdReader reads the requests of c, keeping the descriptors passed with them.
+type fdReader struct {
+	conn *net.UnixConn
+	c    *client
+}
+
+func (r *fdReader) Read(p []byte) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(maxFds*4))
+
+	n, oobn, _, _, err := r.conn.ReadMsgUnix(p, oob)
+	if oobn > 0 {
+		r.c.receive(oob[:oobn])
+	}
+
+	return n, err
+}
+
+func (c *client) receive(oob []byte) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			c.received = append(c.received, os.NewFile(uintptr(fd), fmt.Sprintf("fd:%d", fd)))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Execute runs a registered command as if a client sent it, e.g. for other
+// interfaces offering the same commands.
+func (s *Server) Execute(name string, args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	f, ok := s.commands[name]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorCommandNotFound, name)
+	}
+
+	span := tracing.StartSpan("qmp "+name, "qmp.command", name)
+	ret, err := f(args)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		log.Debug("command failed", "command", name, "err", err)
+
+		return nil, err
+	}
+
+	log.Debug("command executed", "command", name)
+
+	return ret, nil
+}
+
+func errorResponse(id interface{}, err error) response {
+	class := ClassGenericError
+	if errors.Is(err, ErrorCommandNotFound) {
+		class = ClassCommandNotFound
+	}
+
+	return response{Error: &Error{Class: class, Desc: err.Error()}, ID: id}
+}
@@ -0,0 +1,303 @@
+package qmp_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/qmp"
+)
+
+type message struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+	ID    json.RawMessage `json:"id"`
+}
+
+func startServer(t *testing.T) (*qmp.Server, net.Conn, *bufio.Scanner) {
+	t.Helper()
+
+	s, err := qmp.Listen(filepath.Join(t.TempDir(), "qmp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	conn, err := net.Dial("unix", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	scanner := bufio.NewScanner(conn)
+
+	if msg := recv(t, scanner); msg.QMP == nil {
+		t.Fatal("greeting is not received")
+	}
+
+	return s, conn, scanner
+}
+
+func send(t *testing.T, conn net.Conn, req string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(req + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recv(t *testing.T, scanner *bufio.Scanner) message {
+	t.Helper()
+
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+
+	msg := message{}
+	if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func TestNegotiation(t *testing.T) {
+	t.Parallel()
+
+	_, conn, scanner := startServer(t)
+
+	send(t, conn, `{"execute": "query-commands"}`)
+
+	if msg := recv(t, scanner); msg.Error == nil || msg.Error.Class != qmp.ClassCommandNotFound {
+		t.Fatalf("command must be rejected before negotiation: %+v", msg)
+	}
+
+	send(t, conn, `{"execute": "qmp_capabilities", "id": 1}`)
+
+	if msg := recv(t, scanner); msg.Error != nil || string(msg.ID) != "1" {
+		t.Fatalf("unexpected response: %+v", msg)
+	}
+
+	send(t, conn, `{"execute": "query-commands"}`)
+
+	if msg := recv(t, scanner); msg.Return == nil {
+		t.Fatalf("unexpected response: %+v", msg)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	t.Parallel()
+
+	s, conn, scanner := startServer(t)
+
+	s.Register("echo", func(args json.RawMessage) (interface{}, error) {
+		v := struct {
+			Text string `json:"text"`
+		}{}
+
+		if err := json.Unmarshal(args, &v); err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	})
+
+	s.Register("fail", func(json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+
+	send(t, conn, `{"execute": "qmp_capabilities"}`)
+	recv(t, scanner)
+
+	send(t, conn, `{"execute": "echo", "arguments": {"text": "hello"}, "id": "a"}`)
+
+	if msg := recv(t, scanner); string(msg.Return) != `{"text":"hello"}` || string(msg.ID) != `"a"` {
+		t.Fatalf("unexpected response: %+v", msg)
+	}
+
+	send(t, conn, `{"execute": "fail"}`)
+
+	if msg := recv(t, scanner); msg.Error == nil || msg.Error.Class != qmp.ClassGenericError {
+		t.Fatalf("unexpected response: %+v", msg)
+	}
+
+	send(t, conn, `{"execute": "no-such-command"}`)
+
+	if msg := recv(t, scanner); msg.Error == nil || msg.Error.Class != qmp.ClassCommandNotFound {
+		t.Fatalf("unexpected response: %+v", msg)
+	}
+
+	send(t, conn, `not json`)
+
+	if msg := recv(t, scanner); msg.Error == nil {
+		t.Fatalf("unexpected response: %+v", msg)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	t.Parallel()
+
+	s, conn, scanner := startServer(t)
+
+	send(t, conn, `{"execute": "qmp_capabilities"}`)
+	recv(t, scanner)
+
+	s.Emit("SHUTDOWN", map[string]interface{}{"guest": false})
+
+	if msg := recv(t, scanner); msg.Event != "SHUTDOWN" || string(msg.Data) != `{"guest":false}` {
+		t.Fatalf("unexpected event: %+v", msg)
+	}
+}
+
+func TestEmitClose(t *testing.T) {
+	t.Parallel()
+
+	s, conn, scanner := startServer(t)
+
+	send(t, conn, `{"execute": "qmp_capabilities"}`)
+	recv(t, scanner)
+
+	// as gokvm does on exit
+	s.Emit("SHUTDOWN", map[string]interface{}{"guest": true})
+	s.Close()
+	s.Emit("DROPPED", nil)
+
+	if msg := recv(t, scanner); msg.Event != "SHUTDOWN" {
+		t.Fatalf("unexpected event: %+v", msg)
+	}
+
+	if scanner.Scan() {
+		t.Fatalf("unexpected message after close: %s", scanner.Bytes())
+	}
+}
+
+func TestEmitStalledClient(t *testing.T) {
+	t.Parallel()
+
+	s, conn, scanner := startServer(t)
+
+	send(t, conn, `{"execute": "qmp_capabilities"}`)
+	recv(t, scanner)
+
+	// the client stops reading while events overflow the socket buffer
+	data := strings.Repeat("x", 4096)
+	emitted := make(chan struct{})
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			s.Emit("STALLED", data)
+		}
+
+		close(emitted)
+	}()
+
+	select {
+	case <-emitted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Emit blocked on a client not reading")
+	}
+
+	// and is disconnected once the events queued are read
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	for scanner.Scan() {
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("client not disconnected: %v", err)
+	}
+}
+
+func TestGetfd(t *testing.T) {
+	t.Parallel()
+
+	s, err := qmp.Listen(filepath.Join(t.TempDir(), "qmp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	c, err := qmp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if _, err := c.Execute("getfd", map[string]string{"fdname": "none"}); err == nil ||
+		!strings.Contains(err.Error(), qmp.ErrorNoFd.Error()) {
+		t.Fatalf("getfd without a descriptor must fail: %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	if err := c.SendFd("pipe", w); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+
+	f, err := s.TakeFile("pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteString("passed"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil || string(data) != "passed" {
+		t.Fatalf("unexpected data: %q %v", data, err)
+	}
+
+	// a descriptor is taken once
+	if _, err := s.TakeFile("pipe"); !errors.Is(err, qmp.ErrorFdNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := c.SendFd("closed", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Execute("closefd", map[string]string{"fdname": "closed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.TakeFile("closed"); !errors.Is(err, qmp.ErrorFdNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/fdpath"
+	"github.com/bobuhiro11/gokvm/instance"
+	"github.com/bobuhiro11/gokvm/landlock"
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/seccomp"
+)
+
+const (
+	landlockWrite = landlock.AccessWriteFile | landlock.AccessTruncate | landlock.AccessMakeReg
+	landlockFiles = landlock.AccessReadFile | landlock.AccessReadDir | landlock.AccessRemoveFile | landlockWrite
+)
+
+// setupSandbox restricts gokvm once everything the VM needs is open, before
+// the vCPUs run. The vCPUs get a seccomp filter of their own on top, from
+// setupVCPUThreads.
+func setupSandbox(c *config.Config, m *machine.Machine) {
+	if c.Landlock {
+		abi, err := landlockRules(c).Restrict()
+		if err != nil {
+			panic(err)
+		}
+
+		log.Info("landlock ruleset enforced", "abi", abi)
+	}
+
+	if c.Seccomp != "" {
+		if err := seccomp.VMM.InstallProcess(c.Seccomp); err != nil {
+			panic(err)
+		}
+
+		log.Info("seccomp filters installed", "mode", c.Seccomp)
+	}
+}
+
+// landlockRules grants access to the files and directories the configuration
+// names, for what gokvm does with them after the start.
+func landlockRules(c *config.Config) landlock.Ruleset {
+	// reset loads the kernel again, and the sockets and the instance
+	// directory are removed on exit
+	rules := landlock.Ruleset{
+		{Path: instance.Dir(c.Name), Access: landlock.AccessReadDir | landlock.AccessRemoveFile},
+		{Path: instance.RunDir(), Access: landlock.AccessRemoveDir},
+	}
+
+	// descriptors passed as fd=N are used without opening a path
+	for _, path := range []string{c.Kernel, c.Initrd} {
+		if _, isFd, _ := fdpath.Parse(path); path != "" && !isFd {
+			rules = append(rules, landlock.Rule{Path: path, Access: landlock.AccessReadFile})
+		}
+	}
+
+	for _, path := range []string{c.QMP, c.Monitor, c.API, c.PidFile} {
+		if path != "" {
+			rules = append(rules, landlock.Rule{Path: filepath.Dir(path), Access: landlock.AccessRemoveFile})
+		}
+	}
+
+	// rotated by renaming
+	if c.SerialLog != "" {
+		rules = append(rules, landlock.Rule{Path: filepath.Dir(c.SerialLog), Access: landlockFiles})
+	}
+
+	if _, isFd, _ := fdpath.Parse(c.CrashDump); c.CrashDump != "" && !isFd {
+		rules = append(rules, landlock.Rule{Path: filepath.Dir(c.CrashDump), Access: landlockWrite})
+	}
+
+	for _, dir := range c.LandlockAllow {
+		rules = append(rules, landlock.Rule{Path: dir, Access: landlockFiles})
+	}
+
+	// name resolution of the metrics, traces and URL hooks
+	for _, path := range []string{"/etc/hosts", "/etc/resolv.conf", "/etc/nsswitch.conf"} {
+		rules = append(rules, landlock.Rule{Path: path, Access: landlock.AccessReadFile})
+	}
+
+	// e.g. the default kernel of a restored VM; creating them is denied
+	// anyway
+	existing := landlock.Ruleset{}
+
+	for _, rule := range rules {
+		if _, err := os.Stat(rule.Path); err == nil {
+			existing = append(existing, rule)
+		}
+	}
+
+	return existing
+}
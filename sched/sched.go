@@ -0,0 +1,70 @@
+// Package sched sets the realtime scheduling policy of threads, for vCPUs
+// which must not wait for other threads of the host to run.
+//
+// A thread running with a realtime policy takes the CPU from any normal
+// thread of the host as long as it is runnable, so the host needs CPUs left
+// for the rest of gokvm and its own work. Setting a policy needs
+// CAP_SYS_NICE or an RLIMIT_RTPRIO at least as high as the priority.
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// PolicyFIFO runs a thread until it blocks or a thread of higher
+	// priority is runnable.
+	PolicyFIFO = "fifo"
+
+	// PolicyRR is PolicyFIFO, with threads of the same priority taking
+	// turns.
+	PolicyRR = "rr"
+
+	MinPriority = 1
+	MaxPriority = 99
+
+	schedFIFO = 1
+	schedRR   = 2
+)
+
+var (
+	ErrorInvalidPolicy   = errors.New("invalid scheduling policy")
+	ErrorInvalidPriority = errors.New("invalid realtime priority")
+)
+
+var policies = map[string]uintptr{PolicyFIFO: schedFIFO, PolicyRR: schedRR}
+
+// Check returns an error unless policy is PolicyFIFO or PolicyRR and
+// priority is within MinPriority and MaxPriority.
+func Check(policy string, priority int) error {
+	if _, ok := policies[policy]; !ok {
+		return fmt.Errorf("%w: %q (available: %s, %s)", ErrorInvalidPolicy, policy, PolicyFIFO, PolicyRR)
+	}
+
+	if priority < MinPriority || priority > MaxPriority {
+		return fmt.Errorf("%w: %d must be between %d and %d", ErrorInvalidPriority, priority, MinPriority, MaxPriority)
+	}
+
+	return nil
+}
+
+// SetThread sets the scheduling policy and priority of the calling thread
+// only. The goroutine must be locked to its thread and not unlock it, so that
+// other goroutines don't run with the policy.
+func SetThread(policy string, priority int) error {
+	if err := Check(policy, priority); err != nil {
+		return err
+	}
+
+	param := struct{ priority int32 }{int32(priority)}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, policies[policy], uintptr(unsafe.Pointer(&param)))
+	if errno != 0 {
+		return fmt.Errorf("sched_setscheduler %s %d: %w", policy, priority, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package sched_test
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/sched"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []string{sched.PolicyFIFO, sched.PolicyRR} {
+		if err := sched.Check(policy, sched.MaxPriority); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sched.Check("idle", 1); !errors.Is(err, sched.ErrorInvalidPolicy) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, priority := range []int{0, 100} {
+		if err := sched.Check(sched.PolicyFIFO, priority); !errors.Is(err, sched.ErrorInvalidPriority) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestSetThread(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan error, 1)
+
+	// the thread exits with the goroutine
+	go func() {
+		runtime.LockOSThread()
+
+		if err := sched.SetThread(sched.PolicyRR, sched.MinPriority); err != nil {
+			done <- err
+
+			return
+		}
+
+		policy, _, _ := syscall.RawSyscall(syscall.SYS_SCHED_GETSCHEDULER, 0, 0, 0)
+		if policy != 2 {
+			done <- errors.New("policy not set")
+
+			return
+		}
+
+		done <- nil
+	}()
+
+	err := <-done
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("realtime scheduling is not permitted")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
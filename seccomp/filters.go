@@ -0,0 +1,60 @@
+package seccomp
+
+import "syscall"
+
+// system calls newer than the syscall package
+const (
+	sysRenameat2   = 316
+	sysGetrandom   = 318
+	sysUserfaultfd = 323
+	sysStatx       = 332
+	sysRseq        = 334
+	sysClone3      = 435
+	sysEpollPwait2 = 441
+)
+
+// goRuntime is what the Go runtime needs on any thread: memory, scheduling,
+// signals and timers.
+var goRuntime = Filter{
+	syscall.SYS_MMAP, syscall.SYS_MUNMAP, syscall.SYS_MPROTECT, syscall.SYS_MADVISE, syscall.SYS_MINCORE,
+	syscall.SYS_BRK, syscall.SYS_FUTEX, syscall.SYS_SCHED_YIELD, syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_NANOSLEEP, syscall.SYS_CLOCK_GETTIME, syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_RT_SIGACTION, syscall.SYS_RT_SIGPROCMASK, syscall.SYS_RT_SIGRETURN, syscall.SYS_SIGALTSTACK,
+	syscall.SYS_GETPID, syscall.SYS_GETTID, syscall.SYS_TGKILL, syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_SETITIMER, syscall.SYS_TIMER_CREATE, syscall.SYS_TIMER_SETTIME, syscall.SYS_TIMER_DELETE,
+	syscall.SYS_EXIT, syscall.SYS_EXIT_GROUP,
+}
+
+// files is what writing logs, snapshots and dumps needs. Go tries to add the
+// files it opens to its poller.
+var files = Filter{
+	syscall.SYS_READ, syscall.SYS_WRITE, syscall.SYS_READV, syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64, syscall.SYS_PWRITE64, syscall.SYS_LSEEK, syscall.SYS_CLOSE,
+	syscall.SYS_OPENAT, syscall.SYS_FSTAT, syscall.SYS_NEWFSTATAT, sysStatx,
+	syscall.SYS_FSYNC, syscall.SYS_FDATASYNC, syscall.SYS_FTRUNCATE,
+	syscall.SYS_RENAMEAT, sysRenameat2, syscall.SYS_UNLINKAT, syscall.SYS_FCNTL,
+	syscall.SYS_IOCTL, syscall.SYS_EPOLL_CTL,
+}
+
+// VCPU is the filter of the vCPU threads: KVM_RUN and the emulation of port
+// I/O, which writes the serial console and its log files.
+var VCPU = goRuntime.With(files...)
+
+// VMM is the filter of the other threads: the control socket, the API and
+// the monitor, migrations, snapshots with their page faults, the debugger,
+// metrics and URL hooks. It doesn't allow execve, so that exec hooks of the
+// events after the start can't run.
+//
+// Threads of builds with cgo are created by glibc, and seccomp and prctl
+// install the filters of the vCPU threads, which can only restrict further.
+var VMM = VCPU.With(
+	syscall.SYS_SOCKET, syscall.SYS_CONNECT, syscall.SYS_BIND, syscall.SYS_LISTEN, syscall.SYS_ACCEPT4,
+	syscall.SYS_GETSOCKNAME, syscall.SYS_GETPEERNAME, syscall.SYS_SETSOCKOPT, syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO, syscall.SYS_RECVFROM, syscall.SYS_SENDMSG, syscall.SYS_RECVMSG, syscall.SYS_SHUTDOWN,
+	syscall.SYS_EPOLL_CREATE1, syscall.SYS_EPOLL_CTL, syscall.SYS_EPOLL_WAIT, syscall.SYS_EPOLL_PWAIT,
+	sysEpollPwait2, syscall.SYS_EVENTFD2, syscall.SYS_PIPE2, syscall.SYS_POLL, syscall.SYS_PPOLL,
+	syscall.SYS_DUP, syscall.SYS_DUP3, syscall.SYS_GETDENTS64, syscall.SYS_MKDIRAT, syscall.SYS_READLINKAT,
+	syscall.SYS_FCHMOD, syscall.SYS_CLONE, syscall.SYS_UNAME, syscall.SYS_PRLIMIT64, sysGetrandom,
+	sysUserfaultfd, syscall.SYS_GETUID, sysClone3, syscall.SYS_SET_ROBUST_LIST, sysRseq,
+	sysSeccomp, syscall.SYS_PRCTL,
+)
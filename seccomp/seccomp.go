@@ -0,0 +1,163 @@
+// Package seccomp restricts the system calls of gokvm with seccomp filters.
+//
+// The Go runtime runs goroutines on any of its threads, so only goroutines
+// locked to their thread can have a filter of their own: the vCPUs, which
+// spend their time in KVM_RUN and emulating port I/O. The I/O and API
+// goroutines share the other threads, and the filter of the whole process.
+// Filters stack, so that a vCPU thread is restricted by both.
+package seccomp
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// ModeEnforce kills gokvm on a system call not allowed by the filter.
+	ModeEnforce = "enforce"
+
+	// ModeLog allows all system calls, logging the ones not allowed by the
+	// filter to the audit log of the kernel.
+	ModeLog = "log"
+)
+
+const (
+	sysSeccomp           = 317
+	seccompSetModeFilter = 1
+	filterFlagTSync      = 1
+	prSetNoNewPrivs      = 38
+
+	retKillProcess = 0x80000000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+
+	// offsets in struct seccomp_data
+	dataNr   = 0
+	dataArch = 4
+
+	auditArchX86_64 = 0xc000003e
+	x32SyscallBit   = 0x40000000
+
+	bpfLD  = 0x00
+	bpfJMP = 0x05
+	bpfRET = 0x06
+	bpfW   = 0x00
+	bpfABS = 0x20
+	bpfJEQ = 0x10
+	bpfJGE = 0x30
+	bpfK   = 0x00
+)
+
+var (
+	ErrorInvalidMode  = errors.New("invalid seccomp mode")
+	ErrorFilterTooBig = errors.New("seccomp filter too big")
+)
+
+// Filter is an allowlist of system calls.
+type Filter []uintptr
+
+// CheckMode returns an error unless mode is ModeEnforce or ModeLog.
+func CheckMode(mode string) error {
+	if mode != ModeEnforce && mode != ModeLog {
+		return fmt.Errorf("%w: %q (available: %s, %s)", ErrorInvalidMode, mode, ModeEnforce, ModeLog)
+	}
+
+	return nil
+}
+
+// With returns a copy of f allowing nrs too.
+func (f Filter) With(nrs ...uintptr) Filter {
+	return append(append(Filter{}, f...), nrs...)
+}
+
+func stmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// program compiles f into a classic BPF program comparing the system call
+// number with each allowed one in turn:
+//
+//	arch != x86_64 -> deny
+//	nr >= x32 -> deny
+//	nr == f[0] -> allow
+//	...
+//	deny
+//	allow
+func (f Filter) program(deny uint32) ([]syscall.SockFilter, error) {
+	n := len(f)
+
+	// the jumps to allow are relative and 8 bits wide
+	if n > 0xfe {
+		return nil, fmt.Errorf("%w: %d system calls", ErrorFilterTooBig, n)
+	}
+
+	p := []syscall.SockFilter{
+		stmt(bpfLD|bpfW|bpfABS, dataArch),
+		jump(bpfJMP|bpfJEQ|bpfK, auditArchX86_64, 1, 0),
+		stmt(bpfRET|bpfK, deny),
+		stmt(bpfLD|bpfW|bpfABS, dataNr),
+		jump(bpfJMP|bpfJGE|bpfK, x32SyscallBit, uint8(n), 0),
+	}
+
+	for i, nr := range f {
+		p = append(p, jump(bpfJMP|bpfJEQ|bpfK, uint32(nr), uint8(n-i), 0))
+	}
+
+	return append(p, stmt(bpfRET|bpfK, deny), stmt(bpfRET|bpfK, retAllow)), nil
+}
+
+func (f Filter) install(mode string, flags uintptr) error {
+	if err := CheckMode(mode); err != nil {
+		return err
+	}
+
+	deny := uint32(retKillProcess)
+	if mode == ModeLog {
+		deny = retLog
+	}
+
+	p, err := f.program(deny)
+	if err != nil {
+		return err
+	}
+
+	// an unprivileged process may only install filters without gaining
+	// privileges afterwards
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	prog := syscall.SockFprog{Len: uint16(len(p)), Filter: &p[0]}
+
+	r, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, flags, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	}
+
+	// with TSYNC, the thread which could not be synchronized
+	if r != 0 {
+		return fmt.Errorf("failed to install the seccomp filter on thread %d", r)
+	}
+
+	return nil
+}
+
+// InstallProcess installs f on all threads of the process, and on the ones
+// created afterwards. It must be installed before the filters of single
+// threads.
+func (f Filter) InstallProcess(mode string) error {
+	return f.install(mode, filterFlagTSync)
+}
+
+// InstallThread installs f on the calling thread only. The goroutine must be
+// locked to its thread and not unlock it, so that the thread exits with the
+// goroutine rather than running others.
+func (f Filter) InstallThread(mode string) error {
+	return f.install(mode, 0)
+}
@@ -0,0 +1,89 @@
+package seccomp_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/seccomp"
+)
+
+func TestCheckMode(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{seccomp.ModeEnforce, seccomp.ModeLog} {
+		if err := seccomp.CheckMode(mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := seccomp.CheckMode("off"); !errors.Is(err, seccomp.ErrorInvalidMode) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestInstallThread(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan error, 1)
+
+	// the thread exits with the goroutine
+	go func() {
+		runtime.LockOSThread()
+
+		if err := seccomp.VCPU.InstallThread(seccomp.ModeLog); err != nil {
+			done <- err
+
+			return
+		}
+
+		// logged only
+		syscall.Getppid()
+
+		status, err := ioutil.ReadFile("/proc/thread-self/status")
+		if err == nil && !strings.Contains(string(status), "Seccomp:\t2") {
+			err = errors.New("no filter on the thread")
+		}
+
+		done <- err
+	}()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallThreadEnforce(t *testing.T) {
+	t.Parallel()
+
+	if os.Getenv("GOKVM_SECCOMP_CHILD") != "" {
+		runtime.LockOSThread()
+
+		if err := seccomp.VCPU.InstallThread(seccomp.ModeEnforce); err != nil {
+			os.Exit(2)
+		}
+
+		_, _ = syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInstallThreadEnforce$")
+	cmd.Env = append(os.Environ(), "GOKVM_SECCOMP_CHILD=1")
+
+	err := cmd.Run()
+
+	exitErr := &exec.ExitError{}
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("the child was not killed: %v", err)
+	}
+
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); !ok || !ws.Signaled() || ws.Signal() != syscall.SIGSYS {
+		t.Fatalf("unexpected exit: %v", err)
+	}
+}
@@ -1,19 +1,38 @@
 package serial
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
 )
 
 const (
 	COM1Addr = 0x03f8
+
+	// stateVersion is the version of the encoding of SaveState.
+	stateVersion = 1
 )
 
+var ErrorInvalidState = errors.New("invalid serial port state")
+
 type Serial struct {
 	IER byte
 	LCR byte
 
+	// rxBytes and txBytes count the bytes received and transmitted by the
+	// guest.
+	rxBytes uint64
+	txBytes uint64
+
 	inputChan chan byte
 
+	// Transmitted bytes are written to output.
+	output io.Writer
+
 	// This callback is called when serial request IRQ.
 	irqCallback func(irq, level uint32)
 }
@@ -22,6 +41,7 @@ func New(irqCallBack func(irq, level uint32)) (*Serial, error) {
 	s := &Serial{
 		IER: 0, LCR: 0,
 		inputChan:   make(chan byte, 10000),
+		output:      os.Stdout,
 		irqCallback: irqCallBack,
 	}
 
@@ -32,6 +52,106 @@ func (s *Serial) GetInputChan() chan<- byte {
 	return s.inputChan
 }
 
+// SetOutput changes where transmitted bytes are written, os.Stdout by default.
+func (s *Serial) SetOutput(w io.Writer) {
+	s.output = w
+}
+
+// Reset puts the registers back into their initial state and drops the
+// input not yet read by the guest.
+func (s *Serial) Reset() {
+	s.IER, s.LCR = 0, 0
+
+	for len(s.inputChan) > 0 {
+		<-s.inputChan
+	}
+}
+
+// State is what a snapshot keeps of the serial port.
+type State struct {
+	IER, LCR byte
+	// Input is the input not yet read by the guest.
+	Input []byte
+}
+
+// State returns the registers and the pending input. It must not race with
+// the guest accessing the port, e.g. the machine is paused.
+func (s *Serial) State() State {
+	st := State{IER: s.IER, LCR: s.LCR, Input: []byte{}}
+
+	for n := len(s.inputChan); n > 0; n-- {
+		b := <-s.inputChan
+		st.Input = append(st.Input, b)
+		s.inputChan <- b
+	}
+
+	return st
+}
+
+// SetState restores what State returned, replacing the pending input.
+func (s *Serial) SetState(st State) {
+	s.Reset()
+	s.IER, s.LCR = st.IER, st.LCR
+
+	for _, b := range st.Input {
+		s.inputChan <- b
+	}
+}
+
+// savedState is followed by NInput bytes of pending input.
+type savedState struct {
+	IER, LCR byte
+	_        uint16
+	NInput   uint32
+}
+
+// StateVersion returns the version of the encoding of SaveState.
+func (s *Serial) StateVersion() uint32 {
+	return stateVersion
+}
+
+// SaveState encodes State for a snapshot.
+func (s *Serial) SaveState() ([]byte, error) {
+	st := s.State()
+	buf := &bytes.Buffer{}
+
+	h := savedState{IER: st.IER, LCR: st.LCR, NInput: uint32(len(st.Input))}
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+
+	buf.Write(st.Input)
+
+	return buf.Bytes(), nil
+}
+
+// LoadState restores the state encoded by SaveState.
+func (s *Serial) LoadState(version uint32, data []byte) error {
+	st := savedState{}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &st); err != nil {
+		return fmt.Errorf("%w: %s", ErrorInvalidState, err)
+	}
+
+	hdr := binary.Size(st)
+	if uint64(len(data)) < uint64(hdr)+uint64(st.NInput) {
+		return fmt.Errorf("%w: truncated input", ErrorInvalidState)
+	}
+
+	s.SetState(State{IER: st.IER, LCR: st.LCR, Input: data[hdr : hdr+int(st.NInput)]})
+
+	return nil
+}
+
+// Stats returns the number of bytes received and transmitted by the guest.
+func (s *Serial) Stats() (rx, tx uint64) {
+	return atomic.LoadUint64(&s.rxBytes), atomic.LoadUint64(&s.txBytes)
+}
+
+// QueueDepth returns the number of input bytes not yet read by the guest.
+func (s *Serial) QueueDepth() int {
+	return len(s.inputChan)
+}
+
 func (s *Serial) dlab() bool {
 	return s.LCR&0x80 != 0
 }
@@ -49,6 +169,7 @@ func (s *Serial) In(port uint64, values []byte) error {
 		// RBR
 		if len(s.inputChan) > 0 {
 			values[0] = <-s.inputChan
+			atomic.AddUint64(&s.rxBytes, 1)
 		}
 	case port == 0 && s.dlab():
 		// DLL
@@ -87,7 +208,8 @@ func (s *Serial) Out(port uint64, values []byte) error {
 	switch {
 	case port == 0 && !s.dlab():
 		// THR
-		fmt.Printf("%c", values[0])
+		_, _ = s.output.Write(values[:1])
+		atomic.AddUint64(&s.txBytes, 1)
 	case port == 0 && s.dlab():
 		// DLL
 	case port == 1 && !s.dlab():
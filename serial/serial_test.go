@@ -1,6 +1,7 @@
 package serial_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/bobuhiro11/gokvm/serial"
@@ -56,3 +57,98 @@ func TestOut(t *testing.T) {
 		}
 	}
 }
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+
+	callback := func(irq, level uint32) {}
+
+	s, err := serial.New(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Out(serial.COM1Addr+1, []byte{0xf}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.GetInputChan() <- 'a'
+	s.Reset()
+
+	if s.IER != 0 || s.LCR != 0 {
+		t.Fatalf("registers are not reset: IER=0x%x LCR=0x%x", s.IER, s.LCR)
+	}
+
+	v := []byte{0}
+	if err := s.In(serial.COM1Addr, v); err != nil || v[0] != 0 {
+		t.Fatalf("input is not dropped: %v 0x%x", err, v[0])
+	}
+}
+
+func TestState(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(func(irq, level uint32) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.LCR = 0x3
+	s.GetInputChan() <- 'a'
+	s.GetInputChan() <- 'b'
+
+	st := s.State()
+	if st.LCR != 0x3 || string(st.Input) != "ab" || s.QueueDepth() != 2 {
+		t.Fatalf("unexpected state: %+v", st)
+	}
+
+	restored, err := serial.New(func(irq, level uint32) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored.SetState(st)
+
+	values := []byte{0}
+	if err := restored.In(serial.COM1Addr, values); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.LCR != 0x3 || values[0] != 'a' || restored.QueueDepth() != 1 {
+		t.Fatalf("state is not restored: LCR=0x%x input=%c", restored.LCR, values[0])
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(func(irq, level uint32) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.IER = 0x1
+	s.GetInputChan() <- 'a'
+
+	data, err := s.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := serial.New(func(irq, level uint32) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restored.LoadState(restored.StateVersion(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.IER != 0x1 || restored.QueueDepth() != 1 {
+		t.Fatalf("state is not restored: IER=0x%x depth=%d", restored.IER, restored.QueueDepth())
+	}
+
+	if err := restored.LoadState(restored.StateVersion(), data[:len(data)-1]); !errors.Is(err, serial.ErrorInvalidState) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
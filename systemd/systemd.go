@@ -0,0 +1,110 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The service manager protocols are implemented directly so that gokvm can
+// run as a Type=notify service with socket activation:
+//
+//	https://www.freedesktop.org/software/systemd/man/sd_notify.html
+//	https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+
+	// listenFdsStart is the first file descriptor passed by socket
+	// activation, SD_LISTEN_FDS_START.
+	listenFdsStart = 3
+)
+
+var ErrorInvalidListenFds = errors.New("invalid LISTEN_FDS")
+
+// Notify sends state to the service manager. It does nothing when gokvm is
+// not started by a service manager expecting notifications.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// a leading '@' denotes a socket in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// Listeners returns the sockets passed by socket activation, keyed by their
+// names (FileDescriptorName= in the socket unit, which defaults to the unit
+// name). Without LISTEN_FDNAMES they are keyed by position, "0", "1" and so
+// on. The environment variables are unset so that they aren't inherited by
+// child processes.
+func Listeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%w: %q", ErrorInvalidListenFds, os.Getenv("LISTEN_FDS"))
+	}
+
+	names := []string{}
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	lns := map[string]net.Listener{}
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+
+		ln, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("socket %s: %w", name, err)
+		}
+
+		lns[name] = ln
+	}
+
+	return lns, nil
+}
+
+// WritePidFile writes the process id to path.
+func WritePidFile(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
@@ -0,0 +1,87 @@
+package systemd_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/systemd"
+)
+
+// The tests below change the environment, so they don't run in parallel.
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err := systemd.Notify(systemd.StateReady); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != systemd.StateReady {
+		t.Fatalf("unexpected state: %q", buf[:n])
+	}
+}
+
+func TestNotifyWithoutServiceManager(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+
+	if err := systemd.Notify(systemd.StateReady); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	lns, err := systemd.Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lns) != 0 {
+		t.Fatalf("unexpected listeners: %v", lns)
+	}
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("LISTEN_FDS is not unset")
+	}
+}
+
+func TestWritePidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gokvm.pid")
+
+	if err := systemd.WritePidFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("unexpected pidfile: %q", data)
+	}
+}
@@ -45,8 +45,22 @@ func write(fd int, t termios) error {
 	return err
 }
 
+// IsTerminal returns true if fd refers to a terminal.
+func IsTerminal(fd int) bool {
+	_, err := read(fd)
+
+	return err == nil
+}
+
+// SetRawMode puts stdin into raw mode, returning a function restoring it.
 func SetRawMode() (func(), error) {
-	t, err := read(0)
+	return MakeRaw(0)
+}
+
+// MakeRaw puts the terminal fd into raw mode, returning a function restoring
+// it.
+func MakeRaw(fd int) (func(), error) {
+	t, err := read(fd)
 	if err != nil {
 		return func() {}, err
 	}
@@ -62,6 +76,6 @@ func SetRawMode() (func(), error) {
 	t.Cc[syscall.VTIME] = 0
 
 	return func() {
-		_ = write(0, oldTermios)
-	}, write(0, t)
+		_ = write(fd, oldTermios)
+	}, write(fd, t)
 }
@@ -0,0 +1,365 @@
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Spans are exported with the OTLP/HTTP protocol in its JSON encoding, which
+// any OpenTelemetry collector accepts on /v1/traces, so that no SDK is
+// needed. Tracing is disabled until Start is called, and spans created before
+// that are no-ops.
+//
+// refs: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+
+const (
+	// MaxQueued is the number of ended spans kept for the next export;
+	// spans beyond it are dropped.
+	MaxQueued = 2048
+
+	// Interval is how often the queued spans are exported.
+	Interval = 5 * time.Second
+
+	serviceName = "gokvm"
+)
+
+var ErrorExportFailed = errors.New("failed to export spans")
+
+type exporter struct {
+	endpoint string
+	client   *http.Client
+
+	mu    sync.Mutex
+	queue []*Span
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	mu  sync.Mutex
+	exp *exporter
+)
+
+// Span is a timed operation. A nil *Span is valid and does nothing.
+type Span struct {
+	traceID, spanID, parentID string
+
+	name  string
+	start time.Time
+	end   time.Time
+	attrs []interface{}
+	err   string
+}
+
+// Start exports the spans to the OTLP/HTTP endpoint, e.g.
+// http://localhost:4318/v1/traces, until Shutdown.
+func Start(endpoint string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	exp = &exporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go exp.run()
+}
+
+// Shutdown exports the remaining spans and disables tracing.
+func Shutdown() error {
+	mu.Lock()
+	e := exp
+	exp = nil
+	mu.Unlock()
+
+	if e == nil {
+		return nil
+	}
+
+	close(e.stop)
+	<-e.done
+
+	return e.flush()
+}
+
+// Flush exports the queued spans now.
+func Flush() error {
+	mu.Lock()
+	e := exp
+	mu.Unlock()
+
+	if e == nil {
+		return nil
+	}
+
+	return e.flush()
+}
+
+func enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return exp != nil
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// StartSpan starts a root span with alternating attribute keys and values.
+func StartSpan(name string, attrs ...interface{}) *Span {
+	if !enabled() {
+		return nil
+	}
+
+	return &Span{
+		traceID: newID(16),
+		spanID:  newID(8),
+		name:    name,
+		start:   time.Now(),
+		attrs:   attrs,
+	}
+}
+
+// StartChild starts a span as a child of s.
+func (s *Span) StartChild(name string, attrs ...interface{}) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return &Span{
+		traceID:  s.traceID,
+		spanID:   newID(8),
+		parentID: s.spanID,
+		name:     name,
+		start:    time.Now(),
+		attrs:    attrs,
+	}
+}
+
+// Record adds a root span of an operation which already finished, e.g. for
+// operations only worth tracing once they turn out to be slow.
+func Record(name string, start, end time.Time, attrs ...interface{}) {
+	s := StartSpan(name, attrs...)
+	if s == nil {
+		return
+	}
+
+	s.start = start
+	s.end = end
+	s.enqueue()
+}
+
+// SetError marks the operation of s as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.err = err.Error()
+}
+
+// End finishes s and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	s.enqueue()
+}
+
+func (s *Span) enqueue() {
+	mu.Lock()
+	e := exp
+	mu.Unlock()
+
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.queue) >= MaxQueued {
+		return
+	}
+
+	e.queue = append(e.queue, s)
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = e.flush()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *exporter) flush() error {
+	e.mu.Lock()
+	spans := e.queue
+	e.queue = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(encode(spans))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorExportFailed, err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s", ErrorExportFailed, res.Status)
+	}
+
+	return nil
+}
+
+// The types below are the subset of the OTLP trace messages used by gokvm.
+
+type traceData struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanData `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type spanData struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const (
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+func encode(spans []*Span) traceData {
+	data := make([]spanData, 0, len(spans))
+
+	for _, s := range spans {
+		sd := spanData{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        attributes(s.attrs),
+		}
+
+		if s.err != "" {
+			sd.Status = status{Code: statusCodeError, Message: s.err}
+		}
+
+		data = append(data, sd)
+	}
+
+	return traceData{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: attributes([]interface{}{"service.name", serviceName})},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: serviceName}, Spans: data}},
+	}}}
+}
+
+func attributes(attrs []interface{}) []keyValue {
+	kvs := []keyValue{}
+
+	for i := 0; i+1 < len(attrs); i += 2 {
+		kvs = append(kvs, keyValue{Key: fmt.Sprint(attrs[i]), Value: value(attrs[i+1])})
+	}
+
+	return kvs
+}
+
+func value(v interface{}) anyValue {
+	switch v := v.(type) {
+	case bool:
+		return anyValue{BoolValue: &v}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s := fmt.Sprint(v)
+
+		return anyValue{IntValue: &s}
+	case float32:
+		f := float64(v)
+
+		return anyValue{DoubleValue: &f}
+	case float64:
+		return anyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+
+		return anyValue{StringValue: &s}
+	}
+}
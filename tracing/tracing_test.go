@@ -0,0 +1,109 @@
+package tracing_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/tracing"
+)
+
+type span struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+			IntValue    string `json:"intValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+type request struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []span `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// The test changes the global exporter, so it doesn't run in parallel.
+func TestExport(t *testing.T) {
+	requests := make(chan request, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		req := request{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		requests <- req
+	}))
+	defer srv.Close()
+
+	if s := tracing.StartSpan("disabled"); s != nil {
+		t.Fatal("span created without an exporter")
+	}
+
+	tracing.Start(srv.URL + "/v1/traces")
+
+	boot := tracing.StartSpan("boot", "vm.cpus", 2)
+	child := boot.StartChild("load kernel", "kernel", "./bzImage")
+	child.SetError(errors.New("no such file"))
+	child.End()
+	boot.End()
+
+	now := time.Now()
+	tracing.Record("exit io", now.Add(-time.Second), now)
+
+	if err := tracing.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+
+	if len(spans) != 3 {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+
+	c, b := spans[0], spans[1]
+
+	if c.Name != "load kernel" || b.Name != "boot" || spans[2].Name != "exit io" {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+
+	if c.TraceID != b.TraceID || c.ParentSpanID != b.SpanID || b.ParentSpanID != "" ||
+		len(b.TraceID) != 32 || len(b.SpanID) != 16 {
+		t.Fatalf("unexpected ids: %+v %+v", b, c)
+	}
+
+	if c.Status.Code != 2 || c.Status.Message != "no such file" ||
+		c.Attributes[0].Key != "kernel" || c.Attributes[0].Value.StringValue != "./bzImage" ||
+		b.Attributes[0].Value.IntValue != "2" {
+		t.Fatalf("unexpected span: %+v %+v", b, c)
+	}
+
+	if s := tracing.StartSpan("stopped"); s != nil {
+		t.Fatal("span created after shutdown")
+	}
+
+	// a nil span does nothing
+	var s *tracing.Span
+	s.StartChild("child").End()
+}
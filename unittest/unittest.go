@@ -0,0 +1,292 @@
+// Package unittest runs test kernels such as those of kvm-unit-tests, the
+// conformance suite of KVM, and reports their results in the Test Anything
+// Protocol.
+//
+// Each kernel boots with the multiboot protocol in a gokvm of its own, on a
+// microvm machine with the debug exit device at the port of kvm-unit-tests.
+// The kernel reports its result through the device: status (code << 1) | 1
+// passes with code 0 and is skipped with code 77, as with run_tests.sh. Its
+// environment, the number of vCPUs and the memory size in MiB which
+// kvm-unit-tests would otherwise read from fw_cfg, is passed as its
+// module. The serial output and the log of gokvm go to <name>.log in the log
+// directory.
+//
+// refs: https://gitlab.com/kvm-unit-tests/kvm-unit-tests/-/blob/master/scripts/runtime.bash
+package unittest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/ebda"
+	"github.com/bobuhiro11/gokvm/instance"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+const (
+	// DefaultTimeout is the timeout of run_tests.sh.
+	DefaultTimeout = 90 * time.Second
+
+	// DefaultLogDir is the log directory of run_tests.sh.
+	DefaultLogDir = "logs"
+
+	codePass = 0
+	codeSkip = 77
+
+	// summaryPrefix starts the last line kvm-unit-tests print.
+	summaryPrefix = "SUMMARY:"
+)
+
+var ErrorInvalidConfig = errors.New("invalid test configuration")
+
+// Config is how the test kernels are run.
+type Config struct {
+	// Gokvm is the gokvm binary booting the kernels.
+	Gokvm string
+
+	CPUs   int
+	Memory config.Size
+
+	// Params is the command line of every kernel, which kvm-unit-tests take
+	// as the arguments of the test.
+	Params string
+
+	Timeout time.Duration
+	LogDir  string
+}
+
+// Default returns the configuration of run_tests.sh.
+func Default() *Config {
+	return &Config{CPUs: 1, Memory: config.Size(machine.MinMemSize), Timeout: DefaultTimeout, LogDir: DefaultLogDir}
+}
+
+// Validate reports all problems with the configuration at once.
+func (c *Config) Validate() error {
+	problems := []string{}
+
+	if c.CPUs < 1 || c.CPUs > ebda.MaxVCPUs {
+		problems = append(problems, fmt.Sprintf("cpus must be between 1 and %d, got %d", ebda.MaxVCPUs, c.CPUs))
+	}
+
+	if int(c.Memory) < machine.MinMemSize {
+		problems = append(problems, fmt.Sprintf("memory must be at least %s", config.Size(machine.MinMemSize)))
+	}
+
+	if c.Timeout <= 0 {
+		problems = append(problems, fmt.Sprintf("timeout must be positive, got %v", c.Timeout))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrorInvalidConfig, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Status is the outcome of a test.
+type Status string
+
+const (
+	StatusPass    Status = "pass"
+	StatusFail    Status = "fail"
+	StatusSkip    Status = "skip"
+	StatusTimeout Status = "timeout"
+)
+
+// Result is the outcome of a test kernel.
+type Result struct {
+	Name   string
+	Status Status
+
+	// Reason explains failures and skips, e.g. with the last line of the
+	// output of the test.
+	Reason string
+	Log    string
+}
+
+// Name returns the name of the test of kernel, its file name without the
+// extension, e.g. apic for x86/apic.flat.
+func Name(kernel string) string {
+	base := filepath.Base(kernel)
+
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Run runs the kernels one after the other, writing the results to w as TAP,
+// and returns how many failed or timed out.
+func Run(w io.Writer, c *Config, kernels []string) (int, error) {
+	if err := os.MkdirAll(c.LogDir, 0o755); err != nil {
+		return 0, err
+	}
+
+	fmt.Fprintln(w, "TAP version 13")
+	fmt.Fprintf(w, "1..%d\n", len(kernels))
+
+	failed := 0
+
+	for i, kernel := range kernels {
+		r, err := runKernel(c, kernel, fmt.Sprintf("test-%d-%d", os.Getpid(), i))
+		if err != nil {
+			return failed, err
+		}
+
+		if r.Status == StatusFail || r.Status == StatusTimeout {
+			failed++
+		}
+
+		writeTAP(w, i+1, r)
+	}
+
+	return failed, nil
+}
+
+func writeTAP(w io.Writer, n int, r *Result) {
+	switch r.Status {
+	case StatusPass:
+		fmt.Fprintf(w, "ok %d - %s\n", n, r.Name)
+	case StatusSkip:
+		fmt.Fprintf(w, "ok %d - %s # SKIP %s\n", n, r.Name, r.Reason)
+	case StatusFail, StatusTimeout:
+		fmt.Fprintf(w, "not ok %d - %s\n", n, r.Name)
+		fmt.Fprintf(w, "# %s\n", r.Reason)
+		fmt.Fprintf(w, "# log: %s\n", r.Log)
+	}
+}
+
+// runKernel boots kernel in a gokvm called instanceName until it exits or
+// times out.
+func runKernel(c *Config, kernel, instanceName string) (*Result, error) {
+	r := &Result{Name: Name(kernel), Log: filepath.Join(c.LogDir, Name(kernel)+".log")}
+
+	log, err := os.Create(r.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	defer log.Close()
+
+	env, err := writeEnv(c)
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(env)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Gokvm, "run",
+		"-name", instanceName,
+		"-machine", machine.TypeMicroVM1,
+		"-multiboot",
+		"-k", kernel,
+		"-i", env,
+		"-p", c.Params,
+		"-c", strconv.Itoa(c.CPUs),
+		"-m", c.Memory.String(),
+		"-debug-exit",
+		"-debug-exit-port", strconv.Itoa(machine.DebugExitTestAddr),
+		"-log-level", "warn",
+	)
+	cmd.Stdout = log
+	cmd.Stderr = log
+
+	err = cmd.Run()
+
+	exitErr := &exec.ExitError{}
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		// a killed gokvm leaves its instance behind
+		_ = instance.Remove(instanceName)
+
+		r.Status, r.Reason = StatusTimeout, fmt.Sprintf("timed out after %v", c.Timeout)
+
+		return r, nil
+	}
+
+	r.Status, r.Reason = classify(cmd.ProcessState.ExitCode(), lastLine(r.Log))
+
+	return r, nil
+}
+
+// classify maps the exit status of gokvm to the status of the test.
+func classify(status int, summary string) (Status, string) {
+	// gokvm exits with an even status unless the kernel set one
+	if status&1 == 0 {
+		return StatusFail, fmt.Sprintf("gokvm exited with status %d without a result of the test", status)
+	}
+
+	switch code := status >> 1; code {
+	case codePass:
+		return StatusPass, ""
+	case codeSkip:
+		return StatusSkip, summary
+	default:
+		if summary == "" {
+			return StatusFail, fmt.Sprintf("exit code %d", code)
+		}
+
+		return StatusFail, fmt.Sprintf("exit code %d: %s", code, summary)
+	}
+}
+
+// lastLine returns the summary line of the test in the log, or its last
+// non-empty line.
+func lastLine(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+
+	defer f.Close()
+
+	last := ""
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+
+		if strings.HasPrefix(line, summaryPrefix) {
+			return line
+		}
+
+		if line != "" {
+			last = line
+		}
+	}
+
+	return last
+}
+
+// writeEnv writes the environment of the kernels to a temporary file.
+func writeEnv(c *Config) (string, error) {
+	f, err := ioutil.TempFile("", "gokvm-test-env")
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "NR_CPUS=%d\nMEMSIZE=%d\nTEST_DEVICE=0\n", c.CPUs, c.Memory>>20)
+	if err != nil {
+		os.Remove(f.Name())
+
+		return "", err
+	}
+
+	return f.Name(), nil
+}
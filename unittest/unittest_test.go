@@ -0,0 +1,92 @@
+package unittest_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/unittest"
+)
+
+// fakeGokvm runs the kernel given with -k as a shell script, which prints the
+// output of the test and exits with the status gokvm would.
+const fakeGokvm = `#!/bin/sh
+while [ "$1" != "-k" ]; do shift; done
+. "$2"
+`
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	kernels := []string{}
+
+	for _, k := range []struct{ name, script string }{
+		{"pass.flat", "echo 'SUMMARY: 3 tests'; exit 1"},
+		{"fail.flat", "echo 'SUMMARY: 3 tests, 1 unexpected failures'; exit 3"},
+		{"skip.flat", "echo 'SUMMARY: 1 tests, 1 skipped'; exit 155"},
+		{"crash.flat", "echo 'KVM internal error'; exit 2"},
+		{"hang.flat", "exec sleep 10"},
+	} {
+		path := filepath.Join(dir, k.name)
+		if err := ioutil.WriteFile(path, []byte(k.script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		kernels = append(kernels, path)
+	}
+
+	c := unittest.Default()
+	c.Gokvm = filepath.Join(dir, "gokvm")
+	c.LogDir = filepath.Join(dir, "logs")
+	c.Timeout = time.Second
+
+	if err := ioutil.WriteFile(c.Gokvm, []byte(fakeGokvm), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	failed, err := unittest.Run(&out, c, kernels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed != 3 {
+		t.Fatalf("unexpected failures: %d\n%s", failed, out.String())
+	}
+
+	for _, line := range []string{
+		"TAP version 13\n1..5\n",
+		"ok 1 - pass\n",
+		"not ok 2 - fail\n# exit code 1: SUMMARY: 3 tests, 1 unexpected failures\n",
+		"ok 3 - skip # SKIP SUMMARY: 1 tests, 1 skipped\n",
+		"not ok 4 - crash\n# gokvm exited with status 2",
+		"not ok 5 - hang\n# timed out after 1s\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("missing %q in:\n%s", line, out.String())
+		}
+	}
+
+	log, err := ioutil.ReadFile(filepath.Join(c.LogDir, "crash.log"))
+	if err != nil || string(log) != "KVM internal error\n" {
+		t.Fatalf("unexpected log: %q %v", log, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	c := unittest.Default()
+	c.CPUs = 0
+	c.Timeout = 0
+
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cpus") || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package userfaultfd
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// A userfaultfd lets a thread resolve the page faults on a memory range
+// registered by it, such as guest memory arriving over the network. Faults
+// are read from the file as messages and resolved with Copy.
+//
+// refs: https://www.kernel.org/doc/html/latest/admin-guide/mm/userfaultfd.html
+
+const (
+	sysUserfaultfd = 323
+
+	uffdAPI        = 0xAA
+	uffdioAPI      = 0xC018AA3F
+	uffdioRegister = 0xC020AA00
+	uffdioUnreg    = 0x8010AA01
+	uffdioCopy     = 0xC028AA03
+
+	registerModeMissing = 1
+
+	eventPagefault = 0x12
+	msgSize        = 32
+
+	pollIn = 0x1
+)
+
+var ErrorUnexpectedEvent = errors.New("unexpected userfaultfd event")
+
+type pollFd struct {
+	Fd      int32
+	Events  int16
+	Revents int16
+}
+
+type api struct {
+	API      uint64
+	Features uint64
+	Ioctls   uint64
+}
+
+type rangeArg struct {
+	Start uint64
+	Len   uint64
+}
+
+type register struct {
+	Range  rangeArg
+	Mode   uint64
+	Ioctls uint64
+}
+
+type copyArg struct {
+	Dst  uint64
+	Src  uint64
+	Len  uint64
+	Mode uint64
+	Copy int64
+}
+
+// FD is a userfaultfd.
+type FD struct {
+	fd uintptr
+
+	// stop wakes up ReadFault on Close; reading is held while it polls.
+	stop    [2]int
+	reading sync.Mutex
+}
+
+// ioctl takes the argument as unsafe.Pointer, which follows the stack of the
+// goroutine if it moves as ioctl is called.
+func ioctl(fd, op uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, op, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// New creates a userfaultfd and negotiates the API with the kernel.
+func New() (*FD, error) {
+	fd, _, errno := syscall.Syscall(sysUserfaultfd, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0, 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("userfaultfd", errno)
+	}
+
+	u := &FD{fd: fd}
+
+	a := api{API: uffdAPI}
+	if err := ioctl(fd, uffdioAPI, unsafe.Pointer(&a)); err != nil {
+		syscall.Close(int(fd))
+
+		return nil, os.NewSyscallError("UFFDIO_API", err)
+	}
+
+	if err := syscall.Pipe2(u.stop[:], syscall.O_CLOEXEC); err != nil {
+		syscall.Close(int(fd))
+
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Register reports the faults on the pages of mem which are not present.
+func (u *FD) Register(mem []byte) error {
+	r := register{
+		Range: rangeArg{Start: uint64(uintptr(unsafe.Pointer(&mem[0]))), Len: uint64(len(mem))},
+		Mode:  registerModeMissing,
+	}
+
+	return ioctl(u.fd, uffdioRegister, unsafe.Pointer(&r))
+}
+
+// Unregister stops reporting the faults on mem.
+func (u *FD) Unregister(mem []byte) error {
+	r := rangeArg{Start: uint64(uintptr(unsafe.Pointer(&mem[0]))), Len: uint64(len(mem))}
+
+	return ioctl(u.fd, uffdioUnreg, unsafe.Pointer(&r))
+}
+
+// ReadFault waits for a page fault and returns its address, or
+// os.ErrClosed once Close is called.
+//
+// The runtime poller can't be used: a fault by a goroutine is retried when
+// the thread is signalled for preemption, and the edge it triggered is lost.
+func (u *FD) ReadFault() (uint64, error) {
+	u.reading.Lock()
+	defer u.reading.Unlock()
+
+	msg := make([]byte, msgSize)
+
+	for {
+		fds := [2]pollFd{{Fd: int32(u.fd), Events: pollIn}, {Fd: int32(u.stop[0]), Events: pollIn}}
+
+		_, _, errno := syscall.Syscall(syscall.SYS_POLL, uintptr(unsafe.Pointer(&fds[0])), 2, ^uintptr(0))
+		if errno == syscall.EINTR {
+			continue
+		}
+
+		if errno != 0 {
+			return 0, os.NewSyscallError("poll", errno)
+		}
+
+		if fds[1].Revents != 0 {
+			return 0, os.ErrClosed
+		}
+
+		if _, err := syscall.Read(int(u.fd), msg); err == syscall.EAGAIN || err == syscall.EINTR {
+			// the fault was retried in the meantime
+			continue
+		} else if err != nil {
+			return 0, os.NewSyscallError("read", err)
+		}
+
+		if msg[0] != eventPagefault {
+			return 0, ErrorUnexpectedEvent
+		}
+
+		// struct uffd_msg: u8 event, 7 reserved bytes, then flags and address
+		return binary.LittleEndian.Uint64(msg[16:]), nil
+	}
+}
+
+// Copy fills the pages at dst, which must be page aligned, with src and
+// wakes up the threads waiting for them. It fails with EEXIST if a page is
+// already present.
+func (u *FD) Copy(dst, src []byte) error {
+	c := copyArg{
+		Dst: uint64(uintptr(unsafe.Pointer(&dst[0]))),
+		Src: uint64(uintptr(unsafe.Pointer(&src[0]))),
+		Len: uint64(len(src)),
+	}
+
+	return ioctl(u.fd, uffdioCopy, unsafe.Pointer(&c))
+}
+
+// Close interrupts ReadFault and closes the userfaultfd.
+func (u *FD) Close() error {
+	_, _ = syscall.Write(u.stop[1], []byte{0})
+
+	u.reading.Lock()
+	defer u.reading.Unlock()
+
+	syscall.Close(u.stop[0])
+	syscall.Close(u.stop[1])
+
+	return syscall.Close(int(u.fd))
+}
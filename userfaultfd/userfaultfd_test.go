@@ -0,0 +1,94 @@
+package userfaultfd_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/userfaultfd"
+)
+
+func TestCopy(t *testing.T) {
+	t.Parallel()
+
+	u, err := userfaultfd.New()
+	if err != nil {
+		t.Skipf("userfaultfd is not available: %v", err)
+	}
+
+	mem, err := syscall.Mmap(-1, 0, 0x2000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Munmap(mem)
+
+	if err := u.Register(mem); err != nil {
+		t.Fatal(err)
+	}
+
+	page := bytes.Repeat([]byte{0x5a}, 0x1000)
+	faults := make(chan uint64, 1)
+
+	go func() {
+		addr, err := u.ReadFault()
+		if err != nil {
+			t.Error(err)
+		}
+
+		faults <- addr
+
+		if err := u.Copy(mem[0x1000:], page); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+	defer w.Close()
+
+	// the kernel reading the page blocks until it is copied; a goroutine
+	// touching it could keep the handler from running
+	if _, err := w.Write(mem[0x1234:0x1235]); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1)
+	if _, err := r.Read(b); err != nil || b[0] != 0x5a {
+		t.Fatalf("unexpected byte: 0x%x %v", b[0], err)
+	}
+
+	if addr := <-faults; addr != uint64(uintptr(unsafe.Pointer(&mem[0x1000]))) {
+		t.Fatalf("unexpected fault address: 0x%x", addr)
+	}
+
+	if err := u.Copy(mem[0x1000:], page); !errors.Is(err, syscall.EEXIST) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := u.Unregister(mem); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error)
+
+	go func() {
+		_, err := u.ReadFault()
+		closed <- err
+	}()
+
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-closed; !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
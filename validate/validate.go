@@ -0,0 +1,150 @@
+package validate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/fdpath"
+	"github.com/bobuhiro11/gokvm/instance"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+// modes of access(2), which are not defined by package syscall
+const (
+	accessWrite = 2
+	accessRead  = 4
+)
+
+// capabilities are the KVM extensions gokvm can't boot without.
+var capabilities = []struct {
+	capability int
+	name       string
+}{
+	{kvm.CapUserMemory, "KVM_CAP_USER_MEMORY"},
+	{kvm.CapSetTSSAddr, "KVM_CAP_SET_TSS_ADDR"},
+	{kvm.CapIRQChip, "KVM_CAP_IRQCHIP"},
+	{kvm.CapPIT2, "KVM_CAP_PIT2"},
+}
+
+// Check returns every problem that would keep the VM described by c from
+// booting on this host, without creating the VM. An empty result means the
+// configuration is valid.
+func Check(c *config.Config) []string {
+	problems := []string{}
+
+	if err := c.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	problems = append(problems, checkKVM(c)...)
+	problems = append(problems, checkFiles(c)...)
+	problems = append(problems, checkInstance(c)...)
+
+	return problems
+}
+
+func checkKVM(c *config.Config) []string {
+	devKVM, err := fdpath.OpenFile(c.KVMDevice, os.O_RDWR, 0o644)
+	if err != nil {
+		return []string{fmt.Sprintf("kvm is not available: %v", err)}
+	}
+
+	defer devKVM.Close()
+
+	problems := []string{}
+
+	version, err := kvm.GetAPIVersion(devKVM.Fd())
+	if err != nil {
+		return append(problems, fmt.Sprintf("KVM_GET_API_VERSION: %v", err))
+	}
+
+	if version != kvm.APIVersion {
+		problems = append(problems, fmt.Sprintf("unsupported KVM API version %d, expected %d", version, kvm.APIVersion))
+	}
+
+	for _, capability := range capabilities {
+		if n, err := kvm.CheckExtension(devKVM.Fd(), capability.capability); err != nil || n == 0 {
+			problems = append(problems, fmt.Sprintf("kvm does not support %s", capability.name))
+		}
+	}
+
+	// KVM_CAP_MAX_VCPUS is the hard limit, KVM_CAP_NR_VCPUS the recommended
+	// one; older kernels only report the latter.
+	max, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapMaxVCPUs)
+	if err != nil || max == 0 {
+		max, _ = kvm.CheckExtension(devKVM.Fd(), kvm.CapNRVCPUs)
+	}
+
+	if max > 0 && c.CPUs > max {
+		problems = append(problems, fmt.Sprintf("kvm supports at most %d vcpus, got %d", max, c.CPUs))
+	}
+
+	return problems
+}
+
+func checkFiles(c *config.Config) []string {
+	problems := []string{}
+
+	if c.Kernel != "" && c.Multiboot {
+		if err := machine.CheckMultiboot(c.Kernel); err != nil {
+			problems = append(problems, fmt.Sprintf("kernel %s: %v", c.Kernel, err))
+		}
+	} else if c.Kernel != "" {
+		if b, err := bootparam.New(c.Kernel); err != nil {
+			problems = append(problems, fmt.Sprintf("kernel %s: %v", c.Kernel, err))
+		} else if len(c.Params) > b.CmdlineMax() {
+			problems = append(problems, fmt.Sprintf("params: %v: %d bytes, at most %d",
+				bootparam.ErrorCmdlineTooLong, len(c.Params), b.CmdlineMax()))
+		}
+	}
+
+	_, initrdFd, _ := fdpath.Parse(c.Initrd)
+
+	// the module of a multiboot kernel is optional
+	if c.Initrd != "" || !c.Multiboot {
+		if fi, err := fdpath.Stat(c.Initrd); err != nil {
+			problems = append(problems, fmt.Sprintf("initrd: %v", err))
+		} else if fi.Size() > int64(machine.MaxInitrdSize(int(c.Memory))) {
+			problems = append(problems, fmt.Sprintf("initrd %s: %v", c.Initrd, machine.ErrorInitrdTooLarge))
+		} else if err := syscall.Access(c.Initrd, accessRead); !initrdFd && err != nil {
+			problems = append(problems, fmt.Sprintf("initrd %s: %v", c.Initrd, err))
+		}
+	}
+
+	for _, f := range []struct{ what, path string }{
+		{"control socket", c.QMP},
+		{"api socket", c.API},
+		{"pidfile", c.PidFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+
+		if _, err := os.Lstat(f.path); err == nil && f.what != "pidfile" {
+			problems = append(problems, fmt.Sprintf("%s %s already exists", f.what, f.path))
+		}
+
+		if err := syscall.Access(filepath.Dir(f.path), accessWrite); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: directory is not writable: %v", f.what, f.path, err))
+		}
+	}
+
+	return problems
+}
+
+func checkInstance(c *config.Config) []string {
+	if c.Name == "" {
+		return nil
+	}
+
+	if err := instance.Check(c.Name); err != nil {
+		return []string{err.Error()}
+	}
+
+	return nil
+}
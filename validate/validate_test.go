@@ -0,0 +1,54 @@
+package validate_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/validate"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	image := make([]byte, 1024)
+	copy(image[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(image[0x206:], 0x020f)
+
+	c := config.Default()
+	c.Kernel = filepath.Join(dir, "bzImage")
+	c.Initrd = filepath.Join(dir, "initrd")
+	c.QMP = filepath.Join(dir, "qmp.sock")
+
+	if err := ioutil.WriteFile(c.Kernel, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(c.Initrd, []byte("initrd"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := validate.Check(c); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	c.Kernel = c.Initrd
+	c.Initrd = filepath.Join(dir, "missing")
+	c.QMP = filepath.Join(dir, "missing", "qmp.sock")
+
+	problems := validate.Check(c)
+	if len(problems) != 3 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	for i, want := range []string{"kernel", "initrd", "control socket"} {
+		if !strings.HasPrefix(problems[i], want) {
+			t.Fatalf("problem %d is not about %s: %s", i, want, problems[i])
+		}
+	}
+}
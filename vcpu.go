@@ -0,0 +1,48 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/bobuhiro11/gokvm/config"
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/seccomp"
+)
+
+// setupVCPUThreads prepares the threads the vCPUs run on: the realtime
+// policy first, since the seccomp filter of the vCPUs doesn't allow changing
+// it afterwards.
+func setupVCPUThreads(c *config.Config, m *machine.Machine) {
+	if c.VCPUReserveProcs {
+		procs := runtime.GOMAXPROCS(0) + c.CPUs
+		runtime.GOMAXPROCS(procs)
+
+		log.Info("GOMAXPROCS raised for the vCPUs", "gomaxprocs", procs)
+	}
+
+	inits := []func() error{}
+
+	if c.VCPUSched != "" {
+		inits = append(inits, func() error { return sched.SetThread(c.VCPUSched, c.VCPUPriority) })
+
+		log.Info("vCPU threads run with a realtime policy", "policy", c.VCPUSched, "priority", c.VCPUPriority)
+	}
+
+	if c.Seccomp != "" {
+		inits = append(inits, func() error { return seccomp.VCPU.InstallThread(c.Seccomp) })
+	}
+
+	if len(inits) == 0 {
+		return
+	}
+
+	m.SetVCPUThreadInit(func() error {
+		for _, f := range inits {
+			if err := f(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}